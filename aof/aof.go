@@ -2,6 +2,7 @@ package aof
 
 import (
 	"sync"
+	"time"
 
 	"github.com/goose-lang/std"
 	"github.com/mit-pdos/gokv/grove_ffi"
@@ -68,7 +69,9 @@ func CreateAppendOnlyFile(fname string) *AppendOnlyFile {
 
 			a.mu.Unlock()
 
+			start := time.Now()
 			grove_ffi.FileAppend(fname, l)
+			observeFlush(len(l), start)
 
 			a.mu.Lock()
 			a.durableLength = newLength
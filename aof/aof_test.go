@@ -0,0 +1,59 @@
+package aof
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/grove_ffi/memfs"
+)
+
+// Whatever WaitAppend has returned for survives a crash, and nothing but what
+// was appended shows up, even if appends are torn.
+func TestCrashRecovery(t *testing.T) {
+	h := &memfs.Harness{
+		Seed:   1,
+		Config: memfs.Config{TornWrites: true},
+		Op:     memfs.OpAppend,
+	}
+	h.Setup = func() (func(), func() error) {
+		var mu sync.Mutex
+		var appended []byte
+		var durable uint64
+		workload := func() {
+			a := CreateAppendOnlyFile("log")
+			for i := 0; i < 20; i++ {
+				rec := []byte(fmt.Sprintf("record %d;", i))
+				mu.Lock()
+				appended = append(appended, rec...)
+				mu.Unlock()
+				l := a.Append(rec)
+				if i%3 == 0 {
+					a.WaitAppend(l)
+					mu.Lock()
+					durable = l
+					mu.Unlock()
+				}
+			}
+			a.Close()
+		}
+		check := func() error {
+			mu.Lock()
+			defer mu.Unlock()
+			data := grove_ffi.FileRead("log")
+			if uint64(len(data)) < durable {
+				return fmt.Errorf("recovered %d bytes, but %d were durable", len(data), durable)
+			}
+			if !bytes.HasPrefix(appended, data) {
+				return fmt.Errorf("recovered %q, which was never appended", data)
+			}
+			return nil
+		}
+		return workload, check
+	}
+	if err := h.Run(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,22 @@
+package aof
+
+import (
+	"time"
+
+	"github.com/mit-pdos/gokv/metrics"
+)
+
+var (
+	flushBytes = metrics.Default.NewHistogram("aof_flush_bytes",
+		"Bytes written to disk by each flush of an append-only file.",
+		metrics.ExponentialBuckets(64, 4, 10))
+	fsyncLatency = metrics.Default.NewHistogram("aof_fsync_seconds",
+		"Time taken by each flush of an append-only file to become durable.",
+		metrics.LatencyBuckets)
+)
+
+// Records a flush of n bytes that started at start.
+func observeFlush(n int, start time.Time) {
+	flushBytes.Observe(float64(n))
+	fsyncLatency.ObserveDuration(time.Since(start))
+}
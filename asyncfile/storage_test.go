@@ -0,0 +1,60 @@
+package asyncfile
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/mit-pdos/gokv/grove_ffi/memfs"
+)
+
+// After a crash, the file holds some whole version at least as new as the last
+// one that was waited for.
+func TestCrashRecovery(t *testing.T) {
+	h := &memfs.Harness{
+		Seed:   1,
+		Config: memfs.Config{TornWrites: true},
+	}
+	h.Setup = func() (func(), func() error) {
+		var mu sync.Mutex
+		var durable uint64
+		workload := func() {
+			_, f := MakeAsyncFile("state")
+			for i := uint64(1); i <= 20; i++ {
+				wait := f.Write([]byte(strconv.FormatUint(i, 10)))
+				if i%4 == 0 {
+					wait()
+					mu.Lock()
+					durable = i
+					mu.Unlock()
+				}
+			}
+			f.Close()
+		}
+		check := func() error {
+			mu.Lock()
+			defer mu.Unlock()
+			data, f := MakeAsyncFile("state")
+			defer f.Close()
+			if len(data) == 0 {
+				if durable != 0 {
+					return fmt.Errorf("recovered nothing, but version %d was durable", durable)
+				}
+				return nil
+			}
+			v, err := strconv.ParseUint(string(data), 10, 64)
+			if err != nil || v > 20 {
+				return fmt.Errorf("recovered %q, which was never written", data)
+			}
+			if v < durable {
+				return fmt.Errorf("recovered version %d, but %d was durable", v, durable)
+			}
+			return nil
+		}
+		return workload, check
+	}
+	if err := h.Run(); err != nil {
+		t.Fatal(err)
+	}
+}
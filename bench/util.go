@@ -1,13 +1,20 @@
 package bench
 
-import "log"
+import (
+	"context"
+	"fmt"
+	"log/slog"
 
-// Debugging
-const Debug = false
+	"github.com/mit-pdos/gokv/logging"
+)
 
+var logger = logging.For("bench")
+
+// Logs at debug level; turn on with -log-level bench=debug (see
+// logging.SetLevels).
 func DPrintf(format string, a ...interface{}) (n int, err error) {
-	if Debug {
-		log.Printf(format, a...)
+	if logger.Enabled(context.Background(), slog.LevelDebug) {
+		logger.Debug(fmt.Sprintf(format, a...))
 	}
 	return
 }
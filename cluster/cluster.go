@@ -0,0 +1,539 @@
+package cluster
+
+// A description of a whole deployment, read from one JSON file that every
+// command can start from (with -config FILE -node NAME): which nodes run which
+// servers, where they listen and keep their data, and the timeouts they use.
+// For example,
+//
+//	{
+//	  "logLevel": "info",
+//	  "rpc": {"maxMessageSize": 67108864, "maxInflight": 4096},
+//	  "vrsm": {
+//	    "config": [
+//	      {"name": "config1", "addr": "10.0.0.1:12000", "paxos": "10.0.0.1:12001", "dataDir": "/var/lib/gokv"}
+//	    ],
+//	    "replicas": [
+//	      {"name": "kv1", "addr": "10.0.0.2:12100", "dataDir": "/var/lib/gokv", "metrics": ":9100"},
+//	      {"name": "kv2", "addr": "10.0.0.3:12100", "dataDir": "/var/lib/gokv", "metrics": ":9100"}
+//	    ],
+//	    "leaseIntervalMs": 1000,
+//	    "backupConns": 32,
+//	    "timeouts": {"controlMs": 100, "applyMs": 5000}
+//	  },
+//	  "memkv": {
+//	    "nshard": 65536,
+//	    "coordinator": {"name": "coord", "addr": "10.0.1.1:12200"},
+//	    "shards": [{"name": "shard1", "addr": "10.0.1.2:12300"}],
+//	    "initShard": "shard1",
+//	    "routers": [{"name": "router1", "addr": "10.0.1.3:12400"}]
+//	  }
+//	}
+//
+// Settings left out (or zero) keep their built-in defaults. Flags given on the
+// command line override what the file says.
+//
+// The file describes vrsm, memkv and fencing deployments only. The reconfig
+// and paxi prototypes (reconfig/cmd, paxi/cmd and paxi/reconf/cmd) still take
+// their addresses as flags or arguments.
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/logging"
+	"github.com/mit-pdos/gokv/memkv"
+	"github.com/mit-pdos/gokv/urpc"
+	"github.com/mit-pdos/gokv/vrsm/configservice"
+	"github.com/mit-pdos/gokv/vrsm/paxos"
+	"github.com/mit-pdos/gokv/vrsm/replica"
+)
+
+type Config struct {
+	// log levels for every node (see logging.SetLevels), unless the node has
+	// its own
+	LogLevel string `json:"logLevel,omitempty"`
+	// limits for every node's RPC servers
+	RPC RPCLimits `json:"rpc"`
+
+	VRSM    *VRSM    `json:"vrsm,omitempty"`
+	Memkv   *Memkv   `json:"memkv,omitempty"`
+	Fencing *Fencing `json:"fencing,omitempty"`
+}
+
+// One server process.
+type Node struct {
+	// unique across the whole file
+	Name string `json:"name"`
+	// where other nodes (and clients) reach this node
+	Addr string `json:"addr"`
+	// where this node listens, if not Addr, e.g. "[::]:12100" or just a port
+	// (see grove_ffi.MakeListenAddress)
+	Listen string `json:"listen,omitempty"`
+	// where this node keeps its durable files (see grove_ffi.SetDataDir);
+	// ./durable if empty
+	DataDir string `json:"dataDir,omitempty"`
+	// where to serve Prometheus metrics; off if empty
+	Metrics string `json:"metrics,omitempty"`
+	// overrides Config.LogLevel
+	LogLevel string `json:"logLevel,omitempty"`
+}
+
+type VRSMConfigNode struct {
+	Node
+	// where this config server's paxos peer listens, and the other peers reach
+	// it
+	Paxos string `json:"paxos"`
+}
+
+type VRSM struct {
+	// the config service's servers, which replicate the configuration with
+	// paxos among themselves
+	Config []VRSMConfigNode `json:"config"`
+	// every replica that may be part of a configuration
+	Replicas []Node `json:"replicas"`
+	// names of the replicas to initialize the system with; all of Replicas if
+	// empty
+	InitialConfig []string `json:"initialConfig,omitempty"`
+
+	// how long the primary's read lease lasts (see
+	// configservice.LeaseInterval)
+	LeaseIntervalMs uint64 `json:"leaseIntervalMs,omitempty"`
+	// connections from the primary to each backup (see
+	// replica.BackupConnConfig)
+	BackupConns uint64       `json:"backupConns,omitempty"`
+	Timeouts    VRSMTimeouts `json:"timeouts"`
+}
+
+// RPC timeouts, in milliseconds; see configservice.Timeouts, replica.Timeouts
+// and paxos.RPCTimeoutMs.
+type VRSMTimeouts struct {
+	ConfigMs        uint64 `json:"configMs,omitempty"`
+	WriteConfigMs   uint64 `json:"writeConfigMs,omitempty"`
+	PaxosMs         uint64 `json:"paxosMs,omitempty"`
+	ApplyMs         uint64 `json:"applyMs,omitempty"`
+	ApplyRoMs       uint64 `json:"applyRoMs,omitempty"`
+	ApplyAsBackupMs uint64 `json:"applyAsBackupMs,omitempty"`
+	StateTransferMs uint64 `json:"stateTransferMs,omitempty"`
+	ControlMs       uint64 `json:"controlMs,omitempty"`
+}
+
+// See urpc.ServerConfig; also set by the -rpc-* flags (see urpc.RegisterFlags).
+type RPCLimits struct {
+	MaxMessageSize     uint64 `json:"maxMessageSize,omitempty"`
+	MaxInflightPerConn uint64 `json:"maxInflightPerConn,omitempty"`
+	MaxInflight        uint64 `json:"maxInflight,omitempty"`
+}
+
+// Sets this process's RPC server limits from l, except those given as flags.
+func (l RPCLimits) apply() {
+	cfg := urpc.CurrentServerConfig()
+	FillUint64(&cfg.MaxMessageSize, "rpc-max-message-size", l.MaxMessageSize)
+	FillUint64(&cfg.MaxInflightPerConn, "rpc-max-inflight-per-conn", l.MaxInflightPerConn)
+	FillUint64(&cfg.MaxInflight, "rpc-max-inflight", l.MaxInflight)
+	urpc.SetServerConfig(cfg)
+}
+
+type Memkv struct {
+	// see memkv.NSHARD
+	NShard      uint64 `json:"nshard,omitempty"`
+	Coordinator *Node  `json:"coordinator"`
+	Shards      []Node `json:"shards"`
+	// the shard server that owns every shard at first
+	InitShard string       `json:"initShard"`
+	Balance   MemkvBalance `json:"balance"`
+	// mkrouter servers, which forward clients' requests to the shard servers
+	Routers []Node `json:"routers,omitempty"`
+}
+
+// See memkv.BalanceConfig.
+type MemkvBalance struct {
+	// between automatic rebalancing rounds; 0 disables them
+	IntervalMs       uint64 `json:"intervalMs,omitempty"`
+	ThresholdPercent uint64 `json:"thresholdPercent,omitempty"`
+	MaxMoves         uint64 `json:"maxMoves,omitempty"`
+	MoveIntervalMs   uint64 `json:"moveIntervalMs,omitempty"`
+}
+
+type Fencing struct {
+	Config *Node `json:"config"`
+	// exactly two
+	Counters  []Node `json:"counters"`
+	Frontends []Node `json:"frontends"`
+}
+
+// What a node does, as determined by where it appears in the file.
+type Role string
+
+const (
+	VRSMConfigServer Role = "vrsm config server"
+	VRSMReplica      Role = "vrsm replica"
+	MemkvCoordinator Role = "memkv coordinator"
+	MemkvShard       Role = "memkv shard server"
+	MemkvRouter      Role = "memkv router"
+	FencingConfig    Role = "fencing config server"
+	FencingCounter   Role = "fencing counter server"
+	FencingFrontend  Role = "fencing frontend"
+)
+
+// Reads and checks the file at path.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+func Parse(data []byte) (*Config, error) {
+	c := new(Config)
+	dec := json.NewDecoder(bytes.NewReader(data))
+	// so that typos don't silently leave a setting at its default
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return nil, err
+	}
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+type roleNode struct {
+	node *Node
+	role Role
+}
+
+// Every node in the file, in order.
+func (c *Config) nodes() []roleNode {
+	var ns []roleNode
+	if c.VRSM != nil {
+		for i := range c.VRSM.Config {
+			ns = append(ns, roleNode{&c.VRSM.Config[i].Node, VRSMConfigServer})
+		}
+		for i := range c.VRSM.Replicas {
+			ns = append(ns, roleNode{&c.VRSM.Replicas[i], VRSMReplica})
+		}
+	}
+	if c.Memkv != nil {
+		if c.Memkv.Coordinator != nil {
+			ns = append(ns, roleNode{c.Memkv.Coordinator, MemkvCoordinator})
+		}
+		for i := range c.Memkv.Shards {
+			ns = append(ns, roleNode{&c.Memkv.Shards[i], MemkvShard})
+		}
+		for i := range c.Memkv.Routers {
+			ns = append(ns, roleNode{&c.Memkv.Routers[i], MemkvRouter})
+		}
+	}
+	if c.Fencing != nil {
+		if c.Fencing.Config != nil {
+			ns = append(ns, roleNode{c.Fencing.Config, FencingConfig})
+		}
+		for i := range c.Fencing.Counters {
+			ns = append(ns, roleNode{&c.Fencing.Counters[i], FencingCounter})
+		}
+		for i := range c.Fencing.Frontends {
+			ns = append(ns, roleNode{&c.Fencing.Frontends[i], FencingFrontend})
+		}
+	}
+	return ns
+}
+
+func (c *Config) check() error {
+	names := make(map[string]bool)
+	for _, rn := range c.nodes() {
+		n := rn.node
+		if n.Name == "" {
+			return fmt.Errorf("a %s has no name", rn.role)
+		}
+		if names[n.Name] {
+			return fmt.Errorf("two nodes are called %q", n.Name)
+		}
+		names[n.Name] = true
+		if err := grove_ffi.CheckAddress(n.Addr); err != nil {
+			return fmt.Errorf("node %q: bad addr %q: %v", n.Name, n.Addr, err)
+		}
+		if err := logging.CheckLevels(n.LogLevel); err != nil {
+			return fmt.Errorf("node %q: %v", n.Name, err)
+		}
+	}
+	if err := logging.CheckLevels(c.LogLevel); err != nil {
+		return err
+	}
+
+	if v := c.VRSM; v != nil {
+		if len(v.Config) == 0 {
+			return fmt.Errorf("vrsm: no config servers")
+		}
+		for _, n := range v.Config {
+			if err := grove_ffi.CheckAddress(n.Paxos); err != nil {
+				return fmt.Errorf("node %q: bad paxos address %q: %v", n.Name, n.Paxos, err)
+			}
+		}
+		if len(v.Replicas) == 0 {
+			return fmt.Errorf("vrsm: no replicas")
+		}
+		for _, name := range v.InitialConfig {
+			if v.replica(name) == nil {
+				return fmt.Errorf("vrsm: initialConfig names %q, which is not a replica", name)
+			}
+		}
+	}
+	if m := c.Memkv; m != nil {
+		if m.Coordinator == nil {
+			return fmt.Errorf("memkv: no coordinator")
+		}
+		var found = false
+		for _, n := range m.Shards {
+			if n.Name == m.InitShard {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("memkv: initShard %q is not a shard server", m.InitShard)
+		}
+	}
+	if f := c.Fencing; f != nil {
+		if f.Config == nil {
+			return fmt.Errorf("fencing: no config server")
+		}
+		if len(f.Counters) != 2 {
+			return fmt.Errorf("fencing: need exactly 2 counters, not %d", len(f.Counters))
+		}
+	}
+	return nil
+}
+
+// The node called name, and what it does.
+func (c *Config) Node(name string) (*Node, Role, error) {
+	for _, rn := range c.nodes() {
+		if rn.node.Name == name {
+			return rn.node, rn.role, nil
+		}
+	}
+	return nil, "", fmt.Errorf("no node called %q", name)
+}
+
+func (n *Node) Address() grove_ffi.Address {
+	return grove_ffi.MakeAddress(n.Addr)
+}
+
+func (n *Node) ListenAddress() grove_ffi.Address {
+	if n.Listen != "" {
+		return grove_ffi.MakeListenAddress(n.Listen)
+	}
+	return n.Address()
+}
+
+func addresses(nodes []Node) []grove_ffi.Address {
+	addrs := make([]grove_ffi.Address, len(nodes))
+	for i := range nodes {
+		addrs[i] = nodes[i].Address()
+	}
+	return addrs
+}
+
+func (v *VRSM) ConfigHosts() []grove_ffi.Address {
+	addrs := make([]grove_ffi.Address, len(v.Config))
+	for i := range v.Config {
+		addrs[i] = v.Config[i].Address()
+	}
+	return addrs
+}
+
+func (v *VRSM) PaxosHosts() []grove_ffi.Address {
+	addrs := make([]grove_ffi.Address, len(v.Config))
+	for i := range v.Config {
+		addrs[i] = grove_ffi.MakeAddress(v.Config[i].Paxos)
+	}
+	return addrs
+}
+
+// The paxos address of the config server called name.
+func (v *VRSM) PaxosAddress(name string) grove_ffi.Address {
+	for _, n := range v.Config {
+		if n.Name == name {
+			return grove_ffi.MakeAddress(n.Paxos)
+		}
+	}
+	panic("no config server called " + name)
+}
+
+func (v *VRSM) replica(name string) *Node {
+	for i := range v.Replicas {
+		if v.Replicas[i].Name == name {
+			return &v.Replicas[i]
+		}
+	}
+	return nil
+}
+
+// The replicas the system starts out with.
+func (v *VRSM) InitialReplicas() []grove_ffi.Address {
+	if len(v.InitialConfig) == 0 {
+		return addresses(v.Replicas)
+	}
+	addrs := make([]grove_ffi.Address, len(v.InitialConfig))
+	for i, name := range v.InitialConfig {
+		addrs[i] = v.replica(name).Address()
+	}
+	return addrs
+}
+
+// Resolves s, which names either a replica in the file or an address.
+func (v *VRSM) ReplicaAddress(s string) grove_ffi.Address {
+	if n := v.replica(s); n != nil {
+		return n.Address()
+	}
+	return grove_ffi.MakeAddress(s)
+}
+
+// Sets this process's vrsm timeouts from v. The vrsm packages only allow this
+// before their first server or clerk is made.
+func (v *VRSM) apply() {
+	if v.LeaseIntervalMs != 0 {
+		configservice.SetLeaseInterval(v.LeaseIntervalMs * 1_000_000)
+	}
+	if v.BackupConns != 0 {
+		cm := replica.BackupConnConfig()
+		cm.ConnsPerHost = v.BackupConns
+		replica.SetBackupConnConfig(cm)
+	}
+	t := v.Timeouts
+	if t.ConfigMs != 0 || t.WriteConfigMs != 0 {
+		ct := configservice.ClerkTimeouts()
+		setIfNonzero(&ct.CallMs, t.ConfigMs)
+		setIfNonzero(&ct.WriteConfigMs, t.WriteConfigMs)
+		configservice.SetClerkTimeouts(ct)
+	}
+	if t.PaxosMs != 0 {
+		paxos.SetRPCTimeoutMs(t.PaxosMs)
+	}
+	if t.ApplyMs != 0 || t.ApplyRoMs != 0 || t.ApplyAsBackupMs != 0 ||
+		t.StateTransferMs != 0 || t.ControlMs != 0 {
+		rt := replica.ClerkTimeouts()
+		setIfNonzero(&rt.ApplyMs, t.ApplyMs)
+		setIfNonzero(&rt.ApplyRoMs, t.ApplyRoMs)
+		setIfNonzero(&rt.ApplyAsBackupMs, t.ApplyAsBackupMs)
+		setIfNonzero(&rt.StateTransferMs, t.StateTransferMs)
+		setIfNonzero(&rt.ControlMs, t.ControlMs)
+		replica.SetClerkTimeouts(rt)
+	}
+}
+
+func setIfNonzero(p *uint64, v uint64) {
+	if v != 0 {
+		*p = v
+	}
+}
+
+func (m *Memkv) ShardCount() uint64 {
+	if m.NShard == 0 {
+		return memkv.NSHARD
+	}
+	return m.NShard
+}
+
+func (m *Memkv) InitShardAddress() grove_ffi.Address {
+	for i := range m.Shards {
+		if m.Shards[i].Name == m.InitShard {
+			return m.Shards[i].Address()
+		}
+	}
+	panic("no shard server called " + m.InitShard)
+}
+
+// The balancing settings, with defaults for those the file leaves out.
+func (m *Memkv) BalanceConfig() *memkv.BalanceConfig {
+	cfg := memkv.DefaultBalanceConfig()
+	setIfNonzero(&cfg.ThresholdPercent, m.Balance.ThresholdPercent)
+	setIfNonzero(&cfg.MaxMoves, m.Balance.MaxMoves)
+	setIfNonzero(&cfg.MoveIntervalMs, m.Balance.MoveIntervalMs)
+	return cfg
+}
+
+func (f *Fencing) CounterAddresses() (grove_ffi.Address, grove_ffi.Address) {
+	return f.Counters[0].Address(), f.Counters[1].Address()
+}
+
+// Registers every address in the file (so that this process can connect to
+// named addresses it learns about from elsewhere, e.g. replicas from the
+// config service), and applies the file's timeouts and RPC limits to this
+// process. Every process of a cluster, clients included, must call this before
+// starting servers or making clerks: the vrsm packages panic if their settings
+// change after that.
+func (c *Config) Apply() {
+	for _, rn := range c.nodes() {
+		rn.node.Address()
+	}
+	c.RPC.apply()
+	if c.VRSM != nil {
+		for _, n := range c.VRSM.Config {
+			grove_ffi.MakeAddress(n.Paxos)
+		}
+		c.VRSM.apply()
+	}
+}
+
+// Loads the file at path and applies it (see Apply), and returns the node
+// called name, which must have the given role. The node's data directory takes
+// effect, and so does its log level (or the file's) unless -log-level was
+// given.
+func LoadNode(path string, name string, role Role) (*Config, *Node, error) {
+	c, err := Load(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if name == "" {
+		return nil, nil, fmt.Errorf("need -node, the name of this node in %s", path)
+	}
+	n, r, err := c.Node(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if r != role {
+		return nil, nil, fmt.Errorf("node %q is a %s, not a %s", name, r, role)
+	}
+	c.Apply()
+	if n.DataDir != "" {
+		grove_ffi.SetDataDir(n.DataDir)
+	}
+	if !FlagSet("log-level") {
+		if n.LogLevel != "" {
+			logging.SetLevels(n.LogLevel)
+		} else if c.LogLevel != "" {
+			logging.SetLevels(c.LogLevel)
+		}
+	}
+	return c, n, nil
+}
+
+// Whether the flag called name was given on the command line.
+func FlagSet(name string) bool {
+	var set = false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// Sets *p to v, unless v is empty or the flag called name was given on the
+// command line; so that flags override the cluster file.
+func FillString(p *string, name string, v string) {
+	if v != "" && !FlagSet(name) {
+		*p = v
+	}
+}
+
+// As FillString, for uint64 flags; 0 means unset.
+func FillUint64(p *uint64, name string, v uint64) {
+	if v != 0 && !FlagSet(name) {
+		*p = v
+	}
+}
@@ -0,0 +1,165 @@
+package cluster
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/memkv"
+	"github.com/mit-pdos/gokv/urpc"
+	"github.com/mit-pdos/gokv/vrsm/configservice"
+	"github.com/mit-pdos/gokv/vrsm/paxos"
+	"github.com/mit-pdos/gokv/vrsm/replica"
+)
+
+func TestLoad(t *testing.T) {
+	c, err := Load("testdata/cluster.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, role, err := c.Node("kv3")
+	if err != nil || role != VRSMReplica {
+		t.Fatalf("Node(kv3) = %v, %q, %v", n, role, err)
+	}
+	if n.DataDir != "/var/lib/gokv" || n.LogLevel != "debug" {
+		t.Errorf("kv3 is %+v", n)
+	}
+	if n.ListenAddress() != grove_ffi.MakeAddress("0.0.0.0:12100") {
+		t.Errorf("kv3 listens on %s", grove_ffi.AddressToStr(n.ListenAddress()))
+	}
+	if _, role, _ := c.Node("ctr2"); role != FencingCounter {
+		t.Errorf("ctr2 is a %s", role)
+	}
+	if n, role, _ := c.Node("router1"); role != MemkvRouter || n.ListenAddress() != grove_ffi.MakeAddress("0.0.0.0:12400") {
+		t.Errorf("router1 is a %s", role)
+	}
+	if _, _, err := c.Node("nobody"); err == nil {
+		t.Errorf("found a node called nobody")
+	}
+
+	v := c.VRSM
+	if len(v.ConfigHosts()) != 3 || v.PaxosAddress("config2") != grove_ffi.MakeAddress("10.0.0.2:12001") {
+		t.Errorf("config hosts %v", v.ConfigHosts())
+	}
+	initial := v.InitialReplicas()
+	if len(initial) != 3 || initial[2] != grove_ffi.MakeAddress("10.0.1.3:12100") {
+		t.Errorf("initial replicas %v", initial)
+	}
+	if v.ReplicaAddress("kv4") != grove_ffi.MakeAddress("kv4.internal:12100") ||
+		v.ReplicaAddress("10.0.1.9:1") != grove_ffi.MakeAddress("10.0.1.9:1") {
+		t.Errorf("ReplicaAddress")
+	}
+
+	m := c.Memkv
+	if m.ShardCount() != 1024 || m.InitShardAddress() != grove_ffi.MakeAddress("10.0.2.2:12300") {
+		t.Errorf("memkv %+v", m)
+	}
+	bc := m.BalanceConfig()
+	def := memkv.DefaultBalanceConfig()
+	if bc.MaxMoves != 4 || bc.ThresholdPercent != def.ThresholdPercent {
+		t.Errorf("balance config %+v", bc)
+	}
+}
+
+func TestApply(t *testing.T) {
+	oldLease := configservice.LeaseInterval()
+	oldConfig := configservice.ClerkTimeouts()
+	oldReplica := replica.ClerkTimeouts()
+	oldConns := replica.BackupConnConfig()
+	oldPaxos := paxos.RPCTimeoutMs()
+	oldRPC := urpc.CurrentServerConfig()
+	defer func() {
+		urpc.SetServerConfig(oldRPC)
+		configservice.SetLeaseInterval(oldLease)
+		configservice.SetClerkTimeouts(oldConfig)
+		replica.SetClerkTimeouts(oldReplica)
+		replica.SetBackupConnConfig(oldConns)
+		paxos.SetRPCTimeoutMs(oldPaxos)
+	}()
+
+	c, err := Parse([]byte(`{"rpc": {"maxInflight": 7}, "vrsm": {
+		"config": [{"name": "c", "addr": "10.0.0.1:1", "paxos": "10.0.0.1:2"}],
+		"replicas": [{"name": "r", "addr": "10.0.0.2:1"}],
+		"leaseIntervalMs": 300,
+		"backupConns": 4,
+		"timeouts": {"configMs": 50, "stateTransferMs": 60000}
+	}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Apply()
+	lease, conns := configservice.LeaseInterval(), replica.BackupConnConfig().ConnsPerHost
+	if lease != 300_000_000 || conns != 4 {
+		t.Errorf("lease %d, conns %d", lease, conns)
+	}
+	ct, rt := configservice.ClerkTimeouts(), replica.ClerkTimeouts()
+	if ct.CallMs != 50 || rt.StateTransferMs != 60000 {
+		t.Errorf("timeouts %+v %+v", ct, rt)
+	}
+	if rpc := urpc.CurrentServerConfig(); rpc.MaxInflight != 7 || rpc.MaxMessageSize != oldRPC.MaxMessageSize {
+		t.Errorf("rpc limits %+v", rpc)
+	}
+	// left out, so unchanged
+	if ct.WriteConfigMs != oldConfig.WriteConfigMs || rt.ApplyMs != oldReplica.ApplyMs ||
+		paxos.RPCTimeoutMs() != oldPaxos {
+		t.Errorf("timeouts %+v %+v %d", ct, rt, paxos.RPCTimeoutMs())
+	}
+}
+
+func TestLoadNodeDataDir(t *testing.T) {
+	dir := t.TempDir()
+	data := filepath.Join(dir, "data")
+	path := filepath.Join(dir, "cluster.json")
+	file := fmt.Sprintf(`{"fencing": {
+		"config": {"name": "fconfig", "addr": "10.0.3.1:12000", "dataDir": %q},
+		"counters": [{"name": "ctr1", "addr": "10.0.3.2:12200"}, {"name": "ctr2", "addr": "10.0.3.3:12200"}]
+	}}`, data)
+	if err := os.WriteFile(path, []byte(file), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer grove_ffi.SetDataDir("")
+
+	if _, _, err := LoadNode(path, "fconfig", FencingConfig); err != nil {
+		t.Fatal(err)
+	}
+	grove_ffi.FileWrite("config.data", []byte("x"))
+	grove_ffi.FileAppend("log.data", []byte("y"))
+	for _, name := range []string{"config.data", "log.data"} {
+		if _, err := os.Stat(filepath.Join(data, name)); err != nil {
+			t.Errorf("%s isn't in the data directory: %v", name, err)
+		}
+	}
+	if _, _, err := LoadNode(path, "ctr1", FencingConfig); err == nil {
+		t.Errorf("loaded a counter as a config server")
+	}
+}
+
+func TestBadFiles(t *testing.T) {
+	vrsm := func(rest string) string {
+		return `{"vrsm": {"config": [{"name": "c", "addr": "10.0.0.1:1", "paxos": "10.0.0.1:2"}], ` + rest + `}}`
+	}
+	for _, tc := range []struct {
+		file string
+		want string
+	}{
+		{`{"vrsm": {"replicas": [{"name": "r", "addr": "10.0.0.2:1"}]}}`, "no config servers"},
+		{vrsm(`"replicas": []`), "no replicas"},
+		{vrsm(`"replicas": [{"name": "c", "addr": "10.0.0.2:1"}]`), `two nodes are called "c"`},
+		{vrsm(`"replicas": [{"addr": "10.0.0.2:1"}]`), "has no name"},
+		{vrsm(`"replicas": [{"name": "r", "addr": "10.0.0.2"}]`), "bad addr"},
+		{vrsm(`"replicas": [{"name": "r", "addr": "10.0.0.2:1"}], "initialConfig": ["s"]`), `"s", which is not a replica`},
+		{vrsm(`"replicas": [{"name": "r", "addr": "10.0.0.2:1"}], "leaseInterval": 5`), "unknown field"},
+		{vrsm(`"replicas": [{"name": "r", "addr": "10.0.0.2:1", "logLevel": "loud"}]`), "bad log level"},
+		{`{"memkv": {"coordinator": {"name": "co", "addr": "10.0.0.1:1"}, "shards": [], "initShard": "s"}}`, "not a shard server"},
+		{`{"fencing": {"config": {"name": "f", "addr": "10.0.0.1:1"}, "counters": []}}`, "exactly 2 counters"},
+	} {
+		_, err := Parse([]byte(tc.file))
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: got error %v, want %q", tc.file, err, tc.want)
+		}
+	}
+}
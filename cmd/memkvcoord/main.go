@@ -2,28 +2,75 @@ package main
 
 import (
 	"flag"
-	"fmt"
+	"github.com/mit-pdos/gokv/cluster"
 	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/logging"
 	"github.com/mit-pdos/gokv/memkv"
+	"github.com/mit-pdos/gokv/metrics"
+	"github.com/mit-pdos/gokv/urpc"
 	"log"
 	"os"
 )
 
 func main() {
-	var port uint64
+	var port string
 	var host string
-	flag.Uint64Var(&port, "port", 0, "port number to user for server")
+	var nshard uint64
+	var balanceInterval uint64
+	balanceCfg := memkv.DefaultBalanceConfig()
+	var metricsAddr string
+	var clusterFile string
+	var nodeName string
+	flag.StringVar(&clusterFile, "config", "", "cluster description file to start from, with -node (see the cluster package); other flags override it")
+	flag.StringVar(&nodeName, "node", "", "name of this coordinator in the -config file")
+	flag.StringVar(&port, "port", "", "port number to user for server (or an address to listen on, e.g. [::]:PORT or unix:PATH)")
+	flag.Uint64Var(&nshard, "nshard", memkv.NSHARD, "number of shards in the cluster; must match every shard server")
 	flag.StringVar(&host, "init", "", "host for initial shard server")
+	flag.Uint64Var(&balanceInterval, "balance-interval", 0, "milliseconds between automatic load-aware rebalancing rounds; 0 disables them")
+	flag.Uint64Var(&balanceCfg.ThresholdPercent, "balance-threshold", balanceCfg.ThresholdPercent, "percent above the mean load at which a server gets shards moved off it")
+	flag.Uint64Var(&balanceCfg.MaxMoves, "balance-max-moves", balanceCfg.MaxMoves, "maximum number of shards moved per rebalancing round")
+	flag.Uint64Var(&balanceCfg.MoveIntervalMs, "balance-move-interval", balanceCfg.MoveIntervalMs, "milliseconds to wait between shard migrations while rebalancing")
+	flag.StringVar(&metricsAddr, "metrics", "", "address to serve Prometheus metrics on at /metrics, e.g. :9100; off if empty")
+	logging.RegisterFlags(nil)
+	urpc.RegisterFlags(nil)
 	flag.Parse()
 
-	if port == 0 {
+	var me grove_ffi.Address
+	if clusterFile != "" {
+		c, n, err := cluster.LoadNode(clusterFile, nodeName, cluster.MemkvCoordinator)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fileBalanceCfg := c.Memkv.BalanceConfig()
+		cluster.FillUint64(&balanceCfg.ThresholdPercent, "balance-threshold", fileBalanceCfg.ThresholdPercent)
+		cluster.FillUint64(&balanceCfg.MaxMoves, "balance-max-moves", fileBalanceCfg.MaxMoves)
+		cluster.FillUint64(&balanceCfg.MoveIntervalMs, "balance-move-interval", fileBalanceCfg.MoveIntervalMs)
+		cluster.FillUint64(&balanceInterval, "balance-interval", c.Memkv.Balance.IntervalMs)
+		cluster.FillUint64(&nshard, "nshard", c.Memkv.ShardCount())
+		cluster.FillString(&host, "init", grove_ffi.AddressToStr(c.Memkv.InitShardAddress()))
+		cluster.FillString(&metricsAddr, "metrics", n.Metrics)
+		me = n.ListenAddress()
+	} else if port == "" {
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	if port != "" {
+		me = grove_ffi.MakeListenAddress(port)
+	}
+	if nshard == 0 {
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
 
-	s := memkv.MakeKVCoordServer(grove_ffi.MakeAddress(host))
-	me := grove_ffi.MakeAddress(fmt.Sprintf("0.0.0.0:%d", port))
-	log.Printf("Started coordinator server on port %d; id %d", port, me)
+	if metricsAddr != "" {
+		metrics.Serve(metricsAddr)
+	}
+	s := memkv.MakeKVCoordServer(grove_ffi.MakeAddress(host), nshard)
+	s.SetBalanceConfig(balanceCfg)
+	log.Printf("Started coordinator server on %s; id %d", grove_ffi.AddressToStr(me), me)
 	s.Start(me)
+	if balanceInterval > 0 {
+		s.StartBalancer(balanceInterval)
+	}
 	select {}
 }
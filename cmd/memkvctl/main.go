@@ -21,7 +21,11 @@ func main() {
 			fmt.Println("Must provide command in form:")
 			fmt.Println(" get KEY")
 			fmt.Println(" put KEY VALUE")
+			fmt.Println(" append KEY VALUE")
+			fmt.Println(" incr KEY [DELTA]")
+			fmt.Println(" getset KEY VALUE")
 			fmt.Println(" add HOST")
+			fmt.Println(" balance [--dry-run]")
 			os.Exit(1)
 		}
 	}
@@ -35,21 +39,68 @@ func main() {
 	usage_assert(len(a) > 0)
 	if a[0] == "get" {
 		usage_assert(len(a) == 2)
-		k, err := strconv.ParseUint(a[1], 10, 64)
-		usage_assert(err == nil)
-		v := ck.Get(k)
-		fmt.Printf("GET %d ↦ %v\n", k, v)
+		k := a[1]
+		v := ck.Get([]byte(k))
+		fmt.Printf("GET %s ↦ %v\n", k, v)
 	} else if a[0] == "put" {
 		usage_assert(len(a) == 3)
-		k, err := strconv.ParseUint(a[1], 10, 64)
-		usage_assert(err == nil)
+		k := a[1]
 		v := []byte(a[2])
-		ck.Put(k, v)
-		fmt.Printf("PUT %d ↦ %v\n", k, v)
+		ck.Put([]byte(k), v)
+		fmt.Printf("PUT %s ↦ %v\n", k, v)
+	} else if a[0] == "append" {
+		usage_assert(len(a) == 3)
+		k := a[1]
+		v := []byte(a[2])
+		old := ck.Append([]byte(k), v)
+		fmt.Printf("APPEND %s ↦ %v (was %v)\n", k, v, old)
+	} else if a[0] == "incr" {
+		usage_assert(len(a) == 2 || len(a) == 3)
+		k := a[1]
+		delta := uint64(1)
+		if len(a) == 3 {
+			d, err := strconv.ParseUint(a[2], 10, 64)
+			usage_assert(err == nil)
+			delta = d
+		}
+		v, ok := ck.Increment([]byte(k), delta)
+		if !ok {
+			fmt.Printf("INCR %s failed: value is not a counter\n", k)
+			os.Exit(1)
+		}
+		fmt.Printf("INCR %s ↦ %d\n", k, v)
+	} else if a[0] == "getset" {
+		usage_assert(len(a) == 3)
+		k := a[1]
+		v := []byte(a[2])
+		old := ck.GetAndSet([]byte(k), v)
+		fmt.Printf("GETSET %s ↦ %v (was %v)\n", k, v, old)
 	} else if a[0] == "add" {
 		usage_assert(len(a) == 2)
 		h := grove_ffi.MakeAddress(a[1])
 		ck.Add(h)
 		fmt.Printf("Added %s\n", a[1])
+	} else if a[0] == "balance" {
+		fs := flag.NewFlagSet("balance", flag.ExitOnError)
+		dryRun := fs.Bool("dry-run", false, "only print the migrations that would be made")
+		fs.Parse(a[1:])
+		usage_assert(fs.NArg() == 0)
+		moves, err := memkv.MakeKVCoordClerk(coord, connman.MakeConnMan()).Balance(*dryRun)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		for _, mv := range moves {
+			fmt.Printf("move shard %d: %s -> %s (%d keys, %d bytes, %d ops/s)\n",
+				mv.Sid, grove_ffi.AddressToStr(mv.Src), grove_ffi.AddressToStr(mv.Dst),
+				mv.Stats.Keys, mv.Stats.Bytes, mv.Stats.OpsPerSec)
+		}
+		if *dryRun {
+			fmt.Printf("%d moves planned\n", len(moves))
+		} else {
+			fmt.Printf("%d moves made\n", len(moves))
+		}
+	} else {
+		usage_assert(false)
 	}
 }
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"github.com/mit-pdos/gokv/cluster"
+	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/logging"
+	"github.com/mit-pdos/gokv/metrics"
+	"github.com/mit-pdos/gokv/mkrouter"
+	"github.com/mit-pdos/gokv/urpc"
+	"log"
+	"os"
+)
+
+func main() {
+	var port string
+	var coordStr string
+	var metricsAddr string
+	var clusterFile string
+	var nodeName string
+	flag.StringVar(&clusterFile, "config", "", "cluster description file to start from, with -node (see the cluster package); other flags override it")
+	flag.StringVar(&nodeName, "node", "", "name of this router in the -config file")
+	flag.StringVar(&port, "port", "", "port number to user for server (or an address to listen on, e.g. [::]:PORT or unix:PATH)")
+	flag.StringVar(&coordStr, "coord", "", "address of coordinator")
+	flag.StringVar(&metricsAddr, "metrics", "", "address to serve Prometheus metrics on at /metrics, e.g. :9100; off if empty")
+	logging.RegisterFlags(nil)
+	urpc.RegisterFlags(nil)
+	flag.Parse()
+
+	var me grove_ffi.Address
+	if clusterFile != "" {
+		c, n, err := cluster.LoadNode(clusterFile, nodeName, cluster.MemkvRouter)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cluster.FillString(&coordStr, "coord", grove_ffi.AddressToStr(c.Memkv.Coordinator.Address()))
+		cluster.FillString(&metricsAddr, "metrics", n.Metrics)
+		me = n.ListenAddress()
+	} else if port == "" {
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	if port != "" {
+		me = grove_ffi.MakeListenAddress(port)
+	}
+	if coordStr == "" {
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if metricsAddr != "" {
+		metrics.Serve(metricsAddr)
+	}
+	s := mkrouter.MakeMKRouterServer(grove_ffi.MakeAddress(coordStr))
+	log.Printf("Started router on %s; id %d", grove_ffi.AddressToStr(me), me)
+	s.Start(me)
+	select {}
+}
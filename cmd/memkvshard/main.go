@@ -2,9 +2,12 @@ package main
 
 import (
 	"flag"
-	"fmt"
+	"github.com/mit-pdos/gokv/cluster"
 	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/logging"
 	"github.com/mit-pdos/gokv/memkv"
+	"github.com/mit-pdos/gokv/metrics"
+	"github.com/mit-pdos/gokv/urpc"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
@@ -19,20 +22,51 @@ func main() {
 
 	// var coord string
 	var is_init bool
-	var port uint64
+	var port string
+	var nshard uint64
+	var metricsAddr string
+	var clusterFile string
+	var nodeName string
+	flag.StringVar(&clusterFile, "config", "", "cluster description file to start from, with -node (see the cluster package); other flags override it")
+	flag.StringVar(&nodeName, "node", "", "name of this shard server in the -config file")
 	flag.BoolVar(&is_init, "init", false, "true iff this server owns all shard at initialization; default is false")
-	flag.Uint64Var(&port, "port", 0, "port number to user for server")
+	flag.StringVar(&port, "port", "", "port number to user for server (or an address to listen on, e.g. [::]:PORT or unix:PATH)")
+	flag.Uint64Var(&nshard, "nshard", memkv.NSHARD, "number of shards in the cluster; must match the coordinator")
+	flag.StringVar(&metricsAddr, "metrics", "", "address to serve Prometheus metrics on at /metrics, e.g. :9100; off if empty")
 	// flag.StringVar(&coord, "coord", "", "address of coordinator")
+	logging.RegisterFlags(nil)
+	urpc.RegisterFlags(nil)
 	flag.Parse()
 
-	if port == 0 {
+	var me grove_ffi.Address
+	if clusterFile != "" {
+		c, n, err := cluster.LoadNode(clusterFile, nodeName, cluster.MemkvShard)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !cluster.FlagSet("init") {
+			is_init = n.Name == c.Memkv.InitShard
+		}
+		cluster.FillUint64(&nshard, "nshard", c.Memkv.ShardCount())
+		cluster.FillString(&metricsAddr, "metrics", n.Metrics)
+		me = n.ListenAddress()
+	} else if port == "" {
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	if port != "" {
+		me = grove_ffi.MakeListenAddress(port)
+	}
+	if nshard == 0 {
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
 
-	s := memkv.MakeKVShardServer(is_init)
-	me := grove_ffi.MakeAddress(fmt.Sprintf("0.0.0.0:%d", port))
-	log.Printf("Started shard server on port %d; id %d", port, me)
+	if metricsAddr != "" {
+		metrics.Serve(metricsAddr)
+	}
+	s := memkv.MakeKVShardServer(is_init, nshard)
+	log.Printf("Started shard server on %s; id %d", grove_ffi.AddressToStr(me), me)
 	s.Start(me)
 	select {}
 }
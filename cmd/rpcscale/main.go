@@ -2,7 +2,6 @@ package main
 
 import (
 	"flag"
-	"fmt"
 	"github.com/felixge/fgprof"
 	"github.com/mit-pdos/gokv/grove_ffi"
 	"github.com/mit-pdos/gokv/urpc"
@@ -19,10 +18,10 @@ const (
 )
 
 func main() {
-	var port uint64
-	flag.Uint64Var(&port, "port", 0, "port number to user for server")
+	var port string
+	flag.StringVar(&port, "port", "", "port number to user for server (or an address to listen on, e.g. [::]:PORT or unix:PATH)")
 	flag.Parse()
-	if port == 0 {
+	if port == "" {
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
@@ -46,8 +45,8 @@ func main() {
 	}
 
 	s := urpc.MakeServer(handlers)
-	me := grove_ffi.MakeAddress(fmt.Sprintf("0.0.0.0:%d", port))
-	log.Printf("Started null RPC server on port %d; id %d", port, me)
+	me := grove_ffi.MakeListenAddress(port)
+	log.Printf("Started null RPC server on %s; id %d", port, me)
 	s.Serve(me)
 	select {}
 }
@@ -1,88 +1,370 @@
 package connman
 
 // Provides a connection manager, which allows one to make RPCs against any
-// hosts while using only one underlying network connection to each host; this
-// also tries reconnnecting on failures.
+// hosts while sharing a few underlying network connections to each host
+// (just one, by default); this also tries reconnnecting on failures.
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"sync"
+	"time"
 
+	"github.com/goose-lang/primitive"
 	"github.com/mit-pdos/gokv/grove_ffi"
 	"github.com/mit-pdos/gokv/urpc"
 )
 
 type HostName = grove_ffi.Address
 
+// How a call picks which of a host's connections to use.
+type Policy uint64
+
+const (
+	// The connection with the fewest calls in progress, so that new
+	// connections are only opened once the existing ones are busy.
+	LeastLoaded Policy = iota
+	// Each connection in turn.
+	RoundRobin
+)
+
+type Config struct {
+	// The most connections to open to each host.
+	ConnsPerHost uint64
+	Policy       Policy
+	// Connections that have carried no calls for this long are closed, to be
+	// reopened when next needed; 0 means never.
+	IdleTimeout time.Duration
+	// After a failed connection attempt (or a connection that breaks), the next
+	// attempt to connect to the same host waits MinBackoff, doubling with each
+	// further failure up to MaxBackoff, until a call gets through.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+var DefaultConfig = &Config{
+	ConnsPerHost: 1,
+	Policy:       LeastLoaded,
+	MinBackoff:   10 * time.Millisecond,
+	MaxBackoff:   time.Second,
+}
+
+type conn struct {
+	cl       *urpc.Client // nil if not connected
+	making   bool         // someone is connecting this right now
+	inflight uint64       // calls using this connection
+	lastUsed time.Time
+}
+
+type hostConns struct {
+	conns []*conn
+	next  uint64     // for RoundRobin
+	cond  *sync.Cond // signalled when someone is done connecting
+	// consecutive failures to reach the host, and when we may try again
+	failures uint64
+	retryAt  time.Time
+}
+
 type ConnMan struct {
-	mu     *sync.Mutex
-	rpcCls map[HostName]*urpc.Client
-	making map[HostName]*sync.Cond // a key exists iff someone is making the RPCClient for that host right now
+	mu    *sync.Mutex
+	cfg   *Config
+	hosts map[HostName]*hostConns
 }
 
 func MakeConnMan() *ConnMan {
+	return MakeConnManWithConfig(DefaultConfig)
+}
+
+func MakeConnManWithConfig(cfg *Config) *ConnMan {
 	c := new(ConnMan)
 	c.mu = new(sync.Mutex)
-	c.rpcCls = make(map[HostName]*urpc.Client)
-	c.making = make(map[HostName]*sync.Cond)
+	c.cfg = cfg
+	c.hosts = make(map[HostName]*hostConns)
+	if cfg.IdleTimeout != 0 {
+		go func() {
+			c.reapThread()
+		}()
+	}
 	return c
 }
 
-func (c *ConnMan) getClient(host HostName) *urpc.Client {
-	var ret *urpc.Client
+// Requires c.mu.
+func (c *ConnMan) getHost(host HostName) *hostConns {
+	h, ok := c.hosts[host]
+	if !ok {
+		n := c.cfg.ConnsPerHost
+		if n == 0 {
+			n = 1
+		}
+		h = &hostConns{conns: make([]*conn, n), cond: sync.NewCond(c.mu)}
+		for i := range h.conns {
+			h.conns[i] = new(conn)
+		}
+		c.hosts[host] = h
+	}
+	return h
+}
+
+// Requires c.mu.
+func (c *ConnMan) pick(h *hostConns) *conn {
+	if c.cfg.Policy == RoundRobin {
+		cn := h.conns[h.next%uint64(len(h.conns))]
+		h.next++
+		return cn
+	}
+	var best = h.conns[0]
+	for _, cn := range h.conns[1:] {
+		// among equally loaded connections, prefer one that's already open
+		if cn.inflight < best.inflight || (cn.inflight == best.inflight && best.cl == nil && cn.cl != nil) {
+			best = cn
+		}
+	}
+	return best
+}
+
+// Picks one of host's connections and counts a call on it, connecting it if
+// need be. Returns a nil client (after counting the failure) if that fails, or
+// if ctx is done while backing off; either way, the caller must call release.
+func (c *ConnMan) acquire(ctx context.Context, host HostName) (*conn, *urpc.Client) {
+	c.mu.Lock()
+	h := c.getHost(host)
+	cn := c.pick(h)
+	cn.inflight++
+	// want to open a new connection without a thundering herd of threads all
+	// making their own
+	for cn.making {
+		h.cond.Wait()
+	}
+	if cn.cl != nil {
+		cl := cn.cl
+		c.mu.Unlock()
+		return cn, cl
+	}
+	cn.making = true
+	wait := time.Until(h.retryAt)
+	c.mu.Unlock()
+
+	var err = uint64(1)
+	var cl *urpc.Client
+	if wait > 0 {
+		select {
+		case <-ctx.Done():
+		case <-time.After(wait):
+		}
+	}
+	if ctx.Err() == nil {
+		err, cl = urpc.TryMakeClient(host)
+	}
+	if err == 0 {
+		// CallAtLeastOnce wants a reply no matter how long it takes, and the
+		// other calls bound their attempts with a context.
+		cl.SetRetryPolicy(urpc.UntilReplyRetryPolicy)
+	}
 
 	c.mu.Lock()
-	for {
-		cl, ok := c.rpcCls[host]
-		if ok {
-			ret = cl
-			break
-		}
-		// want to open a new RPCClient without a thundering herd of threads all
-		// making their own RPCClient
-		// XXX: This is written under the assumption that MakeRPCClient
-		// takes a long time compared to the other critical sections of c.mu
-		// (e.g. this might establish a TCP connection, incurring some
-		// network delay)
-		cond, ok := c.making[host]
-		if ok { // someone else is making the host
-			cond.Wait()
-			continue
+	cn.making = false
+	h.cond.Broadcast()
+	if err != 0 {
+		if ctx.Err() == nil {
+			c.failed(h)
 		}
-		my_cond := sync.NewCond(c.mu)
-		c.making[host] = my_cond
 		c.mu.Unlock()
-		ret = urpc.MakeClient(host)
-		c.mu.Lock()
-		c.rpcCls[host] = ret
-		my_cond.Broadcast()
-		delete(c.making, host)
-		break
+		return cn, nil
 	}
+	cn.cl = cl
 	c.mu.Unlock()
-	return ret
+	return cn, cl
 }
 
-// This repeatedly retries the RPC after retryTimeout until it gets a response.
-func (c *ConnMan) CallAtLeastOnce(host HostName, rpcid uint64, args []byte, reply *[]byte, retryTimeout uint64) {
-	var cl *urpc.Client
-	cl = c.getClient(host)
+// Requires c.mu.
+func (c *ConnMan) failed(h *hostConns) {
+	var backoff = c.cfg.MinBackoff
+	for i := uint64(0); i < h.failures && backoff < c.cfg.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > c.cfg.MaxBackoff {
+		backoff = c.cfg.MaxBackoff
+	}
+	h.failures++
+	h.retryAt = time.Now().Add(backoff)
+}
+
+// Finishes a call started with acquire, which used cl and ended with err.
+func (c *ConnMan) release(host HostName, cn *conn, cl *urpc.Client, err urpc.Error) {
+	c.mu.Lock()
+	h := c.hosts[host]
+	cn.inflight--
+	cn.lastUsed = time.Now()
+	if err == urpc.ErrDisconnect {
+		// need to reconnect; our client might already be out of date
+		if cl != nil && cl == cn.cl {
+			cn.cl = nil
+			c.failed(h)
+		}
+	} else if err == urpc.ErrNone {
+		h.failures = 0
+	}
+	c.mu.Unlock()
+}
 
+func (c *ConnMan) reapThread() {
 	for {
+		time.Sleep(c.cfg.IdleTimeout / 2)
+		c.mu.Lock()
+		for _, h := range c.hosts {
+			for _, cn := range h.conns {
+				if cn.cl != nil && cn.inflight == 0 && time.Since(cn.lastUsed) >= c.cfg.IdleTimeout {
+					cn.cl.Close()
+					cn.cl = nil
+				}
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// Returned (wrapped) by CallAtLeastOnceContext when the host has no handler
+// for the RPC, e.g. because it runs a different version; retrying won't help.
+var ErrUnknownRPC = errors.New("connman: no handler for RPC")
+
+func unknownRPC(host HostName, rpcid uint64) error {
+	return fmt.Errorf("%w %d on %s", ErrUnknownRPC, rpcid, grove_ffi.AddressToStr(host))
+}
+
+// Returned (wrapped) by CallAtLeastOnceContext when the host doesn't let this
+// process call the RPC (see urpc.Server.Restrict).
+var ErrUnauthorized = errors.New("connman: not authorized to call RPC")
+
+func unauthorized(host HostName, rpcid uint64) error {
+	return fmt.Errorf("%w %d on %s", ErrUnauthorized, rpcid, grove_ffi.AddressToStr(host))
+}
+
+// A call on cl with urpc.UntilReplyRetryPolicy only times out after going a
+// long time without a reply, which most likely means that the connection died
+// without our noticing; hangs up on it so that the next call reconnects.
+// Returns the error to release the connection with.
+func (c *ConnMan) gaveUp(cl *urpc.Client, err urpc.Error) urpc.Error {
+	if err != urpc.ErrTimeout {
+		return err
+	}
+	cl.Close()
+	return urpc.ErrDisconnect
+}
+
+// This repeatedly retransmits the RPC, starting after retryTimeout, until it
+// gets a response. Retransmissions reuse the original seqno (so a late reply to
+// an earlier transmission still counts); only after a reconnect (when the
+// connection breaks, or has gone without a reply for as long as
+// urpc.UntilReplyRetryPolicy allows) is the request sent afresh. If the server
+// is overloaded, this waits retryTimeout before trying again. Returns
+// urpc.ErrNone once there is a reply, or (leaving reply alone)
+// urpc.ErrUnknownRPC if the server has no handler for rpcid or
+// urpc.ErrUnauthorized if it won't let us call it, which retrying won't fix.
+func (c *ConnMan) CallAtLeastOnce(host HostName, rpcid uint64, args []byte, reply *[]byte, retryTimeout uint64) urpc.Error {
+	ctx := context.Background()
+	for {
+		cn, cl := c.acquire(ctx, host)
+		if cl == nil {
+			c.release(host, cn, cl, urpc.ErrDisconnect)
+			continue
+		}
 		err := cl.Call(rpcid, args, reply, retryTimeout)
-		if err == urpc.ErrTimeout {
-			// just retry
+		c.release(host, cn, cl, c.gaveUp(cl, err))
+		if err == urpc.ErrTimeout || err == urpc.ErrDisconnect {
+			// just retry; acquire reconnects if need be
+			continue
+		}
+		if err == urpc.ErrOverload {
+			// the server is shedding load, so give it some time before retrying
+			primitive.Sleep(retryTimeout * 1_000_000)
 			continue
 		}
-		if err == urpc.ErrDisconnect {
-			// need to try reconnecting
-			c.mu.Lock()
-			if cl == c.rpcCls[host] { // our RPCClient might already be out of date
-				delete(c.rpcCls, host)
+		return err
+	}
+}
+
+// Like CallAtLeastOnce, but gives up once ctx is done, returning ctx.Err(). The
+// RPC might or might not have run in that case. If the server has no handler
+// for rpcid, returns an error wrapping ErrUnknownRPC, and if it won't let us
+// call it, one wrapping ErrUnauthorized.
+func (c *ConnMan) CallAtLeastOnceContext(ctx context.Context, host HostName, rpcid uint64, args []byte, reply *[]byte, retryTimeout uint64) error {
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		cn, cl := c.acquire(ctx, host)
+		if cl == nil {
+			c.release(host, cn, cl, urpc.ErrDisconnect)
+			continue
+		}
+		err := cl.CallContext(ctx, rpcid, args, reply, retryTimeout)
+		c.release(host, cn, cl, c.gaveUp(cl, err))
+		if err == urpc.ErrNone {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err == urpc.ErrUnknownRPC {
+			return unknownRPC(host, rpcid)
+		}
+		if err == urpc.ErrUnauthorized {
+			return unauthorized(host, rpcid)
+		}
+		if err == urpc.ErrOverload {
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Duration(retryTimeout) * time.Millisecond):
 			}
-			c.mu.Unlock()
-			cl = c.getClient(host)
+		}
+	}
+}
+
+// Sends the RPC up to maxAttempts times (each one a fresh request, waiting up
+// to timeout_ms for a reply), stopping at the first reply. Returns the error
+// from the last attempt: urpc.ErrTimeout if there was no reply,
+// urpc.ErrDisconnect if the host could not be reached, urpc.ErrOverload if it
+// was too busy; urpc.ErrUnknownRPC and urpc.ErrUnauthorized are returned right
+// away.
+func (c *ConnMan) CallWithRetries(host HostName, rpcid uint64, args []byte, reply *[]byte, timeout_ms uint64, maxAttempts uint64) urpc.Error {
+	return c.CallWithRetriesContext(context.Background(), host, rpcid, args, reply, timeout_ms, maxAttempts)
+}
+
+// Like CallWithRetries, but gives up with urpc.ErrCanceled once ctx is done,
+// and passes ctx's deadline on to the server.
+func (c *ConnMan) CallWithRetriesContext(ctx context.Context, host HostName, rpcid uint64, args []byte, reply *[]byte, timeout_ms uint64, maxAttempts uint64) urpc.Error {
+	var err = urpc.ErrTimeout
+	for attempt := uint64(0); attempt < maxAttempts; attempt++ {
+		if ctx.Err() != nil {
+			return urpc.ErrCanceled
+		}
+		if err == urpc.ErrOverload {
+			select {
+			case <-ctx.Done():
+				return urpc.ErrCanceled
+			case <-time.After(time.Duration(timeout_ms) * time.Millisecond):
+			}
+		}
+		cn, cl := c.acquire(ctx, host)
+		if cl == nil {
+			err = urpc.ErrDisconnect
+			c.release(host, cn, cl, err)
 			continue
 		}
-		break
+		attemptCtx, cancel := context.WithTimeout(ctx, time.Duration(timeout_ms)*time.Millisecond)
+		err = cl.CallContext(attemptCtx, rpcid, args, reply, timeout_ms)
+		cancel()
+		c.release(host, cn, cl, err)
+		if err == urpc.ErrCanceled {
+			if ctx.Err() != nil {
+				return urpc.ErrCanceled
+			}
+			err = urpc.ErrTimeout
+		}
+		if err == urpc.ErrNone || err == urpc.ErrUnknownRPC || err == urpc.ErrUnauthorized {
+			return err
+		}
 	}
+	return err
 }
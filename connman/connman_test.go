@@ -0,0 +1,156 @@
+package connman
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/grove_ffi/memnet"
+	"github.com/mit-pdos/gokv/urpc"
+)
+
+func (c *ConnMan) numConns(host HostName) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var n = 0
+	for _, cn := range c.hosts[host].conns {
+		if cn.cl != nil {
+			n++
+		}
+	}
+	return n
+}
+
+func TestPooling(t *testing.T) {
+	grove_ffi.SetTransport(memnet.New(1))
+	defer grove_ffi.SetTransport(nil)
+
+	host := grove_ffi.MakeAddress("10.0.0.1:1")
+	release := make(chan struct{})
+	handlers := map[uint64]func([]byte, *[]byte){
+		0: func(args []byte, reply *[]byte) { *reply = args },
+		1: func(args []byte, reply *[]byte) { <-release },
+	}
+	urpc.MakeServer(handlers).Serve(host)
+
+	c := MakeConnManWithConfig(&Config{ConnsPerHost: 4, Policy: LeastLoaded, IdleTimeout: 50 * time.Millisecond})
+	// one call at a time only needs one connection
+	for i := 0; i < 10; i++ {
+		c.CallAtLeastOnce(host, 0, nil, new([]byte), 100)
+	}
+	if n := c.numConns(host); n != 1 {
+		t.Fatalf("%d connections for sequential calls", n)
+	}
+
+	// concurrent calls spread out over the pool
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			c.CallAtLeastOnce(host, 1, nil, new([]byte), 1000)
+			wg.Done()
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n := c.numConns(host); n != 4 {
+		t.Fatalf("%d connections for concurrent calls", n)
+	}
+	close(release)
+	wg.Wait()
+
+	// and idle ones are closed again
+	time.Sleep(150 * time.Millisecond)
+	if n := c.numConns(host); n != 0 {
+		t.Fatalf("%d connections left after idling", n)
+	}
+	c.CallAtLeastOnce(host, 0, nil, new([]byte), 100)
+}
+
+func TestCallWithRetries(t *testing.T) {
+	grove_ffi.SetTransport(memnet.New(1))
+	defer grove_ffi.SetTransport(nil)
+
+	c := MakeConnManWithConfig(&Config{ConnsPerHost: 2, Policy: RoundRobin, MinBackoff: 10 * time.Millisecond, MaxBackoff: 40 * time.Millisecond})
+	host := grove_ffi.MakeAddress("10.0.0.1:1")
+	start := time.Now()
+	if err := c.CallWithRetries(host, 0, nil, new([]byte), 10, 4); err != urpc.ErrDisconnect {
+		t.Fatalf("call to a missing server: got %d", err)
+	}
+	// backs off 10, 20 and 40ms between attempts
+	if d := time.Since(start); d < 70*time.Millisecond {
+		t.Errorf("retried without backing off, in %v", d)
+	}
+
+	var calls atomic.Uint64
+	handlers := map[uint64]func([]byte, *[]byte){
+		0: func(args []byte, reply *[]byte) {
+			if calls.Add(1) < 3 {
+				time.Sleep(50 * time.Millisecond)
+			}
+			*reply = []byte("ok")
+		},
+	}
+	urpc.MakeServer(handlers).Serve(host)
+	reply := new([]byte)
+	if err := c.CallWithRetries(host, 0, nil, reply, 20, 2); err != urpc.ErrTimeout {
+		t.Fatalf("expected a timeout, got %d", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := c.CallWithRetries(host, 0, nil, reply, 20, 2); err != urpc.ErrNone || string(*reply) != "ok" {
+		t.Fatalf("call failed: %d %q", err, *reply)
+	}
+}
+
+func TestUnknownRPC(t *testing.T) {
+	grove_ffi.SetTransport(memnet.New(1))
+	defer grove_ffi.SetTransport(nil)
+
+	host := grove_ffi.MakeAddress("10.0.0.1:1")
+	handlers := map[uint64]func([]byte, *[]byte){
+		0: func(args []byte, reply *[]byte) { *reply = args },
+	}
+	urpc.MakeServer(handlers).Serve(host)
+
+	c := MakeConnMan()
+	if err := c.CallAtLeastOnce(host, 0, nil, new([]byte), 100); err != urpc.ErrNone {
+		t.Fatalf("call failed: %d", err)
+	}
+	// a server from another version, which doesn't know the RPC
+	if err := c.CallAtLeastOnce(host, 5, nil, new([]byte), 100); err != urpc.ErrUnknownRPC {
+		t.Errorf("expected unknown RPC, got %d", err)
+	}
+	err := c.CallAtLeastOnceContext(context.Background(), host, 5, nil, new([]byte), 100)
+	if !errors.Is(err, ErrUnknownRPC) {
+		t.Errorf("expected unknown RPC, got %v", err)
+	}
+}
+
+func TestUnauthorized(t *testing.T) {
+	grove_ffi.SetTransport(memnet.New(1))
+	defer grove_ffi.SetTransport(nil)
+
+	host := grove_ffi.MakeAddress("10.0.0.1:1")
+	handlers := map[uint64]func([]byte, *[]byte){
+		0: func(args []byte, reply *[]byte) { *reply = args },
+	}
+	srv := urpc.MakeServer(handlers)
+	srv.Restrict(0, []string{"admin"})
+	srv.Serve(host)
+
+	// returns right away rather than reconnecting and retrying
+	c := MakeConnMan()
+	if err := c.CallAtLeastOnce(host, 0, nil, new([]byte), 100); err != urpc.ErrUnauthorized {
+		t.Errorf("expected unauthorized, got %d", err)
+	}
+	err := c.CallAtLeastOnceContext(context.Background(), host, 0, nil, new([]byte), 100)
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("expected unauthorized, got %v", err)
+	}
+	if err := c.CallWithRetries(host, 0, nil, new([]byte), 100, 3); err != urpc.ErrUnauthorized {
+		t.Errorf("expected unauthorized, got %d", err)
+	}
+}
@@ -12,6 +12,9 @@ type Server struct {
 	lastSeq   map[uint64]uint64
 	lastReply map[uint64][]byte
 	nextCID   uint64
+	// cids with a request running in HandleRequestConcurrent
+	running map[uint64]bool
+	cond    *sync.Cond
 }
 
 func (t *Server) HandleRequest(handler func(raw_args []byte, reply *[]byte)) func(raw_args []byte, reply *[]byte) {
@@ -40,6 +43,40 @@ func (t *Server) HandleRequest(handler func(raw_args []byte, reply *[]byte)) fun
 	}
 }
 
+// Like HandleRequest, but the reply table is not locked while handler runs, so
+// requests from different clients can be handled concurrently (handler has to
+// do its own synchronization). Requests from the same client are still run one
+// at a time, and a retransmission that arrives while the original is running
+// waits for it and gets its reply.
+func (t *Server) HandleRequestConcurrent(handler func(raw_args []byte, reply *[]byte)) func(raw_args []byte, reply *[]byte) {
+	return func(raw_args []byte, reply *[]byte) {
+		cid, raw_args := marshal.ReadInt(raw_args)
+		seq, raw_args := marshal.ReadInt(raw_args)
+
+		t.mu.Lock()
+		for t.running[cid] {
+			t.cond.Wait()
+		}
+		last := t.lastSeq[cid]
+		if seq <= last {
+			*reply = t.lastReply[cid]
+			t.mu.Unlock()
+			return
+		}
+		t.running[cid] = true
+		t.mu.Unlock()
+
+		handler(raw_args, reply)
+
+		t.mu.Lock()
+		t.lastSeq[cid] = seq
+		t.lastReply[cid] = *reply
+		delete(t.running, cid)
+		t.cond.Broadcast()
+		t.mu.Unlock()
+	}
+}
+
 func (t *Server) GetFreshCID() uint64 {
 	t.mu.Lock()
 	r := t.nextCID
@@ -55,6 +92,8 @@ func MakeServer() *Server {
 	t.lastSeq = make(map[uint64]uint64)
 	t.nextCID = 0
 	t.mu = new(sync.Mutex)
+	t.running = make(map[uint64]bool)
+	t.cond = sync.NewCond(t.mu)
 	return t
 }
 
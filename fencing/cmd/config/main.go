@@ -2,15 +2,22 @@ package main
 
 import (
 	"flag"
-	"fmt"
+	"github.com/mit-pdos/gokv/cluster"
 	"github.com/mit-pdos/gokv/fencing/config"
 	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/urpc"
+	"log"
 )
 
 func main() {
-	var port uint64
-	flag.Uint64Var(&port, "port", 0, "port number of frontend server")
+	var port string
+	var clusterFile string
+	var nodeName string
+	flag.StringVar(&clusterFile, "config", "", "cluster description file to start from, with -node (see the cluster package); other flags override it")
+	flag.StringVar(&nodeName, "node", "", "name of this config server in the -config file")
+	flag.StringVar(&port, "port", "", "port number of frontend server (or an address to listen on, e.g. [::]:PORT or unix:PATH)")
 
+	urpc.RegisterFlags(nil)
 	flag.Parse()
 
 	usage_assert := func(b bool) {
@@ -19,9 +26,19 @@ func main() {
 		}
 	}
 
-	usage_assert(port != 0)
-
-	me := grove_ffi.MakeAddress(fmt.Sprintf("0.0.0.0:%d", port))
+	var me grove_ffi.Address
+	if clusterFile != "" {
+		_, n, err := cluster.LoadNode(clusterFile, nodeName, cluster.FencingConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		me = n.ListenAddress()
+	} else {
+		usage_assert(port != "")
+	}
+	if port != "" {
+		me = grove_ffi.MakeListenAddress(port)
+	}
 	config.StartServer(me)
 	select {}
 }
@@ -2,17 +2,19 @@ package main
 
 import (
 	"flag"
-	"fmt"
+	"github.com/mit-pdos/gokv/cluster"
 	"github.com/mit-pdos/gokv/fencing/frontend"
 	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/urpc"
+	"log"
 )
 
 func main() {
-	var port uint64
-	flag.Uint64Var(&port, "port", 0, "port number of frontend server")
+	var port string
+	flag.StringVar(&port, "port", "", "port number of frontend server (or an address to listen on, e.g. [::]:PORT or unix:PATH)")
 
-	var configStr string
-	flag.StringVar(&configStr, "config", "", "address of config server")
+	var confStr string
+	flag.StringVar(&confStr, "conf", "", "address of config server")
 
 	var ctr1Str string
 	flag.StringVar(&ctr1Str, "ctr1", "", "address of counter server 1")
@@ -20,6 +22,13 @@ func main() {
 	var ctr2Str string
 	flag.StringVar(&ctr2Str, "ctr2", "", "address of counter server 2")
 
+	var clusterFile string
+	flag.StringVar(&clusterFile, "config", "", "cluster description file to start from, with -node (see the cluster package); other flags override it")
+
+	var nodeName string
+	flag.StringVar(&nodeName, "node", "", "name of this frontend in the -config file")
+
+	urpc.RegisterFlags(nil)
 	flag.Parse()
 
 	usage_assert := func(b bool) {
@@ -28,15 +37,33 @@ func main() {
 		}
 	}
 
-	usage_assert(configStr != "")
-	usage_assert(port != 0)
-	usage_assert(ctr1Str != "")
-	usage_assert(ctr2Str != "")
-
-	config := grove_ffi.MakeAddress(configStr)
-	me := grove_ffi.MakeAddress(fmt.Sprintf("0.0.0.0:%d", port))
-	ctr1 := grove_ffi.MakeAddress(ctr1Str)
-	ctr2 := grove_ffi.MakeAddress(ctr2Str)
+	var me, config, ctr1, ctr2 grove_ffi.Address
+	if clusterFile != "" {
+		c, n, err := cluster.LoadNode(clusterFile, nodeName, cluster.FencingFrontend)
+		if err != nil {
+			log.Fatal(err)
+		}
+		me = n.ListenAddress()
+		config = c.Fencing.Config.Address()
+		ctr1, ctr2 = c.Fencing.CounterAddresses()
+	} else {
+		usage_assert(confStr != "")
+		usage_assert(port != "")
+		usage_assert(ctr1Str != "")
+		usage_assert(ctr2Str != "")
+	}
+	if port != "" {
+		me = grove_ffi.MakeListenAddress(port)
+	}
+	if confStr != "" {
+		config = grove_ffi.MakeAddress(confStr)
+	}
+	if ctr1Str != "" {
+		ctr1 = grove_ffi.MakeAddress(ctr1Str)
+	}
+	if ctr2Str != "" {
+		ctr2 = grove_ffi.MakeAddress(ctr2Str)
+	}
 	frontend.StartServer(me, config, ctr1, ctr2)
 	select {}
 }
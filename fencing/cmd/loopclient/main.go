@@ -2,13 +2,17 @@ package main
 
 import (
 	"flag"
+	"github.com/mit-pdos/gokv/cluster"
 	"github.com/mit-pdos/gokv/fencing/loopclient"
 	"github.com/mit-pdos/gokv/grove_ffi"
+	"log"
 )
 
 func main() {
-	var configStr string
-	flag.StringVar(&configStr, "config", "", "address of config server")
+	var confStr string
+	flag.StringVar(&confStr, "conf", "", "address of config server")
+	var clusterFile string
+	flag.StringVar(&clusterFile, "config", "", "cluster description file (see the cluster package), in place of -conf")
 	flag.Parse()
 
 	usage_assert := func(b bool) {
@@ -17,9 +21,22 @@ func main() {
 		}
 	}
 
-	usage_assert(configStr != "")
-
-	config := grove_ffi.MakeAddress(configStr)
+	var config grove_ffi.Address
+	if confStr != "" {
+		config = grove_ffi.MakeAddress(confStr)
+	} else if clusterFile != "" {
+		c, err := cluster.Load(clusterFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if c.Fencing == nil {
+			log.Fatalf("%s has no fencing section", clusterFile)
+		}
+		c.Apply()
+		config = c.Fencing.Config.Address()
+	} else {
+		usage_assert(false)
+	}
 
 	go loopclient.LoopOnKey(0, config)
 	go loopclient.LoopOnKey(1, config)
@@ -51,13 +51,13 @@ def start_config(port=12000):
     return start(f"go run ./cmd/config -port {str(port)}")
 
 def start_client(config_ip="127.0.0.1", config_port=12000):
-    return start(f"go run ./cmd/loopclient -config {config_ip}:{str(config_port)}")
+    return start(f"go run ./cmd/loopclient -conf {config_ip}:{str(config_port)}")
 
 def start_ctr(port):
     return start(f"go run ./cmd/ctr -port {str(port)}")
 
 def start_frontend(my_port, config_ip="127.0.0.1", config_port=12000, ctr1="127.0.0.1:12200", ctr2="127.0.0.1:12201"):
-    return start(f"go run ./cmd/frontend -config {config_ip}:{str(config_port)} -port {my_port} " +
+    return start(f"go run ./cmd/frontend -conf {config_ip}:{str(config_port)} -port {my_port} " +
                  f"-ctr1 {ctr1} -ctr2 {ctr2}"
                  )
 
@@ -0,0 +1,202 @@
+package grove_ffi
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Addresses are uint64s, so that they are cheap to store, compare, and send
+// over the network as part of a configuration. There are two kinds:
+//
+//   - "a.b.c.d:port", an IPv4 address and port packed directly into the low 48
+//     bits. This is the original kind, and such addresses mean the same thing
+//     in every process.
+//   - named addresses: an IPv6 "[addr]:port", a DNS "hostname:port" (resolved
+//     each time we connect, so it can follow a container that moves), or a Unix
+//     domain socket "unix:/path". These are a hash of the address string with
+//     the top bit set, and are turned back into the string through a
+//     process-wide address book.
+//
+// MakeAddress adds named addresses to the address book. A process that gets a
+// named address from elsewhere (e.g. a clerk learning replica addresses from
+// the config service) must also have it in its address book, which can be
+// preloaded from the file named by $GROVE_ADDRS (one address per line). Only
+// the hash goes over the wire, so there is no other way to learn the name:
+// connecting to or listening on a named address that isn't in the address book
+// panics, saying so.
+type Address = uint64
+
+const namedAddressTag = uint64(1) << 63
+
+const unixPrefix = "unix:"
+
+var addrBook struct {
+	mu     sync.Mutex
+	names  map[Address]string
+	loaded bool
+}
+
+func loadAddressBookLocked() {
+	if addrBook.loaded {
+		return
+	}
+	addrBook.loaded = true
+	addrBook.names = make(map[Address]string)
+	path := os.Getenv("GROVE_ADDRS")
+	if path == "" {
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("grove_ffi: reading $GROVE_ADDRS: %v", err)
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		registerLocked(line)
+	}
+}
+
+// 63-bit FNV-1a; this has to agree across processes.
+func hashAddress(s string) uint64 {
+	var h = uint64(14695981039346656037)
+	for i := 0; i < len(s); i++ {
+		h = h ^ uint64(s[i])
+		h = h * 1099511628211
+	}
+	return h &^ namedAddressTag
+}
+
+func registerLocked(s string) Address {
+	if a, ok := parseIPv4(s); ok {
+		return a
+	}
+	if err := checkNamedAddress(s); err != nil {
+		panic(fmt.Sprintf("Bad address %s: %v", s, err))
+	}
+	a := namedAddressTag | hashAddress(s)
+	if old, ok := addrBook.names[a]; ok && old != s {
+		panic(fmt.Sprintf("Addresses %s and %s collide", old, s))
+	}
+	addrBook.names[a] = s
+	return a
+}
+
+// Returns an error if MakeAddress would reject s.
+func CheckAddress(s string) error {
+	if _, ok := parseIPv4(s); ok {
+		return nil
+	}
+	return checkNamedAddress(s)
+}
+
+func checkNamedAddress(s string) error {
+	if strings.HasPrefix(s, unixPrefix) {
+		if len(s) == len(unixPrefix) {
+			return fmt.Errorf("empty socket path")
+		}
+		return nil
+	}
+	host, portStr, err := net.SplitHostPort(s)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		return fmt.Errorf("missing host")
+	}
+	_, err = strconv.ParseUint(portStr, 10, 16)
+	return err
+}
+
+func parseIPv4(s string) (Address, bool) {
+	host, portStr, err := net.SplitHostPort(s)
+	if err != nil {
+		return 0, false
+	}
+	ip := net.ParseIP(host).To4()
+	if ip == nil || strings.Contains(host, ":") {
+		return 0, false
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return 0, false
+	}
+	return (uint64(ip[0]) | uint64(ip[1])<<8 | uint64(ip[2])<<16 | uint64(ip[3])<<24 | uint64(port)<<32), true
+}
+
+// Accepts "a.b.c.d:port", "[ipv6]:port", "hostname:port" or "unix:/path", and
+// panics on anything else.
+func MakeAddress(ipStr string) Address {
+	addrBook.mu.Lock()
+	defer addrBook.mu.Unlock()
+	loadAddressBookLocked()
+	return registerLocked(ipStr)
+}
+
+// For -port flags: a bare port number means listening on that port on all IPv4
+// interfaces (as -port always used to); anything else is an address as for
+// MakeAddress, e.g. "[::]:12345" or "unix:/run/srv.sock".
+func MakeListenAddress(portStr string) Address {
+	if _, err := strconv.ParseUint(portStr, 10, 16); err == nil {
+		return MakeAddress("0.0.0.0:" + portStr)
+	}
+	return MakeAddress(portStr)
+}
+
+func IsNamedAddress(a Address) bool {
+	return a&namedAddressTag != 0
+}
+
+func AddressToStr(e Address) string {
+	if IsNamedAddress(e) {
+		addrBook.mu.Lock()
+		defer addrBook.mu.Unlock()
+		loadAddressBookLocked()
+		s, ok := addrBook.names[e]
+		if !ok {
+			return fmt.Sprintf("unresolved-address-%#x", e)
+		}
+		return s
+	}
+	a0 := byte(e & 0xff)
+	e = e >> 8
+	a1 := byte(e & 0xff)
+	e = e >> 8
+	a2 := byte(e & 0xff)
+	e = e >> 8
+	a3 := byte(e & 0xff)
+	e = e >> 8
+	port := e & 0xffff
+	return fmt.Sprintf("%s:%d", net.IPv4(a0, a1, a2, a3).String(), port)
+}
+
+// Returns the arguments for net.Dial/net.Listen; panics if a is a named address
+// that isn't in our address book, since retrying can't make it resolve.
+func netAddress(a Address) (string, string) {
+	if IsNamedAddress(a) {
+		addrBook.mu.Lock()
+		loadAddressBookLocked()
+		s, ok := addrBook.names[a]
+		addrBook.mu.Unlock()
+		if !ok {
+			panic(fmt.Sprintf("grove_ffi: named address %#x is not in this process's address book; "+
+				"every process that uses a hostname, IPv6 or Unix socket address has to list it in $GROVE_ADDRS "+
+				"(or call MakeAddress on it), since only its hash is sent between processes", a))
+		}
+		if strings.HasPrefix(s, unixPrefix) {
+			return "unix", s[len(unixPrefix):]
+		}
+		return "tcp", s
+	}
+	return "tcp", AddressToStr(a)
+}
@@ -0,0 +1,64 @@
+package grove_ffi
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIPv4AddressUnchanged(t *testing.T) {
+	// the packed form of IPv4 addresses is stored in existing configurations
+	a := MakeAddress("10.0.0.1:12345")
+	if a != uint64(10)|uint64(1)<<24|uint64(12345)<<32 {
+		t.Errorf("IPv4 packing changed: %#x", a)
+	}
+	if s := AddressToStr(a); s != "10.0.0.1:12345" {
+		t.Errorf("got %s", s)
+	}
+}
+
+func TestNamedAddresses(t *testing.T) {
+	for _, s := range []string{"[::1]:8080", "db-1.example.com:9000", "unix:/tmp/x.sock"} {
+		a := MakeAddress(s)
+		if !IsNamedAddress(a) {
+			t.Errorf("%s should be a named address", s)
+		}
+		if got := AddressToStr(a); got != s {
+			t.Errorf("got %s, want %s", got, s)
+		}
+	}
+	if MakeAddress("[::1]:8080") != MakeAddress("[::1]:8080") {
+		t.Errorf("named addresses should be deterministic")
+	}
+}
+
+func TestUnresolvedAddress(t *testing.T) {
+	// what another process would send for a hostname we've never heard of
+	a := namedAddressTag | hashAddress("elsewhere.example.com:9000")
+	defer func() {
+		r := recover()
+		if r == nil || !strings.Contains(fmt.Sprint(r), "GROVE_ADDRS") {
+			t.Errorf("got %v, want a panic explaining the address book", r)
+		}
+	}()
+	Connect(a)
+}
+
+func TestUnixSocketConnection(t *testing.T) {
+	a := MakeAddress("unix:" + filepath.Join(t.TempDir(), "s.sock"))
+	l := Listen(a)
+	go func() {
+		c := Accept(l)
+		r := Receive(c)
+		Send(c, r.Data)
+	}()
+	r := Connect(a)
+	if r.Err {
+		t.Fatalf("connect failed")
+	}
+	Send(r.Connection, []byte("hi"))
+	if got := Receive(r.Connection); got.Err || string(got.Data) != "hi" {
+		t.Errorf("got %+v", got)
+	}
+}
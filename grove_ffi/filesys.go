@@ -1,66 +1,201 @@
 package grove_ffi
 
 import (
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io/fs"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 )
 
 // filesystem+network library
+
+// Where FileWrite, FileRead and FileAppend keep files, relative to the working
+// directory, unless SetDataDir says otherwise; temporary files go in ./tmp.
 const DataDir = "durable"
 
+// FileWrite, FileRead and FileAppend go through a FileSystem: by default the
+// real one, but tests can swap in an in-memory one that crashes at chosen points
+// (see grove_ffi/memfs) with SetFileSystem, and check what gets recovered.
+//
+// Names are slash-separated paths, relative to the working directory unless
+// they start with a slash. Written
+// data need not survive a crash until the file is synced; renames are atomic,
+// but need not survive a crash until the directory they rename into is synced.
+type FileSystem interface {
+	// Returns nil if the file doesn't exist.
+	ReadFile(name string) ([]byte, error)
+	// Creates the file, or truncates it if it exists, and writes data to it.
+	WriteFile(name string, data []byte) error
+	// Creates the file if it doesn't exist, and writes data at its end; then,
+	// if sync, does what Sync does.
+	AppendFile(name string, data []byte, sync bool) error
+	// Makes everything written to the file so far durable.
+	Sync(name string) error
+	// Atomically replaces newname with oldname.
+	Rename(oldname string, newname string) error
+	// Makes the renames into dir so far durable.
+	SyncDir(dir string) error
+}
+
+var fileSystemState struct {
+	mu sync.Mutex
+	fs FileSystem
+	// set by SetDataDir; "" for DataDir
+	dir string
+}
+
+// Makes every later FileWrite, FileRead and FileAppend in this process use fsys;
+// nil switches back to the real file system.
+func SetFileSystem(fsys FileSystem) {
+	fileSystemState.mu.Lock()
+	fileSystemState.fs = fsys
+	fileSystemState.mu.Unlock()
+}
+
+// Makes every later FileWrite, FileRead and FileAppend in this process keep
+// files in dir (relative to the working directory, or absolute), and temporary
+// files in dir/tmp; "" switches back to DataDir. Call it before the first of
+// those, since files already written stay where they are.
+func SetDataDir(dir string) {
+	if dir != "" {
+		dir = filepath.ToSlash(filepath.Clean(dir))
+	}
+	fileSystemState.mu.Lock()
+	fileSystemState.dir = dir
+	fileSystemState.mu.Unlock()
+}
+
+func getFileSystem() FileSystem {
+	fileSystemState.mu.Lock()
+	defer fileSystemState.mu.Unlock()
+	if fileSystemState.fs == nil {
+		return osFileSystem{}
+	}
+	return fileSystemState.fs
+}
+
+// The directories that durable and temporary files go in.
+func dataDirs() (string, string) {
+	fileSystemState.mu.Lock()
+	defer fileSystemState.mu.Unlock()
+	if fileSystemState.dir == "" {
+		return DataDir, "tmp"
+	}
+	return fileSystemState.dir, fileSystemState.dir + "/tmp"
+}
+
 func panic_if_err(err error) {
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
+// used to give each temporary file a fresh name
+var tmpCounter atomic.Uint64
+
 // crash-atomically writes content to the file with name filename
 func FileWrite(filename string, content []byte) {
-	_ = os.Mkdir("tmp", 0755)
-	tmpfile, err := ioutil.TempFile("tmp", filename+"_*")
-	panic_if_err(err)
-	// defer tmpfile.Close()
-	defer os.Remove(tmpfile.Name())
-
-	for i := 0; i < len(content); {
-		bytesWritten, err := tmpfile.Write(content[i:])
-		panic_if_err(err)
-		i += bytesWritten
-	}
-	err = tmpfile.Sync()
-	panic_if_err(err)
-
-	_ = os.Mkdir(DataDir, 0755)
-	panic_if_err(os.Rename(tmpfile.Name(), filepath.Join(DataDir, filename)))
-	// FIXME: how to make sure the os.Rename completes?
+	// every step has to go to the same file system, even if SetFileSystem is
+	// called halfway through
+	fsys := getFileSystem()
+	dir, tmpdir := dataDirs()
+	tmpname := fmt.Sprintf("%s/%s_%d_%d", tmpdir, filename, os.Getpid(), tmpCounter.Add(1))
+	panic_if_err(fsys.WriteFile(tmpname, content))
+	panic_if_err(fsys.Sync(tmpname))
+	name := dir + "/" + filename
+	panic_if_err(fsys.Rename(tmpname, name))
+	panic_if_err(fsys.SyncDir(path.Dir(name)))
 }
 
 // reads the contents of the file filename
 func FileRead(filename string) []byte {
-	content, _ := ioutil.ReadFile(filepath.Join(DataDir, filename))
+	dir, _ := dataDirs()
+	content, err := getFileSystem().ReadFile(dir + "/" + filename)
+	panic_if_err(err)
 	return content
 }
 
 func FileAppend(filename string, data []byte) {
-	filename = filepath.Join(DataDir, filename)
-	f, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	fsys := getFileSystem()
+	dir, _ := dataDirs()
+	filename = dir + "/" + filename
+	panic_if_err(fsys.AppendFile(filename, data, true))
+}
+
+// injective function u64 -> str
+func U64ToString(i uint64) string {
+	return fmt.Sprint(i)
+}
+
+// The real file system.
+type osFileSystem struct{}
+
+func (osFileSystem) ReadFile(name string) ([]byte, error) {
+	content, err := os.ReadFile(filepath.FromSlash(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return content, err
+}
+
+func (osFileSystem) open(name string, flag int) (*os.File, error) {
+	name = filepath.FromSlash(name)
+	_ = os.MkdirAll(filepath.Dir(name), 0755)
+	return os.OpenFile(name, flag, 0666)
+}
+
+func (o osFileSystem) write(name string, flag int, data []byte, sync bool) error {
+	f, err := o.open(name, flag)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	f.Write(data)
-	err = f.Sync()
-	panic_if_err(err)
-	// time.Sleep(10 * time.Millisecond)
-	err = f.Close()
+	// Write keeps going until all of data is written, or fails
+	_, err = f.Write(data)
+	if err == nil && sync {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+func (o osFileSystem) WriteFile(name string, data []byte) error {
+	return o.write(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, data, false)
+}
+
+func (o osFileSystem) AppendFile(name string, data []byte, sync bool) error {
+	return o.write(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, data, sync)
+}
+
+func (o osFileSystem) Sync(name string) error {
+	return o.sync(name, os.O_WRONLY)
+}
+
+func (o osFileSystem) sync(name string, flag int) error {
+	f, err := o.open(name, flag)
 	if err != nil {
-		panic(err)
+		return err
 	}
+	err = f.Sync()
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	return err
 }
 
-// injective function u64 -> str
-func U64ToString(i uint64) string {
-	return fmt.Sprint(i)
+func (osFileSystem) Rename(oldname string, newname string) error {
+	newname = filepath.FromSlash(newname)
+	_ = os.MkdirAll(filepath.Dir(newname), 0755)
+	return os.Rename(filepath.FromSlash(oldname), newname)
+}
+
+func (o osFileSystem) SyncDir(dir string) error {
+	// a directory can only be opened for reading
+	return o.sync(dir, os.O_RDONLY)
 }
@@ -0,0 +1,29 @@
+package grove_ffi
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSetDataDir(t *testing.T) {
+	dir := t.TempDir()
+	SetDataDir(dir)
+	defer SetDataDir("")
+
+	FileWrite("a.data", []byte("hello"))
+	FileAppend("b.data", []byte("x"))
+	FileAppend("b.data", []byte("y"))
+	for name, want := range map[string]string{"a.data": "hello", "b.data": "xy"} {
+		got, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil || string(got) != want {
+			t.Errorf("%s holds %q (%v), want %q", name, got, err, want)
+		}
+		if got := FileRead(name); string(got) != want {
+			t.Errorf("FileRead(%s) = %q, want %q", name, got, want)
+		}
+	}
+	if _, err := os.Stat(DataDir); err == nil {
+		t.Errorf("wrote to ./%s", DataDir)
+	}
+}
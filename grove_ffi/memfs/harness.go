@@ -0,0 +1,108 @@
+package memfs
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mit-pdos/gokv/grove_ffi"
+)
+
+// A crash-and-recover test. Each run installs a fresh file system, starts a
+// workload, crashes the file system at some point, and then calls a check with
+// the rebooted file system installed, to restart the components under test and
+// see what they recovered.
+//
+// Since grove_ffi has only one file system per process, components from before
+// the crash must not touch the file system once the check has started. Run waits
+// until the workload has returned, or the file system has seen no new callers for a
+// while, before rebooting; this is enough if, as usual, components only touch the
+// file system on behalf of calls made by the workload.
+type Harness struct {
+	Seed   int64
+	Config Config
+	// The kind of operation to crash at.
+	Op Op
+	// Called at the start of each run, to make that run's workload and its
+	// check, which may share state (protected by a lock) with each other but
+	// not with other runs: workloads from earlier runs may still be running.
+	//
+	// The workload runs in its own goroutine, and may never return if it blocks
+	// on the crashed file system. The check is called after the crash, and
+	// returns an error if the recovered state breaks an invariant; it should
+	// close the components it starts, so that they don't touch the file system
+	// of the next run.
+	Setup func() (workload func(), check func() error)
+	// Give up after this many runs; 0 means 1000.
+	MaxRuns int
+}
+
+// How long the file system has to go without new callers before Run considers a
+// crashed workload to be done.
+const settleTime = 10 * time.Millisecond
+
+// Runs the test once for every crash point: at the first operation of kind
+// h.Op, then at the second, and so on, until a run in which the workload returns
+// before reaching the crash point (which is then crashed right after).
+func (h *Harness) Run() error {
+	defer grove_ffi.SetFileSystem(nil)
+	maxRuns := h.MaxRuns
+	if maxRuns == 0 {
+		maxRuns = 1000
+	}
+	for n := 1; n <= maxRuns; n++ {
+		finished, err := h.RunOnce(n)
+		if err != nil {
+			return err
+		}
+		if finished {
+			return nil
+		}
+	}
+	return fmt.Errorf("memfs: workload still running after crashing at %d different points", maxRuns)
+}
+
+// Runs the test once, crashing at the nth operation of kind h.Op (or when
+// the workload returns, if that comes first, in which case finished is true).
+func (h *Harness) RunOnce(n int) (finished bool, err error) {
+	fs := New(h.Seed + int64(n))
+	fs.SetConfig(h.Config)
+	fs.CrashAt(h.Op, n)
+	grove_ffi.SetFileSystem(fs)
+
+	workload, check := h.Setup()
+	done := make(chan struct{})
+	go func() {
+		workload()
+		close(done)
+	}()
+	select {
+	case <-done:
+		// let background writes started by the workload finish; the workload
+		// may also have returned because of the crash (say, after a timeout)
+		time.Sleep(settleTime)
+		select {
+		case <-fs.Crashed():
+		default:
+			finished = true
+			fs.Crash()
+		}
+	case <-fs.Crashed():
+	}
+
+	// wait for everything still running to block
+	var blocked = fs.Blocked()
+	for {
+		time.Sleep(settleTime)
+		b := fs.Blocked()
+		if b == blocked {
+			break
+		}
+		blocked = b
+	}
+
+	grove_ffi.SetFileSystem(fs.Reboot())
+	if err := check(); err != nil {
+		return finished, fmt.Errorf("after crash at %s %d: %w", h.Op, n, err)
+	}
+	return finished, nil
+}
@@ -0,0 +1,356 @@
+// Package memfs is an in-memory file system for tests: install it with
+// grove_ffi.SetFileSystem, and FileWrite, FileRead and FileAppend use it instead
+// of the disk.
+//
+// The point is to crash it. Written data only becomes durable when its file is
+// synced; when the file system crashes, each file keeps some prefix of the
+// writes made since its last sync (and, if torn writes are enabled, possibly
+// part of the next one), and everything else is lost. Renames are atomic, but
+// only durable once the directory renamed into is synced with SyncDir (which,
+// to keep things simple, also makes every rename before them durable); a crash
+// keeps some prefix of the renames made since. Creating a file needs no
+// directory sync. A crash can be requested at the nth operation of some kind,
+// in which case that operation never completes: a write or append may or may
+// not make it (in part, if torn), and a rename doesn't happen.
+//
+// Once crashed, the file system blocks every caller forever, as if the machine
+// had stopped; Reboot gives a new file system with whatever survived. All
+// randomness comes from the seed passed to New.
+package memfs
+
+import (
+	"fmt"
+	"math/rand"
+	"path"
+	"sync"
+)
+
+// The kinds of operation that a crash can be requested at.
+type Op int
+
+const (
+	// Any of the ones below.
+	AnyOp Op = iota
+	OpWrite
+	OpAppend
+	OpSync
+	OpRename
+)
+
+func (op Op) String() string {
+	switch op {
+	case OpWrite:
+		return "write"
+	case OpAppend:
+		return "append"
+	case OpSync:
+		return "sync"
+	case OpRename:
+		return "rename"
+	default:
+		return "operation"
+	}
+}
+
+type Config struct {
+	// Whether a crash can keep part of a write or append, rather than either
+	// all of it or none of it.
+	TornWrites bool
+}
+
+type write struct {
+	truncate bool
+	data     []byte
+}
+
+type file struct {
+	data    []byte  // what reads see
+	durable []byte  // what survives a crash for sure
+	pending []write // made since the last sync, in order
+}
+
+type rename struct {
+	oldname string
+	newname string
+}
+
+type FS struct {
+	mu    *sync.Mutex
+	rng   *rand.Rand
+	cfg   Config
+	files map[string]*file
+	// the names that survive a crash for sure, and the renames made since
+	// that may not
+	durableFiles map[string]*file
+	renames      []rename
+
+	// crash at the crashIn'th operation of kind crashOp from now; 0 if no crash
+	// was requested
+	crashOp Op
+	crashIn int
+
+	crashed chan struct{} // closed on crash
+	// callers blocked since the crash
+	blocked uint64
+}
+
+// An empty file system.
+func New(seed int64) *FS {
+	return &FS{
+		mu:      new(sync.Mutex),
+		rng:     rand.New(rand.NewSource(seed)),
+		files:   make(map[string]*file),
+		crashed: make(chan struct{}),
+
+		durableFiles: make(map[string]*file),
+	}
+}
+
+func (fs *FS) SetConfig(cfg Config) {
+	fs.mu.Lock()
+	fs.cfg = cfg
+	fs.mu.Unlock()
+}
+
+// Crashes the file system during the nth (counting from 1) operation of kind
+// op from now on, replacing any earlier request.
+func (fs *FS) CrashAt(op Op, n int) {
+	fs.mu.Lock()
+	fs.crashOp = op
+	fs.crashIn = n
+	fs.mu.Unlock()
+}
+
+// Crashes the file system now, unless it already has.
+func (fs *FS) Crash() {
+	fs.mu.Lock()
+	fs.crashLocked()
+	fs.mu.Unlock()
+}
+
+// Closed once the file system has crashed.
+func (fs *FS) Crashed() <-chan struct{} {
+	return fs.crashed
+}
+
+// The number of callers that have blocked since the crash.
+func (fs *FS) Blocked() uint64 {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.blocked
+}
+
+// Returns a new file system with what survived the crash. Requires that fs has
+// crashed.
+func (fs *FS) Reboot() *FS {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	select {
+	case <-fs.crashed:
+	default:
+		panic("memfs: Reboot before a crash")
+	}
+	fs2 := &FS{
+		mu:      new(sync.Mutex),
+		rng:     fs.rng,
+		cfg:     fs.cfg,
+		files:   make(map[string]*file),
+		crashed: make(chan struct{}),
+
+		durableFiles: make(map[string]*file),
+	}
+	for name, f := range fs.files {
+		f2 := &file{data: f.durable, durable: f.durable}
+		fs2.files[name] = f2
+		fs2.durableFiles[name] = f2
+	}
+	return fs2
+}
+
+// Requires fs.mu.
+func (fs *FS) crashLocked() {
+	select {
+	case <-fs.crashed:
+		return
+	default:
+	}
+	for _, f := range fs.files {
+		f.durable = fs.survivor(f)
+		f.pending = nil
+	}
+	// including files only a rename not yet durable has replaced
+	for _, f := range fs.durableFiles {
+		if f.pending != nil {
+			f.durable = fs.survivor(f)
+			f.pending = nil
+		}
+	}
+	k := fs.rng.Intn(len(fs.renames) + 1)
+	fs.applyRenames(fs.renames[:k])
+	fs.files = fs.durableFiles
+	fs.crashIn = 0
+	close(fs.crashed)
+}
+
+// Makes renames durable. Requires fs.mu.
+func (fs *FS) applyRenames(renames []rename) {
+	for _, r := range renames {
+		if f, ok := fs.durableFiles[r.oldname]; ok {
+			delete(fs.durableFiles, r.oldname)
+			fs.durableFiles[r.newname] = f
+		}
+	}
+}
+
+// What's left of f after a crash. Requires fs.mu.
+func (fs *FS) survivor(f *file) []byte {
+	data := f.durable
+	k := fs.rng.Intn(len(f.pending) + 1)
+	for _, w := range f.pending[:k] {
+		data = w.apply(data, len(w.data))
+	}
+	if fs.cfg.TornWrites && k < len(f.pending) {
+		w := f.pending[k]
+		data = w.apply(data, fs.rng.Intn(len(w.data)+1))
+	}
+	return data
+}
+
+// Applies the first n bytes of w to data.
+func (w write) apply(data []byte, n int) []byte {
+	var out []byte
+	if !w.truncate {
+		out = append(out, data...)
+	}
+	return append(out, w.data[:n]...)
+}
+
+// Blocks forever if fs has crashed. Requires fs.mu; if this returns, fs.mu is
+// still held.
+func (fs *FS) checkCrashed() {
+	select {
+	case <-fs.crashed:
+		fs.block()
+	default:
+	}
+}
+
+// Like checkCrashed, but also blocks forever if fs is meant to crash at this
+// operation, in which case before (if not nil) is called first, to let a write
+// or append take part in the crash.
+func (fs *FS) step(op Op, before func()) {
+	fs.checkCrashed()
+	if fs.crashIn == 0 {
+		return
+	}
+	if fs.crashOp != AnyOp && fs.crashOp != op {
+		return
+	}
+	fs.crashIn--
+	if fs.crashIn > 0 {
+		return
+	}
+	if before != nil {
+		before()
+	}
+	fs.crashLocked()
+	fs.block()
+}
+
+// Requires fs.mu, which is released.
+func (fs *FS) block() {
+	fs.blocked++
+	fs.mu.Unlock()
+	select {}
+}
+
+func (fs *FS) ReadFile(name string) ([]byte, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.checkCrashed()
+	f, ok := fs.files[name]
+	if !ok {
+		return nil, nil
+	}
+	return append([]byte(nil), f.data...), nil
+}
+
+// Requires fs.mu.
+func (fs *FS) write(name string, w write) {
+	f, ok := fs.files[name]
+	if !ok {
+		f = new(file)
+		fs.files[name] = f
+		if _, ok := fs.durableFiles[name]; !ok {
+			fs.durableFiles[name] = f
+		}
+	}
+	f.data = w.apply(f.data, len(w.data))
+	f.pending = append(f.pending, w)
+}
+
+func (fs *FS) WriteFile(name string, data []byte) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	w := write{truncate: true, data: append([]byte(nil), data...)}
+	fs.step(OpWrite, func() { fs.write(name, w) })
+	fs.write(name, w)
+	return nil
+}
+
+func (fs *FS) AppendFile(name string, data []byte, sync bool) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	w := write{data: append([]byte(nil), data...)}
+	fs.step(OpAppend, func() { fs.write(name, w) })
+	fs.write(name, w)
+	if sync {
+		fs.sync(name)
+	}
+	return nil
+}
+
+func (fs *FS) Sync(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.sync(name)
+	return nil
+}
+
+// Requires fs.mu.
+func (fs *FS) sync(name string) {
+	fs.step(OpSync, nil)
+	if f, ok := fs.files[name]; ok {
+		f.durable = f.data
+		f.pending = nil
+	}
+}
+
+func (fs *FS) Rename(oldname string, newname string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.step(OpRename, nil)
+	f, ok := fs.files[oldname]
+	if !ok {
+		return fmt.Errorf("memfs: cannot rename %s: no such file", oldname)
+	}
+	delete(fs.files, oldname)
+	fs.files[newname] = f
+	fs.renames = append(fs.renames, rename{oldname: oldname, newname: newname})
+	return nil
+}
+
+func (fs *FS) SyncDir(dir string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.step(OpSync, nil)
+	n := 0
+	for i, r := range fs.renames {
+		if path.Dir(r.newname) == path.Clean(dir) {
+			n = i + 1
+		}
+	}
+	fs.applyRenames(fs.renames[:n])
+	fs.renames = fs.renames[n:]
+	return nil
+}
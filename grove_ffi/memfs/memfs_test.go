@@ -0,0 +1,130 @@
+package memfs
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/mit-pdos/gokv/grove_ffi"
+)
+
+func TestCrashLosesUnsynced(t *testing.T) {
+	fs := New(1)
+	fs.WriteFile("synced", []byte("abc"))
+	fs.Sync("synced")
+	fs.AppendFile("synced", []byte("def"), false)
+	fs.WriteFile("unsynced", []byte("xyz"))
+	fs.Crash()
+
+	for i := 0; i < 10; i++ {
+		fs2 := fs.Reboot()
+		if d, _ := fs2.ReadFile("synced"); string(d) != "abc" && string(d) != "abcdef" {
+			t.Fatalf("synced file has %q after crash", d)
+		}
+		if d, _ := fs2.ReadFile("unsynced"); len(d) != 0 && string(d) != "xyz" {
+			t.Fatalf("unsynced file has %q after crash", d)
+		}
+	}
+}
+
+func TestCrashAtRename(t *testing.T) {
+	fs := New(1)
+	fs.WriteFile("a", []byte("old"))
+	fs.Sync("a")
+	fs.CrashAt(OpRename, 1)
+	go func() {
+		fs.WriteFile("b", []byte("new"))
+		fs.Sync("b")
+		fs.Rename("b", "a")
+		t.Errorf("rename returned after the crash")
+	}()
+	<-fs.Crashed()
+	fs2 := fs.Reboot()
+	if d, _ := fs2.ReadFile("a"); string(d) != "old" {
+		t.Fatalf("a has %q after a crash at the rename", d)
+	}
+	if d, _ := fs2.ReadFile("b"); string(d) != "new" {
+		t.Fatalf("b has %q after a crash at the rename", d)
+	}
+}
+
+func TestRenameNeedsSyncDir(t *testing.T) {
+	lost := false
+	for seed := int64(0); seed < 20; seed++ {
+		fs := New(seed)
+		fs.WriteFile("d/a", []byte("old"))
+		fs.Sync("d/a")
+		fs.WriteFile("tmp/a", []byte("new"))
+		fs.Sync("tmp/a")
+		fs.Rename("tmp/a", "d/a")
+		fs.Crash()
+		d, _ := fs.Reboot().ReadFile("d/a")
+		if string(d) != "old" && string(d) != "new" {
+			t.Fatalf("a has %q after a crash", d)
+		}
+		lost = lost || string(d) == "old"
+
+		fs = New(seed)
+		fs.WriteFile("tmp/b", []byte("new"))
+		fs.Sync("tmp/b")
+		fs.Rename("tmp/b", "d/b")
+		fs.SyncDir("d")
+		fs.Crash()
+		fs2 := fs.Reboot()
+		if d, _ := fs2.ReadFile("d/b"); string(d) != "new" {
+			t.Fatalf("b has %q after a crash after SyncDir", d)
+		}
+		if d, _ := fs2.ReadFile("tmp/b"); d != nil {
+			t.Fatalf("tmp/b has %q after a crash after SyncDir", d)
+		}
+	}
+	if !lost {
+		t.Errorf("a rename was never lost without SyncDir")
+	}
+}
+
+// FileWrite should be atomic, even with torn writes; FileAppend should only
+// lose data it hasn't returned for.
+func TestGroveFFIHarness(t *testing.T) {
+	h := &Harness{
+		Seed:   1,
+		Config: Config{TornWrites: true},
+	}
+	h.Setup = func() (func(), func() error) {
+		var mu sync.Mutex
+		var written, appended []byte
+		workload := func() {
+			for i := 0; i < 5; i++ {
+				v := []byte(fmt.Sprintf("value %d", i))
+				grove_ffi.FileWrite("w", v)
+				grove_ffi.FileAppend("a", v)
+				mu.Lock()
+				written = v
+				appended = append(appended, v...)
+				mu.Unlock()
+			}
+		}
+		check := func() error {
+			mu.Lock()
+			defer mu.Unlock()
+			w := grove_ffi.FileRead("w")
+			whole := len(w) == len("value 0") && bytes.HasPrefix(w, []byte("value "))
+			if !whole && !(written == nil && len(w) == 0) {
+				return fmt.Errorf("FileWrite torn: %q", w)
+			}
+			if string(w) < string(written) {
+				return fmt.Errorf("FileWrite lost: have %q, wrote %q", w, written)
+			}
+			a := grove_ffi.FileRead("a")
+			if !bytes.HasPrefix(a, appended) {
+				return fmt.Errorf("FileAppend lost: have %q, appended %q", a, appended)
+			}
+			return nil
+		}
+		return workload, check
+	}
+	if err := h.Run(); err != nil {
+		t.Fatal(err)
+	}
+}
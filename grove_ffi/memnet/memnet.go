@@ -0,0 +1,316 @@
+// Package memnet is an in-memory network for tests: install it with
+// grove_ffi.SetTransport, and every server and client in the process talks
+// through it instead of real sockets, so a whole cluster can run in one test.
+//
+// The network can delay, drop, duplicate and reorder messages, and cut servers
+// off from everyone else. All randomness comes from the seed passed to New, so
+// a failing test can be rerun with the same faults (up to goroutine
+// scheduling).
+//
+// Clients don't have addresses of their own, so faults are mostly described in
+// terms of the server end of each connection: isolating a server cuts every
+// connection *to* it, but not the connections it makes to other servers as a
+// client. A connection made with grove_ffi.ConnectFrom is also known to come
+// from the server at its source address, which Partition uses to cut two
+// servers off from each other without touching their other connections.
+package memnet
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/mit-pdos/gokv/grove_ffi"
+)
+
+type Config struct {
+	// Each message is delivered after a delay picked uniformly from
+	// [MinDelay, MaxDelay].
+	MinDelay time.Duration
+	MaxDelay time.Duration
+	// Percentage of messages that are silently lost.
+	DropPercent uint64
+	// Percentage of messages that are delivered twice (each copy with its own
+	// delay).
+	DupPercent uint64
+	// Unless Reorder is set, messages on a connection arrive in the order they
+	// were sent, no matter their delays.
+	Reorder bool
+}
+
+type Network struct {
+	mu  *sync.Mutex
+	rng *rand.Rand
+	cfg Config
+
+	listeners map[grove_ffi.Address]*listener
+	isolated  map[grove_ffi.Address]bool
+	// pairs of servers that can't reach each other, both ways round
+	partitioned map[pair]bool
+	// open connections, by the address of the server end
+	conns map[grove_ffi.Address][]*endpoint
+}
+
+// A network that delivers every message right away.
+func New(seed int64) *Network {
+	return &Network{
+		mu:        new(sync.Mutex),
+		rng:       rand.New(rand.NewSource(seed)),
+		listeners: make(map[grove_ffi.Address]*listener),
+		isolated:  make(map[grove_ffi.Address]bool),
+		conns:     make(map[grove_ffi.Address][]*endpoint),
+
+		partitioned: make(map[pair]bool),
+	}
+}
+
+type pair struct {
+	a grove_ffi.Address
+	b grove_ffi.Address
+}
+
+func (n *Network) SetConfig(cfg Config) {
+	n.mu.Lock()
+	n.cfg = cfg
+	n.mu.Unlock()
+}
+
+// Cuts host off: new connections to it fail, and messages in either direction
+// on existing ones are dropped, until Heal.
+func (n *Network) Isolate(host grove_ffi.Address) {
+	n.mu.Lock()
+	n.isolated[host] = true
+	n.mu.Unlock()
+}
+
+// Cuts a and b off from each other: new connections from one to the other (made
+// with grove_ffi.ConnectFrom) fail, and messages in either direction on
+// existing ones are dropped, until Heal. Their connections to and from other
+// servers, and from clients, are unaffected.
+func (n *Network) Partition(a grove_ffi.Address, b grove_ffi.Address) {
+	n.mu.Lock()
+	n.partitioned[pair{a, b}] = true
+	n.partitioned[pair{b, a}] = true
+	n.mu.Unlock()
+}
+
+// Undoes Isolate(host), and every Partition involving host.
+func (n *Network) Heal(host grove_ffi.Address) {
+	n.mu.Lock()
+	delete(n.isolated, host)
+	for p := range n.partitioned {
+		if p.a == host || p.b == host {
+			delete(n.partitioned, p)
+		}
+	}
+	n.mu.Unlock()
+}
+
+// Whether messages between the server at host and the connection's source src
+// are dropped. Requires n.mu.
+func (n *Network) cut(src grove_ffi.Address, host grove_ffi.Address) bool {
+	return n.isolated[host] || n.partitioned[pair{src, host}]
+}
+
+// Breaks every open connection to host, as if its server had restarted; clients
+// will notice and reconnect.
+func (n *Network) Disconnect(host grove_ffi.Address) {
+	n.mu.Lock()
+	conns := n.conns[host]
+	delete(n.conns, host)
+	n.mu.Unlock()
+	for _, e := range conns {
+		e.Close()
+	}
+}
+
+type listener struct {
+	n       *Network
+	host    grove_ffi.Address
+	cond    *sync.Cond // on n.mu
+	pending []*endpoint
+	closed  bool
+}
+
+func (n *Network) Listen(host grove_ffi.Address) (grove_ffi.TransportListener, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.listeners[host]; ok {
+		return nil, fmt.Errorf("memnet: %s is already in use", grove_ffi.AddressToStr(host))
+	}
+	l := &listener{n: n, host: host, cond: sync.NewCond(n.mu)}
+	n.listeners[host] = l
+	return l, nil
+}
+
+func (l *listener) Accept() (grove_ffi.TransportConn, error) {
+	l.n.mu.Lock()
+	defer l.n.mu.Unlock()
+	for len(l.pending) == 0 && !l.closed {
+		l.cond.Wait()
+	}
+	if l.closed {
+		return nil, fmt.Errorf("memnet: listener on %s closed", grove_ffi.AddressToStr(l.host))
+	}
+	e := l.pending[0]
+	l.pending = l.pending[1:]
+	return e, nil
+}
+
+// Connections that arrived but weren't accepted yet are broken.
+func (l *listener) Close() error {
+	n := l.n
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	if n.listeners[l.host] == l {
+		delete(n.listeners, l.host)
+	}
+	for _, e := range l.pending {
+		e.closeLocked()
+	}
+	l.pending = nil
+	l.cond.Broadcast()
+	return nil
+}
+
+func (n *Network) Connect(src grove_ffi.Address, host grove_ffi.Address) (grove_ffi.TransportConn, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	l, ok := n.listeners[host]
+	if !ok || n.cut(src, host) {
+		return nil, fmt.Errorf("memnet: cannot connect to %s", grove_ffi.AddressToStr(host))
+	}
+	client := &endpoint{n: n, src: src, host: host, cond: sync.NewCond(n.mu)}
+	server := &endpoint{n: n, src: src, host: host, cond: sync.NewCond(n.mu)}
+	client.peer = server
+	server.peer = client
+	n.conns[host] = append(n.conns[host], server)
+	l.pending = append(l.pending, server)
+	l.cond.Signal()
+	return client, nil
+}
+
+type message struct {
+	at   time.Time // when it can be received
+	data []byte
+}
+
+// One end of a connection. Both ends' state is protected by n.mu.
+type endpoint struct {
+	n      *Network
+	src    grove_ffi.Address // the client end's server (see ConnectFrom), or 0
+	host   grove_ffi.Address // the server end's address
+	peer   *endpoint
+	cond   *sync.Cond // signalled when a message arrives or we're closed
+	inbox  []message  // sorted by at
+	closed bool
+	// the latest delivery time of any message sent to this endpoint, to keep
+	// messages in order when not reordering
+	lastAt time.Time
+}
+
+// Requires n.mu.
+func (n *Network) delay() time.Duration {
+	d := n.cfg.MinDelay
+	if n.cfg.MaxDelay > n.cfg.MinDelay {
+		d += time.Duration(n.rng.Int63n(int64(n.cfg.MaxDelay - n.cfg.MinDelay + 1)))
+	}
+	return d
+}
+
+// Requires n.mu.
+func (n *Network) percent(p uint64) bool {
+	return p > 0 && uint64(n.rng.Intn(100)) < p
+}
+
+// Queues data at dst. Requires n.mu.
+func (dst *endpoint) deliver(data []byte) {
+	n := dst.n
+	var at = time.Now().Add(n.delay())
+	if !n.cfg.Reorder && at.Before(dst.lastAt) {
+		at = dst.lastAt
+	}
+	if at.After(dst.lastAt) {
+		dst.lastAt = at
+	}
+	i := len(dst.inbox)
+	for i > 0 && dst.inbox[i-1].at.After(at) {
+		i--
+	}
+	dst.inbox = append(dst.inbox, message{})
+	copy(dst.inbox[i+1:], dst.inbox[i:])
+	dst.inbox[i] = message{at: at, data: data}
+	dst.cond.Broadcast()
+	if d := time.Until(at); d > 0 {
+		time.AfterFunc(d, func() {
+			n.mu.Lock()
+			dst.cond.Broadcast()
+			n.mu.Unlock()
+		})
+	}
+}
+
+func (e *endpoint) Send(data []byte) error {
+	n := e.n
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if e.closed {
+		return fmt.Errorf("memnet: connection closed")
+	}
+	if n.cut(e.src, e.host) || n.percent(n.cfg.DropPercent) {
+		return nil
+	}
+	if e.peer.closed {
+		// as with TCP, the sender only finds out later
+		return nil
+	}
+	// the caller may reuse data
+	msg := append([]byte(nil), data...)
+	e.peer.deliver(msg)
+	if n.percent(n.cfg.DupPercent) {
+		e.peer.deliver(msg)
+	}
+	return nil
+}
+
+func (e *endpoint) Receive(max uint64) ([]byte, error) {
+	n := e.n
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for {
+		if e.closed {
+			return nil, fmt.Errorf("memnet: connection closed")
+		}
+		if len(e.inbox) > 0 && !e.inbox[0].at.After(time.Now()) {
+			break
+		}
+		e.cond.Wait()
+	}
+	m := e.inbox[0]
+	e.inbox = e.inbox[1:]
+	if max != 0 && uint64(len(m.data)) > max {
+		e.closeLocked()
+		return nil, fmt.Errorf("memnet: message of %d bytes is over the limit of %d", len(m.data), max)
+	}
+	return m.data, nil
+}
+
+// Requires n.mu.
+func (e *endpoint) closeLocked() {
+	e.closed = true
+	e.peer.closed = true
+	e.cond.Broadcast()
+	e.peer.cond.Broadcast()
+}
+
+func (e *endpoint) Close() error {
+	e.n.mu.Lock()
+	e.closeLocked()
+	e.n.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,137 @@
+package memnet
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/urpc"
+)
+
+func TestFaultyNetwork(t *testing.T) {
+	n := New(1)
+	n.SetConfig(Config{MaxDelay: 2 * time.Millisecond, DropPercent: 20, DupPercent: 20, Reorder: true})
+	grove_ffi.SetTransport(n)
+	defer grove_ffi.SetTransport(nil)
+
+	handlers := map[uint64]func([]byte, *[]byte){
+		0: func(args []byte, reply *[]byte) { *reply = args },
+	}
+	host := grove_ffi.MakeAddress("10.0.0.1:1")
+	urpc.MakeServer(handlers).Serve(host)
+
+	cl := urpc.MakeClient(host)
+	cl.SetRetryPolicy(urpc.UntilReplyRetryPolicy)
+	for i := 0; i < 100; i++ {
+		args := []byte(fmt.Sprint(i))
+		reply := new([]byte)
+		if err := cl.Call(0, args, reply, 10); err != urpc.ErrNone {
+			t.Fatalf("call %d failed: %d", i, err)
+		}
+		if string(*reply) != string(args) {
+			t.Fatalf("call %d got reply %q", i, *reply)
+		}
+	}
+}
+
+func TestIsolate(t *testing.T) {
+	n := New(1)
+	grove_ffi.SetTransport(n)
+	defer grove_ffi.SetTransport(nil)
+
+	var calls atomic.Uint64
+	handlers := map[uint64]func([]byte, *[]byte){
+		0: func(args []byte, reply *[]byte) { calls.Add(1) },
+	}
+	host := grove_ffi.MakeAddress("10.0.0.1:1")
+	urpc.MakeServer(handlers).Serve(host)
+
+	cl := urpc.MakeClient(host)
+	if err := cl.Call(0, nil, new([]byte), 100); err != urpc.ErrNone {
+		t.Fatalf("call failed: %d", err)
+	}
+	n.Isolate(host)
+	if err := cl.Call(0, nil, new([]byte), 50); err != urpc.ErrTimeout {
+		t.Errorf("expected timeout, got %d", err)
+	}
+	if err, _ := urpc.TryMakeClient(host); err == 0 {
+		t.Errorf("connected to an isolated server")
+	}
+	n.Heal(host)
+	if err := cl.Call(0, nil, new([]byte), 100); err != urpc.ErrNone {
+		t.Errorf("call after healing failed: %d", err)
+	}
+
+	n.Disconnect(host)
+	if err := cl.Call(0, nil, new([]byte), 100); err != urpc.ErrDisconnect {
+		t.Errorf("expected disconnect, got %d", err)
+	}
+	if calls.Load() != 2 {
+		t.Errorf("handler ran %d times", calls.Load())
+	}
+}
+
+func TestPartition(t *testing.T) {
+	n := New(1)
+	grove_ffi.SetTransport(n)
+	defer grove_ffi.SetTransport(nil)
+
+	handlers := map[uint64]func([]byte, *[]byte){
+		0: func(args []byte, reply *[]byte) {},
+	}
+	a := grove_ffi.MakeAddress("10.0.0.1:1")
+	b := grove_ffi.MakeAddress("10.0.0.2:1")
+	c := grove_ffi.MakeAddress("10.0.0.3:1")
+	for _, host := range []grove_ffi.Address{a, b, c} {
+		urpc.MakeServer(handlers).Serve(host)
+	}
+
+	_, fromB := urpc.TryMakeClientFrom(b, a)
+	_, fromC := urpc.TryMakeClientFrom(c, a)
+	n.Partition(a, b)
+	if err := fromB.Call(0, nil, new([]byte), 50); err != urpc.ErrTimeout {
+		t.Errorf("b reached a: %d", err)
+	}
+	if err, _ := urpc.TryMakeClientFrom(b, a); err == 0 {
+		t.Errorf("b connected to a")
+	}
+	// the rest of the network is fine
+	if err := fromC.Call(0, nil, new([]byte), 100); err != urpc.ErrNone {
+		t.Errorf("c couldn't reach a: %d", err)
+	}
+	if err, _ := urpc.TryMakeClientFrom(a, c); err != 0 {
+		t.Errorf("a couldn't connect to c")
+	}
+	n.Heal(b)
+	if err := fromB.Call(0, nil, new([]byte), 100); err != urpc.ErrNone {
+		t.Errorf("call after healing failed: %d", err)
+	}
+}
+
+func TestRestartServer(t *testing.T) {
+	grove_ffi.SetTransport(New(1))
+	defer grove_ffi.SetTransport(nil)
+
+	host := grove_ffi.MakeAddress("10.0.0.1:1")
+	serve := func(v byte) *urpc.Server {
+		srv := urpc.MakeServer(map[uint64]func([]byte, *[]byte){
+			0: func(args []byte, reply *[]byte) { *reply = []byte{v} },
+		})
+		srv.Serve(host)
+		return srv
+	}
+	old := serve(1)
+	cl := urpc.MakeClient(host)
+	old.Close()
+	if err := cl.Call(0, nil, new([]byte), 100); err != urpc.ErrDisconnect {
+		t.Errorf("expected disconnect from closed server, got %d", err)
+	}
+
+	serve(2)
+	reply := new([]byte)
+	if err := urpc.MakeClient(host).Call(0, nil, reply, 100); err != urpc.ErrNone || (*reply)[0] != 2 {
+		t.Errorf("restarted server: %d, %v", err, *reply)
+	}
+}
@@ -1,66 +1,24 @@
 package grove_ffi
 
 import (
+	"crypto/tls"
 	"fmt"
 	"github.com/tchajed/marshal"
 	"io"
 	"net"
-	"strconv"
-	"strings"
+	"os"
 	"sync"
 )
 
-type Address = uint64
-
-func MakeAddress(ipStr string) uint64 {
-	// XXX: manually parsing is pretty silly; couldn't figure out how to make
-	// this work cleanly net.IP
-	ipPort := strings.Split(ipStr, ":")
-	if len(ipPort) != 2 {
-		panic(fmt.Sprintf("Not ipv4:port %s", ipStr))
-	}
-	port, err := strconv.ParseUint(ipPort[1], 10, 16)
-	if err != nil {
-		panic(err)
-	}
-
-	ss := strings.Split(ipPort[0], ".")
-	if len(ss) != 4 {
-		panic(fmt.Sprintf("Not ipv4:port %s", ipStr))
-	}
-	ip := make([]byte, 4)
-	for i, s := range ss {
-		a, err := strconv.ParseUint(s, 10, 8)
-		if err != nil {
-			panic(err)
-		}
-		ip[i] = byte(a)
-	}
-	return (uint64(ip[0]) | uint64(ip[1])<<8 | uint64(ip[2])<<16 | uint64(ip[3])<<24 | uint64(port)<<32)
-}
-
-func AddressToStr(e Address) string {
-	a0 := byte(e & 0xff)
-	e = e >> 8
-	a1 := byte(e & 0xff)
-	e = e >> 8
-	a2 := byte(e & 0xff)
-	e = e >> 8
-	a3 := byte(e & 0xff)
-	e = e >> 8
-	port := e & 0xffff
-	return fmt.Sprintf("%s:%d", net.IPv4(a0, a1, a2, a3).String(), port)
-}
-
 // / Listener
 type listener struct {
-	l net.Listener
+	l TransportListener
 }
 
 type Listener *listener
 
 func Listen(host Address) Listener {
-	l, err := net.Listen("tcp", AddressToStr(host))
+	l, err := getTransport().Listen(host)
 	if err != nil {
 		// Assume() no error on Listen. This should fail loud and early, retrying makes little sense (likely the port is already used).
 		panic(err)
@@ -78,14 +36,30 @@ func Accept(l Listener) Connection {
 	return makeConnection(conn)
 }
 
+// Like Accept, but fails (rather than panicking) once l is closed.
+func TryAccept(l Listener) ConnectRet {
+	conn, err := l.l.Accept()
+	if err != nil {
+		return ConnectRet{Err: true}
+	}
+	return ConnectRet{Err: false, Connection: makeConnection(conn)}
+}
+
+// Stops listening: Accept fails from now on, and the address can be listened
+// on again. Connections already accepted stay open.
+func CloseListener(l Listener) {
+	l.l.Close()
+}
+
 // / Connection
 type connection struct {
-	conn    net.Conn
+	conn    TransportConn
 	send_mu *sync.Mutex // guarding *sending* on `conn`
 	recv_mu *sync.Mutex // guarding *receiving* on `conn`
+	maxRecv uint64      // guarded by recv_mu; 0 means no limit
 }
 
-func makeConnection(conn net.Conn) Connection {
+func makeConnection(conn TransportConn) Connection {
 	return &connection{conn: conn, send_mu: new(sync.Mutex), recv_mu: new(sync.Mutex)}
 }
 
@@ -97,7 +71,14 @@ type ConnectRet struct {
 }
 
 func Connect(host Address) ConnectRet {
-	conn, err := net.Dial("tcp", AddressToStr(host))
+	return ConnectFrom(0, host)
+}
+
+// Like Connect, for a connection made on behalf of the server listening at src
+// (e.g. to one of its peers). The real network ignores src, but
+// grove_ffi/memnet uses it to partition servers from each other.
+func ConnectFrom(src Address, host Address) ConnectRet {
+	conn, err := getTransport().Connect(src, host)
 	if err != nil {
 		return ConnectRet{Err: true}
 	}
@@ -105,15 +86,117 @@ func Connect(host Address) ConnectRet {
 }
 
 func Send(c Connection, data []byte) bool {
+	c.send_mu.Lock()
+	defer c.send_mu.Unlock()
+	return c.conn.Send(data) != nil
+}
+
+type ReceiveRet struct {
+	Err  bool
+	Data []byte
+}
+
+func Receive(c Connection) ReceiveRet {
+	c.recv_mu.Lock()
+	defer c.recv_mu.Unlock()
+	data, err := c.conn.Receive(c.maxRecv)
+	if err != nil {
+		return ReceiveRet{Err: true}
+	}
+	return ReceiveRet{Err: false, Data: data}
+}
+
+// Makes Receive fail (and close c) on messages longer than max bytes, rather
+// than allocating a buffer of whatever size the peer claims. 0 means no limit,
+// which is the default.
+func SetMaxMessageSize(c Connection, max uint64) {
+	c.recv_mu.Lock()
+	c.maxRecv = max
+	c.recv_mu.Unlock()
+}
+
+// Closes c; any Send or Receive on it (including ones already waiting) fails.
+func Close(c Connection) {
+	c.conn.Close()
+}
+
+// The network address of the other end of c, for logging, or "" if the
+// transport doesn't have one.
+func PeerAddress(c Connection) string {
+	nc, ok := c.conn.(netConn)
+	if !ok {
+		return ""
+	}
+	return nc.conn.RemoteAddr().String()
+}
+
+// / The real network
+
+type netTransport struct{}
+
+type netListener struct {
+	l net.Listener
+}
+
+// A stream connection, with each message sent as [dataLen] ++ data.
+type netConn struct {
+	conn net.Conn
+}
+
+func (netTransport) Listen(host Address) (TransportListener, error) {
+	network, addr := netAddress(host)
+	if network == "unix" {
+		// a socket file left behind by a previous run would make Listen fail
+		if fi, err := os.Stat(addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(addr)
+		}
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if serverTLS, _ := getTLS(); serverTLS != nil {
+		// the handshake happens on the first Receive/Send on each connection
+		l = tls.NewListener(l, serverTLS)
+	}
+	return netListener{l}, nil
+}
+
+func (l netListener) Accept() (TransportConn, error) {
+	conn, err := l.l.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return netConn{conn}, nil
+}
+
+func (l netListener) Close() error {
+	return l.l.Close()
+}
+
+func (netTransport) Connect(src Address, host Address) (TransportConn, error) {
+	network, addr := netAddress(host)
+	// for hostnames, this does a fresh DNS lookup every time
+	var conn net.Conn
+	var err error
+	if _, clientTLS := getTLS(); clientTLS != nil {
+		conn, err = tls.Dial(network, addr, clientTLSConfig(clientTLS, network, addr))
+	} else {
+		conn, err = net.Dial(network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return netConn{conn}, nil
+}
+
+func (c netConn) Send(data []byte) error {
 	// Encode message
 	e := marshal.NewEnc(8 + uint64(len(data)))
 	e.PutInt(uint64(len(data)))
 	e.PutBytes(data)
 	msg := e.Finish()
 
-	c.send_mu.Lock()
-	defer c.send_mu.Unlock()
-
 	// message format: [dataLen] ++ data
 	// Writing in a single call is faster than 2 calls despite the unnecessary copy.
 	_, err := c.conn.Write(msg)
@@ -122,18 +205,10 @@ func Send(c Connection, data []byte) bool {
 	if err != nil {
 		c.conn.Close() // Go promises this makes this connection object "dead"
 	}
-	return err != nil
+	return err
 }
 
-type ReceiveRet struct {
-	Err  bool
-	Data []byte
-}
-
-func Receive(c Connection) ReceiveRet {
-	c.recv_mu.Lock()
-	defer c.recv_mu.Unlock()
-
+func (c netConn) Receive(max uint64) ([]byte, error) {
 	// message format: [dataLen] ++ data
 
 	header := make([]byte, 8)
@@ -144,18 +219,27 @@ func Receive(c Connection) ReceiveRet {
 		// But also, we clearly lost track here of where in the protocol we are,
 		// so close it.
 		c.conn.Close()
-		return ReceiveRet{Err: true}
+		return nil, err
 	}
 	d := marshal.NewDec(header)
 	dataLen := d.GetInt()
+	if max != 0 && dataLen > max {
+		// Don't allocate whatever the peer claims; there is no way to skip
+		// the message without reading it, so give up on the connection.
+		c.conn.Close()
+		return nil, fmt.Errorf("message of %d bytes is over the limit of %d", dataLen, max)
+	}
 
 	data := make([]byte, dataLen)
 	_, err2 := io.ReadFull(c.conn, data)
 	if err2 != nil {
 		// See comment above.
 		c.conn.Close()
-		return ReceiveRet{Err: true}
+		return nil, err2
 	}
+	return data, nil
+}
 
-	return ReceiveRet{Err: false, Data: data}
+func (c netConn) Close() error {
+	return c.conn.Close()
 }
@@ -0,0 +1,170 @@
+package grove_ffi
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Optional TLS, with mutual authentication, for every connection a process
+// makes or accepts. Every node's certificate is signed by a cluster CA, and a
+// node's identity is the CommonName of its certificate. RPC servers can limit
+// admin RPCs to particular identities (see urpc.Server.RestrictToAdmin).
+//
+// TLS is off unless ConfigureTLS is called, or $GROVE_TLS_CERT, $GROVE_TLS_KEY
+// and $GROVE_TLS_CA are set (and optionally $GROVE_TLS_ADMIN, a comma-separated
+// list of admin identities). Within a cluster, either every process uses TLS or
+// none does.
+type TLSConfig struct {
+	CertFile string // this process's certificate, used as both client and server
+	KeyFile  string
+	CAFile   string // the cluster CA, which must have signed every peer's certificate
+
+	// identities that may call admin RPCs on this process's servers; if empty,
+	// admin RPCs are open to every authenticated peer
+	AdminIdentities []string
+}
+
+var tlsState struct {
+	mu     sync.Mutex
+	loaded bool
+	cfg    *TLSConfig
+	server *tls.Config
+	client *tls.Config
+}
+
+// Turns TLS on with cfg, or off if cfg is nil, for connections made or
+// accepted afterwards.
+func ConfigureTLS(cfg *TLSConfig) {
+	tlsState.mu.Lock()
+	defer tlsState.mu.Unlock()
+	tlsState.loaded = true
+	if cfg == nil {
+		tlsState.cfg, tlsState.server, tlsState.client = nil, nil, nil
+		return
+	}
+	setTLSConfigLocked(cfg)
+}
+
+func setTLSConfigLocked(cfg *TLSConfig) {
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		log.Fatalf("grove_ffi: loading TLS certificate: %v", err)
+	}
+	caPEM, err := os.ReadFile(cfg.CAFile)
+	if err != nil {
+		log.Fatalf("grove_ffi: reading TLS CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		log.Fatalf("grove_ffi: no certificates in %s", cfg.CAFile)
+	}
+
+	tlsState.cfg = cfg
+	tlsState.server = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS12,
+	}
+	tlsState.client = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		MinVersion:   tls.VersionTLS12,
+	}
+}
+
+func loadTLSLocked() {
+	if tlsState.loaded {
+		return
+	}
+	tlsState.loaded = true
+	cert := os.Getenv("GROVE_TLS_CERT")
+	if cert == "" {
+		return
+	}
+	cfg := &TLSConfig{
+		CertFile: cert,
+		KeyFile:  os.Getenv("GROVE_TLS_KEY"),
+		CAFile:   os.Getenv("GROVE_TLS_CA"),
+	}
+	if admin := os.Getenv("GROVE_TLS_ADMIN"); admin != "" {
+		cfg.AdminIdentities = strings.Split(admin, ",")
+	}
+	setTLSConfigLocked(cfg)
+}
+
+// Returns the TLS configs for listening and connecting, both nil if TLS is off.
+func getTLS() (*tls.Config, *tls.Config) {
+	tlsState.mu.Lock()
+	defer tlsState.mu.Unlock()
+	loadTLSLocked()
+	return tlsState.server, tlsState.client
+}
+
+func TLSEnabled() bool {
+	server, _ := getTLS()
+	return server != nil
+}
+
+// Identities allowed to call admin RPCs; empty if TLS is off or no admin
+// identities are configured.
+func AdminIdentities() []string {
+	tlsState.mu.Lock()
+	defer tlsState.mu.Unlock()
+	loadTLSLocked()
+	if tlsState.cfg == nil {
+		return nil
+	}
+	return tlsState.cfg.AdminIdentities
+}
+
+// Client config for connecting to addr: the server's certificate has to be for
+// the host we dialed, except for Unix sockets, where there is no host name and
+// only the CA signature is checked.
+func clientTLSConfig(base *tls.Config, network string, addr string) *tls.Config {
+	cfg := base.Clone()
+	if network == "unix" {
+		cfg.InsecureSkipVerify = true // the chain is still verified below
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return fmt.Errorf("no server certificate")
+			}
+			opts := x509.VerifyOptions{Roots: base.RootCAs, Intermediates: x509.NewCertPool()}
+			for _, c := range cs.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(c)
+			}
+			_, err := cs.PeerCertificates[0].Verify(opts)
+			return err
+		}
+		return cfg
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err == nil {
+		cfg.ServerName = host
+	}
+	return cfg
+}
+
+// The identity (certificate CommonName) of the other end of c, or "" if TLS is
+// off or the handshake hasn't finished.
+func PeerIdentity(c Connection) string {
+	nc, ok := c.conn.(netConn)
+	if !ok {
+		return ""
+	}
+	tc, ok := nc.conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	cs := tc.ConnectionState()
+	if !cs.HandshakeComplete || len(cs.PeerCertificates) == 0 {
+		return ""
+	}
+	return cs.PeerCertificates[0].Subject.CommonName
+}
@@ -0,0 +1,84 @@
+package grove_ffi
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Writes a certificate for cn signed by ca (self-signed if ca is nil) to dir,
+// returning the cert, its key, and the cert and key file names.
+func writeCert(t *testing.T, dir string, cn string, ca *x509.Certificate, caKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	parent, signer := tmpl, key
+	if ca == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		parent, signer = ca, caKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	certFile := filepath.Join(dir, cn+".crt")
+	keyFile := filepath.Join(dir, cn+".key")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return cert, key, certFile, keyFile
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey, caFile, _ := writeCert(t, dir, "ca", nil, nil)
+	_, _, certFile, keyFile := writeCert(t, dir, "admin", ca, caKey)
+
+	ConfigureTLS(&TLSConfig{CertFile: certFile, KeyFile: keyFile, CAFile: caFile})
+	defer func() {
+		tlsState.mu.Lock()
+		tlsState.cfg, tlsState.server, tlsState.client = nil, nil, nil
+		tlsState.mu.Unlock()
+	}()
+
+	a := MakeAddress("unix:" + filepath.Join(dir, "s.sock"))
+	l := Listen(a)
+	ids := make(chan string, 1)
+	go func() {
+		c := Accept(l)
+		r := Receive(c)
+		ids <- PeerIdentity(c)
+		Send(c, r.Data)
+	}()
+	r := Connect(a)
+	if r.Err {
+		t.Fatalf("connect failed")
+	}
+	Send(r.Connection, []byte("hi"))
+	if got := Receive(r.Connection); got.Err || string(got.Data) != "hi" {
+		t.Errorf("got %+v", got)
+	}
+	if id := <-ids; id != "admin" {
+		t.Errorf("server saw peer identity %q", id)
+	}
+}
@@ -0,0 +1,59 @@
+package grove_ffi
+
+import (
+	"sync"
+)
+
+// Listen, Connect, Send and Receive go through a Transport: by default the real
+// network (TCP or Unix domain sockets, with TLS if configured), but tests can
+// swap in an in-memory network (see grove_ffi/memnet) with SetTransport, and run
+// a whole cluster in one process.
+type Transport interface {
+	Listen(host Address) (TransportListener, error)
+	// src is the server the connection is made on behalf of, or 0 if that
+	// isn't known (see ConnectFrom).
+	Connect(src Address, host Address) (TransportConn, error)
+}
+
+type TransportListener interface {
+	// Returns an error once the listener is closed.
+	Accept() (TransportConn, error)
+	// Makes Accept (including one already waiting) fail, and frees the address
+	// for another Listen. Connections already accepted are unaffected.
+	Close() error
+}
+
+// A connection that carries whole messages. grove_ffi never calls Send (or
+// Receive) concurrently with itself, but may call Send, Receive and Close
+// concurrently with each other.
+type TransportConn interface {
+	// Once Send returns an error, the connection must not be used again.
+	Send(data []byte) error
+	// Returns an error if the connection is closed or broken, or if the next
+	// message is longer than max bytes (unless max is 0).
+	Receive(max uint64) ([]byte, error)
+	// Makes every Send and Receive (including ones already waiting) fail.
+	Close() error
+}
+
+var transportState struct {
+	mu sync.Mutex
+	t  Transport
+}
+
+// Makes every later Listen and Connect in this process use t; nil switches back
+// to the real network. Existing connections are unaffected.
+func SetTransport(t Transport) {
+	transportState.mu.Lock()
+	transportState.t = t
+	transportState.mu.Unlock()
+}
+
+func getTransport() Transport {
+	transportState.mu.Lock()
+	defer transportState.mu.Unlock()
+	if transportState.t == nil {
+		return netTransport{}
+	}
+	return transportState.t
+}
@@ -0,0 +1,47 @@
+package logging
+
+import (
+	"flag"
+	"os"
+
+	"github.com/tchajed/marshal"
+)
+
+// Registers -log-level and -log-format on fs (flag.CommandLine if nil), which
+// take effect as the flags are parsed.
+func RegisterFlags(fs *flag.FlagSet) {
+	if fs == nil {
+		fs = flag.CommandLine
+	}
+	fs.Func("log-level", `log levels, e.g. "info" or "info,replica=debug,urpc=warn"; levels are debug, info, warn and error`, SetLevels)
+	fs.Func("log-format", "format of log lines: text (the default) or json", func(format string) error {
+		return SetFormat(format, os.Stderr)
+	})
+}
+
+// A handler for an RPC that changes this process's log levels: the request is
+// a spec for SetLevels (or empty, to leave them as they are), and the reply is
+// an error flag followed by the levels afterwards (or the error message). For
+// servers to register under an rpcid of their own; see DecodeSetLevelsReply.
+func SetLevelsRPC(args []byte, reply *[]byte) {
+	var ok = true
+	var msg string
+	if err := SetLevels(string(args)); err != nil {
+		ok = false
+		msg = err.Error()
+	} else {
+		msg = Levels()
+	}
+	var enc = make([]byte, 0, 1+8+len(msg))
+	enc = marshal.WriteBool(enc, ok)
+	enc = marshal.WriteLenPrefixedBytes(enc, []byte(msg))
+	*reply = enc
+}
+
+// Decodes the reply of SetLevelsRPC: whether it worked, and the levels
+// afterwards or the error message.
+func DecodeSetLevelsReply(enc []byte) (bool, string) {
+	ok, enc := marshal.ReadBool(enc)
+	msg, _ := marshal.ReadLenPrefixedBytes(enc)
+	return ok, string(msg)
+}
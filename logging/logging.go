@@ -0,0 +1,201 @@
+package logging
+
+// Structured, leveled logging for servers, on top of log/slog. Each component
+// (urpc, replica, paxos, ...) has its own logger, whose lines carry a
+// component field, and its own level, which can be changed while the process
+// runs (see SetLevels). Every component logger writes through one handler,
+// text or JSON (see SetFormat), to stderr.
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type component struct {
+	level *slog.LevelVar
+}
+
+var registry struct {
+	mu         sync.Mutex
+	components map[string]*component
+	// the level of components that haven't been given their own
+	defaultLevel slog.Level
+}
+
+// where every component's records go
+var base atomic.Pointer[slog.Handler]
+
+func init() {
+	registry.components = make(map[string]*component)
+	registry.defaultLevel = slog.LevelInfo
+	SetFormat("text", os.Stderr)
+}
+
+func getComponent(name string) *component {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	c, ok := registry.components[name]
+	if !ok {
+		c = &component{level: new(slog.LevelVar)}
+		c.level.Set(registry.defaultLevel)
+		registry.components[name] = c
+	}
+	return c
+}
+
+// Returns the logger for the component called name; every line it logs has a
+// component=name field.
+func For(name string) *slog.Logger {
+	c := getComponent(name)
+	return slog.New(&handler{c: c, attrs: []slog.Attr{slog.String("component", name)}})
+}
+
+// Sends every component's lines to w, as "text" (key=value pairs) or "json"
+// (one object per line).
+func SetFormat(format string, w io.Writer) error {
+	// each component has its own level, so let everything through here
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug - 4}
+	var h slog.Handler
+	if format == "text" {
+		h = slog.NewTextHandler(w, opts)
+	} else if format == "json" {
+		h = slog.NewJSONHandler(w, opts)
+	} else {
+		return fmt.Errorf("unknown log format %q (want text or json)", format)
+	}
+	base.Store(&h)
+	return nil
+}
+
+type setting struct {
+	name  string // "" for every component
+	level slog.Level
+}
+
+func parseLevels(spec string) ([]setting, error) {
+	var settings []setting
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, levelStr, hasName := strings.Cut(item, "=")
+		if !hasName {
+			name, levelStr = "", name
+		}
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(levelStr)); err != nil {
+			return nil, fmt.Errorf("bad log level %q", levelStr)
+		}
+		settings = append(settings, setting{name, level})
+	}
+	return settings, nil
+}
+
+// Returns the error SetLevels would, without changing anything.
+func CheckLevels(spec string) error {
+	_, err := parseLevels(spec)
+	return err
+}
+
+// Sets levels from a comma-separated list of component=level settings, and
+// optionally a bare level for every other component, e.g.
+// "info,replica=debug,urpc=warn". Levels are debug, info, warn and error.
+func SetLevels(spec string) error {
+	settings, err := parseLevels(spec)
+	if err != nil {
+		return err
+	}
+	// a bare level applies first, so that it doesn't undo the others
+	for _, s := range settings {
+		if s.name == "" {
+			registry.mu.Lock()
+			registry.defaultLevel = s.level
+			for _, c := range registry.components {
+				c.level.Set(s.level)
+			}
+			registry.mu.Unlock()
+		}
+	}
+	for _, s := range settings {
+		if s.name != "" {
+			getComponent(s.name).level.Set(s.level)
+		}
+	}
+	return nil
+}
+
+// The current levels, in the form SetLevels takes.
+func Levels() string {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	items := []string{strings.ToLower(registry.defaultLevel.String())}
+	names := make([]string, 0, len(registry.components))
+	for name := range registry.components {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if l := registry.components[name].level.Level(); l != registry.defaultLevel {
+			items = append(items, name+"="+strings.ToLower(l.String()))
+		}
+	}
+	return strings.Join(items, ",")
+}
+
+// A component's handler: filters by the component's level, and passes the rest
+// on to the current base handler, with the component's attributes and groups.
+type handler struct {
+	c *component
+	// applied, in order, to the base handler
+	attrs  []slog.Attr
+	groups []groupOrAttrs
+}
+
+type groupOrAttrs struct {
+	group string // if nonempty
+	attrs []slog.Attr
+}
+
+func (h *handler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.c.level.Level()
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	var b = (*base.Load()).WithAttrs(h.attrs)
+	for _, g := range h.groups {
+		if g.group != "" {
+			b = b.WithGroup(g.group)
+		} else {
+			b = b.WithAttrs(g.attrs)
+		}
+	}
+	return b.Handle(ctx, r)
+}
+
+func (h *handler) with(g groupOrAttrs) *handler {
+	groups := make([]groupOrAttrs, len(h.groups), len(h.groups)+1)
+	copy(groups, h.groups)
+	return &handler{c: h.c, attrs: h.attrs, groups: append(groups, g)}
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	if len(attrs) == 0 {
+		return h
+	}
+	return h.with(groupOrAttrs{attrs: attrs})
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	return h.with(groupOrAttrs{group: name})
+}
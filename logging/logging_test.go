@@ -0,0 +1,117 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Sends logs to a buffer, as JSON, with levels from spec; undone at the end of
+// the test.
+func capture(t *testing.T, spec string) *bytes.Buffer {
+	old := Levels()
+	buf := new(bytes.Buffer)
+	SetFormat("json", buf)
+	if err := SetLevels(spec); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		SetFormat("text", os.Stderr)
+		SetLevels(old)
+	})
+	return buf
+}
+
+func lines(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	var out []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var m map[string]any
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			t.Fatalf("bad line %q: %v", line, err)
+		}
+		out = append(out, m)
+	}
+	return out
+}
+
+func TestComponentLevels(t *testing.T) {
+	buf := capture(t, "warn,testa=debug")
+	a := For("testa")
+	b := For("testb")
+	a.Debug("a debug")
+	b.Info("b info")
+	b.Warn("b warn")
+
+	ls := lines(t, buf)
+	if len(ls) != 2 {
+		t.Fatalf("got %d lines, want 2: %s", len(ls), buf)
+	}
+	if ls[0]["msg"] != "a debug" || ls[0]["component"] != "testa" {
+		t.Errorf("first line is %v", ls[0])
+	}
+	if ls[1]["msg"] != "b warn" || ls[1]["component"] != "testb" {
+		t.Errorf("second line is %v", ls[1])
+	}
+}
+
+func TestSetLevelsAtRuntime(t *testing.T) {
+	buf := capture(t, "info")
+	// a logger made before the level changes follows the change
+	l := For("testc").With("epoch", 3)
+	l.Debug("hidden")
+	if err := SetLevels("testc=debug"); err != nil {
+		t.Fatal(err)
+	}
+	l.Debug("shown", "index", 7)
+
+	ls := lines(t, buf)
+	if len(ls) != 1 {
+		t.Fatalf("got %d lines, want 1: %s", len(ls), buf)
+	}
+	if ls[0]["msg"] != "shown" || ls[0]["epoch"] != 3.0 || ls[0]["index"] != 7.0 {
+		t.Errorf("line is %v", ls[0])
+	}
+	if got := Levels(); !strings.Contains(got, "testc=debug") || !strings.HasPrefix(got, "info") {
+		t.Errorf("Levels() = %q", got)
+	}
+
+	// a bare level resets every component
+	SetLevels("error")
+	if got := Levels(); got != "error" {
+		t.Errorf("Levels() = %q, want %q", got, "error")
+	}
+}
+
+func TestBadSpec(t *testing.T) {
+	capture(t, "info,testd=warn")
+	if err := SetLevels("testd=debug,teste=loud"); err == nil {
+		t.Fatal("expected an error")
+	}
+	// nothing in a bad spec takes effect
+	if got := Levels(); !strings.Contains(got, "testd=warn") {
+		t.Errorf("Levels() = %q", got)
+	}
+	if err := SetFormat("xml", os.Stderr); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestSetLevelsRPC(t *testing.T) {
+	capture(t, "info")
+	reply := new([]byte)
+	SetLevelsRPC([]byte("testf=debug"), reply)
+	ok, msg := DecodeSetLevelsReply(*reply)
+	if !ok || !strings.Contains(msg, "testf=debug") {
+		t.Errorf("got %v %q", ok, msg)
+	}
+	SetLevelsRPC([]byte("testf=nope"), reply)
+	ok, msg = DecodeSetLevelsReply(*reply)
+	if ok || !strings.Contains(msg, "nope") {
+		t.Errorf("got %v %q", ok, msg)
+	}
+}
@@ -14,10 +14,37 @@ type ErrorType = uint64
 const (
 	ENone          = uint64(0)
 	EDontHaveShard = uint64(1)
+	EBadVersion    = uint64(2)
+	ENotCounter    = uint64(3)
+	// Never sent by servers: the clerk's context was done before there was a
+	// reply.
+	ECanceled = uint64(4)
+	// Never sent by shard servers: the server has no handler for the request,
+	// e.g. because it runs an older version (a router passes this on to its
+	// clients).
+	EUnsupported = uint64(5)
+	// The request doesn't make sense, e.g. an MPut with a different number of
+	// values than keys; retrying won't help.
+	EBadRequest = uint64(6)
 )
 
+// Default number of shards; the actual number is picked when the cluster is
+// created (see MakeKVCoordServer and MakeKVShardServer), and clerks learn it
+// from the length of the shard map.
 const NSHARD = uint64(65536)
 
+// Encoding versions. Every request and every encoded shard map starts with the
+// version it was encoded with, so that a server can reject a request from a
+// client speaking a different version rather than misinterpreting its bytes.
+//
+//	0: uint64 keys, fixed NSHARD (no version prefix on the wire)
+//	1: byte-string keys, shard map prefixed by its number of shards
+//
+// Versions are tagged in their high bytes so that a version 0 request, which
+// starts directly with a uint64 key, is unlikely to look like a later version.
+const versionTag = uint64(0x6d656d6b76) << 24 // "memkv"
+const ENCODING_VERSION = versionTag | 1
+
 // rpc ids
 const KV_FRESHCID = uint64(0)
 const KV_PUT = uint64(1)
@@ -25,32 +52,80 @@ const KV_GET = uint64(2)
 const KV_CONDITIONAL_PUT = uint64(3)
 const KV_INS_SHARD = uint64(4)
 const KV_MOV_SHARD = uint64(5)
+const KV_MGET = uint64(6)
+const KV_MPUT = uint64(7)
+const KV_SHARD_STATS = uint64(8)
+const KV_APPEND = uint64(9)
+const KV_INCREMENT = uint64(10)
+const KV_GET_AND_SET = uint64(11)
+
+// 64-bit FNV-1a. This decides which shard a key lives in, so it must never
+// change for a given ENCODING_VERSION.
+func hashKey(key []byte) uint64 {
+	var h = uint64(14695981039346656037)
+	for _, b := range key {
+		h = h ^ uint64(b)
+		h = h * 1099511628211
+	}
+	return h
+}
+
+func shardOf(key []byte, nshard uint64) uint64 {
+	return hashKey(key) % nshard
+}
+
+// For clients (e.g. mkrouter) that keep their own copy of the shard map.
+func ShardOf(key []byte, nshard uint64) uint64 {
+	return shardOf(key, nshard)
+}
 
-func shardOf(key uint64) uint64 {
-	return key % NSHARD
+// Returns the encoding version of a request and the rest of the request. A
+// request too short to have a version is treated as version 0.
+func decodeVersion(rawReq []byte) (uint64, []byte) {
+	if len(rawReq) < 8 {
+		return 0, rawReq
+	}
+	return marshal.ReadInt(rawReq)
+}
+
+// Wraps a handler so that it only sees requests encoded with ENCODING_VERSION
+// (with the version stripped off); other requests get badReply.
+func Versioned(badReply []byte, handler func([]byte, *[]byte)) func([]byte, *[]byte) {
+	return func(rawReq []byte, rawReply *[]byte) {
+		version, rest := decodeVersion(rawReq)
+		if version != ENCODING_VERSION {
+			*rawReply = badReply
+			return
+		}
+		handler(rest, rawReply)
+	}
 }
 
 type PutRequest struct {
-	Key   uint64
+	Key   []byte
 	Value []byte
 }
 
-// doesn't include the operation type
+// doesn't include the operation type or the encoding version
 func EncodePutRequest(args *PutRequest) []byte {
 	// assume no overflow (args.Value would have to be almost 2^64 bytes large...)
-	num_bytes := std.SumAssumeNoOverflow(8+8, uint64(len(args.Value))) // CID + Seq + key + value-len + value
+	// version + key-len + key + value-len + value
+	num_bytes := std.SumAssumeNoOverflow(8+8+8, std.SumAssumeNoOverflow(uint64(len(args.Key)), uint64(len(args.Value))))
 	e := marshal.NewEnc(num_bytes)
-	e.PutInt(args.Key)
+	e.PutInt(ENCODING_VERSION)
+	e.PutInt(uint64(len(args.Key)))
+	e.PutBytes(args.Key)
 	e.PutInt(uint64(len(args.Value)))
 	e.PutBytes(args.Value)
 
 	return e.Finish()
 }
 
+// expects the encoding version to already have been stripped off
 func DecodePutRequest(reqData []byte) *PutRequest {
 	req := new(PutRequest)
 	d := marshal.NewDec(reqData)
-	req.Key = d.GetInt()
+	req.Key = d.GetBytes(d.GetInt())
 	req.Value = d.GetBytes(d.GetInt())
 
 	return req
@@ -74,7 +149,7 @@ func DecodePutReply(replyData []byte) *PutReply {
 }
 
 type GetRequest struct {
-	Key uint64
+	Key []byte
 }
 
 type GetReply struct {
@@ -83,15 +158,17 @@ type GetReply struct {
 }
 
 func EncodeGetRequest(req *GetRequest) []byte {
-	e := marshal.NewEnc(8)
-	e.PutInt(req.Key)
+	e := marshal.NewEnc(std.SumAssumeNoOverflow(8+8, uint64(len(req.Key))))
+	e.PutInt(ENCODING_VERSION)
+	e.PutInt(uint64(len(req.Key)))
+	e.PutBytes(req.Key)
 	return e.Finish()
 }
 
 func DecodeGetRequest(rawReq []byte) *GetRequest {
 	req := new(GetRequest)
 	d := marshal.NewDec(rawReq)
-	req.Key = d.GetInt()
+	req.Key = d.GetBytes(d.GetInt())
 	return req
 }
 
@@ -115,7 +192,7 @@ func DecodeGetReply(rawRep []byte) *GetReply {
 }
 
 type ConditionalPutRequest struct {
-	Key           uint64
+	Key           []byte
 	ExpectedValue []byte
 	NewValue      []byte
 }
@@ -127,10 +204,14 @@ type ConditionalPutReply struct {
 
 func EncodeConditionalPutRequest(req *ConditionalPutRequest) []byte {
 	// assume no overflow (req.NewValue and req.ExpectedValue together would have to be almost 2^64 bytes large...)
-	// CID + Seq + key + exp-value-len + exp-value + new-value-len + new-value
-	num_bytes := std.SumAssumeNoOverflow(8+8+8, std.SumAssumeNoOverflow(uint64(len(req.ExpectedValue)), uint64(len(req.NewValue))))
+	// version + key-len + key + exp-value-len + exp-value + new-value-len + new-value
+	num_bytes := std.SumAssumeNoOverflow(8+8+8+8,
+		std.SumAssumeNoOverflow(uint64(len(req.Key)),
+			std.SumAssumeNoOverflow(uint64(len(req.ExpectedValue)), uint64(len(req.NewValue)))))
 	e := marshal.NewEnc(num_bytes)
-	e.PutInt(req.Key)
+	e.PutInt(ENCODING_VERSION)
+	e.PutInt(uint64(len(req.Key)))
+	e.PutBytes(req.Key)
 	e.PutInt(uint64(len(req.ExpectedValue)))
 	e.PutBytes(req.ExpectedValue)
 	e.PutInt(uint64(len(req.NewValue)))
@@ -141,7 +222,7 @@ func EncodeConditionalPutRequest(req *ConditionalPutRequest) []byte {
 func DecodeConditionalPutRequest(rawReq []byte) *ConditionalPutRequest {
 	req := new(ConditionalPutRequest)
 	d := marshal.NewDec(rawReq)
-	req.Key = d.GetInt()
+	req.Key = d.GetBytes(d.GetInt())
 	req.ExpectedValue = d.GetBytes(d.GetInt())
 	req.NewValue = d.GetBytes(d.GetInt())
 	return req
@@ -162,47 +243,213 @@ func DecodeConditionalPutReply(replyData []byte) *ConditionalPutReply {
 	return reply
 }
 
+// KV_APPEND and KV_GET_AND_SET take a PutRequest and reply with a GetReply
+// holding the value from before the operation.
+
+type IncrementRequest struct {
+	Key   []byte
+	Delta uint64
+}
+
+// Value is the counter after the increment.
+type IncrementReply struct {
+	Err   ErrorType
+	Value uint64
+}
+
+func EncodeIncrementRequest(req *IncrementRequest) []byte {
+	e := marshal.NewEnc(std.SumAssumeNoOverflow(8+8+8, uint64(len(req.Key))))
+	e.PutInt(ENCODING_VERSION)
+	e.PutInt(uint64(len(req.Key)))
+	e.PutBytes(req.Key)
+	e.PutInt(req.Delta)
+	return e.Finish()
+}
+
+func DecodeIncrementRequest(rawReq []byte) *IncrementRequest {
+	req := new(IncrementRequest)
+	d := marshal.NewDec(rawReq)
+	req.Key = d.GetBytes(d.GetInt())
+	req.Delta = d.GetInt()
+	return req
+}
+
+func EncodeIncrementReply(rep *IncrementReply) []byte {
+	e := marshal.NewEnc(8 + 8)
+	e.PutInt(rep.Err)
+	e.PutInt(rep.Value)
+	return e.Finish()
+}
+
+func DecodeIncrementReply(rawRep []byte) *IncrementReply {
+	rep := new(IncrementReply)
+	d := marshal.NewDec(rawRep)
+	rep.Err = d.GetInt()
+	rep.Value = d.GetInt()
+	return rep
+}
+
+// Multi-key operations. Each key in a batch succeeds or fails independently, so
+// that a clerk only has to retry the keys whose shard has moved.
+
+type MGetRequest struct {
+	Keys [][]byte
+}
+
+type MGetReply struct {
+	Errs   []ErrorType // same length and order as the request's Keys
+	Values [][]byte
+}
+
+// Size of a list of byte slices encoded by encBytesList.
+func sizeOfBytesList(l [][]byte) uint64 {
+	var s = uint64(8)
+	for _, b := range l {
+		s = std.SumAssumeNoOverflow(s, std.SumAssumeNoOverflow(8, uint64(len(b))))
+	}
+	return s
+}
+
+func encBytesList(e marshal.Enc, l [][]byte) {
+	e.PutInt(uint64(len(l)))
+	for _, b := range l {
+		e.PutInt(uint64(len(b)))
+		e.PutBytes(b)
+	}
+}
+
+func decBytesList(d marshal.Dec) [][]byte {
+	n := d.GetInt()
+	l := make([][]byte, n)
+	for i := uint64(0); i < n; i++ {
+		l[i] = d.GetBytes(d.GetInt())
+	}
+	return l
+}
+
+func EncodeMGetRequest(req *MGetRequest) []byte {
+	e := marshal.NewEnc(std.SumAssumeNoOverflow(8, sizeOfBytesList(req.Keys)))
+	e.PutInt(ENCODING_VERSION)
+	encBytesList(e, req.Keys)
+	return e.Finish()
+}
+
+func DecodeMGetRequest(rawReq []byte) *MGetRequest {
+	req := new(MGetRequest)
+	d := marshal.NewDec(rawReq)
+	req.Keys = decBytesList(d)
+	return req
+}
+
+func EncodeMGetReply(rep *MGetReply) []byte {
+	errsSize := std.SumAssumeNoOverflow(8, 8*uint64(len(rep.Errs)))
+	e := marshal.NewEnc(std.SumAssumeNoOverflow(errsSize, sizeOfBytesList(rep.Values)))
+	e.PutInt(uint64(len(rep.Errs)))
+	e.PutInts(rep.Errs)
+	encBytesList(e, rep.Values)
+	return e.Finish()
+}
+
+func DecodeMGetReply(rawRep []byte) *MGetReply {
+	rep := new(MGetReply)
+	d := marshal.NewDec(rawRep)
+	rep.Errs = d.GetInts(d.GetInt())
+	rep.Values = decBytesList(d)
+	return rep
+}
+
+type MPutRequest struct {
+	Keys   [][]byte
+	Values [][]byte // same length as Keys
+}
+
+// Whether req has a value for every key (and no more); servers reply
+// EBadRequest for every key if not.
+func (req *MPutRequest) WellFormed() bool {
+	return len(req.Values) == len(req.Keys)
+}
+
+type MPutReply struct {
+	Errs []ErrorType // same length and order as the request's Keys
+}
+
+func EncodeMPutRequest(req *MPutRequest) []byte {
+	num_bytes := std.SumAssumeNoOverflow(8, std.SumAssumeNoOverflow(sizeOfBytesList(req.Keys), sizeOfBytesList(req.Values)))
+	e := marshal.NewEnc(num_bytes)
+	e.PutInt(ENCODING_VERSION)
+	encBytesList(e, req.Keys)
+	encBytesList(e, req.Values)
+	return e.Finish()
+}
+
+func DecodeMPutRequest(rawReq []byte) *MPutRequest {
+	req := new(MPutRequest)
+	d := marshal.NewDec(rawReq)
+	req.Keys = decBytesList(d)
+	req.Values = decBytesList(d)
+	return req
+}
+
+func EncodeMPutReply(rep *MPutReply) []byte {
+	e := marshal.NewEnc(std.SumAssumeNoOverflow(8, 8*uint64(len(rep.Errs))))
+	e.PutInt(uint64(len(rep.Errs)))
+	e.PutInts(rep.Errs)
+	return e.Finish()
+}
+
+func DecodeMPutReply(rawRep []byte) *MPutReply {
+	rep := new(MPutReply)
+	d := marshal.NewDec(rawRep)
+	rep.Errs = d.GetInts(d.GetInt())
+	return rep
+}
+
+// Keys are byte strings, stored as Go strings so they can be map keys.
+type KvMap = map[string][]byte
+
 type InstallShardRequest struct {
 	Sid uint64
-	Kvs map[uint64][]byte
+	Kvs KvMap
 }
 
 // NOTE: probably can just amortize this by keeping track of this with the map itself
-func SizeOfMarshalledMap(m map[uint64][]byte) uint64 {
+func SizeOfMarshalledMap(m KvMap) uint64 {
 	var s uint64
 	s = 8
-	for _, value := range m {
-		v := std.SumAssumeNoOverflow(uint64(len(value)), 8+8)
+	for key, value := range m {
+		v := std.SumAssumeNoOverflow(std.SumAssumeNoOverflow(uint64(len(key)), uint64(len(value))), 8+8)
 		s = std.SumAssumeNoOverflow(s, v)
 	}
 	return s
 }
 
-func EncSliceMap(e marshal.Enc, m map[uint64][]byte) {
+func EncSliceMap(e marshal.Enc, m KvMap) {
 	e.PutInt(uint64(len(m)))
 	for key, value := range m {
-		e.PutInt(key)
+		e.PutInt(uint64(len(key)))
+		e.PutBytes([]byte(key))
 		e.PutInt(uint64(len(value)))
 		e.PutBytes(value)
 	}
 }
 
-func DecSliceMap(d marshal.Dec) map[uint64][]byte {
+func DecSliceMap(d marshal.Dec) KvMap {
 	sz := d.GetInt()
-	m := make(map[uint64][]byte)
+	m := make(KvMap)
 	var i = uint64(0)
 	for i < sz {
-		k := d.GetInt()
+		k := d.GetBytes(d.GetInt())
 		v := d.GetBytes(d.GetInt())
-		m[k] = v
+		m[string(k)] = v
 		i = i + 1
 	}
 	return m
 }
 
 func encodeInstallShardRequest(req *InstallShardRequest) []byte {
-	num_bytes := std.SumAssumeNoOverflow(8, SizeOfMarshalledMap(req.Kvs))
+	num_bytes := std.SumAssumeNoOverflow(8+8, SizeOfMarshalledMap(req.Kvs))
 	e := marshal.NewEnc(num_bytes)
+	e.PutInt(ENCODING_VERSION)
 	e.PutInt(req.Sid)
 	EncSliceMap(e, req.Kvs)
 	return e.Finish()
@@ -222,7 +469,8 @@ type MoveShardRequest struct {
 }
 
 func encodeMoveShardRequest(req *MoveShardRequest) []byte {
-	e := marshal.NewEnc(8 + 8)
+	e := marshal.NewEnc(8 + 8 + 8)
+	e.PutInt(ENCODING_VERSION)
 	e.PutInt(req.Sid)
 	e.PutInt(req.Dst)
 	return e.Finish()
@@ -236,6 +484,86 @@ func decodeMoveShardRequest(rawReq []byte) *MoveShardRequest {
 	return req
 }
 
+// Load of a single shard, as reported by the shard server that owns it.
+type ShardStats struct {
+	Sid       uint64
+	Keys      uint64
+	Bytes     uint64 // total size of keys and values
+	OpsPerSec uint64
+}
+
+type ShardStatsReply struct {
+	Err   ErrorType
+	Stats []ShardStats
+}
+
+func encodeShardStatsReply(rep *ShardStatsReply) []byte {
+	e := marshal.NewEnc(std.SumAssumeNoOverflow(8+8, 8*4*uint64(len(rep.Stats))))
+	e.PutInt(rep.Err)
+	e.PutInt(uint64(len(rep.Stats)))
+	for _, st := range rep.Stats {
+		e.PutInt(st.Sid)
+		e.PutInt(st.Keys)
+		e.PutInt(st.Bytes)
+		e.PutInt(st.OpsPerSec)
+	}
+	return e.Finish()
+}
+
+func decodeShardStatsReply(raw []byte) *ShardStatsReply {
+	rep := new(ShardStatsReply)
+	d := marshal.NewDec(raw)
+	rep.Err = d.GetInt()
+	n := d.GetInt()
+	rep.Stats = make([]ShardStats, n)
+	for i := uint64(0); i < n; i++ {
+		rep.Stats[i].Sid = d.GetInt()
+		rep.Stats[i].Keys = d.GetInt()
+		rep.Stats[i].Bytes = d.GetInt()
+		rep.Stats[i].OpsPerSec = d.GetInt()
+	}
+	return rep
+}
+
+// One migration planned by the coordinator's rebalancer, along with the load
+// of the shard being moved.
+type ShardMove struct {
+	Sid   uint64
+	Src   HostName
+	Dst   HostName
+	Stats ShardStats
+}
+
+func encodeShardMoves(moves []ShardMove) []byte {
+	e := marshal.NewEnc(std.SumAssumeNoOverflow(8, 8*6*uint64(len(moves))))
+	e.PutInt(uint64(len(moves)))
+	for _, mv := range moves {
+		e.PutInt(mv.Sid)
+		e.PutInt(mv.Src)
+		e.PutInt(mv.Dst)
+		e.PutInt(mv.Stats.Keys)
+		e.PutInt(mv.Stats.Bytes)
+		e.PutInt(mv.Stats.OpsPerSec)
+	}
+	return e.Finish()
+}
+
+func decodeShardMoves(raw []byte) []ShardMove {
+	d := marshal.NewDec(raw)
+	n := d.GetInt()
+	moves := make([]ShardMove, n)
+	for i := uint64(0); i < n; i++ {
+		moves[i].Sid = d.GetInt()
+		moves[i].Src = d.GetInt()
+		moves[i].Dst = d.GetInt()
+		moves[i].Stats.Sid = moves[i].Sid
+		moves[i].Stats.Keys = d.GetInt()
+		moves[i].Stats.Bytes = d.GetInt()
+		moves[i].Stats.OpsPerSec = d.GetInt()
+	}
+	return moves
+}
+
 // FIXME: these should just be in goose std or something
 func EncodeUint64(i uint64) []byte {
 	e := marshal.NewEnc(8)
@@ -247,14 +575,23 @@ func DecodeUint64(raw []byte) uint64 {
 	return marshal.NewDec(raw).GetInt()
 }
 
+// The number of shards is the length of the shard map.
 func encodeShardMap(shardMap *[]HostName) []byte {
 	// requires that shardMap is a list
-	e := marshal.NewEnc(8 * NSHARD)
+	nshard := uint64(len(*shardMap))
+	e := marshal.NewEnc(std.SumAssumeNoOverflow(8+8, 8*nshard))
+	e.PutInt(ENCODING_VERSION)
+	e.PutInt(nshard)
 	e.PutInts(*shardMap)
 	return e.Finish()
 }
 
 func decodeShardMap(raw []byte) []HostName {
-	d := marshal.NewDec(raw)
-	return d.GetInts(NSHARD)
+	version, rest := decodeVersion(raw)
+	if version != ENCODING_VERSION {
+		panic("memkv: shard map has unsupported encoding version")
+	}
+	d := marshal.NewDec(rest)
+	nshard := d.GetInt()
+	return d.GetInts(nshard)
 }
@@ -0,0 +1,59 @@
+package memkv
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestShardOfStable(t *testing.T) {
+	// The shard a key maps to is part of the encoding, so it must not change.
+	if h := hashKey([]byte("hello")); h != 0xa430d84680aabd0b {
+		t.Errorf("hashKey changed: got %#x", h)
+	}
+	if sid := shardOf([]byte("hello"), 16); sid != 0xb {
+		t.Errorf("shardOf changed: got %d", sid)
+	}
+}
+
+func TestPutRequestRoundtrip(t *testing.T) {
+	args := &PutRequest{Key: []byte("key"), Value: []byte("value")}
+	version, rest := decodeVersion(EncodePutRequest(args))
+	if version != ENCODING_VERSION {
+		t.Fatalf("wrong version %#x", version)
+	}
+	req := DecodePutRequest(rest)
+	if !bytes.Equal(req.Key, args.Key) || !bytes.Equal(req.Value, args.Value) {
+		t.Errorf("got %+v, want %+v", req, args)
+	}
+}
+
+func TestVersionedRejects(t *testing.T) {
+	called := false
+	h := Versioned([]byte("bad"), func(_ []byte, _ *[]byte) { called = true })
+	reply := new([]byte)
+	// a version 0 request starts directly with its uint64 key
+	h(EncodeUint64(1), reply)
+	if called || string(*reply) != "bad" {
+		t.Errorf("old-version request was not rejected")
+	}
+}
+
+func TestShardMapRoundtrip(t *testing.T) {
+	m := []HostName{1, 2, 3}
+	got := decodeShardMap(encodeShardMap(&m))
+	if len(got) != 3 || got[0] != 1 || got[2] != 3 {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestMGetReplyRoundtrip(t *testing.T) {
+	rep := &MGetReply{
+		Errs:   []ErrorType{ENone, EDontHaveShard},
+		Values: [][]byte{[]byte("a"), nil},
+	}
+	got := DecodeMGetReply(EncodeMGetReply(rep))
+	if len(got.Errs) != 2 || got.Errs[1] != EDontHaveShard ||
+		len(got.Values) != 2 || string(got.Values[0]) != "a" || len(got.Values[1]) != 0 {
+		t.Errorf("got %+v", got)
+	}
+}
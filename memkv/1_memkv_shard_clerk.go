@@ -1,14 +1,22 @@
 package memkv
 
 import (
+	"context"
+	"errors"
+
 	"github.com/mit-pdos/gokv/connman"
 	"github.com/mit-pdos/gokv/erpc"
+	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/urpc"
 )
 
 type KVShardClerk struct {
 	erpc *erpc.Client
 	host HostName
 	c    *connman.ConnMan
+	// set if host has no handler for KV_FRESHCID, i.e. isn't a shard server;
+	// every call then fails with EUnsupported
+	unsupported bool
 }
 
 func MakeFreshKVShardClerk(host HostName, c *connman.ConnMan) *KVShardClerk {
@@ -16,38 +24,106 @@ func MakeFreshKVShardClerk(host HostName, c *connman.ConnMan) *KVShardClerk {
 	ck.host = host
 	ck.c = c
 	rawRep := new([]byte)
-	ck.c.CallAtLeastOnce(host, KV_FRESHCID, make([]byte, 0), rawRep, 100 /*ms*/)
+	if ck.c.CallAtLeastOnce(host, KV_FRESHCID, make([]byte, 0), rawRep, 100 /*ms*/) != urpc.ErrNone {
+		logger.Error("not a memkv shard server", "peer", grove_ffi.AddressToStr(host))
+		ck.unsupported = true
+		ck.erpc = erpc.MakeClient(0)
+		return ck
+	}
 	cid := DecodeUint64(*rawRep)
 	ck.erpc = erpc.MakeClient(cid)
 
 	return ck
 }
 
-func (ck *KVShardClerk) Put(key uint64, value []byte) ErrorType {
+// Calls rpcid on our shard server until there is a reply (returning ENone), ctx
+// is done (returning ECanceled), or it turns out that the server has no handler
+// for rpcid (returning EUnsupported).
+func (ck *KVShardClerk) call(ctx context.Context, rpcid uint64, req []byte, rawRep *[]byte) ErrorType {
+	if ck.unsupported {
+		return EUnsupported
+	}
+	return callShard(ctx, ck.c, ck.host, rpcid, req, rawRep)
+}
+
+// Like KVShardClerk.call, for the shard server at host.
+func callShard(ctx context.Context, c *connman.ConnMan, host HostName, rpcid uint64, req []byte, rawRep *[]byte) ErrorType {
+	err := c.CallAtLeastOnceContext(ctx, host, rpcid, req, rawRep, 100 /*ms*/)
+	if err == nil {
+		return ENone
+	}
+	if errors.Is(err, connman.ErrUnknownRPC) {
+		return EUnsupported
+	}
+	return ECanceled
+}
+
+// n copies of err, for a batch that failed as a whole.
+func batchErrs(n uint64, err ErrorType) []ErrorType {
+	errs := make([]ErrorType, n)
+	for i := range errs {
+		errs[i] = err
+	}
+	return errs
+}
+
+// One error per key from a batch reply. A server that rejects the whole batch
+// (e.g. with EBadVersion) replies with a single error, which goes for every
+// key.
+func keyErrs(n uint64, errs []ErrorType) []ErrorType {
+	if uint64(len(errs)) == n {
+		return errs
+	}
+	if len(errs) == 0 {
+		return batchErrs(n, EBadVersion)
+	}
+	return batchErrs(n, errs[0])
+}
+
+func (ck *KVShardClerk) Put(key []byte, value []byte) ErrorType {
+	return ck.PutContext(context.Background(), key, value)
+}
+
+// Like Put, but returns ECanceled if ctx is done first.
+func (ck *KVShardClerk) PutContext(ctx context.Context, key []byte, value []byte) ErrorType {
 	args := new(PutRequest)
 	args.Key = key
 	args.Value = value
 	req := ck.erpc.NewRequest(EncodePutRequest(args))
 
 	rawRep := new([]byte)
-	ck.c.CallAtLeastOnce(ck.host, KV_PUT, req, rawRep, 100 /*ms*/)
+	if err := ck.call(ctx, KV_PUT, req, rawRep); err != ENone {
+		return err
+	}
 	rep := DecodePutReply(*rawRep)
 	return rep.Err
 }
 
-func (ck *KVShardClerk) Get(key uint64, value *[]byte) ErrorType {
+func (ck *KVShardClerk) Get(key []byte, value *[]byte) ErrorType {
+	return ck.GetContext(context.Background(), key, value)
+}
+
+// Like Get, but returns ECanceled if ctx is done first.
+func (ck *KVShardClerk) GetContext(ctx context.Context, key []byte, value *[]byte) ErrorType {
 	args := new(GetRequest)
 	args.Key = key
 	req := ck.erpc.NewRequest(EncodeGetRequest(args))
 
 	rawRep := new([]byte)
-	ck.c.CallAtLeastOnce(ck.host, KV_GET, req, rawRep, 100 /*ms*/)
+	if err := ck.call(ctx, KV_GET, req, rawRep); err != ENone {
+		return err
+	}
 	rep := DecodeGetReply(*rawRep)
 	*value = rep.Value
 	return rep.Err
 }
 
-func (ck *KVShardClerk) ConditionalPut(key uint64, expectedValue []byte, newValue []byte, success *bool) ErrorType {
+func (ck *KVShardClerk) ConditionalPut(key []byte, expectedValue []byte, newValue []byte, success *bool) ErrorType {
+	return ck.ConditionalPutContext(context.Background(), key, expectedValue, newValue, success)
+}
+
+// Like ConditionalPut, but returns ECanceled if ctx is done first.
+func (ck *KVShardClerk) ConditionalPutContext(ctx context.Context, key []byte, expectedValue []byte, newValue []byte, success *bool) ErrorType {
 	args := new(ConditionalPutRequest)
 	args.Key = key
 	args.ExpectedValue = expectedValue
@@ -55,13 +131,124 @@ func (ck *KVShardClerk) ConditionalPut(key uint64, expectedValue []byte, newValu
 	req := ck.erpc.NewRequest(EncodeConditionalPutRequest(args))
 
 	rawRep := new([]byte)
-	ck.c.CallAtLeastOnce(ck.host, KV_CONDITIONAL_PUT, req, rawRep, 100 /*ms*/)
+	if err := ck.call(ctx, KV_CONDITIONAL_PUT, req, rawRep); err != ENone {
+		return err
+	}
 	rep := DecodeConditionalPutReply(*rawRep)
 	*success = rep.Success
 	return rep.Err
 }
 
-func (ck *KVShardClerk) InstallShard(sid uint64, kvs map[uint64][]byte) {
+// Appends value to the value at key; sets *oldValue to the value before.
+func (ck *KVShardClerk) Append(key []byte, value []byte, oldValue *[]byte) ErrorType {
+	return ck.AppendContext(context.Background(), key, value, oldValue)
+}
+
+// Like Append, but returns ECanceled if ctx is done first.
+func (ck *KVShardClerk) AppendContext(ctx context.Context, key []byte, value []byte, oldValue *[]byte) ErrorType {
+	args := new(PutRequest)
+	args.Key = key
+	args.Value = value
+	req := ck.erpc.NewRequest(EncodePutRequest(args))
+
+	rawRep := new([]byte)
+	if err := ck.call(ctx, KV_APPEND, req, rawRep); err != ENone {
+		return err
+	}
+	rep := DecodeGetReply(*rawRep)
+	*oldValue = rep.Value
+	return rep.Err
+}
+
+// Adds delta to the counter at key; sets *newValue to the result.
+func (ck *KVShardClerk) Increment(key []byte, delta uint64, newValue *uint64) ErrorType {
+	return ck.IncrementContext(context.Background(), key, delta, newValue)
+}
+
+// Like Increment, but returns ECanceled if ctx is done first.
+func (ck *KVShardClerk) IncrementContext(ctx context.Context, key []byte, delta uint64, newValue *uint64) ErrorType {
+	args := new(IncrementRequest)
+	args.Key = key
+	args.Delta = delta
+	req := ck.erpc.NewRequest(EncodeIncrementRequest(args))
+
+	rawRep := new([]byte)
+	if err := ck.call(ctx, KV_INCREMENT, req, rawRep); err != ENone {
+		return err
+	}
+	rep := DecodeIncrementReply(*rawRep)
+	*newValue = rep.Value
+	return rep.Err
+}
+
+// Sets the value at key; sets *oldValue to the value before.
+func (ck *KVShardClerk) GetAndSet(key []byte, value []byte, oldValue *[]byte) ErrorType {
+	return ck.GetAndSetContext(context.Background(), key, value, oldValue)
+}
+
+// Like GetAndSet, but returns ECanceled if ctx is done first.
+func (ck *KVShardClerk) GetAndSetContext(ctx context.Context, key []byte, value []byte, oldValue *[]byte) ErrorType {
+	args := new(PutRequest)
+	args.Key = key
+	args.Value = value
+	req := ck.erpc.NewRequest(EncodePutRequest(args))
+
+	rawRep := new([]byte)
+	if err := ck.call(ctx, KV_GET_AND_SET, req, rawRep); err != ENone {
+		return err
+	}
+	rep := DecodeGetReply(*rawRep)
+	*oldValue = rep.Value
+	return rep.Err
+}
+
+// Gets all of keys in one RPC. Returns one error per key; values[i] is only
+// meaningful if the i'th error is ENone.
+func (ck *KVShardClerk) MGet(keys [][]byte, values *[][]byte) []ErrorType {
+	return ck.MGetContext(context.Background(), keys, values)
+}
+
+// Like MGet, but if ctx is done first, the error for every key is ECanceled.
+func (ck *KVShardClerk) MGetContext(ctx context.Context, keys [][]byte, values *[][]byte) []ErrorType {
+	args := new(MGetRequest)
+	args.Keys = keys
+	req := ck.erpc.NewRequest(EncodeMGetRequest(args))
+
+	rawRep := new([]byte)
+	if err := ck.call(ctx, KV_MGET, req, rawRep); err != ENone {
+		return batchErrs(uint64(len(keys)), err)
+	}
+	rep := DecodeMGetReply(*rawRep)
+	if len(rep.Values) != len(keys) {
+		*values = make([][]byte, len(keys))
+	} else {
+		*values = rep.Values
+	}
+	return keyErrs(uint64(len(keys)), rep.Errs)
+}
+
+// Puts all of keys in one RPC. Returns one error per key.
+func (ck *KVShardClerk) MPut(keys [][]byte, values [][]byte) []ErrorType {
+	return ck.MPutContext(context.Background(), keys, values)
+}
+
+// Like MPut, but if ctx is done first, the error for every key is ECanceled.
+func (ck *KVShardClerk) MPutContext(ctx context.Context, keys [][]byte, values [][]byte) []ErrorType {
+	args := new(MPutRequest)
+	args.Keys = keys
+	args.Values = values
+	req := ck.erpc.NewRequest(EncodeMPutRequest(args))
+
+	rawRep := new([]byte)
+	if err := ck.call(ctx, KV_MPUT, req, rawRep); err != ENone {
+		return batchErrs(uint64(len(keys)), err)
+	}
+	rep := DecodeMPutReply(*rawRep)
+	return keyErrs(uint64(len(keys)), rep.Errs)
+}
+
+// Returns ENone once the shard is installed; on any other error, it isn't.
+func (ck *KVShardClerk) InstallShard(sid uint64, kvs KvMap) ErrorType {
 	// log.Printf("InstallShard %d starting", sid)
 	args := new(InstallShardRequest)
 	args.Sid = sid
@@ -69,17 +256,54 @@ func (ck *KVShardClerk) InstallShard(sid uint64, kvs map[uint64][]byte) {
 	req := ck.erpc.NewRequest(encodeInstallShardRequest(args))
 
 	rawRep := new([]byte)
-	ck.c.CallAtLeastOnce(ck.host, KV_INS_SHARD, req, rawRep, 100 /*ms*/)
+	if err := ck.call(context.Background(), KV_INS_SHARD, req, rawRep); err != ENone {
+		return err
+	}
+	if len(*rawRep) > 0 {
+		return DecodeUint64(*rawRep)
+	}
 	// log.Printf("InstallShard %d finished", sid)
+	return ENone
 }
 
-func (ck *KVShardClerk) MoveShard(sid uint64, dst HostName) {
+// Returns ENone once the shard has moved (or if our server didn't have it); on
+// any other error, it hasn't.
+func (ck *KVShardClerk) MoveShard(sid uint64, dst HostName) ErrorType {
 	args := new(MoveShardRequest)
 	args.Sid = sid
 	args.Dst = dst
 
 	rawRep := new([]byte)
-	ck.c.CallAtLeastOnce(ck.host, KV_MOV_SHARD, encodeMoveShardRequest(args), rawRep, 100 /*ms*/)
+	if err := ck.call(context.Background(), KV_MOV_SHARD, encodeMoveShardRequest(args), rawRep); err != ENone {
+		return err
+	}
+	if len(*rawRep) > 0 {
+		return DecodeUint64(*rawRep)
+	}
+	return ENone
+}
+
+func (ck *KVShardClerk) GetShardStats() ([]ShardStats, ErrorType) {
+	return ck.GetShardStatsContext(context.Background())
+}
+
+// Like GetShardStats, but returns ECanceled if ctx is done first.
+func (ck *KVShardClerk) GetShardStatsContext(ctx context.Context) ([]ShardStats, ErrorType) {
+	if ck.unsupported {
+		return nil, EUnsupported
+	}
+	return getShardStats(ctx, ck.c, ck.host)
+}
+
+// GetShardStatsContext for the shard server at host, without making a clerk
+// for it first (which waits for the server to hand out a client ID).
+func getShardStats(ctx context.Context, c *connman.ConnMan, host HostName) ([]ShardStats, ErrorType) {
+	rawRep := new([]byte)
+	if err := callShard(ctx, c, host, KV_SHARD_STATS, EncodeUint64(ENCODING_VERSION), rawRep); err != ENone {
+		return nil, err
+	}
+	rep := decodeShardStatsReply(*rawRep)
+	return rep.Stats, rep.Err
 }
 
 // The coordinator, and the main clerk, need to talk to a bunch of shards.
@@ -1,37 +1,86 @@
 package memkv
 
 import (
+	"github.com/goose-lang/primitive"
 	"github.com/goose-lang/std"
 	"github.com/mit-pdos/gokv/connman"
 	"github.com/mit-pdos/gokv/erpc"
+	"github.com/mit-pdos/gokv/grove_ffi"
 	"github.com/mit-pdos/gokv/urpc"
 	"sync"
 )
 
-type KvMap = map[uint64][]byte
-
 type KVShardServer struct {
 	me   string //
 	mu   *sync.Mutex
 	erpc *erpc.Server
 
-	shardMap []bool // \box(size=NSHARDS)
+	nshard   uint64
+	shardMap []bool // \box(size=nshard)
 	// if anything is in shardMap, then we have a map[] initialized in kvss
-	kvss  []KvMap                    // \box(size=NSHARDS)
+	kvss  []KvMap                    // \box(size=nshard)
 	peers map[HostName]*KVShardClerk // FIXME use ShardClerkSet, maybe?
 	cm    *connman.ConnMan
+
+	// load statistics, for the coordinator's rebalancer
+	shardBytes []uint64 // \box(size=nshard); total size of keys and values
+	shardOps   []uint64 // \box(size=nshard); requests since statsStart
+	statsStart uint64   // time at which the current window started
+	prevOps    []uint64 // \box(size=nshard); requests in the previous window
+	prevStart  uint64   // time at which the previous window started
+}
+
+// Request rates are measured over windows of (at least) this many
+// nanoseconds, however often they are read.
+const statsWindowNs = uint64(10_000_000_000)
+
+// The total size of the keys and values in m, as counted in shardBytes.
+func kvBytes(m KvMap) uint64 {
+	var n = uint64(0)
+	for key, value := range m {
+		n = std.SumAssumeNoOverflow(n, std.SumAssumeNoOverflow(uint64(len(key)), uint64(len(value))))
+	}
+	return n
+}
+
+// Starts a new window if the current one is over. Requires s.mu.
+func (s *KVShardServer) rotateStats(now uint64) {
+	if now-s.statsStart < statsWindowNs {
+		return
+	}
+	ops := s.prevOps
+	s.prevOps = s.shardOps
+	s.shardOps = ops
+	for sid := range s.shardOps {
+		s.shardOps[sid] = 0
+	}
+	s.prevStart = s.statsStart
+	s.statsStart = now
 }
 
-type PutArgs struct {
-	Key   uint64
-	Value ValueType
+// Forgets the requests made to shard sid. Requires s.mu.
+func (s *KVShardServer) resetOps(sid uint64) {
+	s.shardOps[sid] = 0
+	s.prevOps[sid] = 0
+}
+
+// Sets key to value in shard sid, keeping shardBytes up to date.
+func (s *KVShardServer) setValue(sid uint64, key []byte, value []byte) {
+	m := s.kvss[sid]
+	old, ok := m[string(key)]
+	if ok {
+		s.shardBytes[sid] = s.shardBytes[sid] - uint64(len(key)) - uint64(len(old))
+	}
+	m[string(key)] = value // give ownership of the slice to the server
+	s.shardBytes[sid] = std.SumAssumeNoOverflow(s.shardBytes[sid], std.SumAssumeNoOverflow(uint64(len(key)), uint64(len(value))))
 }
 
 func (s *KVShardServer) put_inner(args *PutRequest, reply *PutReply) {
-	sid := shardOf(args.Key)
+	sid := shardOf(args.Key, s.nshard)
 
 	if s.shardMap[sid] == true {
-		s.kvss[sid][args.Key] = args.Value // give ownership of the slice to the server
+		s.shardOps[sid] += 1
+		s.setValue(sid, args.Key, args.Value)
 		reply.Err = ENone
 	} else {
 		reply.Err = EDontHaveShard
@@ -45,10 +94,11 @@ func (s *KVShardServer) PutRPC(args *PutRequest, reply *PutReply) {
 }
 
 func (s *KVShardServer) get_inner(args *GetRequest, reply *GetReply) {
-	sid := shardOf(args.Key)
+	sid := shardOf(args.Key, s.nshard)
 
 	if s.shardMap[sid] == true {
-		reply.Value = s.kvss[sid][args.Key]
+		s.shardOps[sid] += 1
+		reply.Value = s.kvss[sid][string(args.Key)]
 		reply.Err = ENone
 	} else {
 		reply.Err = EDontHaveShard
@@ -62,13 +112,13 @@ func (s *KVShardServer) GetRPC(args *GetRequest, reply *GetReply) {
 }
 
 func (s *KVShardServer) conditional_put_inner(args *ConditionalPutRequest, reply *ConditionalPutReply) {
-	sid := shardOf(args.Key)
+	sid := shardOf(args.Key, s.nshard)
 
 	if s.shardMap[sid] == true {
-		m := s.kvss[sid]
-		equal := std.BytesEqual(args.ExpectedValue, m[args.Key])
+		s.shardOps[sid] += 1
+		equal := std.BytesEqual(args.ExpectedValue, s.kvss[sid][string(args.Key)])
 		if equal {
-			m[args.Key] = args.NewValue // give ownership of the slice to the server
+			s.setValue(sid, args.Key, args.NewValue)
 		}
 		reply.Success = equal
 		reply.Err = ENone
@@ -83,6 +133,113 @@ func (s *KVShardServer) ConditionalPutRPC(args *ConditionalPutRequest, reply *Co
 	s.mu.Unlock()
 }
 
+func (s *KVShardServer) append_inner(args *PutRequest, reply *GetReply) {
+	sid := shardOf(args.Key, s.nshard)
+
+	if s.shardMap[sid] == true {
+		s.shardOps[sid] += 1
+		old := s.kvss[sid][string(args.Key)]
+		// copy, so that the reply doesn't alias the new value
+		newValue := make([]byte, 0, len(old)+len(args.Value))
+		newValue = append(newValue, old...)
+		newValue = append(newValue, args.Value...)
+		s.setValue(sid, args.Key, newValue)
+		reply.Value = old
+		reply.Err = ENone
+	} else {
+		reply.Err = EDontHaveShard
+	}
+}
+
+func (s *KVShardServer) AppendRPC(args *PutRequest, reply *GetReply) {
+	s.mu.Lock()
+	s.append_inner(args, reply)
+	s.mu.Unlock()
+}
+
+func (s *KVShardServer) get_and_set_inner(args *PutRequest, reply *GetReply) {
+	sid := shardOf(args.Key, s.nshard)
+
+	if s.shardMap[sid] == true {
+		s.shardOps[sid] += 1
+		reply.Value = s.kvss[sid][string(args.Key)]
+		s.setValue(sid, args.Key, args.Value)
+		reply.Err = ENone
+	} else {
+		reply.Err = EDontHaveShard
+	}
+}
+
+func (s *KVShardServer) GetAndSetRPC(args *PutRequest, reply *GetReply) {
+	s.mu.Lock()
+	s.get_and_set_inner(args, reply)
+	s.mu.Unlock()
+}
+
+// Counters are stored as EncodeUint64 of their value, and a missing (or empty)
+// value counts as 0. Any other value is not a counter and is left untouched.
+// Counters wrap around on overflow.
+func (s *KVShardServer) increment_inner(args *IncrementRequest, reply *IncrementReply) {
+	sid := shardOf(args.Key, s.nshard)
+
+	if s.shardMap[sid] == true {
+		s.shardOps[sid] += 1
+		old := s.kvss[sid][string(args.Key)]
+		if len(old) == 0 || len(old) == 8 {
+			var v = uint64(0)
+			if len(old) == 8 {
+				v = DecodeUint64(old)
+			}
+			v = v + args.Delta
+			s.setValue(sid, args.Key, EncodeUint64(v))
+			reply.Value = v
+			reply.Err = ENone
+		} else {
+			reply.Err = ENotCounter
+		}
+	} else {
+		reply.Err = EDontHaveShard
+	}
+}
+
+func (s *KVShardServer) IncrementRPC(args *IncrementRequest, reply *IncrementReply) {
+	s.mu.Lock()
+	s.increment_inner(args, reply)
+	s.mu.Unlock()
+}
+
+func (s *KVShardServer) MGetRPC(args *MGetRequest, reply *MGetReply) {
+	n := uint64(len(args.Keys))
+	reply.Errs = make([]ErrorType, n)
+	reply.Values = make([][]byte, n)
+	s.mu.Lock()
+	for i := uint64(0); i < n; i++ {
+		rep := new(GetReply)
+		s.get_inner(&GetRequest{Key: args.Keys[i]}, rep)
+		reply.Errs[i] = rep.Err
+		reply.Values[i] = rep.Value
+	}
+	s.mu.Unlock()
+}
+
+func (s *KVShardServer) MPutRPC(args *MPutRequest, reply *MPutReply) {
+	n := uint64(len(args.Keys))
+	reply.Errs = make([]ErrorType, n)
+	if !args.WellFormed() {
+		for i := uint64(0); i < n; i++ {
+			reply.Errs[i] = EBadRequest
+		}
+		return
+	}
+	s.mu.Lock()
+	for i := uint64(0); i < n; i++ {
+		rep := new(PutReply)
+		s.put_inner(&PutRequest{Key: args.Keys[i], Value: args.Values[i]}, rep)
+		reply.Errs[i] = rep.Err
+	}
+	s.mu.Unlock()
+}
+
 // NOTE: easy to do a little optimization with shard migration:
 // add a "RemoveShard" rpc, which removes the shard on the target server, and
 // returns half of the ghost state for that shard. Meanwhile, InstallShard()
@@ -93,6 +250,8 @@ func (s *KVShardServer) install_shard_inner(args *InstallShardRequest) {
 	// log.Printf("SHARD INSTALLING %d", args.Sid)
 	s.shardMap[args.Sid] = true
 	s.kvss[args.Sid] = args.Kvs
+	s.shardBytes[args.Sid] = kvBytes(args.Kvs)
+	s.resetOps(args.Sid)
 	// log.Printf("SHARD FINISHED INSTALLING %d", args.Sid)
 }
 
@@ -102,7 +261,9 @@ func (s *KVShardServer) InstallShardRPC(args *InstallShardRequest) {
 	s.mu.Unlock()
 }
 
-func (s *KVShardServer) MoveShardRPC(args *MoveShardRequest) {
+// Sends the shard to args.Dst, and gives it up; keeps it if args.Dst fails to
+// install it, and returns the error.
+func (s *KVShardServer) MoveShardRPC(args *MoveShardRequest) ErrorType {
 	s.mu.Lock()
 	_, ok := s.peers[args.Dst]
 	if !ok {
@@ -114,29 +275,73 @@ func (s *KVShardServer) MoveShardRPC(args *MoveShardRequest) {
 
 	if !s.shardMap[args.Sid] {
 		s.mu.Unlock()
-		return
+		return ENone
 	}
 	kvs := s.kvss[args.Sid]
+	bytes := s.shardBytes[args.Sid]
 	s.kvss[args.Sid] = make(KvMap)
 	s.shardMap[args.Sid] = false
+	s.shardBytes[args.Sid] = 0
+	s.resetOps(args.Sid)
 	// log.Printf("SHARD Moving %d to %d", args.Sid, args.Dst)
-	s.peers[args.Dst].InstallShard(args.Sid, kvs) // XXX: if we want to do this without the lock, need a lock in the clerk itself
+	err := s.peers[args.Dst].InstallShard(args.Sid, kvs) // XXX: if we want to do this without the lock, need a lock in the clerk itself
+	if err != ENone {
+		logger.Error("failed to move shard", "shard", args.Sid, "to", grove_ffi.AddressToStr(args.Dst), "err", err)
+		s.kvss[args.Sid] = kvs
+		s.shardMap[args.Sid] = true
+		s.shardBytes[args.Sid] = bytes
+	}
 	// log.Printf("SHARD Moved %d to %d", args.Sid, args.Dst)
 	s.mu.Unlock()
+	return err
 }
 
-func MakeKVShardServer(is_init bool) *KVShardServer {
+// nshard must match the number of shards the coordinator was created with.
+// Reports load for every nonempty shard we own, with request rates measured
+// over the previous window and the current one so far (see statsWindowNs).
+// Reading stats doesn't affect what later reads report.
+func (s *KVShardServer) ShardStatsRPC() []ShardStats {
+	stats := make([]ShardStats, 0)
+	s.mu.Lock()
+	now := primitive.TimeNow()
+	s.rotateStats(now)
+	elapsed := now - s.prevStart
+	if elapsed == 0 {
+		elapsed = 1
+	}
+	for sid := uint64(0); sid < s.nshard; sid++ {
+		ops := s.prevOps[sid] + s.shardOps[sid]
+		if s.shardMap[sid] && (len(s.kvss[sid]) > 0 || ops > 0) {
+			stats = append(stats, ShardStats{
+				Sid:       sid,
+				Keys:      uint64(len(s.kvss[sid])),
+				Bytes:     s.shardBytes[sid],
+				OpsPerSec: ops * 1_000_000_000 / elapsed,
+			})
+		}
+	}
+	s.mu.Unlock()
+	return stats
+}
+
+func MakeKVShardServer(is_init bool, nshard uint64) *KVShardServer {
 	srv := new(KVShardServer)
 	srv.mu = new(sync.Mutex)
 	srv.erpc = erpc.MakeServer()
-	srv.shardMap = make([]bool, NSHARD)
-	srv.kvss = make([]KvMap, NSHARD)
+	srv.nshard = nshard
+	srv.shardMap = make([]bool, nshard)
+	srv.kvss = make([]KvMap, nshard)
 	srv.peers = make(map[HostName]*KVShardClerk)
 	srv.cm = connman.MakeConnMan()
-	for i := uint64(0); i < NSHARD; i++ {
+	srv.shardBytes = make([]uint64, nshard)
+	srv.shardOps = make([]uint64, nshard)
+	srv.prevOps = make([]uint64, nshard)
+	srv.statsStart = primitive.TimeNow()
+	srv.prevStart = srv.statsStart
+	for i := uint64(0); i < nshard; i++ {
 		srv.shardMap[i] = is_init
 		if is_init {
-			srv.kvss[i] = make(map[uint64][]byte)
+			srv.kvss[i] = make(KvMap)
 		}
 	}
 	return srv
@@ -156,35 +361,86 @@ func (mkv *KVShardServer) Start(host HostName) {
 
 	// TODO: for the proofs it'd be much cleaner if marshaling (and really as much as possible)
 	// was inside a separate function, rather than done inline here.
-	handlers[KV_PUT] = erpc.HandleRequest(func(rawReq []byte, rawReply *[]byte) {
-		rep := new(PutReply)
-		mkv.PutRPC(DecodePutRequest(rawReq), rep)
-		*rawReply = EncodePutReply(rep)
-	})
+	handlers[KV_PUT] = erpc.HandleRequest(Versioned(EncodePutReply(&PutReply{Err: EBadVersion}),
+		func(rawReq []byte, rawReply *[]byte) {
+			rep := new(PutReply)
+			mkv.PutRPC(DecodePutRequest(rawReq), rep)
+			*rawReply = EncodePutReply(rep)
+		}))
+
+	handlers[KV_GET] = erpc.HandleRequest(Versioned(EncodeGetReply(&GetReply{Err: EBadVersion}),
+		func(rawReq []byte, rawReply *[]byte) {
+			rep := new(GetReply)
+			mkv.GetRPC(DecodeGetRequest(rawReq), rep)
+			*rawReply = EncodeGetReply(rep)
+		}))
+
+	handlers[KV_CONDITIONAL_PUT] = erpc.HandleRequest(Versioned(EncodeConditionalPutReply(&ConditionalPutReply{Err: EBadVersion}),
+		func(rawReq []byte, rawReply *[]byte) {
+			rep := new(ConditionalPutReply)
+			mkv.ConditionalPutRPC(DecodeConditionalPutRequest(rawReq), rep)
+			*rawReply = EncodeConditionalPutReply(rep)
+		}))
+
+	handlers[KV_APPEND] = erpc.HandleRequest(Versioned(EncodeGetReply(&GetReply{Err: EBadVersion}),
+		func(rawReq []byte, rawReply *[]byte) {
+			rep := new(GetReply)
+			mkv.AppendRPC(DecodePutRequest(rawReq), rep)
+			*rawReply = EncodeGetReply(rep)
+		}))
+
+	handlers[KV_INCREMENT] = erpc.HandleRequest(Versioned(EncodeIncrementReply(&IncrementReply{Err: EBadVersion}),
+		func(rawReq []byte, rawReply *[]byte) {
+			rep := new(IncrementReply)
+			mkv.IncrementRPC(DecodeIncrementRequest(rawReq), rep)
+			*rawReply = EncodeIncrementReply(rep)
+		}))
+
+	handlers[KV_GET_AND_SET] = erpc.HandleRequest(Versioned(EncodeGetReply(&GetReply{Err: EBadVersion}),
+		func(rawReq []byte, rawReply *[]byte) {
+			rep := new(GetReply)
+			mkv.GetAndSetRPC(DecodePutRequest(rawReq), rep)
+			*rawReply = EncodeGetReply(rep)
+		}))
+
+	handlers[KV_MGET] = erpc.HandleRequest(Versioned(EncodeMGetReply(&MGetReply{Errs: []ErrorType{EBadVersion}}),
+		func(rawReq []byte, rawReply *[]byte) {
+			rep := new(MGetReply)
+			mkv.MGetRPC(DecodeMGetRequest(rawReq), rep)
+			*rawReply = EncodeMGetReply(rep)
+		}))
+
+	handlers[KV_MPUT] = erpc.HandleRequest(Versioned(EncodeMPutReply(&MPutReply{Errs: []ErrorType{EBadVersion}}),
+		func(rawReq []byte, rawReply *[]byte) {
+			rep := new(MPutReply)
+			mkv.MPutRPC(DecodeMPutRequest(rawReq), rep)
+			*rawReply = EncodeMPutReply(rep)
+		}))
+
+	handlers[KV_INS_SHARD] = erpc.HandleRequest(Versioned(EncodeUint64(EBadVersion),
+		func(rawReq []byte, rawReply *[]byte) {
+			// NOTE: decoding, i.e. construction of in-memory map, happens before we get
+			// the lock (but we do hold the erpc lock already...)
+			mkv.InstallShardRPC(decodeInstallShardRequest(rawReq))
+			*rawReply = make([]byte, 0)
+		}))
+
+	handlers[KV_MOV_SHARD] = Versioned(EncodeUint64(EBadVersion),
+		func(rawReq []byte, rawReply *[]byte) {
+			// an empty reply means success, as it did before there were errors
+			if err := mkv.MoveShardRPC(decodeMoveShardRequest(rawReq)); err != ENone {
+				*rawReply = EncodeUint64(err)
+			} else {
+				*rawReply = make([]byte, 0)
+			}
+		})
+
+	handlers[KV_SHARD_STATS] = Versioned(encodeShardStatsReply(&ShardStatsReply{Err: EBadVersion}),
+		func(rawReq []byte, rawReply *[]byte) {
+			*rawReply = encodeShardStatsReply(&ShardStatsReply{Err: ENone, Stats: mkv.ShardStatsRPC()})
+		})
 
-	handlers[KV_GET] = erpc.HandleRequest(func(rawReq []byte, rawReply *[]byte) {
-		rep := new(GetReply)
-		mkv.GetRPC(DecodeGetRequest(rawReq), rep)
-		*rawReply = EncodeGetReply(rep)
-	})
-
-	handlers[KV_CONDITIONAL_PUT] = erpc.HandleRequest(func(rawReq []byte, rawReply *[]byte) {
-		rep := new(ConditionalPutReply)
-		mkv.ConditionalPutRPC(DecodeConditionalPutRequest(rawReq), rep)
-		*rawReply = EncodeConditionalPutReply(rep)
-	})
-
-	handlers[KV_INS_SHARD] = erpc.HandleRequest(func(rawReq []byte, rawReply *[]byte) {
-		// NOTE: decoding, i.e. construction of in-memory map, happens before we get
-		// the lock (but we do hold the erpc lock already...)
-		mkv.InstallShardRPC(decodeInstallShardRequest(rawReq))
-		*rawReply = make([]byte, 0)
-	})
-
-	handlers[KV_MOV_SHARD] = func(rawReq []byte, rawReply *[]byte) {
-		mkv.MoveShardRPC(decodeMoveShardRequest(rawReq))
-		*rawReply = make([]byte, 0)
-	}
 	s := urpc.MakeServer(handlers)
 	s.Serve(host)
+	mkv.registerMetrics(host)
 }
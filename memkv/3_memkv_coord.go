@@ -2,62 +2,79 @@ package memkv
 
 import (
 	"github.com/mit-pdos/gokv/connman"
+	"github.com/mit-pdos/gokv/erpc"
+	"github.com/mit-pdos/gokv/grove_ffi"
 	"github.com/mit-pdos/gokv/urpc"
-	"log"
 	"sync"
 )
 
 const COORD_ADD = uint64(1)
 const COORD_GET = uint64(2)
+const COORD_BALANCE = uint64(3)
+const COORD_FRESHCID = uint64(4)
 
 type KVCoord struct {
 	mu          *sync.Mutex
 	shardMap    []HostName          // maps from sid -> host that currently owns it
 	hostShards  map[HostName]uint64 // maps from host -> num shard that it currently has
 	shardClerks *ShardClerkSet
+
+	balanceMu  *sync.Mutex // held for a whole balancing round
+	balanceCfg *BalanceConfig
+	// so that a retransmitted COORD_BALANCE doesn't run another round
+	erpc *erpc.Server
+}
+
+// Moves shard sid from src to dst, and updates our maps if that worked.
+// Requires c.mu.
+func (c *KVCoord) moveShard(sid uint64, src HostName, dst HostName) bool {
+	logger.Debug("moving shard", "shard", sid, "from", grove_ffi.AddressToStr(src),
+		"to", grove_ffi.AddressToStr(dst))
+	if err := c.shardClerks.GetClerk(src).MoveShard(sid, dst); err != ENone {
+		logger.Error("failed to move shard", "shard", sid, "from", grove_ffi.AddressToStr(src),
+			"to", grove_ffi.AddressToStr(dst), "err", err)
+		return false
+	}
+	c.hostShards[src] -= 1
+	c.hostShards[dst] += 1
+	c.shardMap[sid] = dst
+	return true
 }
 
 func (c *KVCoord) AddServerRPC(newhost HostName) {
 	c.mu.Lock()
 	// Greedily rebalances shards using minimum number of migrations
 
-	// currently, (NSHARD/numHosts) +/- 1 shard should be assigned to each server
+	// currently, (nshard/numHosts) +/- 1 shard should be assigned to each server
 	//
 	// We keep a map[HostName]uint64 to remember how many shards we've given
 	// each shard server. Then, we iterate over shardMap[], and move a shard if the current holder does.
 	//
-	// (NSHARD - numHosts * floor(NSHARD/numHosts)) will have size (floor(NSHARD/numHosts) + 1)
-	log.Printf("Rebalancing\n")
+	// (nshard - numHosts * floor(nshard/numHosts)) will have size (floor(nshard/numHosts) + 1)
+	logger.Info("rebalancing for new server", "peer", grove_ffi.AddressToStr(newhost))
 	c.hostShards[newhost] = 0
+	nshard := uint64(len(c.shardMap))
 	numHosts := uint64(len(c.hostShards))
-	numShardFloor := NSHARD / numHosts
-	numShardCeil := NSHARD/numHosts + 1
+	numShardFloor := nshard / numHosts
+	numShardCeil := nshard/numHosts + 1
 	var nf_left uint64
-	nf_left = numHosts - (NSHARD - numHosts*NSHARD/numHosts) // number of servers that will have one fewer shard than other servers
+	nf_left = numHosts - (nshard - numHosts*nshard/numHosts) // number of servers that will have one fewer shard than other servers
 	for sid, host := range c.shardMap {
 		n := c.hostShards[host]
 		if n > numShardFloor {
 			if n == numShardCeil {
 				if nf_left > 0 {
-					nf_left = nf_left - 1
-					// log.Printf("Moving %d from %s -> %s", sid, host, newhost)
-					c.shardClerks.GetClerk(host).MoveShard(uint64(sid), newhost)
-					c.hostShards[host] = n - 1
-					c.hostShards[newhost] += 1
-					c.shardMap[sid] = newhost
+					if c.moveShard(uint64(sid), host, newhost) {
+						nf_left = nf_left - 1
+					}
 				}
 				// else, we have already made enough hosts have the minimum number of shard servers
 			} else {
-				// log.Printf("Moving %d from %s -> %s", sid, host, newhost)
-				c.shardClerks.GetClerk(host).MoveShard(uint64(sid), newhost)
-				c.hostShards[host] = n - 1
-				c.hostShards[newhost] += 1
-				c.shardMap[sid] = newhost
+				c.moveShard(uint64(sid), host, newhost)
 			}
 		}
 	}
-	log.Println("Done rebalancing")
-	log.Printf("%+v", c.hostShards)
+	logger.Info("done rebalancing", "shards", shardCounts(c.hostShards))
 	c.mu.Unlock()
 }
 
@@ -67,20 +84,31 @@ func (c *KVCoord) GetShardMapRPC(_ []byte, rep *[]byte) {
 	c.mu.Unlock()
 }
 
-func MakeKVCoordServer(initserver HostName) *KVCoord {
+// Creates a coordinator for a cluster with nshard shards, all of which are
+// initially owned by initserver. The number of shards is fixed for the lifetime
+// of the cluster.
+func MakeKVCoordServer(initserver HostName, nshard uint64) *KVCoord {
 	s := new(KVCoord)
 	s.mu = new(sync.Mutex)
 
-	s.shardMap = make([]HostName, NSHARD)
-	for i := uint64(0); i < NSHARD; i++ {
+	s.shardMap = make([]HostName, nshard)
+	for i := uint64(0); i < nshard; i++ {
 		s.shardMap[i] = initserver
 	}
 	s.hostShards = make(map[HostName]uint64)
-	s.hostShards[initserver] = NSHARD
+	s.hostShards[initserver] = nshard
 	s.shardClerks = MakeShardClerkSet(connman.MakeConnMan())
+	s.balanceMu = new(sync.Mutex)
+	s.balanceCfg = DefaultBalanceConfig()
+	s.erpc = erpc.MakeServer()
 	return s
 }
 
+// Must be called before Start.
+func (c *KVCoord) SetBalanceConfig(cfg *BalanceConfig) {
+	c.balanceCfg = cfg
+}
+
 func (c *KVCoord) Start(host HostName) {
 	handlers := make(map[uint64]func([]byte, *[]byte))
 	handlers[COORD_ADD] = func(rawReq []byte, rawRep *[]byte) {
@@ -88,6 +116,13 @@ func (c *KVCoord) Start(host HostName) {
 		c.AddServerRPC(s)
 	}
 	handlers[COORD_GET] = c.GetShardMapRPC
+	handlers[COORD_FRESHCID] = func(rawReq []byte, rawRep *[]byte) {
+		*rawRep = EncodeUint64(c.erpc.GetFreshCID())
+	}
+	handlers[COORD_BALANCE] = c.erpc.HandleRequestConcurrent(func(rawReq []byte, rawRep *[]byte) {
+		dryRun := DecodeUint64(rawReq) != 0
+		*rawRep = encodeShardMoves(c.BalanceRPC(dryRun))
+	})
 	s := urpc.MakeServer(handlers)
 	s.Serve(host)
 }
@@ -0,0 +1,223 @@
+package memkv
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/goose-lang/primitive"
+	"github.com/mit-pdos/gokv/grove_ffi"
+)
+
+// Load-aware rebalancing. AddServerRPC only evens out the *number* of shards
+// each server has; with a skewed keyspace a few shards can hold most of the
+// bytes and traffic, so the coordinator can also move shards around based on
+// the load that shard servers report.
+
+type BalanceConfig struct {
+	// A server is overloaded once its load exceeds the mean load by more than
+	// this many percent.
+	ThresholdPercent uint64
+	// At most this many shards are moved per balancing round.
+	MaxMoves uint64
+	// Pause between consecutive migrations, so that rebalancing doesn't swamp
+	// the shard servers (and clients waiting on a moving shard).
+	MoveIntervalMs uint64
+}
+
+func DefaultBalanceConfig() *BalanceConfig {
+	return &BalanceConfig{
+		ThresholdPercent: 10,
+		MaxMoves:         16,
+		MoveIntervalMs:   100,
+	}
+}
+
+// The load of a shard is its fraction of all bytes plus its fraction of all
+// requests, so that size and traffic count equally.
+func shardLoad(st ShardStats, totalBytes uint64, totalOps uint64) float64 {
+	var l = 0.0
+	if totalBytes > 0 {
+		l += float64(st.Bytes) / float64(totalBytes)
+	}
+	if totalOps > 0 {
+		l += float64(st.OpsPerSec) / float64(totalOps)
+	}
+	return l
+}
+
+// Computes migrations that bring every host's load to within
+// cfg.ThresholdPercent of the mean, or as close to that as cfg.MaxMoves moves
+// allow. Each step moves, from the most to the least loaded host, the shard
+// whose load comes closest to halving the gap between them.
+func planBalance(hostStats map[HostName][]ShardStats, cfg *BalanceConfig) []ShardMove {
+	moves := make([]ShardMove, 0)
+	if len(hostStats) < 2 {
+		return moves
+	}
+
+	hosts := make([]HostName, 0, len(hostStats))
+	var totalBytes uint64
+	var totalOps uint64
+	for host, stats := range hostStats {
+		hosts = append(hosts, host)
+		for _, st := range stats {
+			totalBytes += st.Bytes
+			totalOps += st.OpsPerSec
+		}
+	}
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i] < hosts[j] })
+
+	// per-host shards, so that planned moves can be applied as we go
+	shards := make(map[HostName][]ShardStats)
+	load := make(map[HostName]float64)
+	var total = 0.0
+	for _, host := range hosts {
+		shards[host] = append([]ShardStats(nil), hostStats[host]...)
+		for _, st := range hostStats[host] {
+			l := shardLoad(st, totalBytes, totalOps)
+			load[host] += l
+			total += l
+		}
+	}
+	limit := total / float64(len(hosts)) * (1 + float64(cfg.ThresholdPercent)/100)
+
+	for uint64(len(moves)) < cfg.MaxMoves {
+		src := hosts[0]
+		dst := hosts[0]
+		for _, host := range hosts {
+			if load[host] > load[src] {
+				src = host
+			}
+			if load[host] < load[dst] {
+				dst = host
+			}
+		}
+		if load[src] <= limit {
+			break
+		}
+
+		// Moving a shard with load x leaves the two hosts at load[src]-x and
+		// load[dst]+x, which only helps if x is less than the gap.
+		gap := load[src] - load[dst]
+		best := -1
+		var bestDist = gap
+		for i, st := range shards[src] {
+			x := shardLoad(st, totalBytes, totalOps)
+			if x <= 0 || x >= gap {
+				continue
+			}
+			dist := x - gap/2
+			if dist < 0 {
+				dist = -dist
+			}
+			if dist < bestDist {
+				best = i
+				bestDist = dist
+			}
+		}
+		if best < 0 {
+			break
+		}
+
+		st := shards[src][best]
+		x := shardLoad(st, totalBytes, totalOps)
+		shards[src] = append(shards[src][:best], shards[src][best+1:]...)
+		shards[dst] = append(shards[dst], st)
+		load[src] -= x
+		load[dst] += x
+		moves = append(moves, ShardMove{Sid: st.Sid, Src: src, Dst: dst, Stats: st})
+	}
+	return moves
+}
+
+// How long the coordinator waits for a shard server's stats before leaving it
+// out of a balancing round.
+const statsTimeoutMs = uint64(1000)
+
+// Asks every shard server for its load, without holding c.mu. Servers that
+// can't report their load within statsTimeoutMs (e.g. because they're down, or
+// run an older version) are dropped.
+func (c *KVCoord) collectStats() map[HostName][]ShardStats {
+	c.mu.Lock()
+	hosts := make([]HostName, 0, len(c.hostShards))
+	for host := range c.hostShards {
+		hosts = append(hosts, host)
+	}
+	c.mu.Unlock()
+
+	hostStats := make(map[HostName][]ShardStats)
+	for _, host := range hosts {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(statsTimeoutMs)*time.Millisecond)
+		all, err := getShardStats(ctx, c.shardClerks.c, host)
+		cancel()
+		if err != ENone {
+			// we can't tell how loaded it is, so leave it out of this round
+			logger.Warn("no shard stats; not balancing it", "peer", grove_ffi.AddressToStr(host), "err", err)
+			continue
+		}
+		hostStats[host] = all
+	}
+	return hostStats
+}
+
+// Drops the stats for shards that we don't think their server owns (e.g.
+// because they moved while we were collecting). Requires c.mu.
+func (c *KVCoord) ownedStats(hostStats map[HostName][]ShardStats) map[HostName][]ShardStats {
+	owned := make(map[HostName][]ShardStats)
+	for host, all := range hostStats {
+		stats := make([]ShardStats, 0)
+		for _, st := range all {
+			if st.Sid < uint64(len(c.shardMap)) && c.shardMap[st.Sid] == host {
+				stats = append(stats, st)
+			}
+		}
+		owned[host] = stats
+	}
+	return owned
+}
+
+// Plans a balancing round and, unless dryRun, carries it out, pausing
+// c.balanceCfg.MoveIntervalMs between migrations. Returns the moves that were
+// planned (if dryRun) or actually made.
+func (c *KVCoord) BalanceRPC(dryRun bool) []ShardMove {
+	c.balanceMu.Lock()
+	hostStats := c.collectStats()
+	c.mu.Lock()
+	moves := planBalance(c.ownedStats(hostStats), c.balanceCfg)
+	c.mu.Unlock()
+	logger.Info("planned load-aware rebalance", "moves", len(moves), "dryRun", dryRun)
+	if dryRun {
+		c.balanceMu.Unlock()
+		return moves
+	}
+
+	done := make([]ShardMove, 0)
+	for i, mv := range moves {
+		if i > 0 {
+			primitive.Sleep(c.balanceCfg.MoveIntervalMs * 1_000_000)
+		}
+		c.mu.Lock()
+		// the shard might have moved (e.g. because of AddServerRPC) since we
+		// planned
+		if c.shardMap[mv.Sid] == mv.Src {
+			if c.moveShard(mv.Sid, mv.Src, mv.Dst) {
+				done = append(done, mv)
+			}
+		}
+		c.mu.Unlock()
+	}
+	logger.Info("done rebalancing", "moved", len(done))
+	c.balanceMu.Unlock()
+	return done
+}
+
+// Runs a balancing round every intervalMs milliseconds.
+func (c *KVCoord) StartBalancer(intervalMs uint64) {
+	go func() {
+		for {
+			primitive.Sleep(intervalMs * 1_000_000)
+			c.BalanceRPC(false)
+		}
+	}()
+}
@@ -0,0 +1,44 @@
+package memkv
+
+import "testing"
+
+func TestPlanBalanceSkewed(t *testing.T) {
+	// host 1 has one huge, hot shard and a few small ones; host 2 is idle
+	hostStats := map[HostName][]ShardStats{
+		1: {
+			{Sid: 0, Keys: 10, Bytes: 1000, OpsPerSec: 100},
+			{Sid: 1, Keys: 10, Bytes: 100, OpsPerSec: 10},
+			{Sid: 2, Keys: 10, Bytes: 100, OpsPerSec: 10},
+		},
+		2: {},
+	}
+	moves := planBalance(hostStats, DefaultBalanceConfig())
+	if len(moves) != 1 {
+		// once the hot shard is on host 2, nothing else can help, and the
+		// planner must not move it back
+		t.Fatalf("expected exactly 1 move, got %v", moves)
+	}
+	if moves[0].Sid != 0 || moves[0].Src != 1 || moves[0].Dst != 2 {
+		t.Errorf("unexpected move %+v", moves[0])
+	}
+}
+
+func TestPlanBalanceRespectsLimits(t *testing.T) {
+	hostStats := map[HostName][]ShardStats{
+		1: {{Sid: 0, Bytes: 10}, {Sid: 1, Bytes: 10}, {Sid: 2, Bytes: 10}, {Sid: 3, Bytes: 10}},
+		2: {},
+	}
+	cfg := DefaultBalanceConfig()
+	cfg.MaxMoves = 1
+	if moves := planBalance(hostStats, cfg); len(moves) != 1 {
+		t.Errorf("expected exactly 1 move, got %v", moves)
+	}
+
+	balanced := map[HostName][]ShardStats{
+		1: {{Sid: 0, Bytes: 10}},
+		2: {{Sid: 1, Bytes: 10}},
+	}
+	if moves := planBalance(balanced, DefaultBalanceConfig()); len(moves) != 0 {
+		t.Errorf("balanced cluster got moves %v", moves)
+	}
+}
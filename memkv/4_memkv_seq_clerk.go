@@ -1,26 +1,89 @@
 package memkv
 
 import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/goose-lang/std"
 	"github.com/mit-pdos/gokv/connman"
+	"github.com/mit-pdos/gokv/erpc"
+	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/urpc"
 )
 
 type KVCoordClerk struct {
 	host HostName
 	c    *connman.ConnMan
+
+	// for Balance, which must not run twice; held for a whole Balance, and
+	// erpc is nil until the first one
+	mu   *sync.Mutex
+	erpc *erpc.Client
+}
+
+func (ck *KVCoordClerk) notCoordinator() {
+	logger.Error("not a memkv coordinator", "peer", grove_ffi.AddressToStr(ck.host))
 }
 
 func (ck *KVCoordClerk) AddShardServer(dst HostName) {
 	rawRep := new([]byte)
-	ck.c.CallAtLeastOnce(ck.host, COORD_ADD, EncodeUint64(dst), rawRep, 50000 /*ms*/)
+	if ck.c.CallAtLeastOnce(ck.host, COORD_ADD, EncodeUint64(dst), rawRep, 50000 /*ms*/) != urpc.ErrNone {
+		ck.notCoordinator()
+	}
 	return
 }
 
+// Returns nil (after logging why) if our host isn't a coordinator.
 func (ck *KVCoordClerk) GetShardMap() []HostName {
 	rawRep := new([]byte)
-	ck.c.CallAtLeastOnce(ck.host, COORD_GET, make([]byte, 0), rawRep, 50000 /*ms*/)
+	if ck.c.CallAtLeastOnce(ck.host, COORD_GET, make([]byte, 0), rawRep, 50000 /*ms*/) != urpc.ErrNone {
+		ck.notCoordinator()
+		return nil
+	}
 	return decodeShardMap(*rawRep)
 }
 
+func (ck *KVCoordClerk) GetShardMapContext(ctx context.Context) ([]HostName, error) {
+	rawRep := new([]byte)
+	err := ck.c.CallAtLeastOnceContext(ctx, ck.host, COORD_GET, make([]byte, 0), rawRep, 50000 /*ms*/)
+	if err != nil {
+		return nil, err
+	}
+	return decodeShardMap(*rawRep), nil
+}
+
+// Runs a load-aware balancing round on the coordinator (see BalanceRPC), once
+// even if the request has to be retransmitted. With dryRun, only returns the
+// migrations that would be made. Fails if the coordinator is from before
+// balancing.
+func (ck *KVCoordClerk) Balance(dryRun bool) ([]ShardMove, error) {
+	var arg = uint64(0)
+	if dryRun {
+		arg = 1
+	}
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	if ck.erpc == nil {
+		rawCid := new([]byte)
+		err := ck.c.CallAtLeastOnceContext(context.Background(), ck.host, COORD_FRESHCID, make([]byte, 0), rawCid, 50000 /*ms*/)
+		if err != nil {
+			return nil, err
+		}
+		ck.erpc = erpc.MakeClient(DecodeUint64(*rawCid))
+	}
+	rawRep := new([]byte)
+	err := ck.c.CallAtLeastOnceContext(context.Background(), ck.host, COORD_BALANCE, ck.erpc.NewRequest(EncodeUint64(arg)), rawRep, 50000 /*ms*/)
+	if err != nil {
+		return nil, err
+	}
+	return decodeShardMoves(*rawRep), nil
+}
+
+func MakeKVCoordClerk(host HostName, c *connman.ConnMan) *KVCoordClerk {
+	return &KVCoordClerk{host: host, c: c, mu: new(sync.Mutex)}
+}
+
 // "Sequential" KV clerk, can only be used for one request at a time.
 // NOTE: a single clerk keeps quite a bit of state, via the shardMap[], so it
 // might be good to not need to duplicate shardMap[] for a pool of clerks that's
@@ -28,59 +91,407 @@ func (ck *KVCoordClerk) GetShardMap() []HostName {
 type SeqKVClerk struct {
 	shardClerks *ShardClerkSet
 	coordCk     *KVCoordClerk
-	shardMap    []HostName // size == NSHARD; maps from sid -> host that currently owns it
+	shardMap    []HostName // size == nshard; maps from sid -> host that currently owns it
+}
+
+// Like the methods without Context, the Context methods retry until they
+// succeed, but they give up once ctx is done and return ctx.Err(). A write that
+// gives up might or might not have happened. They also give up, with
+// ErrUnsupported or ErrBadVersion, if a shard server has no handler for the
+// request or doesn't speak our encoding version; the methods without Context
+// log that, and return as if the key were missing.
+
+// The shard server (or router) has no handler for a request, e.g. because it
+// runs an older version.
+var ErrUnsupported = errors.New("memkv: request not supported by the shard server")
+
+// The shard server (or router) speaks a different encoding version; retrying
+// won't help.
+var ErrBadVersion = errors.New("memkv: shard server does not support this encoding version")
+
+// Returned for an MPut with a different number of values than keys.
+var ErrBadRequest = errors.New("memkv: MPut needs exactly one value per key")
+
+// The error to give up with after a shard clerk returns err; nil if a retry
+// (with a fresh shard map) might do better.
+func giveUpErr(ctx context.Context, err ErrorType) error {
+	if err == ECanceled {
+		return ctx.Err()
+	}
+	if err == EUnsupported {
+		return ErrUnsupported
+	}
+	if err == EBadRequest {
+		return ErrBadRequest
+	}
+	if err == EBadVersion {
+		return ErrBadVersion
+	}
+	return nil
+}
+
+func logFailure(op string, err error) {
+	if err != nil {
+		logger.Error("memkv request failed", "op", op, "err", err)
+	}
+}
+
+// Refreshes our shard map after finding that a shard has moved.
+func (ck *SeqKVClerk) refreshShardMap(ctx context.Context) error {
+	shardMap, err := ck.coordCk.GetShardMapContext(ctx)
+	if err != nil {
+		return err
+	}
+	ck.shardMap = shardMap
+	return nil
+}
+
+// Makes sure we have a shard map; we might not if the coordinator couldn't be
+// asked for one when the clerk was made.
+func (ck *SeqKVClerk) ensureShardMap(ctx context.Context) error {
+	if len(ck.shardMap) == 0 {
+		return ck.refreshShardMap(ctx)
+	}
+	return nil
 }
 
-func (ck *SeqKVClerk) Get(key uint64) []byte {
+// The shard server that owns key, according to our shard map.
+func (ck *SeqKVClerk) serverOf(ctx context.Context, key []byte) (HostName, error) {
+	if err := ck.ensureShardMap(ctx); err != nil {
+		return 0, err
+	}
+	return ck.shardMap[shardOf(key, uint64(len(ck.shardMap)))], nil
+}
+
+func (ck *SeqKVClerk) Get(key []byte) []byte {
+	val, err := ck.GetContext(context.Background(), key)
+	logFailure("get", err)
+	return val
+}
+
+func (ck *SeqKVClerk) GetContext(ctx context.Context, key []byte) ([]byte, error) {
 	val := new([]byte)
 	for {
-		sid := shardOf(key)
-		shardServer := ck.shardMap[sid]
+		shardServer, err := ck.serverOf(ctx, key)
+		if err != nil {
+			return nil, err
+		}
 
 		shardCk := ck.shardClerks.GetClerk(shardServer)
-		err := shardCk.Get(key, val)
-		if err == ENone {
+		e := shardCk.GetContext(ctx, key, val)
+		if e == ENone {
 			break
 		}
-		ck.shardMap = ck.coordCk.GetShardMap()
-		continue
+		if err := giveUpErr(ctx, e); err != nil {
+			return nil, err
+		}
+		if err := ck.refreshShardMap(ctx); err != nil {
+			return nil, err
+		}
 	}
-	return *val
+	return *val, nil
 }
 
-func (ck *SeqKVClerk) Put(key uint64, value []byte) {
+func (ck *SeqKVClerk) Put(key []byte, value []byte) {
+	logFailure("put", ck.PutContext(context.Background(), key, value))
+}
+
+func (ck *SeqKVClerk) PutContext(ctx context.Context, key []byte, value []byte) error {
 	for {
-		sid := shardOf(key)
-		shardServer := ck.shardMap[sid]
+		shardServer, err := ck.serverOf(ctx, key)
+		if err != nil {
+			return err
+		}
 
 		shardCk := ck.shardClerks.GetClerk(shardServer)
-		err := shardCk.Put(key, value)
+		e := shardCk.PutContext(ctx, key, value)
 
-		if err == ENone {
+		if e == ENone {
 			break
 		}
-		ck.shardMap = ck.coordCk.GetShardMap()
-		continue
+		if err := giveUpErr(ctx, e); err != nil {
+			return err
+		}
+		if err := ck.refreshShardMap(ctx); err != nil {
+			return err
+		}
 	}
-	return
+	return nil
+}
+
+func (ck *SeqKVClerk) ConditionalPut(key []byte, expectedValue []byte, newValue []byte) bool {
+	ok, err := ck.ConditionalPutContext(context.Background(), key, expectedValue, newValue)
+	logFailure("conditional put", err)
+	return ok
 }
 
-func (ck *SeqKVClerk) ConditionalPut(key uint64, expectedValue []byte, newValue []byte) bool {
+func (ck *SeqKVClerk) ConditionalPutContext(ctx context.Context, key []byte, expectedValue []byte, newValue []byte) (bool, error) {
 	success := new(bool)
 	for {
-		sid := shardOf(key)
-		shardServer := ck.shardMap[sid]
+		shardServer, err := ck.serverOf(ctx, key)
+		if err != nil {
+			return false, err
+		}
 
 		shardCk := ck.shardClerks.GetClerk(shardServer)
-		err := shardCk.ConditionalPut(key, expectedValue, newValue, success)
+		e := shardCk.ConditionalPutContext(ctx, key, expectedValue, newValue, success)
 
-		if err == ENone {
+		if e == ENone {
 			break
 		}
-		ck.shardMap = ck.coordCk.GetShardMap()
-		continue
+		if err := giveUpErr(ctx, e); err != nil {
+			return false, err
+		}
+		if err := ck.refreshShardMap(ctx); err != nil {
+			return false, err
+		}
 	}
-	return *success
+	return *success, nil
+}
+
+// Atomically appends value to the value at key, and returns the value from
+// before the append.
+func (ck *SeqKVClerk) Append(key []byte, value []byte) []byte {
+	oldValue, err := ck.AppendContext(context.Background(), key, value)
+	logFailure("append", err)
+	return oldValue
+}
+
+func (ck *SeqKVClerk) AppendContext(ctx context.Context, key []byte, value []byte) ([]byte, error) {
+	oldValue := new([]byte)
+	for {
+		shardServer, err := ck.serverOf(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+
+		shardCk := ck.shardClerks.GetClerk(shardServer)
+		e := shardCk.AppendContext(ctx, key, value, oldValue)
+
+		if e == ENone {
+			break
+		}
+		if err := giveUpErr(ctx, e); err != nil {
+			return nil, err
+		}
+		if err := ck.refreshShardMap(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return *oldValue, nil
+}
+
+// Atomically adds delta to the counter at key (see IncrementRPC), and returns
+// its new value. Returns false, without changing anything, if the value at key
+// is not a counter.
+func (ck *SeqKVClerk) Increment(key []byte, delta uint64) (uint64, bool) {
+	v, ok, err := ck.IncrementContext(context.Background(), key, delta)
+	logFailure("increment", err)
+	return v, ok
+}
+
+func (ck *SeqKVClerk) IncrementContext(ctx context.Context, key []byte, delta uint64) (uint64, bool, error) {
+	newValue := new(uint64)
+	var e ErrorType
+	for {
+		shardServer, err := ck.serverOf(ctx, key)
+		if err != nil {
+			return 0, false, err
+		}
+
+		shardCk := ck.shardClerks.GetClerk(shardServer)
+		e = shardCk.IncrementContext(ctx, key, delta, newValue)
+
+		if err := giveUpErr(ctx, e); err != nil {
+			return 0, false, err
+		}
+		if e != EDontHaveShard {
+			break
+		}
+		if err := ck.refreshShardMap(ctx); err != nil {
+			return 0, false, err
+		}
+	}
+	return *newValue, e == ENone, nil
+}
+
+// Atomically sets the value at key, and returns the value from before.
+func (ck *SeqKVClerk) GetAndSet(key []byte, value []byte) []byte {
+	oldValue, err := ck.GetAndSetContext(context.Background(), key, value)
+	logFailure("get and set", err)
+	return oldValue
+}
+
+func (ck *SeqKVClerk) GetAndSetContext(ctx context.Context, key []byte, value []byte) ([]byte, error) {
+	oldValue := new([]byte)
+	for {
+		shardServer, err := ck.serverOf(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+
+		shardCk := ck.shardClerks.GetClerk(shardServer)
+		e := shardCk.GetAndSetContext(ctx, key, value, oldValue)
+
+		if e == ENone {
+			break
+		}
+		if err := giveUpErr(ctx, e); err != nil {
+			return nil, err
+		}
+		if err := ck.refreshShardMap(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return *oldValue, nil
+}
+
+// Splits idxs (indices into keys) by the shard server that owns each key,
+// according to our possibly stale shard map. Also returns the shard clerks for
+// those servers, in the same order.
+func (ck *SeqKVClerk) groupByServer(keys [][]byte, idxs []uint64) ([][]uint64, []*KVShardClerk) {
+	nshard := uint64(len(ck.shardMap))
+	groupOf := make(map[HostName]uint64)
+	groups := make([][]uint64, 0)
+	clerks := make([]*KVShardClerk, 0)
+	for _, i := range idxs {
+		host := ck.shardMap[shardOf(keys[i], nshard)]
+		g, ok := groupOf[host]
+		if !ok {
+			g = uint64(len(groups))
+			groupOf[host] = g
+			groups = append(groups, make([]uint64, 0))
+			// the ShardClerkSet isn't safe for concurrent use, so get every
+			// clerk now rather than from the parallel RPCs below
+			clerks = append(clerks, ck.shardClerks.GetClerk(host))
+		}
+		groups[g] = append(groups[g], i)
+	}
+	return groups, clerks
+}
+
+func allIndices(n uint64) []uint64 {
+	idxs := make([]uint64, n)
+	for i := uint64(0); i < n; i++ {
+		idxs[i] = i
+	}
+	return idxs
+}
+
+func concatIndices(ls [][]uint64) []uint64 {
+	var ret = make([]uint64, 0)
+	for _, l := range ls {
+		ret = append(ret, l...)
+	}
+	return ret
+}
+
+// Returns the values of keys, in the same order. Sends one RPC to each shard
+// server that owns some of the keys (in parallel), and retries only the keys
+// whose shard turned out to have moved.
+func (ck *SeqKVClerk) MGet(keys [][]byte) [][]byte {
+	vals, err := ck.MGetContext(context.Background(), keys)
+	logFailure("mget", err)
+	return vals
+}
+
+// The first error in errs to give up with (see giveUpErr), if any.
+func firstGiveUpErr(ctx context.Context, errs []ErrorType) error {
+	for _, e := range errs {
+		if err := giveUpErr(ctx, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ck *SeqKVClerk) MGetContext(ctx context.Context, keys [][]byte) ([][]byte, error) {
+	if err := ck.ensureShardMap(ctx); err != nil {
+		return nil, err
+	}
+	vals := make([][]byte, len(keys))
+	var pending = allIndices(uint64(len(keys)))
+	for len(pending) > 0 {
+		groups, clerks := ck.groupByServer(keys, pending)
+		retry := make([][]uint64, len(groups))
+		failed := make([]ErrorType, len(groups))
+		std.Multipar(uint64(len(groups)), func(g uint64) {
+			batch := make([][]byte, len(groups[g]))
+			for j, i := range groups[g] {
+				batch[j] = keys[i]
+			}
+			batchVals := new([][]byte)
+			errs := clerks[g].MGetContext(ctx, batch, batchVals)
+			retry[g] = make([]uint64, 0)
+			for j, i := range groups[g] {
+				if errs[j] == ENone {
+					vals[i] = (*batchVals)[j]
+				} else if giveUpErr(ctx, errs[j]) != nil {
+					failed[g] = errs[j]
+				} else {
+					retry[g] = append(retry[g], i)
+				}
+			}
+		})
+		if err := firstGiveUpErr(ctx, failed); err != nil {
+			return nil, err
+		}
+		pending = concatIndices(retry)
+		if len(pending) > 0 {
+			if err := ck.refreshShardMap(ctx); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return vals, nil
+}
+
+// Puts values[i] at keys[i] for every i, batching like MGet. There is no
+// atomicity across keys.
+func (ck *SeqKVClerk) MPut(keys [][]byte, values [][]byte) {
+	logFailure("mput", ck.MPutContext(context.Background(), keys, values))
+}
+
+func (ck *SeqKVClerk) MPutContext(ctx context.Context, keys [][]byte, values [][]byte) error {
+	if len(values) != len(keys) {
+		return ErrBadRequest
+	}
+	if err := ck.ensureShardMap(ctx); err != nil {
+		return err
+	}
+	var pending = allIndices(uint64(len(keys)))
+	for len(pending) > 0 {
+		groups, clerks := ck.groupByServer(keys, pending)
+		retry := make([][]uint64, len(groups))
+		failed := make([]ErrorType, len(groups))
+		std.Multipar(uint64(len(groups)), func(g uint64) {
+			batchKeys := make([][]byte, len(groups[g]))
+			batchVals := make([][]byte, len(groups[g]))
+			for j, i := range groups[g] {
+				batchKeys[j] = keys[i]
+				batchVals[j] = values[i]
+			}
+			errs := clerks[g].MPutContext(ctx, batchKeys, batchVals)
+			retry[g] = make([]uint64, 0)
+			for j, i := range groups[g] {
+				if giveUpErr(ctx, errs[j]) != nil {
+					failed[g] = errs[j]
+				} else if errs[j] != ENone {
+					retry[g] = append(retry[g], i)
+				}
+			}
+		})
+		if err := firstGiveUpErr(ctx, failed); err != nil {
+			return err
+		}
+		pending = concatIndices(retry)
+		if len(pending) > 0 {
+			if err := ck.refreshShardMap(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 func (ck *SeqKVClerk) Add(host HostName) {
@@ -88,14 +499,9 @@ func (ck *SeqKVClerk) Add(host HostName) {
 }
 
 func MakeSeqKVClerk(coord HostName, cm *connman.ConnMan) *SeqKVClerk {
-	cck := new(KVCoordClerk)
 	ck := new(SeqKVClerk)
-	ck.coordCk = cck
-	ck.coordCk.host = coord
-	ck.coordCk.c = cm
+	ck.coordCk = MakeKVCoordClerk(coord, cm)
 	ck.shardClerks = MakeShardClerkSet(cm)
 	ck.shardMap = ck.coordCk.GetShardMap()
 	return ck
 }
-
-// TODO: add an Append(key, value) (oldValue []byte) call
@@ -1,8 +1,10 @@
 package memkv
 
 import (
-	"github.com/goose-lang/std"
+	"context"
+
 	"github.com/mit-pdos/gokv/connman"
+	"github.com/mit-pdos/gokv/kv"
 	"sync"
 )
 
@@ -18,8 +20,8 @@ func (p *KVClerk) getSeqClerk() *SeqKVClerk {
 	p.mu.Lock()
 	n := len(p.freeClerks)
 	if n == 0 {
-		p.mu.Unlock()                                         // don't want to hold lock while making a fresh clerk
-		return MakeSeqKVClerk(p.coord, connman.MakeConnMan()) // XXX: different connman for each seqkvclerk
+		p.mu.Unlock()                        // don't want to hold lock while making a fresh clerk
+		return MakeSeqKVClerk(p.coord, p.cm) // calls from all of them share cm's connections
 	} else {
 		ck := p.freeClerks[n-1]
 		p.freeClerks = p.freeClerks[:n-1]
@@ -39,7 +41,7 @@ func (p *KVClerk) putSeqClerk(ck *SeqKVClerk) {
 
 // the hope is that after a while, the number of clerks needed to maintain a
 // request rate for an open system benchmark will stabilize.
-func (p *KVClerk) Put(key uint64, value []byte) {
+func (p *KVClerk) Put(key []byte, value []byte) {
 	ck := p.getSeqClerk()
 
 	// we now own ck
@@ -49,7 +51,7 @@ func (p *KVClerk) Put(key uint64, value []byte) {
 	p.putSeqClerk(ck)
 }
 
-func (p *KVClerk) Get(key uint64) []byte {
+func (p *KVClerk) Get(key []byte) []byte {
 	ck := p.getSeqClerk()
 
 	// we now own ck
@@ -60,7 +62,7 @@ func (p *KVClerk) Get(key uint64) []byte {
 	return value
 }
 
-func (p *KVClerk) ConditionalPut(key uint64, expectedValue []byte, newValue []byte) bool {
+func (p *KVClerk) ConditionalPut(key []byte, expectedValue []byte, newValue []byte) bool {
 	ck := p.getSeqClerk()
 
 	// we now own ck
@@ -72,6 +74,27 @@ func (p *KVClerk) ConditionalPut(key uint64, expectedValue []byte, newValue []by
 	return ret
 }
 
+func (p *KVClerk) Append(key []byte, value []byte) []byte {
+	ck := p.getSeqClerk()
+	ret := ck.Append(key, value)
+	p.putSeqClerk(ck)
+	return ret
+}
+
+func (p *KVClerk) Increment(key []byte, delta uint64) (uint64, bool) {
+	ck := p.getSeqClerk()
+	v, ok := ck.Increment(key, delta)
+	p.putSeqClerk(ck)
+	return v, ok
+}
+
+func (p *KVClerk) GetAndSet(key []byte, value []byte) []byte {
+	ck := p.getSeqClerk()
+	ret := ck.GetAndSet(key, value)
+	p.putSeqClerk(ck)
+	return ret
+}
+
 // FIXME: rename to AddShardServer
 func (p *KVClerk) Add(host HostName) {
 	ck := p.getSeqClerk()
@@ -80,16 +103,82 @@ func (p *KVClerk) Add(host HostName) {
 }
 
 // returns a slice of "values" (which are byte slices) in the same order as the
-// keys passed in as input
-// FIXME: benchmark
-func (p *KVClerk) MGet(keys []uint64) [][]byte {
-	vals := make([][]byte, len(keys))
-	std.Multipar(uint64(len(keys)), func(i uint64) {
-		vals[i] = p.Get(keys[i])
-	})
+// keys passed in as input; sends one batched RPC per shard server involved
+func (p *KVClerk) MGet(keys [][]byte) [][]byte {
+	ck := p.getSeqClerk()
+	vals := ck.MGet(keys)
+	p.putSeqClerk(ck)
 	return vals
 }
 
+// puts values[i] at keys[i], with one batched RPC per shard server involved
+func (p *KVClerk) MPut(keys [][]byte, values [][]byte) {
+	ck := p.getSeqClerk()
+	ck.MPut(keys, values)
+	p.putSeqClerk(ck)
+}
+
+// Versions of the methods above that give up once ctx is done and return
+// ctx.Err() (see SeqKVClerk).
+
+func (p *KVClerk) PutContext(ctx context.Context, key []byte, value []byte) error {
+	ck := p.getSeqClerk()
+	err := ck.PutContext(ctx, key, value)
+	p.putSeqClerk(ck)
+	return err
+}
+
+func (p *KVClerk) GetContext(ctx context.Context, key []byte) ([]byte, error) {
+	ck := p.getSeqClerk()
+	value, err := ck.GetContext(ctx, key)
+	p.putSeqClerk(ck)
+	return value, err
+}
+
+func (p *KVClerk) ConditionalPutContext(ctx context.Context, key []byte, expectedValue []byte, newValue []byte) (bool, error) {
+	ck := p.getSeqClerk()
+	ret, err := ck.ConditionalPutContext(ctx, key, expectedValue, newValue)
+	p.putSeqClerk(ck)
+	return ret, err
+}
+
+func (p *KVClerk) AppendContext(ctx context.Context, key []byte, value []byte) ([]byte, error) {
+	ck := p.getSeqClerk()
+	ret, err := ck.AppendContext(ctx, key, value)
+	p.putSeqClerk(ck)
+	return ret, err
+}
+
+func (p *KVClerk) IncrementContext(ctx context.Context, key []byte, delta uint64) (uint64, bool, error) {
+	ck := p.getSeqClerk()
+	v, ok, err := ck.IncrementContext(ctx, key, delta)
+	p.putSeqClerk(ck)
+	return v, ok, err
+}
+
+func (p *KVClerk) GetAndSetContext(ctx context.Context, key []byte, value []byte) ([]byte, error) {
+	ck := p.getSeqClerk()
+	ret, err := ck.GetAndSetContext(ctx, key, value)
+	p.putSeqClerk(ck)
+	return ret, err
+}
+
+func (p *KVClerk) MGetContext(ctx context.Context, keys [][]byte) ([][]byte, error) {
+	ck := p.getSeqClerk()
+	vals, err := ck.MGetContext(ctx, keys)
+	p.putSeqClerk(ck)
+	return vals, err
+}
+
+func (p *KVClerk) MPutContext(ctx context.Context, keys [][]byte, values [][]byte) error {
+	ck := p.getSeqClerk()
+	err := ck.MPutContext(ctx, keys, values)
+	p.putSeqClerk(ck)
+	return err
+}
+
+// Concurrent calls on the clerk share cm's connections; to spread them over
+// several connections per server, use a connman.ConnMan with ConnsPerHost > 1.
 func MakeKVClerk(coord HostName, cm *connman.ConnMan) *KVClerk {
 	p := new(KVClerk)
 	p.mu = new(sync.Mutex)
@@ -98,3 +187,23 @@ func MakeKVClerk(coord HostName, cm *connman.ConnMan) *KVClerk {
 	p.freeClerks = make([]*SeqKVClerk, 0)
 	return p
 }
+
+// Exposes memkv through the generic string-keyed kv.Kv interface, so clients
+// written against it (e.g. bank, lockservice, cachekv) can run on memkv.
+func MakeKv(coord HostName, cm *connman.ConnMan) *kv.Kv {
+	ck := MakeKVClerk(coord, cm)
+	return &kv.Kv{
+		Put: func(key, value string) {
+			ck.Put([]byte(key), []byte(value))
+		},
+		Get: func(key string) string {
+			return string(ck.Get([]byte(key)))
+		},
+		ConditionalPut: func(key, expect, value string) string {
+			if ck.ConditionalPut([]byte(key), []byte(expect), []byte(value)) {
+				return "ok"
+			}
+			return ""
+		},
+	}
+}
@@ -0,0 +1,254 @@
+package memkv
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mit-pdos/gokv/connman"
+	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/grove_ffi/memnet"
+	"github.com/mit-pdos/gokv/urpc"
+)
+
+// A coordinator and two shard servers on an in-memory network that duplicates
+// and reorders messages; increments must still happen exactly once, and moving
+// shards to the second server must not lose anything.
+func TestClusterDupReorder(t *testing.T) {
+	n := memnet.New(1)
+	n.SetConfig(memnet.Config{MaxDelay: time.Millisecond, DupPercent: 10, Reorder: true})
+	grove_ffi.SetTransport(n)
+	defer grove_ffi.SetTransport(nil)
+
+	coord := grove_ffi.MakeAddress("10.0.0.1:1")
+	shard1 := grove_ffi.MakeAddress("10.0.0.2:1")
+	shard2 := grove_ffi.MakeAddress("10.0.0.3:1")
+	const nshard = 8
+	MakeKVShardServer(true, nshard).Start(shard1)
+	MakeKVShardServer(false, nshard).Start(shard2)
+	MakeKVCoordServer(shard1, nshard).Start(coord)
+
+	ck := MakeKVClerk(coord, connman.MakeConnMan())
+	for i := 0; i < 20; i++ {
+		ck.Put([]byte(fmt.Sprint("k", i)), []byte(fmt.Sprint("v", i)))
+		ck.Increment([]byte("ctr"), 1)
+	}
+	ck.Add(shard2)
+	for i := 0; i < 20; i++ {
+		ck.Increment([]byte("ctr"), 1)
+	}
+
+	for i := 0; i < 20; i++ {
+		if v := string(ck.Get([]byte(fmt.Sprint("k", i)))); v != fmt.Sprint("v", i) {
+			t.Errorf("k%d = %q", i, v)
+		}
+	}
+	if v, ok := ck.Increment([]byte("ctr"), 0); !ok || v != 40 {
+		t.Errorf("ctr = %d", v)
+	}
+	moved := 0
+	for _, host := range MakeKVCoordClerk(coord, connman.MakeConnMan()).GetShardMap() {
+		if host == shard2 {
+			moved++
+		}
+	}
+	if moved == 0 {
+		t.Errorf("no shards moved to the new server")
+	}
+}
+
+// A shard server from before KV_APPEND and KV_SHARD_STATS: clerks and the
+// coordinator get errors for those, rather than crashing.
+func TestOlderShardServer(t *testing.T) {
+	grove_ffi.SetTransport(memnet.New(1))
+	defer grove_ffi.SetTransport(nil)
+
+	coord := grove_ffi.MakeAddress("10.0.0.1:1")
+	shard := grove_ffi.MakeAddress("10.0.0.2:1")
+	handlers := map[uint64]func([]byte, *[]byte){
+		KV_FRESHCID: func(_ []byte, reply *[]byte) { *reply = EncodeUint64(1) },
+	}
+	urpc.MakeServer(handlers).Serve(shard)
+	MakeKVCoordServer(shard, 4).Start(coord)
+
+	ck := MakeSeqKVClerk(coord, connman.MakeConnMan())
+	if _, err := ck.AppendContext(context.Background(), []byte("k"), []byte("v")); err != ErrUnsupported {
+		t.Errorf("append: got %v", err)
+	}
+	if _, err := ck.MGetContext(context.Background(), [][]byte{[]byte("a"), []byte("b")}); err != ErrUnsupported {
+		t.Errorf("mget: got %v", err)
+	}
+	moves, err := MakeKVCoordClerk(coord, connman.MakeConnMan()).Balance(true)
+	if err != nil || len(moves) != 0 {
+		t.Errorf("balance: got %v, %v", moves, err)
+	}
+}
+
+func TestMPutMismatched(t *testing.T) {
+	grove_ffi.SetTransport(memnet.New(1))
+	defer grove_ffi.SetTransport(nil)
+
+	coord := grove_ffi.MakeAddress("10.0.0.1:1")
+	shard := grove_ffi.MakeAddress("10.0.0.2:1")
+	MakeKVShardServer(true, 8).Start(shard)
+	MakeKVCoordServer(shard, 8).Start(coord)
+	cm := connman.MakeConnMan()
+
+	keys := [][]byte{[]byte("a"), []byte("b")}
+	ck := MakeSeqKVClerk(coord, cm)
+	if err := ck.MPutContext(context.Background(), keys, [][]byte{[]byte("1")}); err != ErrBadRequest {
+		t.Errorf("clerk: got %v", err)
+	}
+	// the server checks too, rather than indexing past the values
+	errs := MakeFreshKVShardClerk(shard, cm).MPut(keys, [][]byte{[]byte("1")})
+	if len(errs) != 2 || errs[0] != EBadRequest || errs[1] != EBadRequest {
+		t.Errorf("server: got %v", errs)
+	}
+	if v := ck.Get([]byte("a")); len(v) != 0 {
+		t.Errorf("a = %q", v)
+	}
+}
+
+// Installed shards are counted like written ones, and reading stats (as
+// balance --dry-run does) doesn't reset the request rates.
+func TestShardStats(t *testing.T) {
+	s := MakeKVShardServer(true, 2)
+	kvs := make(KvMap)
+	for i := 0; i < 10; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		s.PutRPC(&PutRequest{Key: key, Value: []byte("value")}, new(PutReply))
+		kvs[string(key)] = []byte("value")
+	}
+	before := s.ShardStatsRPC()
+	again := s.ShardStatsRPC()
+	if len(before) == 0 || len(again) != len(before) {
+		t.Fatalf("stats %v, then %v", before, again)
+	}
+	for i := range before {
+		if before[i].OpsPerSec == 0 || again[i].OpsPerSec == 0 {
+			t.Errorf("shard %d: %d ops/s, then %d", before[i].Sid, before[i].OpsPerSec, again[i].OpsPerSec)
+		}
+	}
+
+	other := MakeKVShardServer(false, 2)
+	for sid := uint64(0); sid < 2; sid++ {
+		shard := make(KvMap)
+		for k, v := range kvs {
+			if shardOf([]byte(k), 2) == sid {
+				shard[k] = v
+			}
+		}
+		other.InstallShardRPC(&InstallShardRequest{Sid: sid, Kvs: shard})
+	}
+	for _, st := range other.ShardStatsRPC() {
+		for _, want := range before {
+			if want.Sid == st.Sid && want.Bytes != st.Bytes {
+				t.Errorf("shard %d has %d bytes written, %d installed", st.Sid, want.Bytes, st.Bytes)
+			}
+		}
+	}
+}
+
+// A shard server that doesn't answer is left out of a balancing round, which
+// doesn't hold up the coordinator's other RPCs while it waits.
+func TestBalanceUnreachableShardServer(t *testing.T) {
+	n := memnet.New(1)
+	grove_ffi.SetTransport(n)
+	defer grove_ffi.SetTransport(nil)
+
+	coord := grove_ffi.MakeAddress("10.0.0.1:1")
+	shard1 := grove_ffi.MakeAddress("10.0.0.2:1")
+	shard2 := grove_ffi.MakeAddress("10.0.0.3:1")
+	MakeKVShardServer(true, 8).Start(shard1)
+	MakeKVShardServer(false, 8).Start(shard2)
+	MakeKVCoordServer(shard1, 8).Start(coord)
+	cm := connman.MakeConnMan()
+	MakeKVClerk(coord, cm).Add(shard2)
+
+	n.Isolate(shard2)
+	done := make(chan error)
+	go func() {
+		_, err := MakeKVCoordClerk(coord, connman.MakeConnMan()).Balance(true)
+		done <- err
+	}()
+	// while the coordinator waits for shard2's stats
+	time.Sleep(100 * time.Millisecond)
+	if len(MakeKVCoordClerk(coord, cm).GetShardMap()) != 8 {
+		t.Errorf("bad shard map")
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("balance: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("balance never finished")
+	}
+}
+
+// A shard server that speaks another encoding version: clerks give up with
+// ErrBadVersion instead of panicking, even for batches, which it rejects with
+// a single error.
+func TestBadVersionShardServer(t *testing.T) {
+	grove_ffi.SetTransport(memnet.New(1))
+	defer grove_ffi.SetTransport(nil)
+
+	coord := grove_ffi.MakeAddress("10.0.0.1:1")
+	shard := grove_ffi.MakeAddress("10.0.0.2:1")
+	handlers := map[uint64]func([]byte, *[]byte){
+		KV_FRESHCID: func(_ []byte, reply *[]byte) { *reply = EncodeUint64(1) },
+		KV_GET: func(_ []byte, reply *[]byte) {
+			*reply = EncodeGetReply(&GetReply{Err: EBadVersion})
+		},
+		KV_MGET: func(_ []byte, reply *[]byte) {
+			*reply = EncodeMGetReply(&MGetReply{Errs: []ErrorType{EBadVersion}})
+		},
+		KV_MPUT: func(_ []byte, reply *[]byte) {
+			*reply = EncodeMPutReply(&MPutReply{Errs: []ErrorType{EBadVersion}})
+		},
+	}
+	urpc.MakeServer(handlers).Serve(shard)
+	MakeKVCoordServer(shard, 4).Start(coord)
+
+	ctx := context.Background()
+	ck := MakeSeqKVClerk(coord, connman.MakeConnMan())
+	if _, err := ck.GetContext(ctx, []byte("k")); err != ErrBadVersion {
+		t.Errorf("get: got %v", err)
+	}
+	keys := [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+	if _, err := ck.MGetContext(ctx, keys); err != ErrBadVersion {
+		t.Errorf("mget: got %v", err)
+	}
+	if err := ck.MPutContext(ctx, keys, keys); err != ErrBadVersion {
+		t.Errorf("mput: got %v", err)
+	}
+}
+
+func TestMakeKv(t *testing.T) {
+	grove_ffi.SetTransport(memnet.New(1))
+	defer grove_ffi.SetTransport(nil)
+
+	coord := grove_ffi.MakeAddress("10.0.0.1:1")
+	shard := grove_ffi.MakeAddress("10.0.0.2:1")
+	MakeKVShardServer(true, 8).Start(shard)
+	MakeKVCoordServer(shard, 8).Start(coord)
+
+	kv := MakeKv(coord, connman.MakeConnMan())
+	if v := kv.Get("a"); v != "" {
+		t.Errorf("a = %q before any put", v)
+	}
+	kv.Put("a", "1")
+	if v := kv.Get("a"); v != "1" {
+		t.Errorf("a = %q", v)
+	}
+	if r := kv.ConditionalPut("a", "2", "3"); r != "" {
+		t.Errorf("conditional put with the wrong expected value returned %q", r)
+	}
+	if r := kv.ConditionalPut("a", "1", "3"); r != "ok" {
+		t.Errorf("conditional put returned %q", r)
+	}
+	if v := kv.Get("a"); v != "3" {
+		t.Errorf("a = %q after the conditional put", v)
+	}
+}
@@ -10,12 +10,12 @@ type LockClerk struct {
 }
 
 func (ck *LockClerk) Lock(key uint64) {
-	for !(ck.kv.ConditionalPut(key, make([]byte, 0), make([]byte, 1))) {
+	for !(ck.kv.ConditionalPut(memkv.EncodeUint64(key), make([]byte, 0), make([]byte, 1))) {
 	}
 }
 
 func (ck *LockClerk) Unlock(key uint64) {
-	ck.kv.Put(key, make([]byte, 0))
+	ck.kv.Put(memkv.EncodeUint64(key), make([]byte, 0))
 }
 
 func MakeLockClerk(lockhost memkv.HostName, cm *connman.ConnMan) *LockClerk {
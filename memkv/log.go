@@ -0,0 +1,17 @@
+package memkv
+
+import (
+	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/logging"
+)
+
+var logger = logging.For("memkv")
+
+// For logging: the number of shards on each host, keyed by address.
+func shardCounts(hostShards map[HostName]uint64) map[string]uint64 {
+	counts := make(map[string]uint64, len(hostShards))
+	for host, n := range hostShards {
+		counts[grove_ffi.AddressToStr(host)] = n
+	}
+	return counts
+}
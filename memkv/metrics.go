@@ -0,0 +1,31 @@
+package memkv
+
+import (
+	"strconv"
+
+	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/metrics"
+)
+
+// Reports the size of each shard that s owns, labelled with its address host.
+func (s *KVShardServer) registerMetrics(host HostName) {
+	server := grove_ffi.AddressToStr(host)
+	labels := []string{"server", "shard"}
+	perShard := func(name string, help string, f func(sid uint64) float64) {
+		metrics.Default.NewGaugeFunc(name, help, labels, func(emit metrics.Emit) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			for sid := uint64(0); sid < s.nshard; sid++ {
+				if s.shardMap[sid] {
+					emit(f(sid), server, strconv.FormatUint(sid, 10))
+				}
+			}
+		})
+	}
+	perShard("memkv_shard_bytes", "Total size of the keys and values in a shard.", func(sid uint64) float64 {
+		return float64(s.shardBytes[sid])
+	})
+	perShard("memkv_shard_keys", "Number of keys in a shard.", func(sid uint64) float64 {
+		return float64(len(s.kvss[sid]))
+	})
+}
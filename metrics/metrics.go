@@ -0,0 +1,314 @@
+package metrics
+
+// A small metrics registry: counters, histograms and gauges (which are computed
+// when the metrics are read), served over HTTP in the Prometheus text format.
+// Each metric can have labels, e.g. the rpcid of an RPC, and keeps one series
+// for each combination of label values it has seen.
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type family interface {
+	write(w *bufio.Writer)
+}
+
+type Registry struct {
+	mu       *sync.Mutex
+	names    []string // in the order registered
+	families map[string]family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{mu: new(sync.Mutex), families: make(map[string]family)}
+}
+
+// The registry that the packages in this repository report to, and that Serve
+// serves.
+var Default = NewRegistry()
+
+// Returns the family called name, making it with mk if there isn't one yet.
+func (r *Registry) get(name string, mk func() family) family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f, ok := r.families[name]
+	if !ok {
+		f = mk()
+		r.families[name] = f
+		r.names = append(r.names, name)
+	}
+	return f
+}
+
+// Writes every metric in r, in the Prometheus text format.
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	fams := make([]family, 0, len(r.names))
+	for _, name := range r.names {
+		fams = append(fams, r.families[name])
+	}
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, f := range fams {
+		f.write(bw)
+	}
+	return bw.Flush()
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.Write(w)
+}
+
+// Serves the Default registry at /metrics on addr (e.g. ":9100"), in the
+// background.
+func Serve(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Default)
+	go func() {
+		log.Println(http.ListenAndServe(addr, mux))
+	}()
+}
+
+func writeHeader(w *bufio.Writer, name string, help string, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, strings.ReplaceAll(help, "\n", " "))
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Formats the labels of a series, with extra (already formatted) appended.
+func formatLabels(names []string, values []string, extra string) string {
+	if len(names) == 0 && extra == "" {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(values[i]))
+		b.WriteByte('"')
+	}
+	if extra != "" {
+		if len(names) > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(extra)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func seriesKey(labelNames []string, labelValues []string) string {
+	if len(labelValues) != len(labelNames) {
+		panic(fmt.Sprintf("metrics: got %d label values for labels %v", len(labelValues), labelNames))
+	}
+	return strings.Join(labelValues, "\x00")
+}
+
+// The series of a metric, in a fixed order.
+func sortedKeys(m *sync.Map) []string {
+	keys := make([]string, 0)
+	m.Range(func(k, _ any) bool {
+		keys = append(keys, k.(string))
+		return true
+	})
+	sort.Strings(keys)
+	return keys
+}
+
+type Counter struct {
+	name   string
+	help   string
+	labels []string
+	series sync.Map // label values key -> *counterSeries
+}
+
+type counterSeries struct {
+	values []string
+	v      atomic.Uint64
+}
+
+// Makes (or returns the existing) counter called name, with the given labels.
+func (r *Registry) NewCounter(name string, help string, labels ...string) *Counter {
+	return r.get(name, func() family {
+		return &Counter{name: name, help: help, labels: labels}
+	}).(*Counter)
+}
+
+func (c *Counter) Add(n uint64, labelValues ...string) {
+	key := seriesKey(c.labels, labelValues)
+	s, ok := c.series.Load(key)
+	if !ok {
+		s, _ = c.series.LoadOrStore(key, &counterSeries{values: append([]string(nil), labelValues...)})
+	}
+	s.(*counterSeries).v.Add(n)
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+	for _, key := range sortedKeys(&c.series) {
+		s, _ := c.series.Load(key)
+		cs := s.(*counterSeries)
+		fmt.Fprintf(w, "%s%s %d\n", c.name, formatLabels(c.labels, cs.values, ""), cs.v.Load())
+	}
+}
+
+// Buckets for latencies in seconds, from 100µs to 10s.
+var LatencyBuckets = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Returns n buckets, starting at start and each factor times the last.
+func ExponentialBuckets(start float64, factor float64, n int) []float64 {
+	buckets := make([]float64, n)
+	var b = start
+	for i := range buckets {
+		buckets[i] = b
+		b *= factor
+	}
+	return buckets
+}
+
+type Histogram struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64 // upper bounds, increasing; +Inf is implicit
+	series  sync.Map  // label values key -> *histogramSeries
+}
+
+type histogramSeries struct {
+	values []string
+	mu     sync.Mutex
+	counts []uint64 // counts[i] is the number of observations in bucket i (not cumulative)
+	count  uint64
+	sum    float64
+}
+
+// Makes (or returns the existing) histogram called name, with the given
+// bucket upper bounds and labels.
+func (r *Registry) NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	return r.get(name, func() family {
+		return &Histogram{name: name, help: help, labels: labels, buckets: buckets}
+	}).(*Histogram)
+}
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	key := seriesKey(h.labels, labelValues)
+	s, ok := h.series.Load(key)
+	if !ok {
+		s, _ = h.series.LoadOrStore(key, &histogramSeries{
+			values: append([]string(nil), labelValues...),
+			counts: make([]uint64, len(h.buckets)+1),
+		})
+	}
+	hs := s.(*histogramSeries)
+	i := sort.SearchFloat64s(h.buckets, v) // the first bucket with bound >= v
+	hs.mu.Lock()
+	hs.counts[i]++
+	hs.count++
+	hs.sum += v
+	hs.mu.Unlock()
+}
+
+// Observes d, in seconds.
+func (h *Histogram) ObserveDuration(d time.Duration, labelValues ...string) {
+	h.Observe(d.Seconds(), labelValues...)
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	writeHeader(w, h.name, h.help, "histogram")
+	for _, key := range sortedKeys(&h.series) {
+		s, _ := h.series.Load(key)
+		hs := s.(*histogramSeries)
+		hs.mu.Lock()
+		counts := append([]uint64(nil), hs.counts...)
+		count, sum := hs.count, hs.sum
+		hs.mu.Unlock()
+
+		var cumulative uint64
+		for i, c := range counts {
+			cumulative += c
+			var le = math.Inf(1)
+			if i < len(h.buckets) {
+				le = h.buckets[i]
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name,
+				formatLabels(h.labels, hs.values, `le="`+formatFloat(le)+`"`), cumulative)
+		}
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, hs.values, ""), formatFloat(sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, hs.values, ""), count)
+	}
+}
+
+// Reports one series of a gauge: its value, and its label values.
+type Emit = func(v float64, labelValues ...string)
+
+type GaugeFunc struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	fs     []func(emit Emit)
+}
+
+// Adds f to the gauge called name (making it if there isn't one yet); each
+// time the metrics are read, every function added to the gauge is called, and
+// reports its series through emit. For example, each server in a process can
+// add a function that reports its own state, labelled with its address.
+func (r *Registry) NewGaugeFunc(name string, help string, labels []string, f func(emit Emit)) {
+	g := r.get(name, func() family {
+		return &GaugeFunc{name: name, help: help, labels: labels}
+	}).(*GaugeFunc)
+	g.mu.Lock()
+	g.fs = append(g.fs, f)
+	g.mu.Unlock()
+}
+
+func (g *GaugeFunc) write(w *bufio.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	g.mu.Lock()
+	fs := make([]func(Emit), len(g.fs))
+	copy(fs, g.fs)
+	g.mu.Unlock()
+	for _, f := range fs {
+		f(func(v float64, labelValues ...string) {
+			seriesKey(g.labels, labelValues) // checks the number of labels
+			fmt.Fprintf(w, "%s%s %s\n", g.name, formatLabels(g.labels, labelValues, ""), formatFloat(v))
+		})
+	}
+}
+
+// Returns 1 for true and 0 for false, for reporting conditions as gauges.
+func Bool(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,65 @@
+package metrics
+
+import (
+	"bytes"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTextFormat(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("reqs_total", "Requests.", "rpc")
+	c.Inc("1")
+	c.Add(2, "1")
+	c.Inc("0")
+	h := r.NewHistogram("lat_seconds", "Latency.", []float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.ObserveDuration(2 * time.Second)
+	r.NewGaugeFunc("up", "Up.", []string{"server"}, func(emit Emit) {
+		emit(Bool(true), `a"b`)
+	})
+	r.NewGaugeFunc("up", "Up.", []string{"server"}, func(emit Emit) {
+		emit(0, "c")
+	})
+
+	var b bytes.Buffer
+	if err := r.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP reqs_total Requests.
+# TYPE reqs_total counter
+reqs_total{rpc="0"} 1
+reqs_total{rpc="1"} 3
+# HELP lat_seconds Latency.
+# TYPE lat_seconds histogram
+lat_seconds_bucket{le="0.1"} 1
+lat_seconds_bucket{le="1"} 2
+lat_seconds_bucket{le="+Inf"} 3
+lat_seconds_sum 2.55
+lat_seconds_count 3
+# HELP up Up.
+# TYPE up gauge
+up{server="a\"b"} 1
+up{server="c"} 0
+`
+	if b.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", b.String(), want)
+	}
+}
+
+func TestSameNameSameMetric(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("x_total", "X.").Inc()
+	r.NewCounter("x_total", "X.").Inc()
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+	if !strings.Contains(string(body), "\nx_total 2\n") {
+		t.Errorf("got\n%s", body)
+	}
+}
@@ -1,21 +1,63 @@
 package mkrouter
 
 import (
+	"github.com/mit-pdos/gokv/connman"
 	"github.com/mit-pdos/gokv/memkv"
-	"github.com/mit-pdos/gokv/urpc"
 )
 
+// Thin memkv client that sends everything through a router, so it doesn't need
+// to know the shard map. The router never rejects a request for not owning a
+// shard, so unlike memkv.SeqKVClerk there is nothing to retry here.
+//
+// Like memkv.SeqKVClerk, a Clerk can only be used for one request at a time.
 type Clerk struct {
-	cl *urpc.Client
+	ck *memkv.KVShardClerk
 }
 
-func (ck *Clerk) Get(key uint64) []byte {
-	var ret []byte
-	ck.cl.Call(memkv.KV_GET, memkv.EncodeGetRequest(&memkv.GetRequest{Key: key}), &ret, 100 /*ms*/)
-	return ret
+func MakeClerk(router HostName, cm *connman.ConnMan) *Clerk {
+	return &Clerk{ck: memkv.MakeFreshKVShardClerk(router, cm)}
 }
 
-func (ck *Clerk) Put(key uint64, value []byte) {
-	var ret []byte
-	ck.cl.Call(memkv.KV_GET, memkv.EncodePutRequest(&memkv.PutRequest{Key: key, Value: value}), &ret, 100 /*ms*/)
+func (ck *Clerk) Get(key []byte) []byte {
+	ret := new([]byte)
+	ck.ck.Get(key, ret)
+	return *ret
+}
+
+func (ck *Clerk) Put(key []byte, value []byte) {
+	ck.ck.Put(key, value)
+}
+
+func (ck *Clerk) ConditionalPut(key []byte, expectedValue []byte, newValue []byte) bool {
+	success := new(bool)
+	ck.ck.ConditionalPut(key, expectedValue, newValue, success)
+	return *success
+}
+
+func (ck *Clerk) Append(key []byte, value []byte) []byte {
+	ret := new([]byte)
+	ck.ck.Append(key, value, ret)
+	return *ret
+}
+
+func (ck *Clerk) Increment(key []byte, delta uint64) (uint64, bool) {
+	ret := new(uint64)
+	err := ck.ck.Increment(key, delta, ret)
+	return *ret, err == memkv.ENone
+}
+
+func (ck *Clerk) GetAndSet(key []byte, value []byte) []byte {
+	ret := new([]byte)
+	ck.ck.GetAndSet(key, value, ret)
+	return *ret
+}
+
+func (ck *Clerk) MGet(keys [][]byte) [][]byte {
+	ret := new([][]byte)
+	ck.ck.MGet(keys, ret)
+	return *ret
+}
+
+func (ck *Clerk) MPut(keys [][]byte, values [][]byte) {
+	ck.ck.MPut(keys, values)
 }
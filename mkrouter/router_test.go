@@ -0,0 +1,71 @@
+package mkrouter
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mit-pdos/gokv/connman"
+	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/grove_ffi/memnet"
+	"github.com/mit-pdos/gokv/memkv"
+)
+
+// A router in front of a coordinator and two shard servers, on an in-memory
+// network that duplicates and reorders messages. Half the shards move to the
+// second server after the router has cached the shard map, so the router has
+// to notice and refresh it.
+func TestRouterTwoShardServers(t *testing.T) {
+	n := memnet.New(1)
+	n.SetConfig(memnet.Config{MaxDelay: time.Millisecond, DupPercent: 10, Reorder: true})
+	grove_ffi.SetTransport(n)
+	defer grove_ffi.SetTransport(nil)
+
+	coord := grove_ffi.MakeAddress("10.0.0.1:1")
+	shard1 := grove_ffi.MakeAddress("10.0.0.2:1")
+	shard2 := grove_ffi.MakeAddress("10.0.0.3:1")
+	router := grove_ffi.MakeAddress("10.0.0.4:1")
+	const nshard = 8
+	memkv.MakeKVShardServer(true, nshard).Start(shard1)
+	memkv.MakeKVShardServer(false, nshard).Start(shard2)
+	memkv.MakeKVCoordServer(shard1, nshard).Start(coord)
+	MakeMKRouterServer(coord).Start(router)
+
+	cm := connman.MakeConnMan()
+	ck := MakeClerk(router, cm)
+	keys := make([][]byte, 0)
+	values := make([][]byte, 0)
+	for i := 0; i < 20; i++ {
+		keys = append(keys, []byte(fmt.Sprint("k", i)))
+		values = append(values, []byte(fmt.Sprint("v", i)))
+	}
+	for i := 0; i < 10; i++ {
+		ck.Put(keys[i], values[i])
+	}
+
+	memkv.MakeKVClerk(coord, cm).Add(shard2)
+	owners := make(map[HostName]bool)
+	shardMap := memkv.MakeKVCoordClerk(coord, cm).GetShardMap()
+	for _, key := range keys {
+		owners[shardMap[memkv.ShardOf(key, nshard)]] = true
+	}
+	if !owners[shard1] || !owners[shard2] {
+		t.Fatalf("the keys aren't spread over both shard servers: %v", owners)
+	}
+
+	ck.MPut(keys[10:], values[10:])
+	for i := 0; i < 10; i++ {
+		if v := string(ck.Get(keys[i])); v != string(values[i]) {
+			t.Errorf("%s = %q", keys[i], v)
+		}
+	}
+	got := ck.MGet(keys)
+	if len(got) != len(keys) {
+		t.Fatalf("MGet returned %d values for %d keys", len(got), len(keys))
+	}
+	for i := range keys {
+		if string(got[i]) != string(values[i]) {
+			t.Errorf("MGet: %s = %q", keys[i], got[i])
+		}
+	}
+}
@@ -1,62 +1,310 @@
 package mkrouter
 
 import (
-	"github.com/mit-pdos/gokv/memkv"
 	"sync"
+
+	"github.com/goose-lang/primitive"
+	"github.com/goose-lang/std"
+	"github.com/mit-pdos/gokv/connman"
+	"github.com/mit-pdos/gokv/erpc"
+	"github.com/mit-pdos/gokv/memkv"
+	"github.com/mit-pdos/gokv/urpc"
 )
 
-// Totally naive RPC based MemKV proxy/load balancer
+// RPC based MemKV proxy. Clients talk to the router with the same RPCs (and
+// encodings) they would use for a single shard server, and the router forwards
+// each request to whichever shard server owns the key, so clients don't need a
+// copy of the shard map.
+//
+// The router keeps no durable state: it caches the shard map (refreshing it
+// when a shard server says it doesn't own a shard), and keeps a reply table
+// for exactly-once requests from its own clients. Like a shard server's reply
+// table, that one is lost if the router restarts, at which point clients have
+// to get a fresh CID.
 
 type HostName = uint64
 
 type MKRouterServer struct {
-	coord HostName
-	mu    *sync.Mutex
-	cks   []*memkv.KVClerk // pool of clerks
+	mu       *sync.Mutex
+	erpc     *erpc.Server
+	cm       *connman.ConnMan
+	coordCk  *memkv.KVCoordClerk
+	shardMap []HostName
+	mapGen   uint64 // incremented whenever shardMap is refreshed
+
+	// idle shard clerks for each shard server. A KVShardClerk can only be used
+	// for one request at a time, so each concurrent request forwarded to a
+	// server uses its own (sharing the connection through cm).
+	freeClerks map[HostName][]*memkv.KVShardClerk
 }
 
-func (s *MKRouterServer) GetRPC(args *memkv.GetRequest, val *[]byte) {
-	var ck *memkv.KVClerk
+// Returns the owner of key, and the generation of the shard map that says so.
+func (s *MKRouterServer) ownerOf(key []byte) (HostName, uint64) {
 	s.mu.Lock()
-	if len(s.cks) > 0 {
-		ck = s.cks[0]
-		s.mu.Unlock()
-	} else {
+	host := s.shardMap[memkv.ShardOf(key, uint64(len(s.shardMap)))]
+	gen := s.mapGen
+	s.mu.Unlock()
+	return host, gen
+}
+
+// Called after a shard server rejects a request that was routed using
+// generation gen of the shard map; only fetches a new map if nobody else has
+// since.
+func (s *MKRouterServer) refreshShardMap(gen uint64) {
+	s.mu.Lock()
+	if s.mapGen != gen {
 		s.mu.Unlock()
-		ck = memkv.MakeKVClerk(s.coord, nil) // FIXME: needs a connman
+		return
 	}
+	s.mu.Unlock()
 
-	*val = ck.Get(args.Key)
+	shardMap := s.coordCk.GetShardMap()
 	s.mu.Lock()
-	s.cks = append(s.cks, ck)
+	// an empty map means the coordinator couldn't be asked (and GetShardMap
+	// has said why), so keep using the old one
+	if s.mapGen == gen && len(shardMap) > 0 {
+		s.shardMap = shardMap
+		s.mapGen = std.SumAssumeNoOverflow(s.mapGen, 1)
+	}
 	s.mu.Unlock()
 }
 
-func (s *MKRouterServer) PutRPC(args *memkv.PutRequest) {
-	var ck *memkv.KVClerk
+func (s *MKRouterServer) getClerk(host HostName) *memkv.KVShardClerk {
 	s.mu.Lock()
-	if len(s.cks) > 0 {
-		ck = s.cks[0]
-		s.mu.Unlock()
-	} else {
-		s.mu.Unlock()
-		ck = memkv.MakeKVClerk(s.coord, nil) // FIXME: needs a connman
+	cks := s.freeClerks[host]
+	n := len(cks)
+	if n == 0 {
+		s.mu.Unlock() // making a clerk takes an RPC to get a fresh CID
+		return memkv.MakeFreshKVShardClerk(host, s.cm)
 	}
+	ck := cks[n-1]
+	s.freeClerks[host] = cks[:n-1]
+	s.mu.Unlock()
+	return ck
+}
+
+func (s *MKRouterServer) putClerk(host HostName, ck *memkv.KVShardClerk) {
+	s.mu.Lock()
+	s.freeClerks[host] = append(s.freeClerks[host], ck)
+	s.mu.Unlock()
+}
+
+// Runs op against the owner of key with a shard clerk, until the owner accepts
+// it. op returns the error from the shard server.
+func (s *MKRouterServer) forward(key []byte, op func(ck *memkv.KVShardClerk) memkv.ErrorType) {
+	for {
+		host, gen := s.ownerOf(key)
+		ck := s.getClerk(host)
+		err := op(ck)
+		s.putClerk(host, ck)
+		if err != memkv.EDontHaveShard {
+			break
+		}
+		s.refreshShardMap(gen)
+	}
+}
+
+func (s *MKRouterServer) PutRPC(args *memkv.PutRequest, reply *memkv.PutReply) {
+	s.forward(args.Key, func(ck *memkv.KVShardClerk) memkv.ErrorType {
+		reply.Err = ck.Put(args.Key, args.Value)
+		return reply.Err
+	})
+}
+
+func (s *MKRouterServer) GetRPC(args *memkv.GetRequest, reply *memkv.GetReply) {
+	s.forward(args.Key, func(ck *memkv.KVShardClerk) memkv.ErrorType {
+		reply.Err = ck.Get(args.Key, &reply.Value)
+		return reply.Err
+	})
+}
 
-	ck.Put(args.Key, args.Value)
+func (s *MKRouterServer) ConditionalPutRPC(args *memkv.ConditionalPutRequest, reply *memkv.ConditionalPutReply) {
+	s.forward(args.Key, func(ck *memkv.KVShardClerk) memkv.ErrorType {
+		reply.Err = ck.ConditionalPut(args.Key, args.ExpectedValue, args.NewValue, &reply.Success)
+		return reply.Err
+	})
+}
+
+func (s *MKRouterServer) AppendRPC(args *memkv.PutRequest, reply *memkv.GetReply) {
+	s.forward(args.Key, func(ck *memkv.KVShardClerk) memkv.ErrorType {
+		reply.Err = ck.Append(args.Key, args.Value, &reply.Value)
+		return reply.Err
+	})
+}
+
+func (s *MKRouterServer) IncrementRPC(args *memkv.IncrementRequest, reply *memkv.IncrementReply) {
+	s.forward(args.Key, func(ck *memkv.KVShardClerk) memkv.ErrorType {
+		reply.Err = ck.Increment(args.Key, args.Delta, &reply.Value)
+		return reply.Err
+	})
+}
+
+func (s *MKRouterServer) GetAndSetRPC(args *memkv.PutRequest, reply *memkv.GetReply) {
+	s.forward(args.Key, func(ck *memkv.KVShardClerk) memkv.ErrorType {
+		reply.Err = ck.GetAndSet(args.Key, args.Value, &reply.Value)
+		return reply.Err
+	})
+}
+
+// Multi-key operations are split into one batch per shard server, which run
+// in parallel; keys are then retried individually if their shard moved. The
+// router never replies EDontHaveShard.
+func (s *MKRouterServer) groupByServer(keys [][]byte) ([][]uint64, []HostName) {
 	s.mu.Lock()
-	s.cks = append(s.cks, ck)
+	shardMap := s.shardMap
 	s.mu.Unlock()
+	nshard := uint64(len(shardMap))
+
+	groupOf := make(map[HostName]uint64)
+	groups := make([][]uint64, 0)
+	hosts := make([]HostName, 0)
+	for i, key := range keys {
+		host := shardMap[memkv.ShardOf(key, nshard)]
+		g, ok := groupOf[host]
+		if !ok {
+			g = uint64(len(groups))
+			groupOf[host] = g
+			groups = append(groups, make([]uint64, 0))
+			hosts = append(hosts, host)
+		}
+		groups[g] = append(groups[g], uint64(i))
+	}
+	return groups, hosts
+}
+
+func (s *MKRouterServer) MGetRPC(args *memkv.MGetRequest, reply *memkv.MGetReply) {
+	n := len(args.Keys)
+	reply.Errs = make([]memkv.ErrorType, n)
+	reply.Values = make([][]byte, n)
+	groups, hosts := s.groupByServer(args.Keys)
+	std.Multipar(uint64(len(groups)), func(g uint64) {
+		batch := make([][]byte, len(groups[g]))
+		for j, i := range groups[g] {
+			batch[j] = args.Keys[i]
+		}
+		ck := s.getClerk(hosts[g])
+		vals := new([][]byte)
+		errs := ck.MGet(batch, vals)
+		s.putClerk(hosts[g], ck)
+		for j, i := range groups[g] {
+			if errs[j] == memkv.ENone {
+				reply.Values[i] = (*vals)[j]
+			} else {
+				rep := new(memkv.GetReply)
+				s.GetRPC(&memkv.GetRequest{Key: args.Keys[i]}, rep)
+				reply.Errs[i] = rep.Err
+				reply.Values[i] = rep.Value
+			}
+		}
+	})
+}
+
+func (s *MKRouterServer) MPutRPC(args *memkv.MPutRequest, reply *memkv.MPutReply) {
+	reply.Errs = make([]memkv.ErrorType, len(args.Keys))
+	if !args.WellFormed() {
+		for i := range reply.Errs {
+			reply.Errs[i] = memkv.EBadRequest
+		}
+		return
+	}
+	groups, hosts := s.groupByServer(args.Keys)
+	std.Multipar(uint64(len(groups)), func(g uint64) {
+		batchKeys := make([][]byte, len(groups[g]))
+		batchVals := make([][]byte, len(groups[g]))
+		for j, i := range groups[g] {
+			batchKeys[j] = args.Keys[i]
+			batchVals[j] = args.Values[i]
+		}
+		ck := s.getClerk(hosts[g])
+		errs := ck.MPut(batchKeys, batchVals)
+		s.putClerk(hosts[g], ck)
+		for j, i := range groups[g] {
+			if errs[j] != memkv.ENone {
+				rep := new(memkv.PutReply)
+				s.PutRPC(&memkv.PutRequest{Key: args.Keys[i], Value: args.Values[i]}, rep)
+				reply.Errs[i] = rep.Err
+			}
+		}
+	})
+}
+
+func MakeMKRouterServer(coord HostName) *MKRouterServer {
+	s := new(MKRouterServer)
+	s.mu = new(sync.Mutex)
+	s.erpc = erpc.MakeServer()
+	s.cm = connman.MakeConnMan()
+	s.coordCk = memkv.MakeKVCoordClerk(coord, s.cm)
+	s.shardMap = s.coordCk.GetShardMap()
+	// like urpc.MakeClient, give up right away if the coordinator is wrong
+	primitive.Assume(len(s.shardMap) > 0)
+	s.freeClerks = make(map[HostName][]*memkv.KVShardClerk)
+	return s
 }
 
 func (mkv *MKRouterServer) Start(host HostName) {
 	handlers := make(map[uint64]func([]byte, *[]byte))
+	erpc := mkv.erpc
 
-	handlers[memkv.KV_PUT] = func(rawReq []byte, rawReply *[]byte) {
-		mkv.PutRPC(memkv.DecodePutRequest(rawReq))
+	handlers[memkv.KV_FRESHCID] = func(rawReq []byte, rawReply *[]byte) {
+		*rawReply = memkv.EncodeUint64(erpc.GetFreshCID())
 	}
 
-	handlers[memkv.KV_GET] = func(rawReq []byte, rawReply *[]byte) {
-		mkv.GetRPC(memkv.DecodeGetRequest(rawReq), rawReply)
-	}
+	handlers[memkv.KV_PUT] = erpc.HandleRequestConcurrent(memkv.Versioned(memkv.EncodePutReply(&memkv.PutReply{Err: memkv.EBadVersion}),
+		func(rawReq []byte, rawReply *[]byte) {
+			rep := new(memkv.PutReply)
+			mkv.PutRPC(memkv.DecodePutRequest(rawReq), rep)
+			*rawReply = memkv.EncodePutReply(rep)
+		}))
+
+	handlers[memkv.KV_GET] = erpc.HandleRequestConcurrent(memkv.Versioned(memkv.EncodeGetReply(&memkv.GetReply{Err: memkv.EBadVersion}),
+		func(rawReq []byte, rawReply *[]byte) {
+			rep := new(memkv.GetReply)
+			mkv.GetRPC(memkv.DecodeGetRequest(rawReq), rep)
+			*rawReply = memkv.EncodeGetReply(rep)
+		}))
+
+	handlers[memkv.KV_CONDITIONAL_PUT] = erpc.HandleRequestConcurrent(memkv.Versioned(memkv.EncodeConditionalPutReply(&memkv.ConditionalPutReply{Err: memkv.EBadVersion}),
+		func(rawReq []byte, rawReply *[]byte) {
+			rep := new(memkv.ConditionalPutReply)
+			mkv.ConditionalPutRPC(memkv.DecodeConditionalPutRequest(rawReq), rep)
+			*rawReply = memkv.EncodeConditionalPutReply(rep)
+		}))
+
+	handlers[memkv.KV_APPEND] = erpc.HandleRequestConcurrent(memkv.Versioned(memkv.EncodeGetReply(&memkv.GetReply{Err: memkv.EBadVersion}),
+		func(rawReq []byte, rawReply *[]byte) {
+			rep := new(memkv.GetReply)
+			mkv.AppendRPC(memkv.DecodePutRequest(rawReq), rep)
+			*rawReply = memkv.EncodeGetReply(rep)
+		}))
+
+	handlers[memkv.KV_INCREMENT] = erpc.HandleRequestConcurrent(memkv.Versioned(memkv.EncodeIncrementReply(&memkv.IncrementReply{Err: memkv.EBadVersion}),
+		func(rawReq []byte, rawReply *[]byte) {
+			rep := new(memkv.IncrementReply)
+			mkv.IncrementRPC(memkv.DecodeIncrementRequest(rawReq), rep)
+			*rawReply = memkv.EncodeIncrementReply(rep)
+		}))
+
+	handlers[memkv.KV_GET_AND_SET] = erpc.HandleRequestConcurrent(memkv.Versioned(memkv.EncodeGetReply(&memkv.GetReply{Err: memkv.EBadVersion}),
+		func(rawReq []byte, rawReply *[]byte) {
+			rep := new(memkv.GetReply)
+			mkv.GetAndSetRPC(memkv.DecodePutRequest(rawReq), rep)
+			*rawReply = memkv.EncodeGetReply(rep)
+		}))
+
+	handlers[memkv.KV_MGET] = erpc.HandleRequestConcurrent(memkv.Versioned(memkv.EncodeMGetReply(&memkv.MGetReply{Errs: []memkv.ErrorType{memkv.EBadVersion}}),
+		func(rawReq []byte, rawReply *[]byte) {
+			rep := new(memkv.MGetReply)
+			mkv.MGetRPC(memkv.DecodeMGetRequest(rawReq), rep)
+			*rawReply = memkv.EncodeMGetReply(rep)
+		}))
+
+	handlers[memkv.KV_MPUT] = erpc.HandleRequestConcurrent(memkv.Versioned(memkv.EncodeMPutReply(&memkv.MPutReply{Errs: []memkv.ErrorType{memkv.EBadVersion}}),
+		func(rawReq []byte, rawReply *[]byte) {
+			rep := new(memkv.MPutReply)
+			mkv.MPutRPC(memkv.DecodeMPutRequest(rawReq), rep)
+			*rawReply = memkv.EncodeMPutReply(rep)
+		}))
+
+	s := urpc.MakeServer(handlers)
+	s.Serve(host)
 }
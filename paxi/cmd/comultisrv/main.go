@@ -2,18 +2,19 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"log"
+
 	"github.com/mit-pdos/gokv/grove_ffi"
 	"github.com/mit-pdos/gokv/paxi/comulti"
-	"log"
-	// "time"
 )
 
 func main() {
-	l := make([]comulti.Entry, 0)
+	var numCommitted uint64
 	commitf := func(e comulti.Entry) {
-		l = append(l, e)
-		log.Printf("Log is %+v\n", l)
-		if len(l)%100 == 0 {
+		numCommitted++
+		log.Printf("Committed entry %d: %q\n", numCommitted-1, e)
+		if numCommitted%100 == 0 {
 			log.Println("Another 100")
 		}
 	}
@@ -21,23 +22,21 @@ func main() {
 	var i uint64
 	flag.Uint64Var(&i, "index", 0, "the index of the server to start")
 
-	var isLeader bool
-	flag.BoolVar(&isLeader, "leader", false, "whether or now this node is initially leader")
+	var fname string
+	flag.StringVar(&fname, "filename", "", "the file with the replica's durable state (default comulti<index>.data)")
 	flag.Parse()
 
-	peerHosts := []uint64{
+	if fname == "" {
+		fname = fmt.Sprintf("comulti%d.data", i)
+	}
+
+	peerHosts := []grove_ffi.Address{
 		grove_ffi.MakeAddress("127.0.0.1:37001"),
 		grove_ffi.MakeAddress("127.0.0.1:37002"),
 		grove_ffi.MakeAddress("127.0.0.1:37003"),
 	}
 
-	r := comulti.MakeReplica(peerHosts[i], commitf, peerHosts, isLeader)
-	log.Printf("Started replica")
-	log.Printf("Started to try appending commands")
-	for i := uint64(13); i < 1000000; i++ {
-		go r.TryAppendRPC(i)
-		go r.TryAppendRPC(i * 10)
-		// time.Sleep(time.Millisecond * 500)
-	}
+	comulti.MakeReplica(fname, peerHosts[i], commitf, peerHosts)
+	log.Printf("Started replica %d", i)
 	select {}
 }
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/paxi/single"
+)
+
+// Proposes a value for the register, and prints the one that was decided.
+func main() {
+	var serversStr string
+	flag.StringVar(&serversStr, "servers", "", "comma-separated addresses of the replicas")
+	flag.Parse()
+
+	if serversStr == "" || len(flag.Args()) != 1 {
+		flag.PrintDefaults()
+		fmt.Println("Must provide the value to propose")
+		os.Exit(1)
+	}
+	hosts := make([]grove_ffi.Address, 0)
+	for _, hostStr := range strings.Split(serversStr, ",") {
+		hosts = append(hosts, grove_ffi.MakeAddress(hostStr))
+	}
+	fmt.Printf("%s\n", single.MakeClerk(hosts).Decide([]byte(flag.Args()[0])))
+}
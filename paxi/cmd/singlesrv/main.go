@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/paxi/single"
+)
+
+func main() {
+	var i uint64
+	var fname string
+	flag.Uint64Var(&i, "index", 0, "the index, among the replicas given as arguments, of the one to start")
+	flag.StringVar(&fname, "filename", "", "the file with the replica's durable state (default single<index>.data)")
+	flag.Parse()
+
+	a := flag.Args()
+	if len(a) == 0 || i >= uint64(len(a)) {
+		flag.PrintDefaults()
+		fmt.Println("Must provide the replicas: host1 [host2 ...]")
+		os.Exit(1)
+	}
+	if fname == "" {
+		fname = fmt.Sprintf("single%d.data", i)
+	}
+
+	peerHosts := make([]grove_ffi.Address, 0)
+	for _, hostStr := range a {
+		peerHosts = append(peerHosts, grove_ffi.MakeAddress(hostStr))
+	}
+	single.MakeReplica(fname, peerHosts[i], peerHosts)
+	log.Printf("Started replica %d", i)
+	select {}
+}
@@ -1,7 +1,25 @@
 package comulti
 
-type HostName uint64
+type Entry = []byte
 
-const PREPARE = uint64(1)
-const PROPOSE = uint64(2)
-const TRY_APPEND = uint64(3)
+type Error = uint64
+
+const (
+	ENone = uint64(0)
+	// This replica isn't the leader (any more).
+	ENotLeader = uint64(1)
+	// The proposal number is lower than one this replica has promised.
+	EStale = uint64(2)
+	// The replica is missing entries before the ones sent; resend from the
+	// index in the reply.
+	EOutOfOrder = uint64(3)
+	ETimeout    = uint64(4)
+)
+
+const (
+	PREPARE = uint64(1)
+	PROPOSE = uint64(2)
+	// for clients
+	APPEND = uint64(3)
+	READ   = uint64(4)
+)
@@ -4,68 +4,134 @@ import (
 	"github.com/tchajed/marshal"
 )
 
-func encodeBool(a bool) []byte {
-	e := marshal.NewEnc(1)
-	e.PutBool(a)
-	return e.Finish()
+func encodeEntries(enc []byte, entries []Entry) []byte {
+	var e = marshal.WriteInt(enc, uint64(len(entries)))
+	for _, entry := range entries {
+		e = marshal.WriteLenPrefixedBytes(e, entry)
+	}
+	return e
 }
 
-func decodeBool(raw []byte) bool {
-	return marshal.NewDec(raw).GetBool()
+func decodeEntries(enc []byte) ([]Entry, []byte) {
+	n, e := marshal.ReadInt(enc)
+	entries := make([]Entry, n)
+	for i := range entries {
+		entries[i], e = marshal.ReadLenPrefixedBytes(e)
+	}
+	return entries, e
 }
 
-func encodeUint64(a uint64) []byte {
-	e := marshal.NewEnc(8)
-	e.PutInt(a)
-	return e.Finish()
+type PrepareArgs struct {
+	Pn uint64
+	// the candidate already has the log up to here, so replies need only
+	// include the rest
+	FromIndex uint64
 }
 
-func decodeUint64(raw []byte) uint64 {
-	return marshal.NewDec(raw).GetInt()
+func encodePrepareArgs(args *PrepareArgs) []byte {
+	var enc = make([]byte, 0, 8*2)
+	enc = marshal.WriteInt(enc, args.Pn)
+	return marshal.WriteInt(enc, args.FromIndex)
+}
+
+func decodePrepareArgs(rawArgs []byte) *PrepareArgs {
+	args := new(PrepareArgs)
+	var enc = rawArgs
+	args.Pn, enc = marshal.ReadInt(enc)
+	args.FromIndex, _ = marshal.ReadInt(enc)
+	return args
 }
 
 type PrepareReply struct {
-	Success bool
-	Log     []Entry // full log;
-	Pn      uint64
+	Err Error
+	// if Err == ENone, the proposal number of the accepted log; otherwise, the
+	// promised proposal number
+	Pn uint64
+	// the accepted log, from StartIndex on
+	StartIndex uint64
+	Log        []Entry
 }
 
 func encodePrepareReply(rep *PrepareReply) []byte {
-	e := marshal.NewEnc(1 + 8 + 8*uint64(len(rep.Log)))
-	e.PutBool(rep.Success)
-	e.PutInt(rep.Pn)
-	e.PutInts(rep.Log)
-	return e.Finish()
+	var enc = make([]byte, 0, 8*4)
+	enc = marshal.WriteInt(enc, rep.Err)
+	enc = marshal.WriteInt(enc, rep.Pn)
+	enc = marshal.WriteInt(enc, rep.StartIndex)
+	return encodeEntries(enc, rep.Log)
 }
 
 func decodePrepareReply(rawRep []byte) *PrepareReply {
 	rep := new(PrepareReply)
-	d := marshal.NewDec(rawRep) // (1 + 8 + 8 * uint64(len(rep.Log)))
-	rep.Success = d.GetBool()
-	rep.Pn = d.GetInt()
-	rep.Log = d.GetInts((uint64(len(rawRep)) - 9) / 8)
+	var enc = rawRep
+	rep.Err, enc = marshal.ReadInt(enc)
+	rep.Pn, enc = marshal.ReadInt(enc)
+	rep.StartIndex, enc = marshal.ReadInt(enc)
+	rep.Log, _ = decodeEntries(enc)
 	return rep
 }
 
+// Asks the replica to accept the leader's log, which has Entries from Index on.
 type ProposeArgs struct {
 	Pn          uint64
 	CommitIndex uint64
-	Log         []Entry
+	Index       uint64
+	Entries     []Entry
 }
 
 func encodeProposeArgs(args *ProposeArgs) []byte {
-	e := marshal.NewEnc(8 + 8 + 8*uint64(len(args.Log)))
-	e.PutInt(args.Pn)
-	e.PutInt(args.CommitIndex)
-	e.PutInts(args.Log)
-	return e.Finish()
+	var enc = make([]byte, 0, 8*4)
+	enc = marshal.WriteInt(enc, args.Pn)
+	enc = marshal.WriteInt(enc, args.CommitIndex)
+	enc = marshal.WriteInt(enc, args.Index)
+	return encodeEntries(enc, args.Entries)
 }
 
 func decodeProposeArgs(rawArgs []byte) *ProposeArgs {
 	args := new(ProposeArgs)
-	d := marshal.NewDec(rawArgs) // (1 + 8 + 8 * uint64(len(rep.Log)))
-	args.Pn = d.GetInt()
-	args.CommitIndex = d.GetInt()
-	args.Log = d.GetInts((uint64(len(rawArgs)) - 16) / 8)
+	var enc = rawArgs
+	args.Pn, enc = marshal.ReadInt(enc)
+	args.CommitIndex, enc = marshal.ReadInt(enc)
+	args.Index, enc = marshal.ReadInt(enc)
+	args.Entries, _ = decodeEntries(enc)
 	return args
 }
+
+type ProposeReply struct {
+	Err Error
+	// the promised proposal number if Err == EStale, or where to resend from if
+	// Err == EOutOfOrder
+	Hint uint64
+}
+
+func encodeProposeReply(rep *ProposeReply) []byte {
+	var enc = make([]byte, 0, 8*2)
+	enc = marshal.WriteInt(enc, rep.Err)
+	return marshal.WriteInt(enc, rep.Hint)
+}
+
+func decodeProposeReply(rawRep []byte) *ProposeReply {
+	rep := new(ProposeReply)
+	var enc = rawRep
+	rep.Err, enc = marshal.ReadInt(enc)
+	rep.Hint, _ = marshal.ReadInt(enc)
+	return rep
+}
+
+type AppendReply struct {
+	Err   Error
+	Index uint64
+}
+
+func encodeAppendReply(rep *AppendReply) []byte {
+	var enc = make([]byte, 0, 8*2)
+	enc = marshal.WriteInt(enc, rep.Err)
+	return marshal.WriteInt(enc, rep.Index)
+}
+
+func decodeAppendReply(rawRep []byte) *AppendReply {
+	rep := new(AppendReply)
+	var enc = rawRep
+	rep.Err, enc = marshal.ReadInt(enc)
+	rep.Index, _ = marshal.ReadInt(enc)
+	return rep
+}
@@ -1,26 +1,102 @@
 package comulti
 
 import (
-	"github.com/mit-pdos/gokv/urpc"
+	"sync"
+
+	"github.com/goose-lang/primitive"
+	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/reconnectclient"
+	"github.com/tchajed/marshal"
 )
 
-type Clerk struct {
-	cl *urpc.Client
+// Used by replicas to talk to each other; connection failures come back as
+// ETimeout.
+type singleClerk struct {
+	cl *reconnectclient.ReconnectingClient
 }
 
-func MakeClerk(host uint64) *Clerk {
-	return &Clerk{cl: urpc.MakeClient(host)}
+func makeSingleClerk(host grove_ffi.Address) *singleClerk {
+	return &singleClerk{cl: reconnectclient.MakeReconnectingClient(host)}
 }
 
-func (ck *Clerk) Prepare(pn uint64, reply *PrepareReply) {
+func (ck *singleClerk) prepare(args *PrepareArgs) *PrepareReply {
 	rawRep := new([]byte)
-	ck.cl.Call(PREPARE, encodeUint64(pn), rawRep, 100 /* ms */)
-	*reply = *(decodePrepareReply(*rawRep))
+	err := ck.cl.Call(PREPARE, encodePrepareArgs(args), rawRep, 100 /* ms */)
+	if err == 0 {
+		return decodePrepareReply(*rawRep)
+	} else {
+		return &PrepareReply{Err: ETimeout}
+	}
 }
 
-func (ck *Clerk) Propose(Pn uint64, CommitIndex uint64, Log []Entry) bool {
+func (ck *singleClerk) propose(args *ProposeArgs) *ProposeReply {
 	rawRep := new([]byte)
-	args := &ProposeArgs{Pn: Pn, CommitIndex: CommitIndex, Log: Log}
-	ck.cl.Call(PROPOSE, encodeProposeArgs(args), rawRep, 100 /* ms */)
-	return decodeBool(*rawRep)
+	err := ck.cl.Call(PROPOSE, encodeProposeArgs(args), rawRep, 100 /* ms */)
+	if err == 0 {
+		return decodeProposeReply(*rawRep)
+	} else {
+		return &ProposeReply{Err: ETimeout}
+	}
+}
+
+// A client of the shared log. It remembers which replica was last the leader,
+// and tries the others in turn when that one doesn't work out.
+type Clerk struct {
+	mu     *sync.Mutex
+	cls    []*reconnectclient.ReconnectingClient
+	leader uint64
+}
+
+func MakeClerk(hosts []grove_ffi.Address) *Clerk {
+	ck := &Clerk{mu: new(sync.Mutex), cls: make([]*reconnectclient.ReconnectingClient, len(hosts))}
+	for i, host := range hosts {
+		ck.cls[i] = reconnectclient.MakeReconnectingClient(host)
+	}
+	return ck
+}
+
+// Appends e to the log, retrying until it's committed, and returns its index.
+//
+// If a leader fails after getting e, e might end up in the log twice.
+func (ck *Clerk) Append(e Entry) uint64 {
+	ck.mu.Lock()
+	var i = ck.leader
+	ck.mu.Unlock()
+	for {
+		rawRep := new([]byte)
+		err := ck.cls[i].Call(APPEND, e, rawRep, 2000 /* ms */)
+		if err == 0 {
+			rep := decodeAppendReply(*rawRep)
+			if rep.Err == ENone {
+				ck.mu.Lock()
+				ck.leader = i
+				ck.mu.Unlock()
+				return rep.Index
+			}
+		}
+		// back off for a random while, rather than spinning through the
+		// replicas while they elect a leader or refuse connections
+		primitive.Sleep((primitive.RandomUint64() % 50) * 1_000_000)
+		i = (i + 1) % uint64(len(ck.cls))
+	}
+}
+
+// Returns the committed entries starting at index from, according to some
+// replica. These might not be all the committed entries, but do agree with
+// what any other replica returns.
+func (ck *Clerk) Read(from uint64) []Entry {
+	ck.mu.Lock()
+	var i = ck.leader
+	ck.mu.Unlock()
+	for {
+		rawRep := new([]byte)
+		err := ck.cls[i].Call(READ, marshal.WriteInt(make([]byte, 0, 8), from), rawRep, 2000 /* ms */)
+		if err == 0 {
+			entries, _ := decodeEntries(*rawRep)
+			return entries
+		}
+		// as in Append
+		primitive.Sleep((primitive.RandomUint64() % 50) * 1_000_000)
+		i = (i + 1) % uint64(len(ck.cls))
+	}
 }
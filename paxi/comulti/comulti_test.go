@@ -0,0 +1,129 @@
+package comulti_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/paxi/comulti"
+	"github.com/mit-pdos/gokv/paxi/paxitest"
+)
+
+// The entries each replica has applied, in order.
+type applied struct {
+	mu      sync.Mutex
+	entries [][]comulti.Entry
+}
+
+func (a *applied) commitf(i int) func(comulti.Entry) {
+	return func(e comulti.Entry) {
+		a.mu.Lock()
+		a.entries[i] = append(a.entries[i], e)
+		a.mu.Unlock()
+	}
+}
+
+// Checks that what each replica applied is a prefix of want.
+func (a *applied) check(t *testing.T, want []string) {
+	t.Helper()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i, es := range a.entries {
+		if len(es) > len(want) {
+			t.Fatalf("replica %d applied %d entries, only %d appended", i, len(es), len(want))
+		}
+		for j, e := range es {
+			if string(e) != want[j] {
+				t.Fatalf("replica %d applied %q at %d, want %q", i, e, j, want[j])
+			}
+		}
+	}
+}
+
+// Appends more entries after another replica takes over as leader; nothing
+// committed is lost.
+func TestAppendAcrossLeaderChange(t *testing.T) {
+	paxitest.Start(t, 1)
+
+	hosts := make([]grove_ffi.Address, 3)
+	for i := range hosts {
+		hosts[i] = grove_ffi.MakeAddress(fmt.Sprintf("10.0.2.%d:1", i+1))
+	}
+	a := &applied{entries: make([][]comulti.Entry, len(hosts))}
+	rs := make([]*comulti.Replica, len(hosts))
+	for i, host := range hosts {
+		rs[i] = comulti.MakeReplica(fmt.Sprintf("comulti%d", i), host, a.commitf(i), hosts)
+	}
+
+	ck := comulti.MakeClerk(hosts)
+	// the index each entry was committed at; the clerk might append an entry
+	// twice if a leader fails, so this isn't necessarily its position in want
+	indices := make(map[string]uint64)
+	appendAll := func(from int, to int) {
+		for i := from; i < to; i++ {
+			e := fmt.Sprint("entry ", i)
+			indices[e] = ck.Append([]byte(e))
+		}
+	}
+	appendAll(0, 10)
+
+	var leader = -1
+	for i, r := range rs {
+		if r.IsLeader() {
+			leader = i
+		}
+	}
+	if leader < 0 {
+		t.Fatal("no leader after appending")
+	}
+	if !rs[(leader+1)%len(rs)].TryBecomeLeader() {
+		t.Fatal("TryBecomeLeader failed")
+	}
+	appendAll(10, 20)
+
+	got := ck.Read(0)
+	for e, index := range indices {
+		if index >= uint64(len(got)) || string(got[index]) != e {
+			t.Fatalf("%q committed at %d, but it's not in the log %q", e, index, got)
+		}
+	}
+	var want []string
+	for _, e := range got {
+		want = append(want, string(e))
+	}
+	a.check(t, want)
+}
+
+// A replica recovers the promised and accepted proposal numbers and log it had
+// replied with, from before a crash.
+func TestRecoveryAfterCrash(t *testing.T) {
+	_, fs := paxitest.Start(t, 2)
+
+	hosts := []grove_ffi.Address{grove_ffi.MakeAddress("10.0.3.1:1")}
+	a := &applied{entries: make([][]comulti.Entry, 1)}
+	ck := comulti.MakeClerk(hosts)
+	comulti.MakeReplica("comulti", hosts[0], a.commitf(0), hosts)
+	var want []string
+	for i := 0; i < 5; i++ {
+		e := fmt.Sprint("entry ", i)
+		ck.Append([]byte(e))
+		want = append(want, e)
+	}
+
+	// restart the replica with only what was durable
+	paxitest.Reboot(fs, 3)
+	a = &applied{entries: make([][]comulti.Entry, 1)}
+	ck = comulti.MakeClerk(hosts)
+	comulti.MakeReplica("comulti", hosts[0], a.commitf(0), hosts)
+	e := "entry 5"
+	if index := ck.Append([]byte(e)); index != uint64(len(want)) {
+		t.Fatalf("appended %q at %d after recovery, want %d", e, index, len(want))
+	}
+	want = append(want, e)
+	got := ck.Read(0)
+	if len(got) != len(want) {
+		t.Fatalf("read %d entries, want %d", len(got), len(want))
+	}
+	a.check(t, want)
+}
@@ -0,0 +1,152 @@
+package comulti
+
+import (
+	"github.com/mit-pdos/gokv/aof"
+	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/tchajed/marshal"
+)
+
+// The acceptor state, kept in an append-only file.
+//
+// File format: a sequence of records, each one a u64 kind followed by
+//
+//	recPromise: u64 pn
+//	recAppend:  u64 length ++ entry; appended to the log accepted at logPN
+//	recAccept:  u64 pn ++ u64 index ++ entries; the log is now its first
+//	            index entries followed by entries, accepted at pn
+//
+// Replacing the log is a single record, so that a crash can't leave part of
+// the new log accepted at the old proposal number. A partial record at the end
+// (from a crash in the middle of an append) is ignored.
+type durableState struct {
+	fname   string
+	logFile *aof.AppendOnlyFile
+	// the length of the file when the last record has been written
+	length uint64
+}
+
+const (
+	recPromise = uint64(0)
+	recAppend  = uint64(1)
+	recAccept  = uint64(2)
+)
+
+func encodeAccept(pn uint64, index uint64, entries []Entry) []byte {
+	var enc = make([]byte, 0, 8*4)
+	enc = marshal.WriteInt(enc, recAccept)
+	enc = marshal.WriteInt(enc, pn)
+	enc = marshal.WriteInt(enc, index)
+	return encodeEntries(enc, entries)
+}
+
+func (d *durableState) write(rec []byte) {
+	d.length = d.logFile.Append(rec)
+}
+
+func (d *durableState) promise(pn uint64) {
+	var enc = make([]byte, 0, 8*2)
+	enc = marshal.WriteInt(enc, recPromise)
+	enc = marshal.WriteInt(enc, pn)
+	d.write(enc)
+}
+
+func (d *durableState) append(entry Entry) {
+	var enc = make([]byte, 0, 8+8+uint64(len(entry)))
+	enc = marshal.WriteInt(enc, recAppend)
+	enc = marshal.WriteLenPrefixedBytes(enc, entry)
+	d.write(enc)
+}
+
+func (d *durableState) accept(pn uint64, index uint64, entries []Entry) {
+	d.write(encodeAccept(pn, index, entries))
+}
+
+// Returns a function that waits until everything written so far is durable.
+func (d *durableState) waitFn() func() {
+	f := d.logFile
+	l := d.length
+	return func() {
+		f.WaitAppend(l)
+	}
+}
+
+type acceptorState struct {
+	promisedPN uint64
+	logPN      uint64
+	log        []Entry
+}
+
+// Reads the state from the file, skipping a partial record at the end.
+func decodeAcceptorState(enc0 []byte) *acceptorState {
+	st := &acceptorState{log: make([]Entry, 0)}
+	var enc = enc0
+	for uint64(len(enc)) >= 16 {
+		kind, rest := marshal.ReadInt(enc)
+		if kind == recPromise {
+			st.promisedPN, enc = marshal.ReadInt(rest)
+		} else if kind == recAppend {
+			l, data := marshal.ReadInt(rest)
+			if uint64(len(data)) < l {
+				break
+			}
+			st.log = append(st.log, data[:l])
+			enc = data[l:]
+		} else {
+			entries, ok, next := decodeAcceptRecord(rest, st)
+			if !ok {
+				break
+			}
+			st.log = append(st.log, entries...)
+			enc = next
+		}
+	}
+	if st.logPN > st.promisedPN {
+		// accepting is also promising
+		st.promisedPN = st.logPN
+	}
+	return st
+}
+
+// Decodes the body of a recAccept record into st (except for its entries,
+// which it returns), or returns false if the record is incomplete.
+func decodeAcceptRecord(rest []byte, st *acceptorState) ([]Entry, bool, []byte) {
+	if len(rest) < 24 {
+		return nil, false, nil
+	}
+	pn, e1 := marshal.ReadInt(rest)
+	index, e2 := marshal.ReadInt(e1)
+	n, e3 := marshal.ReadInt(e2)
+	var enc = e3
+	entries := make([]Entry, 0, n)
+	for i := uint64(0); i < n; i++ {
+		if len(enc) < 8 {
+			return nil, false, nil
+		}
+		l, data := marshal.ReadInt(enc)
+		if uint64(len(data)) < l {
+			return nil, false, nil
+		}
+		entries = append(entries, data[:l])
+		enc = data[l:]
+	}
+	st.logPN = pn
+	if index < uint64(len(st.log)) {
+		st.log = st.log[:index]
+	}
+	return entries, true, enc
+}
+
+// Recovers the acceptor state in fname (empty if there's no such file).
+func recoverDurableState(fname string) (*durableState, *acceptorState) {
+	st := decodeAcceptorState(grove_ffi.FileRead(fname))
+
+	// get rid of any partial record and overwritten entries
+	var enc = make([]byte, 0, 8*2)
+	enc = marshal.WriteInt(enc, recPromise)
+	enc = marshal.WriteInt(enc, st.promisedPN)
+	enc = marshal.WriteBytes(enc, encodeAccept(st.logPN, 0, st.log))
+	grove_ffi.FileWrite(fname, enc)
+
+	d := &durableState{fname: fname, logFile: aof.CreateAppendOnlyFile(fname)}
+	return d, st
+}
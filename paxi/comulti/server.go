@@ -8,20 +8,36 @@ package comulti
 // least_ contains some prefix of a log.
 //
 // If you stare at this for long enough, you'll see that it's similar to Raft.
-// In fact, if you start optimizing this some more (so e.g. you don't need to
-// send the *whole* log on every request), you'll end up converging to something
-// much closer to Raft.
+// In particular, the leader doesn't send the whole log on every request, but
+// only what each peer is missing: a peer that has accepted a log with the same
+// proposal number has a prefix of the leader's log, and one with an older
+// proposal number has (at least) the committed prefix of it.
 //
 // One could also use this idea to implement a fault-tolerant monotonic counter
 // without worrying about any sort of log.
 
 import (
-	"github.com/mit-pdos/gokv/urpc"
+	"log/slog"
 	"sync"
-	"time"
+
+	"github.com/goose-lang/primitive"
+	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/logging"
+	"github.com/mit-pdos/gokv/urpc"
+	"github.com/tchajed/marshal"
 )
 
-type Entry = uint64
+var logger = logging.For("comulti")
+
+// A replica that hears nothing from a leader for this long (plus up to as much
+// again, at random) tries to become the leader.
+const electionTimeoutMs = uint64(300)
+
+// The leader sends appends (empty if there's nothing new) at least this often.
+const heartbeatMs = uint64(50)
+
+// How long an APPEND waits for its entry to be committed.
+const appendTimeoutMs = uint64(1000)
 
 type Replica struct {
 	mu         *sync.Mutex
@@ -30,219 +46,391 @@ type Replica struct {
 	logPN uint64  // proposal number of accepted val
 	log   []Entry // the value itself
 
-	commitIndex uint64
+	durable *durableState
+
+	commitIndex uint64 // the number of committed entries
 
-	peers []*Clerk
+	peers []*singleClerk
 
-	isLeader      bool // this means that we own the proposal with number logPN
-	leaderCond    *sync.Cond
-	commitCond    *sync.Cond
-	applyCond     *sync.Cond
-	acceptedIndex []uint64 // how much of the log has each peer accepted?
-	commitf       func(Entry)
+	isLeader    bool // this means that we own the proposal with number logPN
+	leaderCond  *sync.Cond
+	commitCond  *sync.Cond // signalled when commitIndex changes or the leader steps down
+	applyCond   *sync.Cond
+	sendCond    *sync.Cond // signalled when the leader has something new to send
+	matchIndex  []uint64   // how much of the log has each peer accepted?
+	nextIndex   []uint64   // where the next append to each peer starts
+	lastHeard   uint64     // when we last heard from a leader (or became one)
+	commitf     func(Entry)
+	lastApplied uint64 // the number of entries passed to commitf
+
+	logger *slog.Logger
+}
+
+// Requires r.mu.
+func (r *Replica) stepDown() {
+	if r.isLeader {
+		r.isLeader = false
+		r.commitCond.Broadcast()
+	}
 }
 
-func (r *Replica) PrepareRPC(pn uint64, reply *PrepareReply) {
+func (r *Replica) PrepareRPC(args *PrepareArgs, reply *PrepareReply) {
 	r.mu.Lock()
-	if pn > r.promisedPN {
-		r.promisedPN = pn
+	if args.Pn > r.promisedPN {
+		r.promisedPN = args.Pn
+		r.durable.promise(args.Pn)
+		r.stepDown()
+		r.lastHeard = primitive.TimeNow()
 
+		reply.Err = ENone
 		reply.Pn = r.logPN
-		reply.Log = r.log
-		reply.Success = true
+		var start = args.FromIndex
+		if start > uint64(len(r.log)) {
+			start = uint64(len(r.log))
+		}
+		reply.StartIndex = start
+		reply.Log = r.log[start:]
+		wait := r.durable.waitFn()
+		r.mu.Unlock()
+		wait()
 	} else {
-		reply.Success = false
+		reply.Err = EStale
 		reply.Pn = r.promisedPN
+		r.mu.Unlock()
 	}
-	r.mu.Unlock()
 }
 
-func (r *Replica) ProposeRPC(pn uint64, commitIndex uint64, val []Entry) bool {
+// Requires r.mu.
+func (r *Replica) setCommitIndex(commitIndex uint64) {
+	if commitIndex > r.commitIndex {
+		r.commitIndex = commitIndex
+		r.applyCond.Signal()
+		r.commitCond.Broadcast()
+		r.sendCond.Broadcast()
+	}
+}
+
+func (r *Replica) ProposeRPC(args *ProposeArgs, reply *ProposeReply) {
 	r.mu.Lock()
-	if pn >= r.promisedPN && pn >= r.logPN {
-		if pn > r.logPN {
-			r.log = val
-			r.logPN = pn
-		} else if len(val) > len(r.log) {
-			r.log = val
+	if args.Pn < r.promisedPN || args.Pn < r.logPN {
+		reply.Err = EStale
+		reply.Hint = r.promisedPN
+		r.mu.Unlock()
+		return
+	}
+	r.lastHeard = primitive.TimeNow()
+
+	if args.Pn > r.logPN {
+		// Our log beyond the committed entries might differ from the leader's,
+		// so only take the leader's log from there on.
+		if args.Index > r.commitIndex {
+			reply.Err = EOutOfOrder
+			reply.Hint = r.commitIndex
+			r.mu.Unlock()
+			return
 		}
-		if commitIndex > r.commitIndex {
-			r.commitIndex = commitIndex
-			r.applyCond.Signal()
+		if args.Pn > r.promisedPN {
+			// the accept record below also promises pn
+			r.promisedPN = args.Pn
+			r.stepDown()
 		}
-		// What if r.commitIndex > commitIndex?  pn |-> val means that val
-		// contains anything that might have been committed before. That means
-		// that commitIndex >= r.commitIndex must always be true since pn >=
-		// r.logPN.
-		r.mu.Unlock()
-		return true
+		r.log = append(r.log[:args.Index:args.Index], args.Entries...)
+		r.logPN = args.Pn
+		r.durable.accept(args.Pn, args.Index, args.Entries)
 	} else {
+		// Our log is a prefix of the leader's.
+		if args.Index > uint64(len(r.log)) {
+			reply.Err = EOutOfOrder
+			reply.Hint = uint64(len(r.log))
+			r.mu.Unlock()
+			return
+		}
+		end := args.Index + uint64(len(args.Entries))
+		for i := uint64(len(r.log)); i < end; i++ {
+			r.log = append(r.log, args.Entries[i-args.Index])
+			r.durable.append(args.Entries[i-args.Index])
+		}
+	}
+	if args.CommitIndex < uint64(len(r.log)) {
+		r.setCommitIndex(args.CommitIndex)
+	} else {
+		r.setCommitIndex(uint64(len(r.log)))
+	}
+	wait := r.durable.waitFn()
+	r.mu.Unlock()
+
+	wait()
+	reply.Err = ENone
+}
+
+// Appends e to the log, if this replica is the leader; it's committed once a
+// majority has accepted it. Returns the index of the entry.
+func (r *Replica) TryAppend(e Entry) (Error, uint64) {
+	r.mu.Lock()
+	if !r.isLeader {
 		r.mu.Unlock()
-		return false
+		return ENotLeader, 0
 	}
+	index := uint64(len(r.log))
+	r.log = append(r.log, e)
+	r.durable.append(e)
+	r.sendCond.Broadcast()
+	r.mu.Unlock()
+	return ENone, index
 }
 
-func (r *Replica) TryAppendRPC(cmd Entry) bool {
+// Like TryAppend, but waits until the entry is committed. Returns ENotLeader
+// if this replica stops being the leader first, and ETimeout if that takes
+// too long; the entry might still be committed in either case.
+func (r *Replica) AppendAndWait(e Entry) (Error, uint64) {
+	err, index := r.TryAppend(e)
+	if err != ENone {
+		return err, 0
+	}
+	deadline := primitive.TimeNow() + appendTimeoutMs*1_000_000
 	r.mu.Lock()
-	if r.isLeader {
-		r.log = append(r.log, cmd)
+	pn := r.logPN
+	for r.commitIndex <= index && r.isLeader && r.logPN == pn {
+		now := primitive.TimeNow()
+		if now >= deadline {
+			r.mu.Unlock()
+			return ETimeout, index
+		}
+		primitive.WaitTimeout(r.commitCond, (deadline-now)/1_000_000+1)
+	}
+	if r.commitIndex <= index {
+		r.mu.Unlock()
+		return ENotLeader, index
 	}
 	r.mu.Unlock()
-	return true
+	return ENone, index
 }
 
-func (r *Replica) GetLog() []Entry {
-	return nil
+// Returns the committed entries, starting at index from.
+func (r *Replica) GetLog(from uint64) []Entry {
+	r.mu.Lock()
+	var ret = make([]Entry, 0)
+	if from < r.commitIndex {
+		ret = append(ret, r.log[from:r.commitIndex]...)
+	}
+	r.mu.Unlock()
+	return ret
 }
 
-// proposes whatever is in our log
-// requires that the lock is held and that we are the leader
-func (r *Replica) doPropose(peerIdx uint64) {
-	pn := r.logPN
-	log := r.log
-	commitIndex := r.commitIndex
+func (r *Replica) IsLeader() bool {
+	r.mu.Lock()
+	l := r.isLeader
 	r.mu.Unlock()
-	a := r.peers[peerIdx].Propose(pn, commitIndex, log)
-	if a {
-		r.mu.Lock()
-		if r.logPN == pn && uint64(len(log)) > r.acceptedIndex[peerIdx] {
-			r.acceptedIndex[peerIdx] = uint64(len(log))
-			r.commitCond.Signal()
+	return l
+}
+
+// Requires r.mu, and that we are the leader. Commits as much as a majority of
+// peers have accepted.
+func (r *Replica) updateCommitIndex() {
+	var newCommitIndex = r.commitIndex
+	for {
+		var tally uint64
+		for _, a := range r.matchIndex {
+			if a > newCommitIndex {
+				tally++
+			}
+		}
+		if 2*tally > uint64(len(r.peers)) {
+			newCommitIndex = newCommitIndex + 1
+		} else {
+			break
 		}
-		r.mu.Unlock()
 	}
-	r.mu.Lock()
+	r.setCommitIndex(newCommitIndex)
 }
 
 func (r *Replica) applyThread() {
-	var lastApplied uint64 // := 0
-
 	r.mu.Lock()
 	for {
-		// fmt.Printf("lastApplied %+v\n", lastApplied)
-		for r.commitIndex <= lastApplied {
+		for r.commitIndex <= r.lastApplied {
 			r.applyCond.Wait()
 		}
-		for lastApplied < r.commitIndex {
-			r.commitf(r.log[lastApplied])
-			lastApplied++
-		}
+		e := r.log[r.lastApplied]
+		r.mu.Unlock()
+		r.commitf(e)
+		r.mu.Lock()
+		r.lastApplied++
 	}
 }
 
-func (r *Replica) commitThread() {
+// While we are the leader, keeps peer i up to date.
+func (r *Replica) replicaThread(i uint64) {
 	r.mu.Lock()
 	for {
 		for !r.isLeader {
 			r.leaderCond.Wait()
 		}
 
-		// update commitIndex
-		for r.isLeader {
-			oldCommitIndex := r.commitIndex
-			for { // increase commitIndex as much as possible
-				var tally uint64
-				for _, a := range r.acceptedIndex {
-					if a > r.commitIndex {
-						tally++
-					}
-				}
-				if 2*tally > uint64(len(r.peers)) {
-					r.commitIndex = r.commitIndex + 1
-				} else {
-					break
-				}
+		pn := r.logPN
+		var next = r.nextIndex[i]
+		if next > uint64(len(r.log)) {
+			next = uint64(len(r.log))
+		}
+		args := &ProposeArgs{
+			Pn:          pn,
+			CommitIndex: r.commitIndex,
+			Index:       next,
+			Entries:     r.log[next:],
+		}
+		r.mu.Unlock()
+		reply := r.peers[i].propose(args)
+		r.mu.Lock()
+
+		if !r.isLeader || r.logPN != pn {
+			continue
+		}
+		if reply.Err == ENone {
+			end := next + uint64(len(args.Entries))
+			r.nextIndex[i] = end
+			if end > r.matchIndex[i] {
+				r.matchIndex[i] = end
+				r.updateCommitIndex()
 			}
-			// apply everything in the range [oldCommitIndex + 1, commitIndex]
-			if r.commitIndex > oldCommitIndex {
-				r.applyCond.Signal()
+			if end >= uint64(len(r.log)) && args.CommitIndex >= r.commitIndex {
+				// nothing new to send; wait for something, or until it's time
+				// for a heartbeat
+				primitive.WaitTimeout(r.sendCond, heartbeatMs)
 			}
-			r.commitCond.Wait() // going to have to wait in any case, since we already committed as much as possible
+		} else if reply.Err == EStale {
+			r.logger.Info("stepping down as leader", "pn", pn)
+			r.stepDown()
+		} else if reply.Err == EOutOfOrder {
+			r.nextIndex[i] = reply.Hint
+		} else {
+			// the peer is unreachable; try again later
+			primitive.WaitTimeout(r.sendCond, heartbeatMs)
 		}
 	}
 }
 
-func (r *Replica) replicaThread(i uint64) {
-	r.mu.Lock()
+// Starts an election if we haven't heard from a leader in a while.
+func (r *Replica) electionThread() {
 	for {
-		for !r.isLeader {
-			r.leaderCond.Wait()
+		timeout := electionTimeoutMs + primitive.RandomUint64()%electionTimeoutMs
+		primitive.Sleep(timeout * 1_000_000)
+		r.mu.Lock()
+		expired := !r.isLeader && primitive.TimeNow() > r.lastHeard+timeout*1_000_000
+		r.mu.Unlock()
+		if expired {
+			r.TryBecomeLeader()
 		}
-
-		r.doPropose(i)
-		// fmt.Printf("%+v\n", r)
-		time.Sleep(10 * time.Millisecond)
 	}
 }
 
-// returns true iff there was an error
-func (r *Replica) TryBecomeLeader() {
+// Runs phase 1 with a fresh proposal number, waiting for replies from a
+// majority (or a timeout). Returns true iff this replica is now the leader.
+func (r *Replica) TryBecomeLeader() bool {
 	r.mu.Lock()
-	pn := r.promisedPN + 1 // don't need to bother incrementing; will invoke RPC on ourselves
+	if r.isLeader {
+		r.mu.Unlock()
+		return true
+	}
+	// will invoke RPC on ourselves, which makes sure no one else gets pn
+	args := &PrepareArgs{Pn: r.promisedPN + 1, FromIndex: r.commitIndex}
+	r.lastHeard = primitive.TimeNow()
 	r.mu.Unlock()
 
-	var numPrepared uint64
-	numPrepared = 0
-	var highestPn uint64
-	highestPn = 0
-	var highestLog []Entry
-	highestLog = r.log // if no one in our majority has accepted a value, we'll propose this one
+	var numReplies = uint64(0)
+	var numPrepared = uint64(0)
+	var highest *PrepareReply
 	mu := new(sync.Mutex)
+	cond := sync.NewCond(mu)
+	n := uint64(len(r.peers))
 
 	for _, peer := range r.peers { // XXX: peers is readonly
 		local_peer := peer
 		go func() {
-			reply_ptr := new(PrepareReply)
-			local_peer.Prepare(pn, reply_ptr)
+			reply := local_peer.prepare(args)
 
-			if reply_ptr.Success {
-				mu.Lock()
+			mu.Lock()
+			numReplies = numReplies + 1
+			if reply.Err == ENone {
 				numPrepared = numPrepared + 1
-				if reply_ptr.Pn > highestPn {
-					highestLog = reply_ptr.Log
-					highestPn = reply_ptr.Pn
+				if highest == nil || reply.Pn > highest.Pn ||
+					(reply.Pn == highest.Pn && reply.StartIndex+uint64(len(reply.Log)) > highest.StartIndex+uint64(len(highest.Log))) {
+					highest = reply
 				}
-				mu.Unlock()
 			}
+			cond.Signal()
+			mu.Unlock()
 		}()
 	}
 
-	// FIXME: put this in a condvar loop with timeout
+	deadline := primitive.TimeNow() + electionTimeoutMs*1_000_000
 	mu.Lock()
-	if 2*numPrepared > uint64(len(r.peers)) && r.promisedPN <= pn && r.logPN <= pn {
-		r.log = highestLog
-		r.logPN = pn
-		r.isLeader = true
+	for 2*numPrepared <= n && numReplies < n {
+		now := primitive.TimeNow()
+		if now >= deadline {
+			break
+		}
+		primitive.WaitTimeout(cond, (deadline-now)/1_000_000+1)
+	}
+	if 2*numPrepared <= n {
+		mu.Unlock()
+		return false
 	}
+	// RULE: lock r.mu after mu
+	r.mu.Lock()
+	if r.promisedPN != args.Pn || r.logPN >= args.Pn {
+		// someone else has started another election since
+		r.mu.Unlock()
+		mu.Unlock()
+		return false
+	}
+	// The highest log has everything that might have been committed; we
+	// already have it up to highest.StartIndex, since that's no more than our
+	// commitIndex.
+	start := highest.StartIndex
+	r.log = append(r.log[:start:start], highest.Log...)
+	r.logPN = args.Pn
+	r.durable.accept(args.Pn, start, highest.Log)
+	r.isLeader = true
+	r.matchIndex = make([]uint64, n)
+	r.nextIndex = make([]uint64, n)
+	for i := range r.nextIndex {
+		r.nextIndex[i] = r.commitIndex
+	}
+	r.logger.Info("became leader", "pn", args.Pn, "index", len(r.log))
+	r.leaderCond.Broadcast()
+	r.mu.Unlock()
 	mu.Unlock()
+	return true
 }
 
-func MakeReplica(me uint64, commitf func(Entry), peerHosts []uint64, isLeader bool) *Replica {
+// Starts a replica of the log shared by peerHosts (which includes me), keeping
+// its durable state in fname; commitf is called on each committed entry, in
+// order.
+func MakeReplica(fname string, me grove_ffi.Address, commitf func(Entry), peerHosts []grove_ffi.Address) *Replica {
 	r := new(Replica)
 	r.mu = new(sync.Mutex)
-	r.log = make([]Entry, 0)
-	r.peers = make([]*Clerk, len(peerHosts))
+	r.peers = make([]*singleClerk, len(peerHosts))
 	r.leaderCond = sync.NewCond(r.mu)
 	r.commitCond = sync.NewCond(r.mu)
 	r.applyCond = sync.NewCond(r.mu)
+	r.sendCond = sync.NewCond(r.mu)
 	r.commitf = commitf
+	r.logger = logger.With("server", grove_ffi.AddressToStr(me))
 
-	r.mu.Lock() // XXX: this is here to make sure that we don't start processing any RPCs until after peers has been initialized
-	r.StartServer(me)
-	time.Sleep(time.Second * 3) // XXX: this is here just to give time for everything to start up before connecting to peers
+	d, st := recoverDurableState(fname)
+	r.durable = d
+	r.promisedPN = st.promisedPN
+	r.logPN = st.logPN
+	r.log = st.log
+	r.lastHeard = primitive.TimeNow()
 
 	for i, peerHost := range peerHosts {
-		r.peers[i] = MakeClerk(peerHost)
+		r.peers[i] = makeSingleClerk(peerHost)
 	}
 
-	// FIXME: this is temporary
-	r.isLeader = isLeader
-	if r.isLeader {
-		r.acceptedIndex = make([]uint64, len(peerHosts))
-	}
+	r.StartServer(me)
 
 	go func() { r.applyThread() }() // FIXME: this is for Goose; really, should add support for [[go foo.bar()]] to Goose.
-	go func() { r.commitThread() }()
+	go func() { r.electionThread() }()
 	n := uint64(len(r.peers))
 	for i := uint64(0); i < n; i++ {
 		local_i := i
@@ -250,29 +438,32 @@ func MakeReplica(me uint64, commitf func(Entry), peerHosts []uint64, isLeader bo
 			r.replicaThread(local_i)
 		}()
 	}
-	r.mu.Unlock()
 	return r
 }
 
-func (r *Replica) StartServer(host uint64) {
+func (r *Replica) StartServer(host grove_ffi.Address) {
 	handlers := make(map[uint64]func([]byte, *[]byte))
-	handlers[TRY_APPEND] = func(rawReq []byte, rawRep *[]byte) {
-		e := decodeUint64(rawReq)
-		r.TryAppendRPC(e)
-	}
-
 	handlers[PREPARE] = func(rawReq []byte, rawRep *[]byte) {
-		pn := decodeUint64(rawReq)
 		rep := new(PrepareReply)
-		r.PrepareRPC(pn, rep)
+		r.PrepareRPC(decodePrepareArgs(rawReq), rep)
 		*rawRep = encodePrepareReply(rep)
 	}
 
 	handlers[PROPOSE] = func(rawReq []byte, rawRep *[]byte) {
-		args := decodeProposeArgs(rawReq)
-		b := r.ProposeRPC(args.Pn, args.CommitIndex, args.Log)
-		*rawRep = encodeBool(b)
+		rep := new(ProposeReply)
+		r.ProposeRPC(decodeProposeArgs(rawReq), rep)
+		*rawRep = encodeProposeReply(rep)
+	}
+
+	handlers[APPEND] = func(rawReq []byte, rawRep *[]byte) {
+		err, index := r.AppendAndWait(rawReq)
+		*rawRep = encodeAppendReply(&AppendReply{Err: err, Index: index})
+	}
+
+	handlers[READ] = func(rawReq []byte, rawRep *[]byte) {
+		from, _ := marshal.ReadInt(rawReq)
+		*rawRep = encodeEntries(make([]byte, 0), r.GetLog(from))
 	}
 	s := urpc.MakeServer(handlers)
-	s.Serve(host) // 1 == num workers
+	s.Serve(host)
 }
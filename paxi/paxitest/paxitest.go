@@ -0,0 +1,46 @@
+// Package paxitest sets up what the tests of the paxi replicas share: an
+// in-memory network that loses nothing but delays, duplicates and reorders a
+// few messages, and an in-memory file system that can crash.
+package paxitest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/grove_ffi/memfs"
+	"github.com/mit-pdos/gokv/grove_ffi/memnet"
+)
+
+func installNetwork(seed int64) *memnet.Network {
+	n := memnet.New(seed)
+	n.SetConfig(memnet.Config{MaxDelay: time.Millisecond, DupPercent: 5, Reorder: true})
+	grove_ffi.SetTransport(n)
+	return n
+}
+
+// Installs an in-memory network and file system, both seeded with seed, and
+// returns them: the network to cut replicas off, and the file system to crash
+// (see Reboot).
+//
+// The network is switched back to the real one when t finishes, but the file
+// system is left installed: replicas keep running, and writing their durable
+// state, after the test.
+func Start(t testing.TB, seed int64) (*memnet.Network, *memfs.FS) {
+	fs := memfs.New(seed)
+	grove_ffi.SetFileSystem(fs)
+	n := installNetwork(seed)
+	t.Cleanup(func() { grove_ffi.SetTransport(nil) })
+	return n, fs
+}
+
+// Crashes fs and installs what survived, for restarted replicas to recover
+// from. The replicas from before the crash are still running, so this also
+// installs a fresh network (seeded with seed) on which the restarted ones can
+// listen at the same addresses.
+func Reboot(fs *memfs.FS, seed int64) (*memnet.Network, *memfs.FS) {
+	fs.Crash()
+	rebooted := fs.Reboot()
+	grove_ffi.SetFileSystem(rebooted)
+	return installNetwork(seed), rebooted
+}
@@ -9,33 +9,52 @@ type Config struct {
 	NextMembers []grove_ffi.Address
 }
 
-// Returns some integer i with the property that
-// there exists W such that W contains a majority of members and of nextMembers,
-// and every node n in W has indices[n] >= i.
-// Even more precisely, it returns the largest such i.
-func GetHighestIndexOfQuorum(config *Config, indices map[grove_ffi.Address]uint64) uint64 {
-	// Will fill orderedIndices with indices of config.members, keeping only the
-	// smallest ceil(n/2) values.
-	var orderedIndices = make([]uint64, (len(config.Members)+1)/2)
-	for _, m := range config.Members {
+// Returns the largest i such that a majority of members have indices[n] >= i,
+// or 0 if there are no members.
+func getHighestIndexOfMajority(members []grove_ffi.Address, indices map[grove_ffi.Address]uint64) uint64 {
+	if len(members) == 0 {
+		return 0
+	}
+	// Will fill orderedIndices with indices of members, in increasing order.
+	var orderedIndices = make([]uint64, 0, len(members))
+	for _, m := range members {
 		indexToInsert := indices[m]
 
 		// search for where indexToInsert would belong
-		for i := range orderedIndices {
-			if orderedIndices[i] > indexToInsert {
-				// insert indexToInsert at position i, and move everything else
-				// to the right
-				for j := uint64(i); j < uint64(len(orderedIndices))-1; j += 1 {
-					orderedIndices[i+1] = orderedIndices[i]
-				}
+		var pos = uint64(len(orderedIndices))
+		for i, index := range orderedIndices {
+			if index > indexToInsert {
+				pos = uint64(i)
+				break
 			}
 		}
+		// insert indexToInsert at position pos, and move everything else to
+		// the right
+		orderedIndices = append(orderedIndices, 0)
+		for j := uint64(len(orderedIndices)) - 1; j > pos; j-- {
+			orderedIndices[j] = orderedIndices[j-1]
+		}
+		orderedIndices[pos] = indexToInsert
 	}
-	ret := orderedIndices[len(config.Members)-1]
+	// the members from here on are a majority
+	return orderedIndices[(len(members)-1)/2]
+}
+
+// Returns some integer i with the property that
+// there exists W such that W contains a majority of members and of nextMembers,
+// and every node n in W has indices[n] >= i.
+// Even more precisely, it returns the largest such i.
+func GetHighestIndexOfQuorum(config *Config, indices map[grove_ffi.Address]uint64) uint64 {
+	ret := getHighestIndexOfMajority(config.Members, indices)
 	if len(config.NextMembers) == 0 {
 		return ret
 	}
-	return 0
+	// W can be the union of a majority of each.
+	nextRet := getHighestIndexOfMajority(config.NextMembers, indices)
+	if nextRet < ret {
+		return nextRet
+	}
+	return ret
 }
 
 // Returns true iff w is a (write) quorum for the config `config`.
@@ -88,3 +107,11 @@ func (c *Config) Contains(m grove_ffi.Address) bool {
 	}
 	return ret
 }
+
+func copyMembers(members []grove_ffi.Address) []grove_ffi.Address {
+	return append(make([]grove_ffi.Address, 0, len(members)), members...)
+}
+
+func (c *Config) copy() *Config {
+	return &Config{Members: copyMembers(c.Members), NextMembers: copyMembers(c.NextMembers)}
+}
@@ -0,0 +1,65 @@
+package reconf
+
+import (
+	"testing"
+
+	"github.com/mit-pdos/gokv/grove_ffi"
+)
+
+func TestGetHighestIndexOfQuorum(t *testing.T) {
+	indices := map[grove_ffi.Address]uint64{1: 5, 2: 3, 3: 9, 4: 1, 5: 7, 6: 2}
+	tests := []struct {
+		conf *Config
+		want uint64
+	}{
+		{&Config{Members: []grove_ffi.Address{1}}, 5},
+		{&Config{Members: []grove_ffi.Address{1, 2}}, 3},
+		{&Config{Members: []grove_ffi.Address{1, 2, 3}}, 5},
+		{&Config{Members: []grove_ffi.Address{3, 2, 1}}, 5},
+		{&Config{Members: []grove_ffi.Address{1, 2, 3, 4}}, 3},
+		{&Config{Members: []grove_ffi.Address{1, 2, 3, 4, 5}}, 5},
+		// members without an index count as 0
+		{&Config{Members: []grove_ffi.Address{1, 3, 7}}, 5},
+		{&Config{Members: []grove_ffi.Address{1, 7, 8}}, 0},
+		{&Config{Members: []grove_ffi.Address{1, 2, 3}, NextMembers: []grove_ffi.Address{3, 5}}, 5},
+		{&Config{Members: []grove_ffi.Address{1, 2, 3}, NextMembers: []grove_ffi.Address{4, 5, 6}}, 2},
+		{&Config{Members: []grove_ffi.Address{4, 6}, NextMembers: []grove_ffi.Address{3, 5}}, 1},
+		{&Config{}, 0},
+	}
+	for _, tt := range tests {
+		if got := GetHighestIndexOfQuorum(tt.conf, indices); got != tt.want {
+			t.Errorf("GetHighestIndexOfQuorum(%+v) = %d, want %d", tt.conf, got, tt.want)
+		}
+	}
+}
+
+// GetHighestIndexOfQuorum returns the largest i for which the nodes with
+// indices[n] >= i are a quorum.
+func TestGetHighestIndexOfQuorumMatchesIsQuorum(t *testing.T) {
+	indices := map[grove_ffi.Address]uint64{1: 4, 2: 4, 3: 0, 4: 2, 5: 3, 6: 1}
+	confs := []*Config{
+		{Members: []grove_ffi.Address{1, 2, 3}},
+		{Members: []grove_ffi.Address{1, 2, 3}, NextMembers: []grove_ffi.Address{3, 4, 5, 6}},
+		{Members: []grove_ffi.Address{3, 6}, NextMembers: []grove_ffi.Address{1, 2, 4}},
+	}
+	for _, conf := range confs {
+		got := GetHighestIndexOfQuorum(conf, indices)
+		for i := uint64(0); i <= 5; i++ {
+			w := make(map[grove_ffi.Address]bool)
+			for n, index := range indices {
+				w[n] = index >= i
+			}
+			if IsQuorum(conf, w) != (i <= got) {
+				t.Errorf("%+v: GetHighestIndexOfQuorum is %d, but IsQuorum at %d is %v", conf, got, i, IsQuorum(conf, w))
+			}
+		}
+	}
+}
+
+func TestConfigEncoding(t *testing.T) {
+	conf := &Config{Members: []grove_ffi.Address{1, 2}, NextMembers: []grove_ffi.Address{2, 3, 4}}
+	got, rest := DecConfig(EncConfig(nil, conf))
+	if len(rest) != 0 || len(got.Members) != 2 || len(got.NextMembers) != 3 || got.NextMembers[2] != 4 {
+		t.Fatalf("decoded %+v, want %+v", got, conf)
+	}
+}
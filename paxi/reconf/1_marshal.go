@@ -36,7 +36,7 @@ func DecConfig(encoded []byte) (*Config, []byte) {
 	}
 
 	for i := range conf.NextMembers {
-		conf.Members[i], dec = marshal.ReadInt(dec)
+		conf.NextMembers[i], dec = marshal.ReadInt(dec)
 	}
 	return conf, dec
 }
@@ -114,6 +114,49 @@ func DecProposeArgs(encoded []byte) (*ProposeArgs, []byte) {
 type TryCommitReply struct {
 	err     uint64
 	version uint64
+	conf    *Config // the configuration as of version
+}
+
+// The acceptor state, as kept on disk.
+type replicaState struct {
+	promisedTerm uint64
+	acceptedTerm uint64
+	acceptedMVal *MonotonicValue
+}
+
+func encReplicaState(st *replicaState) []byte {
+	var enc = make([]byte, 0, 8*2)
+	enc = marshal.WriteInt(enc, st.promisedTerm)
+	enc = marshal.WriteInt(enc, st.acceptedTerm)
+	return EncMonotonicValue(enc, st.acceptedMVal)
+}
+
+func decReplicaState(encoded []byte) *replicaState {
+	var dec = encoded
+	st := new(replicaState)
+	st.promisedTerm, dec = marshal.ReadInt(dec)
+	st.acceptedTerm, dec = marshal.ReadInt(dec)
+	st.acceptedMVal, _ = DecMonotonicValue(dec)
+	return st
+}
+
+// The reply to a configuration change or read: an error, followed by the
+// configuration if there was none.
+func encConfigReply(err uint64, conf *Config) []byte {
+	var enc = marshal.WriteInt(make([]byte, 0, 8), err)
+	if err == ENone {
+		enc = EncConfig(enc, conf)
+	}
+	return enc
+}
+
+func decConfigReply(encoded []byte) (uint64, *Config) {
+	err, dec := marshal.ReadInt(encoded)
+	if err != ENone {
+		return err, nil
+	}
+	conf, _ := DecConfig(dec)
+	return err, conf
 }
 
 func EncMembers(members []grove_ffi.Address) []byte {
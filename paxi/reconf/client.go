@@ -3,6 +3,7 @@ package reconf
 import (
 	"github.com/mit-pdos/gokv/connman"
 	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/urpc"
 	"github.com/tchajed/marshal"
 )
 
@@ -15,8 +16,14 @@ const (
 	RPC_PROPOSE           = uint64(1)
 	RPC_TRY_COMMIT_VAL    = uint64(2)
 	RPC_TRY_CONFIG_CHANGE = uint64(3)
+	RPC_ADD_MEMBER        = uint64(4)
+	RPC_REMOVE_MEMBER     = uint64(5)
+	RPC_GET_CONFIG        = uint64(6)
 )
 
+// How many times the clerks send an RPC before giving up with ETimeout.
+const maxAttempts = uint64(3)
+
 func MakeClerkPool() *ClerkPool {
 	return &ClerkPool{cl: connman.MakeConnMan()}
 }
@@ -24,36 +31,110 @@ func MakeClerkPool() *ClerkPool {
 func (ck *ClerkPool) PrepareRPC(srv grove_ffi.Address, newTerm uint64, reply_ptr *PrepareReply) {
 	raw_reply := new([]byte)
 
-	// FIXME: this should be allowed to give up, rather than loop forever
-	ck.cl.CallAtLeastOnce(srv, RPC_PREPARE, marshal.WriteInt(make([]byte, 0), newTerm), raw_reply, 10 /* ms */)
-	*reply_ptr = *DecPrepareReply(*raw_reply)
+	err := ck.cl.CallWithRetries(srv, RPC_PREPARE, marshal.WriteInt(make([]byte, 0), newTerm), raw_reply, 100 /* ms */, maxAttempts)
+	if err == urpc.ErrNone {
+		*reply_ptr = *DecPrepareReply(*raw_reply)
+	} else {
+		reply_ptr.Err = ETimeout
+	}
 }
 
-func (ck *ClerkPool) ProposeRPC(srv grove_ffi.Address, term uint64, val *MonotonicValue) bool {
+func (ck *ClerkPool) ProposeRPC(srv grove_ffi.Address, term uint64, val *MonotonicValue) uint64 {
 	args := &ProposeArgs{Term: term, Val: val}
 	raw_reply := new([]byte)
 
-	// FIXME: this should be allowed to give up, rather than loop forever
-	ck.cl.CallAtLeastOnce(srv, RPC_PROPOSE, EncProposeArgs(args), raw_reply, 10 /* ms */)
-	err, _ := marshal.ReadInt(*raw_reply)
-	return err == 0
+	err := ck.cl.CallWithRetries(srv, RPC_PROPOSE, EncProposeArgs(args), raw_reply, 100 /* ms */, maxAttempts)
+	if err != urpc.ErrNone {
+		return ETimeout
+	}
+	e, _ := marshal.ReadInt(*raw_reply)
+	return e
 }
 
-func (ck *ClerkPool) TryCommitVal(srv grove_ffi.Address, v []byte) bool {
+func (ck *ClerkPool) TryCommitVal(srv grove_ffi.Address, v []byte) uint64 {
 	raw_reply := new([]byte)
 
-	// FIXME: this should be allowed to give up, rather than loop forever
-	ck.cl.CallAtLeastOnce(srv, RPC_TRY_COMMIT_VAL, v, raw_reply, 1000 /* ms */)
-	err, _ := marshal.ReadInt(*raw_reply)
-	return err == 0
+	err := ck.cl.CallWithRetries(srv, RPC_TRY_COMMIT_VAL, v, raw_reply, 2000 /* ms */, 1)
+	if err != urpc.ErrNone {
+		return ETimeout
+	}
+	e, _ := marshal.ReadInt(*raw_reply)
+	return e
 }
 
-func (ck *ClerkPool) TryConfigChange(srv grove_ffi.Address, newMembers []grove_ffi.Address) bool {
-	raw_args := EncMembers(newMembers)
+// The configuration changes wait for three commits, and possibly an election.
+func (ck *ClerkPool) configCall(srv grove_ffi.Address, rpcid uint64, raw_args []byte) (uint64, *Config) {
 	raw_reply := new([]byte)
 
-	// FIXME: this should be allowed to give up, rather than loop forever
-	ck.cl.CallAtLeastOnce(srv, RPC_TRY_CONFIG_CHANGE, raw_args, raw_reply, 50 /* ms */)
-	err, _ := marshal.ReadInt(*raw_reply)
-	return err == 0
+	err := ck.cl.CallWithRetries(srv, rpcid, raw_args, raw_reply, 5000 /* ms */, 1)
+	if err != urpc.ErrNone {
+		return ETimeout, nil
+	}
+	return decConfigReply(*raw_reply)
+}
+
+func (ck *ClerkPool) TryConfigChange(srv grove_ffi.Address, newMembers []grove_ffi.Address) (uint64, *Config) {
+	return ck.configCall(srv, RPC_TRY_CONFIG_CHANGE, EncMembers(newMembers))
+}
+
+func (ck *ClerkPool) AddMember(srv grove_ffi.Address, m grove_ffi.Address) (uint64, *Config) {
+	return ck.configCall(srv, RPC_ADD_MEMBER, marshal.WriteInt(make([]byte, 0, 8), m))
+}
+
+func (ck *ClerkPool) RemoveMember(srv grove_ffi.Address, m grove_ffi.Address) (uint64, *Config) {
+	return ck.configCall(srv, RPC_REMOVE_MEMBER, marshal.WriteInt(make([]byte, 0, 8), m))
+}
+
+func (ck *ClerkPool) GetConfig(srv grove_ffi.Address) (uint64, *Config) {
+	return ck.configCall(srv, RPC_GET_CONFIG, make([]byte, 0))
+}
+
+// For changing the membership. Each request goes to the replica that last
+// handled one, or else to each of hosts in turn, which becomes the leader if it
+// isn't already.
+type AdminClerk struct {
+	ck     *ClerkPool
+	hosts  []grove_ffi.Address
+	leader uint64
+}
+
+func MakeAdminClerk(hosts []grove_ffi.Address) *AdminClerk {
+	return &AdminClerk{ck: MakeClerkPool(), hosts: hosts}
+}
+
+// Tries f on each host, starting with the last leader, until one succeeds.
+// Returns the last error if none does.
+func (a *AdminClerk) call(f func(grove_ffi.Address) (uint64, *Config)) (uint64, *Config) {
+	var err = ETimeout
+	var conf *Config
+	n := uint64(len(a.hosts))
+	for i := uint64(0); i < n; i++ {
+		j := (a.leader + i) % n
+		err, conf = f(a.hosts[j])
+		if err == ENone || err == EEmptyConfig {
+			a.leader = j
+			break
+		}
+	}
+	return err, conf
+}
+
+// Adds m to the members, returning the new configuration.
+func (a *AdminClerk) AddMember(m grove_ffi.Address) (uint64, *Config) {
+	return a.call(func(srv grove_ffi.Address) (uint64, *Config) {
+		return a.ck.AddMember(srv, m)
+	})
+}
+
+// Removes m from the members, returning the new configuration.
+func (a *AdminClerk) RemoveMember(m grove_ffi.Address) (uint64, *Config) {
+	return a.call(func(srv grove_ffi.Address) (uint64, *Config) {
+		return a.ck.RemoveMember(srv, m)
+	})
+}
+
+func (a *AdminClerk) GetConfig() (uint64, *Config) {
+	return a.call(func(srv grove_ffi.Address) (uint64, *Config) {
+		return a.ck.GetConfig(srv)
+	})
 }
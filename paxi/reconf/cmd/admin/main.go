@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/paxi/reconf"
+)
+
+func addrsToStrs(addrs []grove_ffi.Address) []string {
+	strs := make([]string, 0)
+	for _, addr := range addrs {
+		strs = append(strs, grove_ffi.AddressToStr(addr))
+	}
+	return strs
+}
+
+func main() {
+	var serversStr string
+	flag.StringVar(&serversStr, "servers", "", "comma-separated addresses of the replicas to send requests to")
+	flag.Parse()
+
+	usage_assert := func(b bool) {
+		if !b {
+			flag.PrintDefaults()
+			fmt.Println("Must provide command in form:")
+			fmt.Println(" add host")
+			fmt.Println(" remove host")
+			fmt.Println(" getconf")
+			os.Exit(1)
+		}
+	}
+
+	usage_assert(serversStr != "")
+	servers := make([]grove_ffi.Address, 0)
+	for _, srvStr := range strings.Split(serversStr, ",") {
+		servers = append(servers, grove_ffi.MakeAddress(srvStr))
+	}
+	ck := reconf.MakeAdminClerk(servers)
+
+	a := flag.Args()
+	usage_assert(len(a) > 0)
+	var err uint64
+	var conf *reconf.Config
+	if a[0] == "add" {
+		usage_assert(len(a) == 2)
+		err, conf = ck.AddMember(grove_ffi.MakeAddress(a[1]))
+	} else if a[0] == "remove" {
+		usage_assert(len(a) == 2)
+		err, conf = ck.RemoveMember(grove_ffi.MakeAddress(a[1]))
+	} else if a[0] == "getconf" {
+		err, conf = ck.GetConfig()
+	} else {
+		usage_assert(false)
+	}
+	if err != reconf.ENone {
+		fmt.Printf("Failed: %d\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Configuration is: %v\n", addrsToStrs(conf.Members))
+}
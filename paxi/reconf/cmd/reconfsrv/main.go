@@ -0,0 +1,33 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/paxi/reconf"
+)
+
+func main() {
+	var me string
+	var fname string
+	flag.StringVar(&me, "me", "", "address to listen on")
+	flag.StringVar(&fname, "filename", "reconf.data", "file with the replica's durable state")
+	flag.Parse()
+
+	if me == "" || len(flag.Args()) == 0 {
+		flag.PrintDefaults()
+		fmt.Println("Must provide the initial members (used if there's no durable state yet): host1 [host2 ...]")
+		os.Exit(1)
+	}
+
+	initConfig := &reconf.Config{Members: make([]grove_ffi.Address, 0)}
+	for _, srvStr := range flag.Args() {
+		initConfig.Members = append(initConfig.Members, grove_ffi.MakeAddress(srvStr))
+	}
+	reconf.StartReplicaServer(fname, grove_ffi.MakeAddress(me), initConfig)
+	log.Printf("Started replica on %s", me)
+	select {}
+}
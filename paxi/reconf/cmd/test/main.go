@@ -1,9 +1,11 @@
 package main
 
 import (
+	"fmt"
+	"log"
+
 	"github.com/mit-pdos/gokv/grove_ffi"
 	"github.com/mit-pdos/gokv/paxi/reconf"
-	"log"
 )
 
 func main() {
@@ -23,12 +25,24 @@ func main() {
 
 	initConfig := &reconf.Config{Members: srvs[:3]}
 
-	for _, addr := range srvs {
-		reconf.StartReplicaServer(addr, initConfig)
+	for i, addr := range srvs {
+		reconf.StartReplicaServer(fmt.Sprintf("reconf%d.data", i), addr, initConfig)
 	}
 
 	ck := reconf.MakeClerkPool()
-	if ck.TryCommitVal(srvs[0], []byte("Hello!")) == false {
+	if ck.TryCommitVal(srvs[0], []byte("Hello!")) != reconf.ENone {
 		log.Fatal("Unable to commit")
 	}
+
+	admin := reconf.MakeAdminClerk(srvs)
+	err, conf := admin.AddMember(srvs[3])
+	if err != reconf.ENone {
+		log.Fatalf("Unable to add member: %d", err)
+	}
+	log.Printf("Added member; config is %+v", conf)
+	err, conf = admin.RemoveMember(srvs[0])
+	if err != reconf.ENone {
+		log.Fatalf("Unable to remove member: %d", err)
+	}
+	log.Printf("Removed member; config is %+v", conf)
 }
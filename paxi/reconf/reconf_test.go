@@ -0,0 +1,100 @@
+package reconf_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/paxi/paxitest"
+	"github.com/mit-pdos/gokv/paxi/reconf"
+)
+
+func makeServers(n int) []grove_ffi.Address {
+	srvs := make([]grove_ffi.Address, n)
+	for i := range srvs {
+		srvs[i] = grove_ffi.MakeAddress(fmt.Sprintf("10.0.4.%d:1", i+1))
+	}
+	return srvs
+}
+
+func startServers(srvs []grove_ffi.Address, initConfig *reconf.Config) {
+	for i, srv := range srvs {
+		reconf.StartReplicaServer(fmt.Sprintf("reconf%d", i), srv, initConfig)
+	}
+}
+
+func checkConfig(t *testing.T, err uint64, conf *reconf.Config, want []grove_ffi.Address) {
+	t.Helper()
+	if err != reconf.ENone {
+		t.Fatalf("error %d", err)
+	}
+	if len(conf.NextMembers) != 0 || len(conf.Members) != len(want) {
+		t.Fatalf("configuration is %+v, want members %v", conf, want)
+	}
+	for _, m := range want {
+		if !conf.Contains(m) {
+			t.Fatalf("configuration is %+v, want members %v", conf, want)
+		}
+	}
+}
+
+// Adds and removes members; once a member is removed, the rest can go on
+// without it.
+func TestAddRemoveMembers(t *testing.T) {
+	n, _ := paxitest.Start(t, 1)
+
+	srvs := makeServers(5)
+	startServers(srvs, &reconf.Config{Members: srvs[:3]})
+
+	ck := reconf.MakeClerkPool()
+	if err := ck.TryCommitVal(srvs[0], []byte("Hello!")); err != reconf.ENone {
+		t.Fatalf("TryCommitVal: %d", err)
+	}
+
+	admin := reconf.MakeAdminClerk(srvs)
+	err, conf := admin.AddMember(srvs[3])
+	checkConfig(t, err, conf, srvs[:4])
+	err, conf = admin.AddMember(srvs[4])
+	checkConfig(t, err, conf, srvs)
+	err, conf = admin.RemoveMember(srvs[0])
+	checkConfig(t, err, conf, srvs[1:])
+	err, conf = admin.RemoveMember(srvs[1])
+	checkConfig(t, err, conf, srvs[2:])
+
+	// the first two servers aren't needed any more, even to elect a new leader
+	n.Isolate(srvs[0])
+	n.Isolate(srvs[1])
+	if err := ck.TryCommitVal(srvs[2], []byte("Goodbye!")); err != reconf.ENone {
+		t.Fatalf("TryCommitVal after removing members: %d", err)
+	}
+	admin = reconf.MakeAdminClerk(srvs[2:])
+	err, conf = admin.GetConfig()
+	checkConfig(t, err, conf, srvs[2:])
+
+	err, conf = admin.RemoveMember(srvs[2])
+	checkConfig(t, err, conf, srvs[3:])
+	err, conf = admin.RemoveMember(srvs[3])
+	checkConfig(t, err, conf, srvs[4:])
+	if err, _ := admin.RemoveMember(srvs[4]); err != reconf.EEmptyConfig {
+		t.Fatalf("removing the last member: %d, want EEmptyConfig", err)
+	}
+}
+
+// Replicas recover the configuration after a crash, rather than starting over
+// with the initial one.
+func TestConfigSurvivesCrash(t *testing.T) {
+	_, fs := paxitest.Start(t, 2)
+
+	srvs := makeServers(4)
+	initConfig := &reconf.Config{Members: srvs[:3]}
+	startServers(srvs, initConfig)
+	err, conf := reconf.MakeAdminClerk(srvs).AddMember(srvs[3])
+	checkConfig(t, err, conf, srvs)
+
+	// restart every replica
+	paxitest.Reboot(fs, 3)
+	startServers(srvs, initConfig)
+
+	err, conf = reconf.MakeAdminClerk(srvs[1:]).GetConfig()
+	checkConfig(t, err, conf, srvs)
+}
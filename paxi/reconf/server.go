@@ -1,19 +1,27 @@
 package reconf
 
 import (
+	"log/slog"
+	"sync"
+
 	"github.com/goose-lang/primitive"
+	"github.com/mit-pdos/gokv/asyncfile"
 	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/logging"
 	"github.com/mit-pdos/gokv/urpc"
 	"github.com/tchajed/marshal"
-	"log"
-	"sync"
-	// "github.com/davecgh/go-spew/spew"
 )
 
+var logger = logging.For("reconf")
+
 func (lhs *MonotonicValue) GreaterThan(rhs *MonotonicValue) bool {
 	return lhs.version > rhs.version
 }
 
+func (v *MonotonicValue) clone() *MonotonicValue {
+	return &MonotonicValue{version: v.version, val: v.val, conf: v.conf.copy()}
+}
+
 type Replica struct {
 	mu           *sync.Mutex
 	promisedTerm uint64
@@ -21,11 +29,19 @@ type Replica struct {
 	acceptedTerm uint64
 	acceptedMVal *MonotonicValue
 
+	storage *asyncfile.AsyncFile
+
 	clerkPool *ClerkPool
 
 	isLeader bool
 	// Leader state
-	// acceptedVersions map[grove_ffi.Address]uint64
+	// the last value proposed in promisedTerm; the next one is built from it
+	proposedMVal     *MonotonicValue
+	acceptedVersions map[grove_ffi.Address]uint64
+	// signalled when acceptedVersions changes, or the leader steps down
+	acceptedCond *sync.Cond
+
+	log *slog.Logger
 }
 
 const (
@@ -33,73 +49,112 @@ const (
 	ETermStale    = uint64(1)
 	ENotLeader    = uint64(2)
 	EQuorumFailed = uint64(3)
+	ETimeout      = uint64(4)
+	// The configuration change would leave no members.
+	EEmptyConfig = uint64(5)
 )
 
-func (r *Replica) PrepareRPC(term uint64, reply *PrepareReply) {
+// How long to wait for a quorum to reply, in TryBecomeLeader and tryCommit.
+const quorumTimeoutMs = uint64(1000)
+
+// Runs f with r.mu held, and then waits (without it) for the acceptor state to
+// be durable.
+func (r *Replica) withLock(f func()) {
 	r.mu.Lock()
-	if term > r.promisedTerm {
-		r.promisedTerm = term
-		reply.Term = r.acceptedTerm
-		reply.Val = r.acceptedMVal
-		reply.Err = ENone
-	} else {
-		reply.Err = ETermStale
-		reply.Val = new(MonotonicValue)
-		reply.Val.conf = new(Config)
-		reply.Term = r.promisedTerm
-	}
+	f()
+	waitFn := r.storage.Write(encReplicaState(&replicaState{
+		promisedTerm: r.promisedTerm,
+		acceptedTerm: r.acceptedTerm,
+		acceptedMVal: r.acceptedMVal,
+	}))
 	r.mu.Unlock()
+	waitFn()
+}
+
+// Requires r.mu.
+func (r *Replica) stepDown() {
+	if r.isLeader {
+		r.isLeader = false
+		r.acceptedCond.Broadcast()
+	}
+}
+
+func (r *Replica) PrepareRPC(term uint64, reply *PrepareReply) {
+	r.withLock(func() {
+		if term > r.promisedTerm {
+			r.promisedTerm = term
+			r.stepDown()
+			reply.Term = r.acceptedTerm
+			reply.Val = r.acceptedMVal
+			reply.Err = ENone
+		} else {
+			reply.Err = ETermStale
+			reply.Val = new(MonotonicValue)
+			reply.Val.conf = new(Config)
+			reply.Term = r.promisedTerm
+		}
+	})
 }
 
 func (r *Replica) ProposeRPC(term uint64, v *MonotonicValue) uint64 {
-	r.mu.Lock()
-	if term >= r.promisedTerm {
-		r.promisedTerm = term
-		r.acceptedTerm = term
-		if v.GreaterThan(r.acceptedMVal) {
-			r.acceptedMVal = v
+	var err = ENone
+	r.withLock(func() {
+		if term >= r.promisedTerm {
+			if term > r.promisedTerm {
+				r.promisedTerm = term
+				r.stepDown()
+			}
+			// A value from a later term replaces ours even if its version is
+			// lower: ours was never committed.
+			if term > r.acceptedTerm || v.GreaterThan(r.acceptedMVal) {
+				r.acceptedTerm = term
+				r.acceptedMVal = v
+			}
+		} else {
+			err = ETermStale
 		}
-		r.mu.Unlock()
-		return ENone
-	} else {
-		r.mu.Unlock()
-		return ETermStale
-	}
+	})
+	return err
 }
 
 func (r *Replica) TryBecomeLeader() bool {
 	r.mu.Lock()
 	newTerm := r.promisedTerm + 1 // don't need to bother incrementing; will invoke RPC on ourselves
-	r.promisedTerm = newTerm
-
-	var highestTerm uint64
-	highestTerm = 0
-	var highestVal *MonotonicValue
-	highestVal = r.acceptedMVal // if no one in our majority has accepted a value, we'll propose this one
 	conf := r.acceptedMVal.conf
 	r.mu.Unlock()
 
 	mu := new(sync.Mutex)
+	cond := sync.NewCond(mu)
 
+	var highestTerm uint64
+	highestTerm = 0
+	var highestVal *MonotonicValue
 	prepared := make(map[grove_ffi.Address]bool)
-
-	conf.ForEachMember(func(addr grove_ffi.Address) {
+	contacted := make(map[grove_ffi.Address]bool)
+	var numContacted uint64
+	var numReplies uint64
+
+	// Requires mu.
+	prepare := func(addr grove_ffi.Address) {
+		if contacted[addr] {
+			return
+		}
+		contacted[addr] = true
+		numContacted += 1
 		go func() {
 			reply_ptr := new(PrepareReply)
 			r.clerkPool.PrepareRPC(addr, newTerm, reply_ptr)
 
+			mu.Lock()
+			numReplies += 1
 			if reply_ptr.Err == ENone {
-				mu.Lock()
 				prepared[addr] = true
 
-				if reply_ptr.Term > highestTerm {
+				if highestVal == nil || reply_ptr.Term > highestTerm ||
+					(reply_ptr.Term == highestTerm && reply_ptr.Val.GreaterThan(highestVal)) {
+					highestTerm = reply_ptr.Term
 					highestVal = reply_ptr.Val
-				} else if reply_ptr.Term == highestTerm {
-					if highestVal.GreaterThan(reply_ptr.Val) {
-						highestVal = reply_ptr.Val
-					}
 				}
-				mu.Unlock()
 			} else {
 				// If we did the following, then whenever a single other node
 				// has a higher term number than us, we would just give up on
@@ -110,31 +165,55 @@ func (r *Replica) TryBecomeLeader() bool {
 				// r.promisedTerm = reply_ptr.Term
 				// }
 			}
+			cond.Signal()
+			mu.Unlock()
 		}()
-	})
+	}
 
-	// FIXME: put this in a condvar loop with timeout
-	primitive.Sleep(50 * 1_000_000) // 50 ms
+	deadline := primitive.TimeNow() + quorumTimeoutMs*1_000_000
 	mu.Lock()
-	if IsQuorum(highestVal.conf, prepared) {
-		// We successfully became the leader
-		r.mu.Lock()
-		if r.promisedTerm == newTerm {
-			r.acceptedMVal = highestVal
-			r.isLeader = true
-			// r.acceptedIndices = make(map[grove_ffi.Address]uint64)
+	conf.ForEachMember(prepare)
+	for {
+		if highestVal != nil {
+			if IsQuorum(highestVal.conf, prepared) {
+				break
+			}
+			// The value might be from a later configuration than the one we
+			// knew about; its members are the ones whose votes count.
+			highestVal.conf.ForEachMember(prepare)
+		}
+		now := primitive.TimeNow()
+		if numReplies == numContacted || now >= deadline {
+			mu.Unlock()
+			return false
 		}
+		primitive.WaitTimeout(cond, (deadline-now)/1_000_000+1)
+	}
+
+	// We successfully became the leader, unless someone has since started
+	// another term.
+	// RULE: lock r.mu after mu
+	r.mu.Lock()
+	if r.promisedTerm > newTerm {
 		r.mu.Unlock()
 		mu.Unlock()
-		return true
+		return false
 	}
+	r.promisedTerm = newTerm
+	r.isLeader = true
+	r.proposedMVal = highestVal.clone()
+	r.acceptedVersions = make(map[grove_ffi.Address]uint64)
+	r.mu.Unlock()
 	mu.Unlock()
-	return false
+	r.log.Info("became leader", "term", newTerm)
+	return true
 }
 
-// Returns true iff there was an error;
-// The error is either that r is not currently a primary, or that r was unable
-// to commit the value within one round of commits.
+// Tries to commit a new version of the value, made by mvalModifier from the
+// last one this leader proposed, waiting for a quorum of its configuration to
+// accept it. The error is ENotLeader if r is not currently the leader (or stops
+// being it), and EQuorumFailed if r was unable to commit the value within the
+// timeout.
 //
 // mvalModifier is not allowed to modify the version number in the given mval.
 func (r *Replica) tryCommit(mvalModifier func(*MonotonicValue), reply *TryCommitReply) {
@@ -144,55 +223,73 @@ func (r *Replica) tryCommit(mvalModifier func(*MonotonicValue), reply *TryCommit
 		reply.err = ENotLeader
 		return
 	}
-	mvalModifier(r.acceptedMVal)
-	// if !r.acceptedMVal.conf.Contains(r.me) {
-	// I don't think we need to do this; even if the new configuration we're
-	// going to doesn't contain us, we're still the leader of this term. In
-	// fact, I think we can even commit new entries even if we're not
-	// actually in the config!
-	// r.isLeader = false
-	// }
-
-	log.Printf("Trying to commit value; node state: %+v\n", r)
-	// spew.Printf("MVal state: %+v\n", r.acceptedMVal)
-
-	r.acceptedMVal.version += 1
+	mval := r.proposedMVal.clone()
+	mvalModifier(mval)
+	// Even if the new configuration we're going to doesn't contain us, we're
+	// still the leader of this term. In fact, we can even commit new values
+	// even if we're not actually in the config!
+	mval.version = r.proposedMVal.version + 1
+	r.proposedMVal = mval
 	term := r.promisedTerm
-	mval := r.acceptedMVal
+	acceptedVersions := r.acceptedVersions
 	r.mu.Unlock()
 
-	mu := new(sync.Mutex)
-	accepted := make(map[grove_ffi.Address]bool)
-
 	mval.conf.ForEachMember(func(addr grove_ffi.Address) {
 		go func() {
-			if r.clerkPool.ProposeRPC(addr, term, mval) {
-				mu.Lock()
-				accepted[addr] = true
-				mu.Unlock()
+			err := r.clerkPool.ProposeRPC(addr, term, mval)
+			r.mu.Lock()
+			if err == ENone {
+				// accepting a later version (from this term) also counts,
+				// since it was built from this one
+				if acceptedVersions[addr] < mval.version {
+					acceptedVersions[addr] = mval.version
+				}
+				r.acceptedCond.Broadcast()
+			} else if err == ETermStale && r.promisedTerm == term {
+				r.stepDown()
 			}
+			r.mu.Unlock()
 		}()
 	})
 
-	// FIXME: put this in a condvar loop with timeout
-	primitive.Sleep(100 * 1_000_000) // 100ms
-	mu.Lock()
-	if IsQuorum(mval.conf, accepted) {
-		reply.err = ENone
-		reply.version = mval.version
-	} else {
-		reply.err = EQuorumFailed
+	deadline := primitive.TimeNow() + quorumTimeoutMs*1_000_000
+	r.mu.Lock()
+	for GetHighestIndexOfQuorum(mval.conf, acceptedVersions) < mval.version {
+		now := primitive.TimeNow()
+		if !r.isLeader || r.promisedTerm != term {
+			reply.err = ENotLeader
+			r.mu.Unlock()
+			return
+		}
+		if now >= deadline {
+			reply.err = EQuorumFailed
+			r.mu.Unlock()
+			return
+		}
+		primitive.WaitTimeout(r.acceptedCond, (deadline-now)/1_000_000+1)
 	}
-	log.Printf("Result of trying to commit: %+v\n", reply)
+	r.mu.Unlock()
+	reply.err = ENone
+	reply.version = mval.version
+	reply.conf = mval.conf
 }
 
-func (r *Replica) TryCommitVal(v []byte, reply *TryCommitReply) {
+// Becomes the leader if r isn't already.
+func (r *Replica) ensureLeader() bool {
 	r.mu.Lock()
 	if !r.isLeader {
 		r.mu.Unlock()
-		r.TryBecomeLeader()
+		return r.TryBecomeLeader()
 	} else {
 		r.mu.Unlock()
+		return true
+	}
+}
+
+func (r *Replica) TryCommitVal(v []byte, reply *TryCommitReply) {
+	if !r.ensureLeader() {
+		reply.err = ENotLeader
+		return
 	}
 
 	r.tryCommit(func(mval *MonotonicValue) {
@@ -200,31 +297,111 @@ func (r *Replica) TryCommitVal(v []byte, reply *TryCommitReply) {
 	}, reply)
 }
 
-// requires that newConfig has overlapping quorums with r.config
-func (r *Replica) TryEnterNewConfig(newMembers []grove_ffi.Address) {
-	reply := new(TryCommitReply)
+// Finishes any configuration change in progress.
+func (r *Replica) leaveJointConfig(reply *TryCommitReply) {
 	r.tryCommit(func(mval *MonotonicValue) {
-		if len(mval.conf.NextMembers) == 0 {
-			mval.conf.NextMembers = newMembers
+		if len(mval.conf.NextMembers) != 0 {
+			mval.conf.Members = mval.conf.NextMembers
+			mval.conf.NextMembers = make([]grove_ffi.Address, 0)
 		}
 	}, reply)
+}
 
+// Changes the members to newMembers(current members), by way of a joint
+// configuration with both; if some other change is in progress, finishes that
+// one first. The reply has the final configuration.
+func (r *Replica) changeMembers(newMembers func([]grove_ffi.Address) []grove_ffi.Address, reply *TryCommitReply) {
+	if !r.ensureLeader() {
+		reply.err = ENotLeader
+		return
+	}
+	r.leaveJointConfig(reply)
+	if reply.err != ENone {
+		return
+	}
+
+	var empty = false
 	r.tryCommit(func(mval *MonotonicValue) {
-		if len(mval.conf.NextMembers) != 0 {
-			mval.conf.Members = mval.conf.NextMembers
-			mval.conf.NextMembers = make([]grove_ffi.Address, 0)
+		if len(mval.conf.NextMembers) == 0 {
+			next := newMembers(copyMembers(mval.conf.Members))
+			if len(next) == 0 {
+				// NextMembers being empty means there's no change in progress
+				empty = true
+			} else {
+				mval.conf.NextMembers = next
+			}
+		}
+	}, reply)
+	if reply.err != ENone {
+		return
+	}
+	if empty {
+		reply.err = EEmptyConfig
+		return
+	}
+	r.leaveJointConfig(reply)
+}
+
+// requires that newConfig has overlapping quorums with r.config
+func (r *Replica) TryEnterNewConfig(newMembers []grove_ffi.Address, reply *TryCommitReply) {
+	r.changeMembers(func(_ []grove_ffi.Address) []grove_ffi.Address {
+		return newMembers
+	}, reply)
+}
+
+func (r *Replica) AddMember(m grove_ffi.Address, reply *TryCommitReply) {
+	r.changeMembers(func(members []grove_ffi.Address) []grove_ffi.Address {
+		if (&Config{Members: members}).Contains(m) {
+			return members
 		}
+		return append(members, m)
 	}, reply)
 }
 
-func StartReplicaServer(me grove_ffi.Address, initConfig *Config) {
+func (r *Replica) RemoveMember(m grove_ffi.Address, reply *TryCommitReply) {
+	r.changeMembers(func(members []grove_ffi.Address) []grove_ffi.Address {
+		var ret = make([]grove_ffi.Address, 0)
+		for _, member := range members {
+			if member != m {
+				ret = append(ret, member)
+			}
+		}
+		return ret
+	}, reply)
+}
+
+// Gets the current configuration, by committing the value again (so that no
+// other leader can have changed it).
+func (r *Replica) GetConfig(reply *TryCommitReply) {
+	if !r.ensureLeader() {
+		reply.err = ENotLeader
+		return
+	}
+	r.tryCommit(func(mval *MonotonicValue) {}, reply)
+}
+
+// Starts a replica, keeping its durable state in fname; if there isn't any, it
+// starts out with initConfig.
+func StartReplicaServer(fname string, me grove_ffi.Address, initConfig *Config) *Replica {
 	s := new(Replica)
 
 	s.mu = new(sync.Mutex)
-	s.promisedTerm = 0
-	s.acceptedTerm = 0
-	s.acceptedMVal = new(MonotonicValue)
-	s.acceptedMVal.conf = initConfig
+	s.acceptedCond = sync.NewCond(s.mu)
+	s.log = logger.With("server", grove_ffi.AddressToStr(me))
+
+	var encstate []byte
+	encstate, s.storage = asyncfile.MakeAsyncFile(fname)
+	if len(encstate) == 0 {
+		s.promisedTerm = 0
+		s.acceptedTerm = 0
+		s.acceptedMVal = new(MonotonicValue)
+		s.acceptedMVal.conf = initConfig
+	} else {
+		st := decReplicaState(encstate)
+		s.promisedTerm = st.promisedTerm
+		s.acceptedTerm = st.acceptedTerm
+		s.acceptedMVal = st.acceptedMVal
+	}
 
 	s.clerkPool = MakeClerkPool()
 	s.isLeader = false
@@ -235,7 +412,6 @@ func StartReplicaServer(me grove_ffi.Address, initConfig *Config) {
 		reply := new(PrepareReply)
 		s.PrepareRPC(term, reply)
 		*raw_reply = EncPrepareReply(make([]byte, 0), reply)
-		DecPrepareReply(*raw_reply)
 	}
 
 	handlers[RPC_PROPOSE] = func(raw_args []byte, raw_reply *[]byte) {
@@ -245,7 +421,6 @@ func StartReplicaServer(me grove_ffi.Address, initConfig *Config) {
 	}
 
 	handlers[RPC_TRY_COMMIT_VAL] = func(raw_args []byte, raw_reply *[]byte) {
-		log.Println("RPC_TRY_COMMIT_VAL")
 		val := raw_args
 		reply := new(TryCommitReply)
 		s.TryCommitVal(val, reply)
@@ -254,10 +429,32 @@ func StartReplicaServer(me grove_ffi.Address, initConfig *Config) {
 
 	handlers[RPC_TRY_CONFIG_CHANGE] = func(raw_args []byte, raw_reply *[]byte) {
 		args, _ := DecMembers(raw_args)
-		s.TryEnterNewConfig(args)
-		*raw_reply = make([]byte, 0)
+		reply := new(TryCommitReply)
+		s.TryEnterNewConfig(args, reply)
+		*raw_reply = encConfigReply(reply.err, reply.conf)
+	}
+
+	handlers[RPC_ADD_MEMBER] = func(raw_args []byte, raw_reply *[]byte) {
+		m, _ := marshal.ReadInt(raw_args)
+		reply := new(TryCommitReply)
+		s.AddMember(m, reply)
+		*raw_reply = encConfigReply(reply.err, reply.conf)
+	}
+
+	handlers[RPC_REMOVE_MEMBER] = func(raw_args []byte, raw_reply *[]byte) {
+		m, _ := marshal.ReadInt(raw_args)
+		reply := new(TryCommitReply)
+		s.RemoveMember(m, reply)
+		*raw_reply = encConfigReply(reply.err, reply.conf)
+	}
+
+	handlers[RPC_GET_CONFIG] = func(raw_args []byte, raw_reply *[]byte) {
+		reply := new(TryCommitReply)
+		s.GetConfig(reply)
+		*raw_reply = encConfigReply(reply.err, reply.conf)
 	}
 
 	r := urpc.MakeServer(handlers)
 	r.Serve(me)
+	return s
 }
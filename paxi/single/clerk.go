@@ -1,22 +1,83 @@
 package single
 
 import (
-	"github.com/mit-pdos/gokv/urpc"
+	"sync"
+
+	"github.com/goose-lang/primitive"
+	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/reconnectclient"
+	"github.com/tchajed/marshal"
 )
 
-type Clerk struct {
-	cl *urpc.Client
+// How a proposer reaches one of its peers for the two phases of Decide. A peer
+// that doesn't answer in time counts as ETimeout, i.e. as neither promising nor
+// accepting.
+type singleClerk struct {
+	cl *reconnectclient.ReconnectingClient
 }
 
-func MakeClerk(host uint64) *Clerk {
-	return &Clerk{cl: urpc.MakeClient(host)}
+func makeSingleClerk(host grove_ffi.Address) *singleClerk {
+	return &singleClerk{cl: reconnectclient.MakeReconnectingClient(host)}
+}
+
+func (ck *singleClerk) prepare(pn uint64) *PrepareReply {
+	rawRep := new([]byte)
+	err := ck.cl.Call(PREPARE, marshal.WriteInt(make([]byte, 0, 8), pn), rawRep, 100 /* ms */)
+	if err == 0 {
+		return decodePrepareReply(*rawRep)
+	} else {
+		return &PrepareReply{Err: ETimeout}
+	}
+}
+
+func (ck *singleClerk) propose(args *ProposeArgs) Error {
+	rawRep := new([]byte)
+	err := ck.cl.Call(PROPOSE, encodeProposeArgs(args), rawRep, 100 /* ms */)
+	if err == 0 {
+		e, _ := marshal.ReadInt(*rawRep)
+		return e
+	} else {
+		return ETimeout
+	}
+}
+
+// A client of the register.
+type Clerk struct {
+	mu   *sync.Mutex
+	cls  []*reconnectclient.ReconnectingClient
+	next uint64 // the replica to try first
 }
 
-func (ck *Clerk) Prepare(pn uint64, reply *PrepareReply) {
-	// pass
+func MakeClerk(hosts []grove_ffi.Address) *Clerk {
+	ck := &Clerk{mu: new(sync.Mutex), cls: make([]*reconnectclient.ReconnectingClient, len(hosts))}
+	for i, host := range hosts {
+		ck.cls[i] = reconnectclient.MakeReconnectingClient(host)
+	}
+	return ck
 }
 
-func (ck *Clerk) Propose(Pn uint64, Val ValType) bool {
-	// pass
-	return false
+// Tries to decide v, and returns the value that is decided: v, or whatever was
+// decided before. Retries, with each replica in turn, until some replica gets a
+// value decided.
+func (ck *Clerk) Decide(v ValType) ValType {
+	ck.mu.Lock()
+	var i = ck.next
+	ck.mu.Unlock()
+	for {
+		rawRep := new([]byte)
+		err := ck.cls[i].Call(DECIDE, v, rawRep, 2000 /* ms */)
+		if err == 0 {
+			e, ret := decodeDecideReply(*rawRep)
+			if e == ENone {
+				ck.mu.Lock()
+				ck.next = i
+				ck.mu.Unlock()
+				return ret
+			}
+		}
+		// back off for a random while, so that replicas trying at the same
+		// time don't keep getting in each other's way
+		primitive.Sleep((primitive.RandomUint64() % 50) * 1_000_000)
+		i = (i + 1) % uint64(len(ck.cls))
+	}
 }
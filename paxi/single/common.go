@@ -1,6 +1,20 @@
 package single
 
-type ValType = uint64
+type ValType = []byte
 
-const PREPARE = uint64(1)
-const PROPOSE = uint64(2)
+type Error = uint64
+
+const (
+	ENone = uint64(0)
+	// A replica has promised a higher proposal number.
+	EStale = uint64(1)
+	// Not enough replicas replied in time.
+	ETimeout = uint64(2)
+)
+
+const (
+	PREPARE = uint64(1)
+	PROPOSE = uint64(2)
+	// for clients
+	DECIDE = uint64(3)
+)
@@ -0,0 +1,89 @@
+package single
+
+import (
+	"github.com/tchajed/marshal"
+)
+
+type PrepareReply struct {
+	Err Error
+	// the accepted proposal number if Err == ENone (0 if there is none), or the
+	// promised one if Err == EStale
+	Pn  uint64
+	Val ValType
+}
+
+func encodePrepareReply(reply *PrepareReply) []byte {
+	var enc = make([]byte, 0, 8*3+uint64(len(reply.Val)))
+	enc = marshal.WriteInt(enc, reply.Err)
+	enc = marshal.WriteInt(enc, reply.Pn)
+	return marshal.WriteLenPrefixedBytes(enc, reply.Val)
+}
+
+func decodePrepareReply(enc0 []byte) *PrepareReply {
+	var enc = enc0
+	reply := new(PrepareReply)
+	reply.Err, enc = marshal.ReadInt(enc)
+	reply.Pn, enc = marshal.ReadInt(enc)
+	reply.Val, _ = marshal.ReadLenPrefixedBytes(enc)
+	return reply
+}
+
+type ProposeArgs struct {
+	Pn  uint64
+	Val ValType
+}
+
+func encodeProposeArgs(args *ProposeArgs) []byte {
+	var enc = make([]byte, 0, 8*2+uint64(len(args.Val)))
+	enc = marshal.WriteInt(enc, args.Pn)
+	return marshal.WriteLenPrefixedBytes(enc, args.Val)
+}
+
+func decodeProposeArgs(enc0 []byte) *ProposeArgs {
+	var enc = enc0
+	args := new(ProposeArgs)
+	args.Pn, enc = marshal.ReadInt(enc)
+	args.Val, _ = marshal.ReadLenPrefixedBytes(enc)
+	return args
+}
+
+// The reply to DECIDE: an error, followed by the decided value if there was
+// none.
+func encodeDecideReply(err Error, v ValType) []byte {
+	var enc = make([]byte, 0, 8*2+uint64(len(v)))
+	enc = marshal.WriteInt(enc, err)
+	return marshal.WriteLenPrefixedBytes(enc, v)
+}
+
+func decodeDecideReply(enc0 []byte) (Error, ValType) {
+	err, enc := marshal.ReadInt(enc0)
+	v, _ := marshal.ReadLenPrefixedBytes(enc)
+	return err, v
+}
+
+// The acceptor state, as kept on disk.
+type acceptorState struct {
+	promisedPN  uint64
+	acceptedPN  uint64 // 0 if nothing has been accepted
+	acceptedVal ValType
+	// whether acceptedVal is known to have been decided
+	decided bool
+}
+
+func encodeAcceptorState(st *acceptorState) []byte {
+	var enc = make([]byte, 0, 8*4+uint64(len(st.acceptedVal)))
+	enc = marshal.WriteInt(enc, st.promisedPN)
+	enc = marshal.WriteInt(enc, st.acceptedPN)
+	enc = marshal.WriteLenPrefixedBytes(enc, st.acceptedVal)
+	return marshal.WriteBool(enc, st.decided)
+}
+
+func decodeAcceptorState(enc0 []byte) *acceptorState {
+	var enc = enc0
+	st := new(acceptorState)
+	st.promisedPN, enc = marshal.ReadInt(enc)
+	st.acceptedPN, enc = marshal.ReadInt(enc)
+	st.acceptedVal, enc = marshal.ReadLenPrefixedBytes(enc)
+	st.decided, _ = marshal.ReadBool(enc)
+	return st
+}
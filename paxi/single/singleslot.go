@@ -1,10 +1,23 @@
 package single
 
+// A write-once register, replicated with single-decree Paxos: the first value
+// that a majority of replicas accepts is decided, and every later attempt to
+// decide a value returns that one instead. This is meant for one-time
+// decisions, such as the initial configuration of a cluster.
+
 import (
 	"sync"
+
+	"github.com/goose-lang/primitive"
+	"github.com/mit-pdos/gokv/asyncfile"
+	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/urpc"
+	"github.com/tchajed/marshal"
 )
 
-// This isn't quite paxos
+// How long TryDecide waits for a majority to reply, in each phase.
+const quorumTimeoutMs = uint64(500)
+
 type Replica struct {
 	mu         *sync.Mutex
 	promisedPN uint64 // server has promised not to accept proposals below this
@@ -12,116 +25,217 @@ type Replica struct {
 	acceptedPN  uint64  // proposal number of accepted val
 	acceptedVal ValType // the value itself
 
-	committedVal ValType
+	decided bool // whether acceptedVal is known to have been decided
 
-	peers []*Clerk
-}
+	// the highest proposal number any replica has told us it promised, so we
+	// don't keep trying lower ones
+	maxSeenPN uint64
 
-type PrepareReply struct {
-	Success bool
-	Val     uint64
-	Pn      uint64
+	storage *asyncfile.AsyncFile
+
+	peers []*singleClerk
 }
 
-func (r *Replica) PrepareRPC(pn uint64, reply *PrepareReply) {
+// Runs f, which may change the promise, the accepted value or the decision,
+// under r.mu; then writes all of them out and, with r.mu released, waits for
+// the write, so that f's reply only goes out once it would survive a crash.
+func (r *Replica) withLock(f func()) {
 	r.mu.Lock()
-	if pn > r.promisedPN {
-		r.promisedPN = pn
-		reply.Pn = r.acceptedPN
-		reply.Val = r.acceptedVal
-		reply.Success = true
-	} else {
-		reply.Success = false
-		reply.Pn = r.promisedPN
-	}
+	f()
+	waitFn := r.storage.Write(encodeAcceptorState(&acceptorState{
+		promisedPN:  r.promisedPN,
+		acceptedPN:  r.acceptedPN,
+		acceptedVal: r.acceptedVal,
+		decided:     r.decided,
+	}))
 	r.mu.Unlock()
+	waitFn()
 }
 
-type ProposeArgs struct {
-	Pn  uint64
-	Val ValType
+func (r *Replica) PrepareRPC(pn uint64, reply *PrepareReply) {
+	r.withLock(func() {
+		if pn > r.promisedPN {
+			r.promisedPN = pn
+			reply.Pn = r.acceptedPN
+			reply.Val = r.acceptedVal
+			reply.Err = ENone
+		} else {
+			reply.Err = EStale
+			reply.Pn = r.promisedPN
+		}
+	})
 }
 
-func (r *Replica) ProposeRPC(pn uint64, val ValType) bool {
-	r.mu.Lock()
-	if pn >= r.promisedPN && pn >= r.acceptedPN {
-		r.acceptedVal = val
-		r.acceptedPN = pn
-		r.mu.Unlock()
-		return true
-	} else {
-		r.mu.Unlock()
-		return false
+func (r *Replica) ProposeRPC(args *ProposeArgs) Error {
+	var err = ENone
+	r.withLock(func() {
+		if args.Pn >= r.promisedPN && args.Pn >= r.acceptedPN {
+			r.promisedPN = args.Pn
+			r.acceptedVal = args.Val
+			r.acceptedPN = args.Pn
+		} else {
+			err = EStale
+		}
+	})
+	return err
+}
+
+// Runs f on each peer in parallel, and waits until a majority of them return
+// ENone, or all of them return, or the timeout passes. Returns whether a
+// majority returned ENone. Calls to f may still be running when this returns.
+func (r *Replica) forMajority(f func(*singleClerk) Error) bool {
+	var numReplies = uint64(0)
+	var numOk = uint64(0)
+	mu := new(sync.Mutex)
+	cond := sync.NewCond(mu)
+	n := uint64(len(r.peers))
+
+	for _, peer := range r.peers { // XXX: peers is readonly
+		local_peer := peer
+		go func() {
+			err := f(local_peer)
+			mu.Lock()
+			numReplies = numReplies + 1
+			if err == ENone {
+				numOk = numOk + 1
+			}
+			cond.Signal()
+			mu.Unlock()
+		}()
 	}
+
+	deadline := primitive.TimeNow() + quorumTimeoutMs*1_000_000
+	mu.Lock()
+	for 2*numOk <= n && numReplies < n {
+		now := primitive.TimeNow()
+		if now >= deadline {
+			break
+		}
+		primitive.WaitTimeout(cond, (deadline-now)/1_000_000+1)
+	}
+	ok := 2*numOk > n
+	mu.Unlock()
+	return ok
 }
 
-// returns true iff there was an error
-func (r *Replica) TryDecide(v ValType, outv *ValType) bool {
+// Tries to get v decided, with a fresh proposal number. Returns the decided
+// value, which is v unless some other value was already decided (or might
+// have been). Returns EStale or ETimeout if this attempt couldn't get a
+// majority; it's fine to try again, though attempts from different replicas
+// at the same time can keep each other from succeeding.
+func (r *Replica) TryDecide(v ValType) (Error, ValType) {
 	r.mu.Lock()
-	pn := r.promisedPN + 1 // don't need to bother incrementing; will invoke RPC on ourselves
+	if r.decided {
+		ret := r.acceptedVal
+		r.mu.Unlock()
+		return ENone, ret
+	}
+	var pn = r.promisedPN + 1 // don't need to bother incrementing; will invoke RPC on ourselves
+	if r.maxSeenPN >= pn {
+		pn = r.maxSeenPN + 1
+	}
 	r.mu.Unlock()
 
-	var numPrepared uint64
-	numPrepared = 0
 	var highestPn uint64
 	highestPn = 0
 	var highestVal ValType
 	highestVal = v // if no one in our majority has accepted a value, we'll propose this one
+	var stale = false
 	mu := new(sync.Mutex)
 
-	for _, peer := range r.peers { // XXX: peers is readonly
-		local_peer := peer
-		go func() {
-			reply_ptr := new(PrepareReply)
-			local_peer.Prepare(pn, reply_ptr) // TODO: replace with real RPC
-
-			if reply_ptr.Success {
-				mu.Lock()
-				numPrepared = numPrepared + 1
-				if reply_ptr.Pn > highestPn {
-					highestVal = reply_ptr.Val
-					highestPn = reply_ptr.Pn
-				}
-				mu.Unlock()
+	prepared := r.forMajority(func(peer *singleClerk) Error {
+		reply := peer.prepare(pn)
+		mu.Lock()
+		if reply.Err == ENone {
+			if reply.Pn > highestPn {
+				highestVal = reply.Val
+				highestPn = reply.Pn
 			}
-		}()
-	}
+		} else if reply.Err == EStale {
+			stale = true
+			r.seePN(reply.Pn)
+		}
+		mu.Unlock()
+		return reply.Err
+	})
 
-	// FIXME: put this in a condvar loop with timeout
 	mu.Lock()
-	n := numPrepared
 	proposeVal := highestVal
+	wasStale := stale
 	mu.Unlock()
-
-	if 2*n > uint64(len(r.peers)) {
-		mu2 := new(sync.Mutex)
-		var numAccepted uint64
-		numAccepted = 0
-
-		for _, peer := range r.peers {
-			local_peer := peer
-			// each thread talks to a unique peer
-			go func() {
-				r := local_peer.Propose(pn, proposeVal) // TODO: replace with real RPC
-				if r {
-					mu2.Lock()
-					numAccepted = numAccepted + 1
-					mu2.Unlock()
-				}
-			}()
+	if !prepared {
+		if wasStale {
+			return EStale, nil
 		}
+		return ETimeout, nil
+	}
 
-		mu2.Lock()
-		n := numAccepted
-		mu2.Unlock()
+	args := &ProposeArgs{Pn: pn, Val: proposeVal}
+	if !r.forMajority(func(peer *singleClerk) Error {
+		return peer.propose(args)
+	}) {
+		return ETimeout, nil
+	}
 
-		if 2*n > uint64(len(r.peers)) {
-			*outv = proposeVal
-			return false
-		} else {
-			return true
+	r.withLock(func() {
+		// we might not have accepted it ourselves, if our reply was late; any
+		// later proposal has the same value
+		if r.acceptedPN < pn {
+			r.acceptedPN = pn
+			r.acceptedVal = proposeVal
 		}
-	} else {
-		return true
+		r.decided = true
+	})
+	return ENone, proposeVal
+}
+
+func (r *Replica) seePN(pn uint64) {
+	r.mu.Lock()
+	if pn > r.maxSeenPN {
+		r.maxSeenPN = pn
+	}
+	r.mu.Unlock()
+}
+
+// Starts a replica of the register replicated on peerHosts (which includes
+// me), keeping its durable state in fname.
+func MakeReplica(fname string, me grove_ffi.Address, peerHosts []grove_ffi.Address) *Replica {
+	r := new(Replica)
+	r.mu = new(sync.Mutex)
+
+	var encstate []byte
+	encstate, r.storage = asyncfile.MakeAsyncFile(fname)
+	if len(encstate) != 0 {
+		st := decodeAcceptorState(encstate)
+		r.promisedPN = st.promisedPN
+		r.acceptedPN = st.acceptedPN
+		r.acceptedVal = st.acceptedVal
+		r.decided = st.decided
+	}
+
+	r.peers = make([]*singleClerk, len(peerHosts))
+	for i, peerHost := range peerHosts {
+		r.peers[i] = makeSingleClerk(peerHost)
+	}
+
+	handlers := make(map[uint64]func([]byte, *[]byte))
+	handlers[PREPARE] = func(rawReq []byte, rawRep *[]byte) {
+		pn, _ := marshal.ReadInt(rawReq)
+		reply := new(PrepareReply)
+		r.PrepareRPC(pn, reply)
+		*rawRep = encodePrepareReply(reply)
+	}
+
+	handlers[PROPOSE] = func(rawReq []byte, rawRep *[]byte) {
+		err := r.ProposeRPC(decodeProposeArgs(rawReq))
+		*rawRep = marshal.WriteInt(make([]byte, 0, 8), err)
+	}
+
+	handlers[DECIDE] = func(rawReq []byte, rawRep *[]byte) {
+		err, v := r.TryDecide(rawReq)
+		*rawRep = encodeDecideReply(err, v)
 	}
+	s := urpc.MakeServer(handlers)
+	s.Serve(me)
+	return r
 }
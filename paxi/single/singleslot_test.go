@@ -0,0 +1,70 @@
+package single_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/paxi/paxitest"
+	"github.com/mit-pdos/gokv/paxi/single"
+)
+
+func startReplicas(n int) []grove_ffi.Address {
+	hosts := make([]grove_ffi.Address, n)
+	for i := range hosts {
+		hosts[i] = grove_ffi.MakeAddress(fmt.Sprintf("10.0.5.%d:1", i+1))
+	}
+	for i, host := range hosts {
+		single.MakeReplica(fmt.Sprintf("single%d", i), host, hosts)
+	}
+	return hosts
+}
+
+// Clients proposing different values at the same time all get the same one,
+// and so do later ones.
+func TestConcurrentDecide(t *testing.T) {
+	n, _ := paxitest.Start(t, 1)
+
+	hosts := startReplicas(3)
+	decided := make([]string, 5)
+	var wg sync.WaitGroup
+	for i := range decided {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// start each clerk at a different replica
+			ck := single.MakeClerk(append(hosts[i%3:], hosts[:i%3]...))
+			decided[i] = string(ck.Decide([]byte(fmt.Sprint("value ", i))))
+		}(i)
+	}
+	wg.Wait()
+	for i, v := range decided {
+		if v != decided[0] {
+			t.Fatalf("client %d got %q, but client 0 got %q", i, v, decided[0])
+		}
+	}
+
+	// a minority can be down
+	n.Isolate(hosts[0])
+	if v := string(single.MakeClerk(hosts).Decide([]byte("later"))); v != decided[0] {
+		t.Fatalf("later Decide got %q, want %q", v, decided[0])
+	}
+}
+
+// The decision survives all the replicas crashing.
+func TestDecideSurvivesCrash(t *testing.T) {
+	_, fs := paxitest.Start(t, 2)
+
+	hosts := startReplicas(3)
+	if v := string(single.MakeClerk(hosts).Decide([]byte("first"))); v != "first" {
+		t.Fatalf("Decide got %q, want %q", v, "first")
+	}
+
+	// restart every replica
+	paxitest.Reboot(fs, 3)
+	hosts = startReplicas(3)
+	if v := string(single.MakeClerk(hosts[1:]).Decide([]byte("second"))); v != "first" {
+		t.Fatalf("Decide after crash got %q, want %q", v, "first")
+	}
+}
@@ -6,152 +6,210 @@ import (
 	"github.com/mit-pdos/gokv/reconfig/config"
 	"github.com/mit-pdos/gokv/reconfig/example"
 	"github.com/mit-pdos/gokv/reconfig/replica"
+	"github.com/mit-pdos/gokv/reconfig/util"
 )
 
-func EnterNewConfig(cfgHost grove_ffi.Address, servers []grove_ffi.Address) replica.Error {
-	confCk := config.MakeClerk(cfgHost)
-	epoch, conf_enc := confCk.GetFreshEpochAndRead()
-	oldServers := replica.DecodeConfiguration(conf_enc).Replicas
-
-	// figure out which servers are actually new
-	oldServerSet := make(map[grove_ffi.Address]bool)
-	for _, oldServer := range oldServers {
-		oldServerSet[oldServer] = true
+func contains(l []grove_ffi.Address, x grove_ffi.Address) bool {
+	for _, y := range l {
+		if y == x {
+			return true
+		}
 	}
+	return false
+}
 
+// Splits servers into those that were in oldServers and those that weren't.
+func split(oldServers []grove_ffi.Address, servers []grove_ffi.Address) ([]grove_ffi.Address, []grove_ffi.Address) {
 	var remainingServers = make([]grove_ffi.Address, 0)
 	var newServers = make([]grove_ffi.Address, 0)
 	for _, server := range servers {
-		if oldServerSet[server] {
+		if contains(oldServers, server) {
 			remainingServers = append(remainingServers, server)
 		} else {
 			newServers = append(newServers, server)
 		}
 	}
+	return remainingServers, newServers
+}
+
+// Gets the log from some replica of oldServers that replies, trying them in
+// turn from a random one, and entering it into epoch; before that, if there are
+// newServers, transfers that replica's state to them. This way, the old
+// configuration keeps running during the transfer (which may take a while),
+// and only stops when its log is taken.
+//
+// Returns ETimeout if none of oldServers reply.
+func getLog(epoch uint64, oldServers []grove_ffi.Address, newServers []grove_ffi.Address) (replica.Error, *replica.BecomeReplicaArgs) {
+	n := uint64(len(oldServers))
+	start := primitive.RandomUint64()
+	for i := uint64(0); i < n; i++ {
+		server := oldServers[(start+i)%n]
+		if len(newServers) > 0 {
+			// get state, and tell the server to stop truncating until it
+			// enters epoch, so that its log will start no later than the state
+			err, index, state := example.MakeClerk(server).GetStateAndStopTruncation()
+			if err != replica.ENone {
+				continue
+			}
+			// transfer state to all the new servers
+			var transferred = true
+			for _, newServer := range newServers {
+				if example.MakeClerk(newServer).SetState(index, state) != replica.ENone {
+					transferred = false
+					break
+				}
+			}
+			if !transferred {
+				return replica.ETimeout, nil
+			}
+		}
 
-	// make application clerks for new servers
-	newClerks := replica.FmapList(newServers, example.MakeClerk)
-
-	// pick a replica of the old config
-	oldCk := example.MakeClerk(oldServers[13%len(oldServers)])
-	// get state, and tell it to stop truncating
-	// FIXME: the server should be allowed to eventually truncate
-	// options:
-	// a.) server promises not to truncate during this epoch, so if it wants to
-	// 	   truncate it has to bump epoch
-	// b.) server can truncate whenever it wants, this is just an "optimization"
-	index, state := oldCk.GetStateAndStopTruncation()
-
-	// transfer state to all the new servers
-	for _, newClerk := range newClerks {
-		newClerk.SetState(index, state)
+		// this is where the old config becomes unavailable
+		err, startIndex, log := replica.MakeClerk(server).GetUncommittedLog(epoch)
+		if err == replica.ETimeout {
+			continue
+		}
+		if err != replica.ENone {
+			return err, nil
+		}
+		return replica.ENone, &replica.BecomeReplicaArgs{Epoch: epoch, StartIndex: startIndex, Log: log}
 	}
+	return replica.ETimeout, nil
+}
 
-	// LOG ALIGNMENT
-	// get log
-	oldLogCk := replica.MakeClerk(oldServers[13%len(oldServers)])
-	err, startIndex, log := oldLogCk.GetUncommittedLog(epoch) // this is where the old config becomes unavailable
+// Moves the system from the configuration oldServers to servers, in epoch
+// (which must have been reserved from confCk): new servers get a state snapshot
+// and the log of a replica of oldServers, the remaining servers align their
+// logs with it, and then the configuration is written to the config service and
+// its first server becomes the primary. The configuration also has those of
+// leaving (servers of oldServers) that accept the log; servers of oldServers
+// that aren't in it are left behind in an earlier epoch, so they can't commit
+// anything any more.
+func enterConfig(confCk *config.Clerk, epoch uint64, oldServers []grove_ffi.Address, servers []grove_ffi.Address, leaving []grove_ffi.Address) replica.Error {
+	remainingServers, newServers := split(oldServers, servers)
+
+	err, args := getLog(epoch, oldServers, newServers)
 	if err != replica.ENone {
 		return err
 	}
 
+	// LOG ALIGNMENT
 	// send logs to replicas that were in prev config; guaranteed not to return EIncompleteLog
-	args := &replica.BecomeReplicaArgs{Epoch: epoch, StartIndex: startIndex, Log: log}
-	remainingLogClerks := replica.FmapList(remainingServers, replica.MakeClerk)
-
-	for _, remainingClerk := range remainingLogClerks {
-		err := remainingClerk.RemainReplica(args)
-		if err == replica.EStale {
+	for _, server := range remainingServers {
+		err := replica.MakeClerk(server).RemainReplica(args)
+		if err != replica.ENone {
 			return err
 		}
 	}
-
-	// send logs to new servers that weren't in prev config; theoretically can
-	// return EIncompleteLog, if the state snapshot is too old.
-	success := true
-	newLogClerks := replica.FmapList(newServers, replica.MakeClerk)
-	for _, newClerk := range newLogClerks {
-		err := newClerk.TryBecomeReplica(args)
+	var conf = replica.Configuration{Replicas: append(make([]grove_ffi.Address, 0), servers...)}
+	for _, server := range leaving {
+		err := replica.MakeClerk(server).RemainReplica(args)
 		if err == replica.EStale {
 			return err
 		}
-		if err == replica.EIncompleteLog {
-			success = false
+		// a leaving server that's down is just left out now
+		if err == replica.ENone {
+			conf.Replicas = append(conf.Replicas, server)
 		}
 	}
-	if !success {
-		panic("admin: unexpected EIncompleteLog during log alignment")
+
+	// send logs to new servers that weren't in prev config; these got a state
+	// snapshot from the server the log came from, which was not allowed to
+	// truncate past it, so this can't return EIncompleteLog either
+	for _, server := range newServers {
+		err := replica.MakeClerk(server).TryBecomeReplica(args)
+		if err != replica.ENone {
+			return err
+		}
 	}
 
-	newLogClerks[0].BecomePrimary(&replica.BecomePrimaryArgs{Epoch: epoch, Conf: replica.Configuration{Replicas: newServers}})
-	return replica.ENone
+	// clients find the primary through the config service
+	werr := confCk.Write(epoch, replica.EncodeConfiguration(&conf))
+	if werr != config.ENone {
+		return configError(werr)
+	}
+	return replica.MakeClerk(servers[0]).BecomePrimary(&replica.BecomePrimaryArgs{Epoch: epoch, Conf: conf})
 }
 
-// A better protocol
-func EnterNewConfig2(cfgHost grove_ffi.Address, servers []grove_ffi.Address) replica.Error {
-	var err = replica.ENone
-	confCk := config.MakeClerk(cfgHost)
-	epoch, conf_enc := confCk.GetFreshEpochAndRead()
-	oldServers := replica.DecodeConfiguration(conf_enc).Replicas
-
-	// figure out which servers are actually new
-	oldServerSet := make(map[grove_ffi.Address]bool)
-	for _, oldServer := range oldServers {
-		oldServerSet[oldServer] = true
+// The replica.Error for a config.Clerk error.
+func configError(err config.Error) replica.Error {
+	if err == config.EUnauthorized {
+		return replica.EUnauthorized
 	}
+	return replica.EStale
+}
 
-	var remainingServers = make([]grove_ffi.Address, 0)
-	var newServers = make([]grove_ffi.Address, 0)
-	for _, server := range servers {
-		if oldServerSet[server] {
-			remainingServers = append(remainingServers, server)
-		} else {
-			newServers = append(newServers, server)
-		}
+// Switches to the configuration servers in one step. The system is unavailable
+// from when the log is taken from the old configuration until the new primary
+// starts.
+func EnterNewConfig(confHosts []grove_ffi.Address, servers []grove_ffi.Address) replica.Error {
+	confCk := config.MakeClerk(confHosts)
+	cerr, epoch, conf_enc := confCk.GetFreshEpochAndRead()
+	if cerr != config.ENone {
+		return configError(cerr)
 	}
+	oldServers := replica.DecodeConfiguration(conf_enc).Replicas
+	return enterConfig(confCk, epoch, oldServers, servers, nil)
+}
 
-	// get log
-	oldLogCk := replica.MakeClerk(oldServers[primitive.RandomUint64()%uint64(len(oldServers))])
-	err, startIndex, log := oldLogCk.GetUncommittedLog(epoch)
-	if err != replica.ENone {
-		return err
-	}
+// A better protocol: first moves to a joint configuration, with both the old
+// servers and the new ones, and then drops the servers that are leaving.
+// Departing servers keep acknowledging appends until the second step, so the
+// system doesn't depend on the new servers alone until they have caught up.
+//
+// This can be run again after failing (or crashing) partway, with the same
+// servers, to finish the job: each step starts from whatever configuration the
+// config service has.
+func EnterNewConfig2(confHosts []grove_ffi.Address, servers []grove_ffi.Address) replica.Error {
+	confCk := config.MakeClerk(confHosts)
 
 	// STEP 1
-	// add servers to membership for the log replication; log alignment to make
-	// sure the new servers have the same entries as old log servers.
-
-	// send logs to replicas that were in prev config; guaranteed not to return EIncompleteLog
-	args := &replica.BecomeReplicaArgs{Epoch: epoch, StartIndex: startIndex, Log: log}
-	remainingLogClerks := replica.FmapList(remainingServers, replica.MakeClerk)
-	for _, remainingClerk := range remainingLogClerks {
-		err = remainingClerk.RemainReplica(args)
-		if err == replica.EStale {
-			break
-		} else {
-			continue
-		}
+	// add servers to membership for the log replication, transferring a state
+	// snapshot to them and aligning their logs with the old servers'.
+	cerr, epoch, conf_enc := confCk.GetFreshEpochAndRead()
+	if cerr != config.ENone {
+		return configError(cerr)
 	}
-	if err != replica.ENone {
-		return err
-	}
-
-	// send logs to new replicas;
-	newLogClerks := replica.FmapList(newServers, replica.MakeClerk)
-	for _, newClerk := range newLogClerks {
-		err = newClerk.TryBecomeReplica(args)
-		if err == replica.EStale {
-			break
+	oldServers := replica.DecodeConfiguration(conf_enc).Replicas
+	_, newServers := split(oldServers, servers)
+	if len(newServers) > 0 {
+		_, leaving := split(servers, oldServers)
+		err := enterConfig(confCk, epoch, oldServers, servers, leaving)
+		if err != replica.ENone {
+			return err
 		}
-	}
-	if err != replica.ENone {
-		return err
+		cerr, epoch, conf_enc = confCk.GetFreshEpochAndRead()
+		if cerr != config.ENone {
+			return configError(cerr)
+		}
+		oldServers = replica.DecodeConfiguration(conf_enc).Replicas
 	}
 
 	// STEP 2
-	// transfer state snapshot
-
-	// STEP 3
 	// kick out (oldServers ∖ servers)
+	return enterConfig(confCk, epoch, oldServers, servers, nil)
+}
+
+// Runs EnterNewConfig2, after recording servers in the file fname, so that if
+// this process crashes partway, ResumeNewConfig can finish the job.
+func EnterNewConfigResumable(confHosts []grove_ffi.Address, servers []grove_ffi.Address, fname string) replica.Error {
+	c := util.Configuration(servers)
+	grove_ffi.FileWrite(fname, util.EncodeConfiguration(&c))
+	err := EnterNewConfig2(confHosts, servers)
+	if err == replica.ENone {
+		grove_ffi.FileWrite(fname, make([]byte, 0))
+	}
 	return err
 }
+
+// Finishes the reconfiguration recorded in fname by EnterNewConfigResumable, if
+// it didn't finish. Returns the servers it was moving to, or nil if there was
+// nothing to do.
+func ResumeNewConfig(confHosts []grove_ffi.Address, fname string) (replica.Error, []grove_ffi.Address) {
+	enc := grove_ffi.FileRead(fname)
+	if len(enc) == 0 {
+		return replica.ENone, nil
+	}
+	servers := util.DecodeConfiguration(enc)
+	return EnterNewConfigResumable(confHosts, servers, fname), servers
+}
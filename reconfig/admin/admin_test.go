@@ -0,0 +1,124 @@
+package admin
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/grove_ffi/memnet"
+	"github.com/mit-pdos/gokv/reconfig/config"
+	"github.com/mit-pdos/gokv/reconfig/example"
+	"github.com/mit-pdos/gokv/reconfig/replica"
+	"github.com/mit-pdos/gokv/vrsm/vrsmtest"
+)
+
+// Starts a config server with the initial configuration servers[:nInit], and a
+// ValServer on each of servers, all on an in-memory network.
+func startCluster(t *testing.T, servers []grove_ffi.Address, nInit int) (*memnet.Network, []grove_ffi.Address) {
+	n, confHosts := vrsmtest.StartConfigService(t, servers[:nInit])
+	for _, srv := range servers {
+		example.NewValServer().Serve(srv)
+	}
+	return n, confHosts
+}
+
+func makeServers(n int) []grove_ffi.Address {
+	servers := make([]grove_ffi.Address, n)
+	for i := range servers {
+		servers[i] = grove_ffi.MakeAddress(fmt.Sprintf("10.0.1.%d:1", i+1))
+	}
+	return servers
+}
+
+// Appends i to the value, which should be want before.
+func appendAndCheck(t *testing.T, cl *example.Client, want []byte, i int) []byte {
+	t.Helper()
+	v := []byte(fmt.Sprint(i))
+	if got := cl.FetchAndAppend(v); !bytes.Equal(got, want) {
+		t.Fatalf("FetchAndAppend returned %q, want %q", got, want)
+	}
+	return append(want, v...)
+}
+
+func currentConfig(confHosts []grove_ffi.Address) []grove_ffi.Address {
+	return replica.DecodeConfiguration(config.MakeClerk(confHosts).Read()).Replicas
+}
+
+// Adds two servers and removes one with EnterNewConfig2; the new servers get
+// the state, and the removed one can be cut off.
+func TestEnterNewConfig2(t *testing.T) {
+	servers := makeServers(4)
+	n, confHosts := startCluster(t, servers, 2)
+
+	if err := EnterNewConfig2(confHosts, servers[:2]); err != replica.ENone {
+		t.Fatalf("EnterNewConfig2: %d", err)
+	}
+	cl := example.MakeClient(confHosts)
+	var want []byte
+	for i := 0; i < 10; i++ {
+		want = appendAndCheck(t, cl, want, i)
+	}
+
+	if err := EnterNewConfig2(confHosts, servers[1:]); err != replica.ENone {
+		t.Fatalf("EnterNewConfig2: %d", err)
+	}
+	if c := currentConfig(confHosts); len(c) != 3 || c[0] != servers[1] {
+		t.Fatalf("configuration is %v", c)
+	}
+	n.Isolate(servers[0])
+	for i := 10; i < 20; i++ {
+		want = appendAndCheck(t, cl, want, i)
+	}
+
+	// the new servers have the whole state
+	for _, srv := range servers[2:] {
+		err, _, state := example.MakeClerk(srv).GetState()
+		if err != replica.ENone {
+			t.Fatalf("GetState: %d", err)
+		}
+		if !bytes.HasPrefix(want, state) || len(state) < len(want)-len("19") {
+			t.Errorf("%s has %q, want %q", grove_ffi.AddressToStr(srv), state, want)
+		}
+	}
+}
+
+// After an admin crashes partway through a reconfiguration, leaving the system
+// unavailable, ResumeNewConfig finishes it.
+func TestResumeNewConfig(t *testing.T) {
+	servers := makeServers(3)
+	_, confHosts := startCluster(t, servers, 2)
+
+	if err := EnterNewConfig(confHosts, servers[:2]); err != replica.ENone {
+		t.Fatalf("EnterNewConfig: %d", err)
+	}
+	cl := example.MakeClient(confHosts)
+	var want []byte
+	for i := 0; i < 5; i++ {
+		want = appendAndCheck(t, cl, want, i)
+	}
+
+	// crash right after taking the log from the old configuration
+	c := currentConfig(confHosts)
+	c = append(c[1:], servers[2])
+	enc := replica.EncodeConfiguration(&replica.Configuration{Replicas: c})
+	grove_ffi.FileWrite("admin.data", enc)
+	_, epoch, _ := config.MakeClerk(confHosts).GetFreshEpochAndRead()
+	if err, _, _ := replica.MakeClerk(servers[0]).GetUncommittedLog(epoch); err != replica.ENone {
+		t.Fatalf("GetUncommittedLog: %d", err)
+	}
+
+	err, resumed := ResumeNewConfig(confHosts, "admin.data")
+	if err != replica.ENone || len(resumed) != 2 {
+		t.Fatalf("ResumeNewConfig: %d, %v", err, resumed)
+	}
+	if c := currentConfig(confHosts); len(c) != 2 || c[0] != servers[1] || c[1] != servers[2] {
+		t.Fatalf("configuration is %v", c)
+	}
+	for i := 5; i < 10; i++ {
+		want = appendAndCheck(t, cl, want, i)
+	}
+	if err, resumed := ResumeNewConfig(confHosts, "admin.data"); err != replica.ENone || resumed != nil {
+		t.Fatalf("second ResumeNewConfig: %d, %v", err, resumed)
+	}
+}
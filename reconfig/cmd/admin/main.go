@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/reconfig/admin"
+	"github.com/mit-pdos/gokv/reconfig/config"
+	"github.com/mit-pdos/gokv/reconfig/replica"
+)
+
+func main() {
+	var confStr string
+	var stateFile string
+	flag.StringVar(&confStr, "conf", "", "address of config server")
+	flag.StringVar(&stateFile, "state", "reconfig-admin.data", "file that records a reconfiguration in progress, so it can be resumed")
+	flag.Parse()
+
+	usage_assert := func(b bool) {
+		if !b {
+			flag.PrintDefaults()
+			fmt.Println("Must provide command in form:")
+			fmt.Println(" reconfig host1 [host2 ...]")
+			fmt.Println(" resume")
+			fmt.Println(" getconf")
+			os.Exit(1)
+		}
+	}
+
+	usage_assert(confStr != "")
+
+	confHosts := []grove_ffi.Address{grove_ffi.MakeAddress(confStr)}
+
+	a := flag.Args()
+	usage_assert(len(a) > 0)
+	if a[0] == "reconfig" {
+		usage_assert(len(a) > 1)
+		servers := make([]grove_ffi.Address, 0)
+		for _, srvStr := range a[1:] {
+			servers = append(servers, grove_ffi.MakeAddress(srvStr))
+		}
+		err := admin.EnterNewConfigResumable(confHosts, servers, stateFile)
+		if err != replica.ENone {
+			fmt.Printf("Failed to switch config: %d; run resume to try again\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Finished switching configuration\n")
+	} else if a[0] == "resume" {
+		err, servers := admin.ResumeNewConfig(confHosts, stateFile)
+		if err != replica.ENone {
+			fmt.Printf("Failed to switch config: %d; run resume to try again\n", err)
+			os.Exit(1)
+		}
+		if servers == nil {
+			fmt.Printf("No reconfiguration in progress\n")
+		} else {
+			fmt.Printf("Finished switching configuration\n")
+		}
+	} else if a[0] == "getconf" {
+		conf := replica.DecodeConfiguration(config.MakeClerk(confHosts).Read())
+		servers := make([]string, 0)
+		for _, srv := range conf.Replicas {
+			servers = append(servers, grove_ffi.AddressToStr(srv))
+		}
+		fmt.Printf("Configuration is: %v\n", servers)
+	} else {
+		usage_assert(false)
+	}
+}
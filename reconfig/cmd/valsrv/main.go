@@ -0,0 +1,26 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/reconfig/example"
+)
+
+func main() {
+	var port string
+	flag.StringVar(&port, "port", "", "port number to use for server (or an address to listen on, e.g. [::]:PORT or unix:PATH)")
+	flag.Parse()
+
+	if port == "" {
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	me := grove_ffi.MakeListenAddress(port)
+	example.NewValServer().Serve(me)
+	log.Printf("Started ValServer on %s", port)
+	select {}
+}
@@ -1,22 +1,64 @@
 package config
 
+// A clerk for the configuration that a reconfig/replica group runs in, kept by
+// a vrsm/configservice: reconfiguration reserves a fresh epoch and reads the old
+// configuration, and then writes the new one in that epoch.
+
 import (
 	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/reconfig/util"
+	"github.com/mit-pdos/gokv/vrsm/configservice"
+	"github.com/mit-pdos/gokv/vrsm/e"
 )
 
 type Clerk struct {
+	ck *configservice.Clerk
 }
 
 type Error uint64
 
-func MakeClerk(host grove_ffi.Address) *Clerk {
-	panic("config: impl")
+const (
+	ENone = Error(0)
+	// A later epoch has been reserved since.
+	EStale = Error(1)
+	// The config service only lets the admin reserve epochs and write the
+	// configuration, and this process isn't it.
+	EUnauthorized = Error(2)
+)
+
+// hosts are the config service's servers.
+func MakeClerk(hosts []grove_ffi.Address) *Clerk {
+	return &Clerk{ck: configservice.MakeClerk(hosts)}
+}
+
+// Reserves an epoch later than any reserved before, and returns it along with
+// the current configuration (encoded with util.EncodeConfiguration).
+// Returns EUnauthorized if the config service won't let this process do so.
+func (ck *Clerk) GetFreshEpochAndRead() (Error, uint64, []byte) {
+	err, epoch, conf := ck.ck.ReserveEpochAndGetConfig()
+	if err == e.Unauthorized {
+		return EUnauthorized, 0, nil
+	}
+	c := util.Configuration(conf)
+	return ENone, epoch, util.EncodeConfiguration(&c)
 }
 
-func (ck *Clerk) GetFreshEpochAndRead() (uint64, []byte) {
-	panic("config: impl")
+// Returns the current configuration (encoded with util.EncodeConfiguration).
+func (ck *Clerk) Read() []byte {
+	c := util.Configuration(ck.ck.GetConfig())
+	return util.EncodeConfiguration(&c)
 }
 
+// Writes v (encoded with util.EncodeConfiguration) as the configuration for
+// epoch, unless a later epoch has been reserved since (EStale) or this process
+// isn't allowed to (EUnauthorized).
 func (ck *Clerk) Write(epoch uint64, v []byte) Error {
-	panic("config: impl")
+	err := ck.ck.TryWriteConfig(epoch, util.DecodeConfiguration(v))
+	if err == e.None {
+		return ENone
+	}
+	if err == e.Unauthorized {
+		return EUnauthorized
+	}
+	return EStale
 }
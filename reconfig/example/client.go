@@ -1,26 +1,121 @@
 package example
 
 import (
+	"github.com/goose-lang/primitive"
 	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/reconfig/config"
+	pb "github.com/mit-pdos/gokv/reconfig/replica"
+	"github.com/mit-pdos/gokv/reconfig/util"
+	"github.com/mit-pdos/gokv/reconnectclient"
 	"github.com/mit-pdos/gokv/urpc"
+	"github.com/tchajed/marshal"
 )
 
+// A clerk for one ValServer.
 type Clerk struct {
-	cl *urpc.Client
+	cl *reconnectclient.ReconnectingClient
 }
 
-func MakeClerk(grove_ffi.Address) Clerk {
-	panic("example: impl")
+func MakeClerk(host grove_ffi.Address) *Clerk {
+	return &Clerk{cl: reconnectclient.MakeReconnectingClient(host)}
 }
 
-func (ck *Clerk) GetStateAndStopTruncation() (uint64, []byte) {
-	panic("example: impl")
+// Returns ENone and the value before appending v, or an error if this server
+// isn't the primary or didn't reply (in which case v might or might not have
+// been appended).
+func (ck *Clerk) FetchAndAppend(v []byte) (pb.Error, []byte) {
+	reply := new([]byte)
+	err := ck.cl.Call(RPC_FETCHANDAPPEND, v, reply, 1000 /* ms */)
+	if err != 0 {
+		return pb.ETimeout, nil
+	}
+	r := DecodeFetchAndAppendReply(*reply)
+	return r.err, r.val
 }
 
-func (ck *Clerk) GetState() (uint64, []byte) {
-	panic("example: impl")
+// The pb.Error for a call that failed with the urpc error err.
+func callError(err uint64) pb.Error {
+	if err == urpc.ErrUnauthorized {
+		return pb.EUnauthorized
+	}
+	return pb.ETimeout
 }
 
-func (ck *Clerk) SetState(index uint64, state []byte) {
-	panic("example: impl")
+// Returns ETimeout if the server doesn't reply, and EUnauthorized if it only
+// lets the admin call this.
+func (ck *Clerk) GetStateAndStopTruncation() (pb.Error, uint64, []byte) {
+	reply := new([]byte)
+	// the state might be large
+	err := ck.cl.Call(RPC_GETSTATEANDSTOPTRUNCATION, make([]byte, 0), reply, 10000 /* ms */)
+	if err != 0 {
+		return callError(err), 0, nil
+	}
+	index, state := decodeState(*reply)
+	return pb.ENone, index, state
+}
+
+func (ck *Clerk) GetState() (pb.Error, uint64, []byte) {
+	reply := new([]byte)
+	err := ck.cl.Call(RPC_GETSTATE, make([]byte, 0), reply, 10000 /* ms */)
+	if err != 0 {
+		return pb.ETimeout, 0, nil
+	}
+	index, state := decodeState(*reply)
+	return pb.ENone, index, state
+}
+
+// Returns ETimeout if the server doesn't reply, and EUnauthorized if it only
+// lets the admin call this.
+func (ck *Clerk) SetState(index uint64, state []byte) pb.Error {
+	reply := new([]byte)
+	err := ck.cl.Call(RPC_SETSTATE, encodeState(index, state), reply, 10000 /* ms */)
+	if err != 0 {
+		return callError(err)
+	}
+	return pb.ENone
+}
+
+// A client for whichever ValServer is the primary of the current
+// configuration.
+type Client struct {
+	confCk *config.Clerk
+	cks    []*Clerk
+	// which of cks was the primary last time
+	primary uint64
+}
+
+func MakeClient(confHosts []grove_ffi.Address) *Client {
+	return &Client{confCk: config.MakeClerk(confHosts)}
+}
+
+// Returns the value before appending v. If a server doesn't reply, this tries
+// again, so v might be appended more than once.
+func (c *Client) FetchAndAppend(v []byte) []byte {
+	for {
+		n := uint64(len(c.cks))
+		for i := uint64(0); i < n; i++ {
+			j := (c.primary + i) % n
+			err, val := c.cks[j].FetchAndAppend(v)
+			if err == pb.ENone {
+				c.primary = j
+				return val
+			}
+		}
+		// no primary among the servers we know of; maybe the configuration
+		// changed
+		primitive.Sleep(10_000_000) // 10ms
+		conf := util.DecodeConfiguration(c.confCk.Read())
+		c.cks = pb.FmapList(conf, MakeClerk)
+		c.primary = 0
+	}
+}
+
+func encodeState(index uint64, state []byte) []byte {
+	var enc = make([]byte, 0, 8+uint64(len(state)))
+	enc = marshal.WriteInt(enc, index)
+	return marshal.WriteBytes(enc, state)
+}
+
+func decodeState(enc []byte) (uint64, []byte) {
+	return marshal.ReadInt(enc)
 }
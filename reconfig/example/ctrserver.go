@@ -3,16 +3,35 @@ package example
 import (
 	"sync"
 
+	"github.com/mit-pdos/gokv/grove_ffi"
 	pb "github.com/mit-pdos/gokv/reconfig/replica"
-	// "github.com/goose-lang/primitive"
 	"github.com/tchajed/marshal"
 )
 
+const (
+	RPC_FETCHANDAPPEND            = uint64(16)
+	RPC_GETSTATEANDSTOPTRUNCATION = uint64(17)
+	RPC_GETSTATE                  = uint64(18)
+	RPC_SETSTATE                  = uint64(19)
+)
+
 type FetchAndAppendReply struct {
 	err pb.Error
 	val []byte
 }
 
+func EncodeFetchAndAppendReply(reply *FetchAndAppendReply) []byte {
+	var enc = make([]byte, 0, 8+uint64(len(reply.val)))
+	enc = marshal.WriteInt(enc, reply.err)
+	return marshal.WriteBytes(enc, reply.val)
+}
+
+func DecodeFetchAndAppendReply(enc []byte) *FetchAndAppendReply {
+	reply := new(FetchAndAppendReply)
+	reply.err, reply.val = marshal.ReadInt(enc)
+	return reply
+}
+
 type LogEntryExtra struct {
 	completed *bool
 	reply     *FetchAndAppendReply
@@ -22,30 +41,27 @@ type LogEntryExtra struct {
 type ValServer struct {
 	s *pb.Server[LogEntryExtra]
 
-	sid    uint64
-	nextID uint64
-
-	mu              *sync.Mutex
-	appliedIndex    uint64
-	val             []byte
-	truncationLimit uint64
+	mu           *sync.Mutex
+	appliedIndex uint64 // the number of entries applied to val
+	val          []byte
+	// The log is not truncated while the server is in this epoch, so that the
+	// state handed out by GetStateAndStopTruncation can be brought up to date
+	// with the log handed out by GetUncommittedLog.
+	noTruncationEpoch uint64
 }
 
 func (s *ValServer) applyThread() {
 	s.mu.Lock()
 	for {
-		// TODO: add no overflow assumption
 		appliedIndex := s.appliedIndex
 		s.mu.Unlock()
 
-		err, le := s.s.GetEntry(appliedIndex + 1)
-		if err == pb.ETruncated { // this is supposed to only happen when a snapshot is installed
-			continue
-		}
+		err, le := s.s.GetEntry(appliedIndex)
 
 		s.mu.Lock()
-		if s.appliedIndex != appliedIndex {
-			// this means entries have been skipped
+		if err == pb.ETruncated || s.appliedIndex != appliedIndex {
+			// a snapshot was installed in the meantime, and entries have been
+			// skipped
 			continue
 		}
 
@@ -61,9 +77,11 @@ func (s *ValServer) applyThread() {
 		s.appliedIndex += 1
 
 		// truncate everything that can be truncated
-		if s.appliedIndex <= s.truncationLimit {
+		if s.s.Epoch() > s.noTruncationEpoch {
+			index := s.appliedIndex
 			s.mu.Unlock()
-			s.s.Truncate(s.appliedIndex)
+			s.s.Truncate(index)
+			s.mu.Lock()
 		}
 	}
 }
@@ -115,29 +133,54 @@ func (cs *ValServer) getState() (uint64, []byte) {
 	return i, v
 }
 
-func (cs *ValServer) setState(index uint64, val []byte) {
+// Stops truncation until the server enters a later epoch.
+func (cs *ValServer) getStateAndStopTruncation() (uint64, []byte) {
 	cs.mu.Lock()
-	cs.val = val
-	cs.appliedIndex = index
+	cs.noTruncationEpoch = cs.s.Epoch()
+	v := cs.val
+	i := cs.appliedIndex
 	cs.mu.Unlock()
+	return i, v
 }
 
-func (cs *ValServer) truncateAndBecomeReplica(args *pb.BecomeReplicaArgs) pb.Error {
-	// FIXME: what if this request is from an old reconf attempt that failed?
-	// If this replica is in the latest config, then this truncation might trim
-	// off entries that this node has not yet applied, resulting in this node
-	// not having the latest state, a violation of the informal invariant we
-	// hope to maintain about the latest config.
+// Installs a snapshot of the state after the first index entries, on a server
+// that is about to become a replica with TryBecomeReplica.
+func (cs *ValServer) setState(index uint64, val []byte) {
 	cs.mu.Lock()
-	cs.appliedIndex = args.StartIndex
+	cs.val = val
+	cs.appliedIndex = index
 	cs.mu.Unlock()
-	cs.s.Truncate(args.StartIndex)
-
-	return cs.s.TryBecomeReplicaRPC(args)
+	cs.s.ResetLog(index)
 }
 
 func NewValServer() *ValServer {
 	s := new(ValServer)
-	// FIXME: init
+	s.mu = new(sync.Mutex)
+	s.val = make([]byte, 0)
+	dstate := NonDurable()
+	s.s = pb.MakeServer[LogEntryExtra](&dstate, new(pb.ProtocolState))
+	go func() {
+		s.applyThread()
+	}()
 	return s
 }
+
+func (cs *ValServer) Serve(me grove_ffi.Address) {
+	handlers := make(map[uint64]func([]byte, *[]byte))
+	handlers[RPC_FETCHANDAPPEND] = func(args []byte, reply *[]byte) {
+		r := new(FetchAndAppendReply)
+		cs.FetchAndAppend(args, r)
+		*reply = EncodeFetchAndAppendReply(r)
+	}
+	handlers[RPC_GETSTATEANDSTOPTRUNCATION] = func(args []byte, reply *[]byte) {
+		*reply = encodeState(cs.getStateAndStopTruncation())
+	}
+	handlers[RPC_GETSTATE] = func(args []byte, reply *[]byte) {
+		*reply = encodeState(cs.getState())
+	}
+	handlers[RPC_SETSTATE] = func(args []byte, reply *[]byte) {
+		cs.setState(decodeState(args))
+		*reply = marshal.WriteInt(nil, pb.ENone)
+	}
+	cs.s.Serve(me, handlers, []uint64{RPC_GETSTATEANDSTOPTRUNCATION, RPC_SETSTATE})
+}
@@ -0,0 +1,49 @@
+package example_test
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/reconfig/admin"
+	"github.com/mit-pdos/gokv/reconfig/example"
+	"github.com/mit-pdos/gokv/reconfig/replica"
+	"github.com/mit-pdos/gokv/vrsm/vrsmtest"
+)
+
+// A config server and three ValServers on an in-memory network; after the
+// primary is cut off and the other two are reconfigured into a new
+// configuration, clients see everything appended before.
+func TestReplicationAndPrimaryFailure(t *testing.T) {
+	servers := []grove_ffi.Address{
+		grove_ffi.MakeAddress("10.0.1.1:1"),
+		grove_ffi.MakeAddress("10.0.1.2:1"),
+		grove_ffi.MakeAddress("10.0.1.3:1"),
+	}
+	n, confHosts := vrsmtest.StartConfigService(t, servers)
+	for _, srv := range servers {
+		example.NewValServer().Serve(srv)
+	}
+	if err := admin.EnterNewConfig(confHosts, servers); err != replica.ENone {
+		t.Fatalf("EnterNewConfig: %d", err)
+	}
+
+	cl := example.MakeClient(confHosts)
+	var want []byte
+	for i := 0; i < 10; i++ {
+		v := []byte(fmt.Sprint(i))
+		if got := cl.FetchAndAppend(v); !bytes.Equal(got, want) {
+			t.Fatalf("FetchAndAppend returned %q, want %q", got, want)
+		}
+		want = append(want, v...)
+	}
+
+	n.Isolate(servers[0])
+	if err := admin.EnterNewConfig(confHosts, servers[1:]); err != replica.ENone {
+		t.Fatalf("EnterNewConfig: %d", err)
+	}
+	if got := cl.FetchAndAppend([]byte("x")); !bytes.Equal(got, want) {
+		t.Fatalf("after reconfiguration, FetchAndAppend returned %q, want %q", got, want)
+	}
+}
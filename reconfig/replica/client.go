@@ -1,12 +1,23 @@
 package replica
 
 import (
+	"sync"
+
+	"github.com/goose-lang/primitive"
+	"github.com/mit-pdos/gokv/connman"
 	"github.com/mit-pdos/gokv/grove_ffi"
 	"github.com/mit-pdos/gokv/urpc"
+	"github.com/tchajed/marshal"
 )
 
 type Clerk struct {
-	cl *urpc.Client
+	cm   *connman.ConnMan
+	host grove_ffi.Address
+
+	// The primary pipelines appends on a connection of their own, so that
+	// they arrive in the order they were sent.
+	mu       *sync.Mutex
+	appendCl *urpc.Client // nil if not connected
 }
 
 type Error = uint64
@@ -18,32 +29,131 @@ const (
 	EAppendOutOfOrder = uint64(3)
 	ETruncated        = uint64(4)
 	EIncompleteLog    = uint64(5)
+	// The server did not reply.
+	ETimeout = uint64(6)
+	// The server doesn't let this process call the RPC (see
+	// urpc.Server.RestrictToAdmin).
+	EUnauthorized = uint64(7)
+)
+
+// Services that embed a Server should use rpcids from 16 up for their own RPCs.
+const (
+	RPC_APPEND            = uint64(0)
+	RPC_BECOMEPRIMARY     = uint64(1)
+	RPC_TRYBECOMEREPLICA  = uint64(2)
+	RPC_REMAINREPLICA     = uint64(3)
+	RPC_GETUNCOMMITTEDLOG = uint64(4)
 )
 
-func (ck *Clerk) appendRPC(args *AppendArgs) Error {
-	// FIXME: impl
-	panic("replica: impl")
+func MakeClerk(host grove_ffi.Address) *Clerk {
+	return MakeClerkWithConnMan(host, connman.MakeConnMan())
+}
+
+// A clerk that shares cm's connections to host with everyone else using cm
+// (except for appends).
+func MakeClerkWithConnMan(host grove_ffi.Address, cm *connman.ConnMan) *Clerk {
+	return &Clerk{cm: cm, host: host, mu: new(sync.Mutex)}
+}
+
+func (ck *Clerk) call(rpcid uint64, args []byte, reply *[]byte, timeout_ms uint64) Error {
+	err := ck.cm.CallWithRetries(ck.host, rpcid, args, reply, timeout_ms, 3)
+	if err == urpc.ErrUnauthorized {
+		return EUnauthorized
+	}
+	if err != urpc.ErrNone {
+		return ETimeout
+	}
+	return ENone
+}
+
+func (ck *Clerk) callForError(rpcid uint64, args []byte, timeout_ms uint64) Error {
+	reply := new([]byte)
+	err := ck.call(rpcid, args, reply, timeout_ms)
+	if err != ENone {
+		return err
+	}
+	e, _ := marshal.ReadInt(*reply)
+	return e
+}
+
+// Sends args on the append connection (connecting it first if need be),
+// without waiting for the reply; appendComplete waits for it.
+func (ck *Clerk) appendStart(args *AppendArgs) (*urpc.Client, *urpc.Callback, Error) {
+	ck.mu.Lock()
+	var cl = ck.appendCl
+	ck.mu.Unlock()
+	if cl == nil {
+		err, newCl := urpc.TryMakeClient(ck.host)
+		if err != 0 {
+			primitive.Sleep(10_000_000) // 10ms
+			return nil, nil, ETimeout
+		}
+		ck.mu.Lock()
+		if ck.appendCl == nil {
+			ck.appendCl = newCl
+		}
+		cl = ck.appendCl
+		ck.mu.Unlock()
+		if cl != newCl {
+			// someone else connected first
+			newCl.Close()
+		}
+	}
+	cb, err := cl.CallStart(RPC_APPEND, EncodeAppendArgs(args))
+	if err != urpc.ErrNone {
+		ck.disconnected(cl)
+		return nil, nil, ETimeout
+	}
+	return cl, cb, ENone
+}
+
+// Returns the error and the end of the replica's log.
+func (ck *Clerk) appendComplete(cl *urpc.Client, cb *urpc.Callback) (Error, uint64) {
+	reply := new([]byte)
+	err := cl.CallComplete(cb, reply, 1000 /* ms */)
+	if err != urpc.ErrNone {
+		if err == urpc.ErrDisconnect {
+			ck.disconnected(cl)
+		}
+		return ETimeout, 0
+	}
+	r := DecodeAppendReply(*reply)
+	return r.err, r.logEnd
+}
+
+// Drops cl, closing it, unless it has already been replaced.
+func (ck *Clerk) disconnected(cl *urpc.Client) {
+	ck.mu.Lock()
+	var drop = ck.appendCl == cl
+	if drop {
+		ck.appendCl = nil
+	}
+	ck.mu.Unlock()
+	if drop {
+		cl.Close()
+	}
 }
 
 func (ck *Clerk) BecomePrimary(args *BecomePrimaryArgs) Error {
-	// FIXME: impl
-	panic("replica: impl")
+	return ck.callForError(RPC_BECOMEPRIMARY, EncodeBecomePrimaryArgs(args), 100 /* ms */)
 }
 
 func (ck *Clerk) TryBecomeReplica(args *BecomeReplicaArgs) Error {
-	// FIXME: impl
-	panic("replica: impl")
+	// the log might be long
+	return ck.callForError(RPC_TRYBECOMEREPLICA, EncodeBecomeReplicaArgs(args), 10000 /* ms */)
 }
 
 func (ck *Clerk) RemainReplica(args *BecomeReplicaArgs) Error {
-	// FIXME: impl
-	panic("replica: impl")
+	return ck.callForError(RPC_REMAINREPLICA, EncodeBecomeReplicaArgs(args), 10000 /* ms */)
 }
 
+// Returns the error, the index of the first entry in the log, and the log.
 func (ck *Clerk) GetUncommittedLog(epoch uint64) (Error, uint64, []LogEntry) {
-	panic("replica: impl")
-}
-
-func MakeClerk(host grove_ffi.Address) *Clerk {
-	return &Clerk{cl: urpc.MakeClient(host)}
+	reply := new([]byte)
+	err := ck.call(RPC_GETUNCOMMITTEDLOG, marshal.WriteInt(nil, epoch), reply, 10000 /* ms */)
+	if err != ENone {
+		return err, 0, nil
+	}
+	r := DecodeGetLogReply(*reply)
+	return r.err, r.startIndex, r.log
 }
@@ -0,0 +1,174 @@
+package replica
+
+import (
+	"github.com/mit-pdos/gokv/aof"
+	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/tchajed/marshal"
+)
+
+// A DurableState kept in an append-only file.
+//
+// File format: a sequence of records, each one a u64 kind followed by
+//
+//	recordAppend:   u64 length ++ entry
+//	recordEpoch:    u64 epoch
+//	recordTruncate: u64 index; the log now starts at index (and is empty if
+//	                it ended before index)
+//
+// A partial record at the end (from a crash in the middle of an append) is
+// ignored.
+type durableLog struct {
+	fname   string
+	logFile *aof.AppendOnlyFile
+
+	// mirrors the file, so that it can be rewritten
+	epoch      uint64
+	startIndex uint64
+	log        []LogEntry
+	// how many truncated entries are still in the file
+	garbage uint64
+}
+
+const (
+	recordAppend   = uint64(0)
+	recordEpoch    = uint64(1)
+	recordTruncate = uint64(2)
+)
+
+// Rewrite the file once this many truncated entries have piled up in it.
+const maxGarbage = uint64(1024)
+
+func (d *durableLog) encode() []byte {
+	var enc = make([]byte, 0, 8*4)
+	enc = marshal.WriteInt(enc, recordEpoch)
+	enc = marshal.WriteInt(enc, d.epoch)
+	enc = marshal.WriteInt(enc, recordTruncate)
+	enc = marshal.WriteInt(enc, d.startIndex)
+	for _, entry := range d.log {
+		enc = marshal.WriteInt(enc, recordAppend)
+		enc = marshal.WriteLenPrefixedBytes(enc, entry)
+	}
+	return enc
+}
+
+// Replaces the file with one holding just the current state.
+func (d *durableLog) rewrite() {
+	d.logFile.Close()
+	grove_ffi.FileWrite(d.fname, d.encode())
+	d.logFile = aof.CreateAppendOnlyFile(d.fname)
+	d.garbage = 0
+}
+
+func (d *durableLog) append(entry LogEntry) func() {
+	d.log = append(d.log, entry)
+	var enc = make([]byte, 0, 8+8+uint64(len(entry)))
+	enc = marshal.WriteInt(enc, recordAppend)
+	enc = marshal.WriteLenPrefixedBytes(enc, entry)
+	l := d.logFile.Append(enc)
+	// the file might be rewritten (and logFile replaced) before the wait
+	f := d.logFile
+	return func() {
+		f.WaitAppend(l)
+	}
+}
+
+func (d *durableLog) setLog(startIndex uint64, log []LogEntry) {
+	d.startIndex = startIndex
+	d.log = log
+	d.rewrite()
+}
+
+func (d *durableLog) truncate(index uint64) {
+	if index <= d.startIndex {
+		return
+	}
+	if index >= d.startIndex+uint64(len(d.log)) {
+		d.garbage += uint64(len(d.log))
+		d.log = make([]LogEntry, 0)
+	} else {
+		d.garbage += index - d.startIndex
+		d.log = d.log[index-d.startIndex:]
+	}
+	d.startIndex = index
+	if d.garbage >= maxGarbage {
+		d.rewrite()
+		return
+	}
+	// Losing this record in a crash only means keeping more of the log, so
+	// don't wait for it.
+	var enc = make([]byte, 0, 8*2)
+	enc = marshal.WriteInt(enc, recordTruncate)
+	enc = marshal.WriteInt(enc, index)
+	d.logFile.Append(enc)
+}
+
+func (d *durableLog) setEpoch(epoch uint64) {
+	d.epoch = epoch
+	var enc = make([]byte, 0, 8*2)
+	enc = marshal.WriteInt(enc, recordEpoch)
+	enc = marshal.WriteInt(enc, epoch)
+	l := d.logFile.Append(enc)
+	d.logFile.WaitAppend(l)
+}
+
+// Reads the state from the file, if any, skipping a partial record at the end.
+func (d *durableLog) recover(enc0 []byte) {
+	d.log = make([]LogEntry, 0)
+	var enc = enc0
+	for uint64(len(enc)) >= 16 {
+		var kind uint64
+		var rest []byte
+		kind, rest = marshal.ReadInt(enc)
+		if kind == recordAppend {
+			l, data := marshal.ReadInt(rest)
+			if uint64(len(data)) < l {
+				break
+			}
+			d.log = append(d.log, data[:l])
+			enc = data[l:]
+		} else if kind == recordEpoch {
+			d.epoch, enc = marshal.ReadInt(rest)
+		} else {
+			var index uint64
+			index, enc = marshal.ReadInt(rest)
+			if index >= d.startIndex+uint64(len(d.log)) {
+				d.log = make([]LogEntry, 0)
+			} else if index > d.startIndex {
+				d.log = d.log[index-d.startIndex:]
+			}
+			d.startIndex = index
+		}
+	}
+}
+
+// Recovers the state kept in fname (empty if there's no such file), and
+// returns it along with a DurableState that keeps it there, to be passed to
+// MakeServer.
+func RecoverDurableState(fname string) (*DurableState, *ProtocolState) {
+	d := &durableLog{fname: fname}
+	d.recover(grove_ffi.FileRead(fname))
+	// get rid of any partial record, and of truncated entries
+	grove_ffi.FileWrite(fname, d.encode())
+	d.logFile = aof.CreateAppendOnlyFile(fname)
+
+	dstate := &DurableState{
+		Append: func(entry LogEntry) func() {
+			return d.append(entry)
+		},
+		SetLog: func(startIndex uint64, log []LogEntry) {
+			d.setLog(startIndex, log)
+		},
+		Truncate: func(index uint64) {
+			d.truncate(index)
+		},
+		SetEpoch: func(epoch uint64) {
+			d.setEpoch(epoch)
+		},
+	}
+	pstate := &ProtocolState{
+		epoch:      d.epoch,
+		startIndex: d.startIndex,
+		log:        append(make([]LogEntry, 0, len(d.log)), d.log...),
+	}
+	return dstate, pstate
+}
@@ -0,0 +1,82 @@
+package replica
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/mit-pdos/gokv/grove_ffi/memfs"
+)
+
+// The recovered log is what was last set, plus a prefix of what was appended
+// since, including everything that was waited for; truncation only ever drops
+// a prefix.
+func TestDurableStateCrashRecovery(t *testing.T) {
+	h := &memfs.Harness{
+		Seed:   1,
+		Config: memfs.Config{TornWrites: true},
+	}
+	h.Setup = func() (func(), func() error) {
+		var mu sync.Mutex
+		// the last epoch set, and the one being set
+		var epoch, newEpoch uint64
+		var appended []LogEntry
+		var durable uint64
+		workload := func() {
+			dstate, _ := RecoverDurableState("log")
+			// may be durable before SetLog returns
+			mu.Lock()
+			appended = []LogEntry{[]byte("init")}
+			mu.Unlock()
+			dstate.SetLog(0, []LogEntry{[]byte("init")})
+			mu.Lock()
+			durable = 1
+			mu.Unlock()
+			for i := 0; i < 20; i++ {
+				if i%5 == 0 {
+					mu.Lock()
+					newEpoch = uint64(i)
+					mu.Unlock()
+					dstate.SetEpoch(uint64(i))
+					mu.Lock()
+					epoch = uint64(i)
+					mu.Unlock()
+				}
+				e := []byte(fmt.Sprint("entry ", i))
+				mu.Lock()
+				appended = append(appended, e)
+				mu.Unlock()
+				wait := dstate.Append(e)
+				if i%3 == 0 {
+					dstate.Truncate(uint64(i))
+				}
+				wait()
+				mu.Lock()
+				durable = uint64(i) + 2
+				mu.Unlock()
+			}
+		}
+		check := func() error {
+			mu.Lock()
+			defer mu.Unlock()
+			_, pstate := RecoverDurableState("log")
+			if pstate.epoch != epoch && pstate.epoch != newEpoch {
+				return fmt.Errorf("recovered epoch %d, set %d", pstate.epoch, epoch)
+			}
+			end := pstate.startIndex + uint64(len(pstate.log))
+			if end < durable || end > uint64(len(appended)) {
+				return fmt.Errorf("recovered log up to %d, appended %d of which %d are durable", end, len(appended), durable)
+			}
+			for i, e := range pstate.log {
+				if string(e) != string(appended[pstate.startIndex+uint64(i)]) {
+					return fmt.Errorf("recovered %q at %d", e, pstate.startIndex+uint64(i))
+				}
+			}
+			return nil
+		}
+		return workload, check
+	}
+	if err := h.Run(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,33 +1,88 @@
 package replica
 
-import "github.com/mit-pdos/gokv/grove_ffi"
+import (
+	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/reconfig/util"
+	"github.com/tchajed/marshal"
+)
 
+func encodeLog(enc []byte, log []LogEntry) []byte {
+	var e = marshal.WriteInt(enc, uint64(len(log)))
+	for _, entry := range log {
+		e = marshal.WriteLenPrefixedBytes(e, entry)
+	}
+	return e
+}
+
+func decodeLog(enc []byte) ([]LogEntry, []byte) {
+	n, e := marshal.ReadInt(enc)
+	log := make([]LogEntry, n)
+	for i := range log {
+		log[i], e = marshal.ReadLenPrefixedBytes(e)
+	}
+	return log, e
+}
+
+// Appends entries to the log starting at index, and tells the replica that
+// everything before commitIndex is committed.
 type AppendArgs struct {
-	epoch uint64
-	entry LogEntry
-	index uint64
+	epoch       uint64
+	index       uint64
+	entries     []LogEntry
+	commitIndex uint64
 }
 
 func EncodeAppendArgs(args *AppendArgs) []byte {
-	// TODO:impl
-	return nil
+	var enc = make([]byte, 0, 8*4)
+	enc = marshal.WriteInt(enc, args.epoch)
+	enc = marshal.WriteInt(enc, args.index)
+	enc = marshal.WriteInt(enc, args.commitIndex)
+	return encodeLog(enc, args.entries)
 }
 
 func DecodeAppendArgs(args []byte) *AppendArgs {
-	// TODO:impl
-	return nil
+	a := new(AppendArgs)
+	var enc = args
+	a.epoch, enc = marshal.ReadInt(enc)
+	a.index, enc = marshal.ReadInt(enc)
+	a.commitIndex, enc = marshal.ReadInt(enc)
+	a.entries, _ = decodeLog(enc)
+	return a
+}
+
+type AppendReply struct {
+	err Error
+	// the end of the replica's log, so that the primary knows where to resume
+	// after EAppendOutOfOrder
+	logEnd uint64
+}
+
+func EncodeAppendReply(reply *AppendReply) []byte {
+	var enc = make([]byte, 0, 8*2)
+	enc = marshal.WriteInt(enc, reply.err)
+	return marshal.WriteInt(enc, reply.logEnd)
+}
+
+func DecodeAppendReply(enc_reply []byte) *AppendReply {
+	reply := new(AppendReply)
+	var enc = enc_reply
+	reply.err, enc = marshal.ReadInt(enc)
+	reply.logEnd, _ = marshal.ReadInt(enc)
+	return reply
 }
 
 type Configuration struct {
 	Replicas []grove_ffi.Address
 }
 
+// Same format as util.EncodeConfiguration.
 func EncodeConfiguration(conf *Configuration) []byte {
-	panic("impl")
+	c := util.Configuration(conf.Replicas)
+	return util.EncodeConfiguration(&c)
 }
 
 func DecodeConfiguration(conf_enc []byte) *Configuration {
-	panic("impl")
+	return &Configuration{Replicas: util.DecodeConfiguration(conf_enc)}
 }
 
 type BecomeReplicaArgs struct {
@@ -36,13 +91,59 @@ type BecomeReplicaArgs struct {
 	Log        []LogEntry
 }
 
+func EncodeBecomeReplicaArgs(args *BecomeReplicaArgs) []byte {
+	var enc = make([]byte, 0, 8*3)
+	enc = marshal.WriteInt(enc, args.Epoch)
+	enc = marshal.WriteInt(enc, args.StartIndex)
+	return encodeLog(enc, args.Log)
+}
+
+func DecodeBecomeReplicaArgs(enc_args []byte) *BecomeReplicaArgs {
+	args := new(BecomeReplicaArgs)
+	var enc = enc_args
+	args.Epoch, enc = marshal.ReadInt(enc)
+	args.StartIndex, enc = marshal.ReadInt(enc)
+	args.Log, _ = decodeLog(enc)
+	return args
+}
+
 type BecomePrimaryArgs struct {
 	Epoch uint64
 	Conf  Configuration
 }
 
+func EncodeBecomePrimaryArgs(args *BecomePrimaryArgs) []byte {
+	var enc = make([]byte, 0, 8+8+8*len(args.Conf.Replicas))
+	enc = marshal.WriteInt(enc, args.Epoch)
+	return marshal.WriteBytes(enc, EncodeConfiguration(&args.Conf))
+}
+
+func DecodeBecomePrimaryArgs(enc_args []byte) *BecomePrimaryArgs {
+	args := new(BecomePrimaryArgs)
+	var enc = enc_args
+	args.Epoch, enc = marshal.ReadInt(enc)
+	args.Conf = *DecodeConfiguration(enc)
+	return args
+}
+
 type GetLogReply struct {
 	err        Error
 	log        []LogEntry
 	startIndex uint64
 }
+
+func EncodeGetLogReply(reply *GetLogReply) []byte {
+	var enc = make([]byte, 0, 8*3)
+	enc = marshal.WriteInt(enc, reply.err)
+	enc = marshal.WriteInt(enc, reply.startIndex)
+	return encodeLog(enc, reply.log)
+}
+
+func DecodeGetLogReply(enc_reply []byte) *GetLogReply {
+	reply := new(GetLogReply)
+	var enc = enc_reply
+	reply.err, enc = marshal.ReadInt(enc)
+	reply.startIndex, enc = marshal.ReadInt(enc)
+	reply.log, _ = decodeLog(enc)
+	return reply
+}
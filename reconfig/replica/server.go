@@ -4,6 +4,9 @@ import (
 	"sync"
 
 	"github.com/goose-lang/primitive"
+	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/urpc"
+	"github.com/tchajed/marshal"
 )
 
 type LogEntry = []byte
@@ -17,13 +20,15 @@ type LogEntryAndExtra[ExtraT any] struct {
 }
 
 type DurableState struct {
-	// Append the entry to the end of the log
-	Append func(entry LogEntry)
+	// Append the entry to the end of the log; the returned function waits until
+	// it is durable.
+	Append func(entry LogEntry) func()
 
 	// Update the given three pieces of state atomically
 	SetLog func(startIndex uint64, log []LogEntry)
 
-	// Allow for the prefix of the log up to and including the given `index` to be truncated
+	// Allow for the prefix of the log up to (but not including) the given
+	// `index` to be truncated
 	Truncate func(index uint64)
 
 	SetEpoch func(epoch uint64)
@@ -41,12 +46,20 @@ type Server[ExtraT any] struct {
 	startIndex uint64
 	log        []LogEntryAndExtra[ExtraT]
 
+	// The entries before durableIndex have been made durable. logGen changes
+	// whenever entries are overwritten, so that a wait for earlier entries to
+	// become durable doesn't count for their replacements.
+	durableIndex uint64
+	logGen       uint64
+	durable_cond *sync.Cond
+
 	// This state is not made durable
 	isPrimary  bool
-	clerks     []*Clerk
-	matchIndex []uint64 // the primary remembers how much of the log all the replicas have accepted
+	clerks     map[grove_ffi.Address]*Clerk
+	matchIndex []uint64   // the primary remembers how much of the log all the replicas have accepted
+	send_cond  *sync.Cond // signaled when the primary has something new to send
 
-	commitIndex      uint64     // the commitIndex is not made durable (no need to)
+	commitIndex      uint64     // the number of committed entries; not made durable (no need to)
 	commitIndex_cond *sync.Cond // signaled whenever commitIndex is updated
 	applyFn          ApplyFunc[ExtraT]
 }
@@ -61,41 +74,85 @@ func min(l []uint64) uint64 {
 	return m
 }
 
+// Requires s.mu.
+func (s *Server[ExtraT]) logEnd() uint64 {
+	return s.startIndex + uint64(len(s.log))
+}
+
+// Passes each committed entry to applyFn in order. Skips entries that have been
+// truncated, which is only right if the application has installed a snapshot
+// that covers them.
 func (s *Server[ExtraT]) applyThread() {
-	var appliedIndex uint64 = 0
+	var nextIndex uint64 = 0
 	for {
-		// TODO: add no overflow assumption
-		err, le := s.GetEntry(appliedIndex + 1)
-		primitive.Assert(err == ENone)
+		err, le := s.GetEntry(nextIndex)
+		if err == ETruncated {
+			s.mu.Lock()
+			nextIndex = s.startIndex
+			s.mu.Unlock()
+			continue
+		}
 		s.applyFn(le)
+		nextIndex = nextIndex + 1
 	}
 }
 
-func (s *Server[ExtraT]) postSuccessfulAppendRPC(idx uint64, args *AppendArgs) {
-	s.mu.Lock()
-	// Check if this node has moved on to a future epoch, in which case this
-	// reply to AppendRPC should be ignored.
-	if s.epoch != args.epoch {
-		s.mu.Unlock()
+// Starts passing committed entries to applyFn, for applications that don't
+// read them with GetEntry themselves.
+func (s *Server[ExtraT]) StartApplyThread(applyFn ApplyFunc[ExtraT]) {
+	s.applyFn = applyFn
+	go func() {
+		s.applyThread()
+	}()
+}
+
+// Requires s.mu. Appends entries to the log, and makes them durable in the
+// background.
+func (s *Server[ExtraT]) appendLocked(entries []LogEntryAndExtra[ExtraT]) {
+	if len(entries) == 0 {
 		return
 	}
-
-	// increase matchIndex
-	if args.index > s.matchIndex[idx] {
-		s.matchIndex[idx] = args.index
+	var wait func()
+	for _, le := range entries {
+		s.log = append(s.log, le)
+		wait = s.dstate.Append(le.Op)
 	}
+	end := s.logEnd()
+	gen := s.logGen
+	go func() {
+		wait()
+		s.mu.Lock()
+		if s.logGen == gen && s.durableIndex < end {
+			s.durableIndex = end
+			s.durable_cond.Broadcast()
+		}
+		s.mu.Unlock()
+	}()
+}
 
-	// TODO: can this min be lower than commitIndex across a config change?
-	s.commitIndex = min(s.matchIndex)
-	s.mu.Unlock()
+// Requires s.mu. Called after overwriting the log with dstate.SetLog.
+func (s *Server[ExtraT]) logReplaced() {
+	s.logGen = s.logGen + 1
+	s.durableIndex = s.logEnd()
+	s.durable_cond.Broadcast()
+}
+
+// Requires s.mu.
+func (s *Server[ExtraT]) advanceCommitIndex(index uint64) {
+	if index > s.commitIndex {
+		s.commitIndex = index
+		s.commitIndex_cond.Broadcast()
+		s.send_cond.Broadcast()
+	}
 }
 
 // External function, called by users of this library.
 // Tries to apply the given `op` to the state machine.
 // If unable to apply the operation (e.g. if this server is not currently the
-// primary), returns (ENotPrimary, 0).
-// Otherwise, returns ENone and the index at which to expect the operation,
-// along with the epoch at which it was proposed.
+// primary), returns ENotPrimary.
+// Otherwise, returns ENone, and the op will either be committed, in which case
+// it comes out of GetEntry with extra, or be overwritten in a later epoch, in
+// which case cancelFn is called.
 func (s *Server[ExtraT]) Propose(op LogEntry, extra ExtraT, cancelFn func()) Error {
 	s.mu.Lock()
 	if !s.isPrimary {
@@ -103,128 +160,272 @@ func (s *Server[ExtraT]) Propose(op LogEntry, extra ExtraT, cancelFn func()) Err
 		return ENotPrimary
 	}
 
+	s.appendLocked([]LogEntryAndExtra[ExtraT]{
+		{Op: op, HaveExtra: true, Extra: extra, haveCancel: true, cancelFn: cancelFn},
+	})
 	// now tell everyone else about the op
-	index := s.startIndex + uint64(len(s.log))
-	s.log = append(s.log, LogEntryAndExtra[ExtraT]{Op: op, Extra: extra, haveCancel: true, cancelFn: cancelFn})
-	args := &AppendArgs{epoch: s.epoch, entry: op, index: index}
-	clerks := s.clerks
+	s.send_cond.Broadcast()
 	s.mu.Unlock()
+	return ENone
+}
 
-	// TODO: pipelining; need to be able to send out a second AppendArgs RPC
-	// even after the first one. Ideally, we only send the second one after the
-	// first one has definitely been sent.
-	for i, ck := range clerks {
-		ck := ck
-		idx := i
-		go func() {
-			// keep trying to get entry accepted until it succeeds, or until
-			// we're no longer leader.
-			for {
-				err := ck.appendRPC(args)
-
-				if err == ENone {
-					s.postSuccessfulAppendRPC(uint64(idx), args)
-					break
-				} else if err == EStale {
-					// we are no longer the leader in this epoch
-					s.mu.Lock()
-					if s.epoch == args.epoch { // if we're still in the same epoch,
-						s.isPrimary = false // stop telling people we're the leader
-					}
-					s.mu.Unlock()
-					break
-				} else if err == EAppendOutOfOrder {
-					// retry and hope that the missing append has managed to
-					// reach the server now.
-				}
-				continue
+// How many appends the primary keeps outstanding to each replica.
+const maxInflightAppends = 32
+
+type inflightAppend struct {
+	cl   *urpc.Client
+	cb   *urpc.Callback
+	args *AppendArgs
+}
+
+// The primary keeps replica i of the configuration up to date, for as long as
+// it is primary in epoch: this sends the new entries (and commitIndex, whenever
+// it advances) without waiting for earlier appends to be acknowledged, and
+// receiveThread handles the replies.
+func (s *Server[ExtraT]) sendThread(epoch uint64, i uint64, ck *Clerk) {
+	inflight := make(chan *inflightAppend, maxInflightAppends)
+	// where the next append starts; receiveThread moves this back if an append
+	// is lost
+	sentIndex := new(uint64)
+	var sentCommit uint64 = 0
+	// the first append tells the replica to commit what it has from the last
+	// epoch, once everyone has it
+	var probed = false
+	go func() {
+		s.receiveThread(epoch, i, ck, inflight, sentIndex)
+	}()
+
+	s.mu.Lock()
+	*sentIndex = s.logEnd()
+	for {
+		if s.epoch != epoch || !s.isPrimary {
+			break
+		}
+		if probed && *sentIndex >= s.logEnd() && sentCommit >= s.commitIndex {
+			s.send_cond.Wait()
+			continue
+		}
+		if *sentIndex < s.startIndex {
+			// Can only happen if the replica lost entries that it had
+			// acknowledged, which were then truncated here; it needs to be
+			// reconfigured out.
+			*sentIndex = s.startIndex
+		}
+		args := &AppendArgs{
+			epoch:       epoch,
+			index:       *sentIndex,
+			entries:     FmapList(s.log[*sentIndex-s.startIndex:], forgetExtra[ExtraT]),
+			commitIndex: s.commitIndex,
+		}
+		*sentIndex = s.logEnd()
+		sentCommit = s.commitIndex
+		probed = true
+		s.mu.Unlock()
+
+		cl, cb, err := ck.appendStart(args)
+		if err == ENone {
+			inflight <- &inflightAppend{cl: cl, cb: cb, args: args}
+		}
+		s.mu.Lock()
+		if err != ENone {
+			// resend from what the replica is known to have
+			*sentIndex = s.matchIndex[i]
+		}
+	}
+	s.mu.Unlock()
+	close(inflight)
+}
+
+func (s *Server[ExtraT]) receiveThread(epoch uint64, i uint64, ck *Clerk, inflight chan *inflightAppend, sentIndex *uint64) {
+	for a := range inflight {
+		err, logEnd := ck.appendComplete(a.cl, a.cb)
+		if err == EAppendOutOfOrder {
+			// don't resend in a tight loop while the replica catches up
+			primitive.Sleep(1_000_000) // 1ms
+		}
+		s.mu.Lock()
+		if s.epoch != epoch || !s.isPrimary {
+			s.mu.Unlock()
+			continue
+		}
+		if err == ENone {
+			end := a.args.index + uint64(len(a.args.entries))
+			if end > s.matchIndex[i] {
+				s.matchIndex[i] = end
+				s.advanceCommitIndex(min(s.matchIndex))
 			}
-		}()
+		} else if err == EStale {
+			// we are no longer the primary in this epoch
+			s.isPrimary = false
+			s.send_cond.Broadcast()
+		} else if err == EAppendOutOfOrder {
+			// the replica is missing entries before these ones
+			if logEnd < *sentIndex {
+				*sentIndex = logEnd
+			} else {
+				*sentIndex = s.matchIndex[i]
+			}
+			s.send_cond.Broadcast()
+		} else {
+			// lost; everything sent after it will be out of order, so start
+			// again from what the replica is known to have
+			*sentIndex = s.matchIndex[i]
+			s.send_cond.Broadcast()
+		}
+		s.mu.Unlock()
 	}
-	return ENone
 }
 
 // Blocking function that waits for something to be committed at the given
 // index, then returns what's been committed.
-// Requires that the server's epoch number is at least `epoch`.
 // Possible errors:
 //
 //	ETruncated iff the log has been truncated past the specified index.
-//	EStale iff the server's epoch number is higher than the specified one.
 func (s *Server[ExtraT]) GetEntry(index uint64) (Error, LogEntryAndExtra[ExtraT]) {
 	s.mu.Lock()
-	for s.commitIndex < index {
+	for s.commitIndex <= index {
 		s.commitIndex_cond.Wait()
 	}
 
 	if s.startIndex <= index {
+		le := s.log[index-s.startIndex]
 		s.mu.Unlock()
-		return ENone, s.log[index-s.startIndex]
+		return ENone, le
 	} else {
 		s.mu.Unlock()
 		return ETruncated, LogEntryAndExtra[ExtraT]{}
 	}
 }
 
+// Discards the entries before index, which must all have been applied (or be
+// covered by a snapshot the application installed).
 func (s *Server[ExtraT]) Truncate(index uint64) {
 	s.mu.Lock()
-	if index >= uint64(len(s.log))+s.startIndex {
+	if index <= s.startIndex {
+		s.mu.Unlock()
+		return
+	}
+	if index >= s.logEnd() {
 		s.log = make([]LogEntryAndExtra[ExtraT], 0)
 	} else {
 		s.log = s.log[index-s.startIndex:]
 	}
 	s.startIndex = index
-	if s.commitIndex < s.startIndex {
-		s.commitIndex = s.startIndex
+	s.advanceCommitIndex(s.startIndex)
+	if s.durableIndex < s.startIndex {
+		s.durableIndex = s.startIndex
 	}
 	s.dstate.Truncate(index)
 	s.mu.Unlock()
 }
 
-// Internal RPC. Applies a single operation to a replica.
-// Must have made sure that this replica has already entered the epoch.
-func (s *Server[ExtraT]) appendRPC(args *AppendArgs) Error {
+// Discards the whole log, which then starts (empty) at index. This is for
+// installing a snapshot of the state after the first index entries, on a server
+// that is about to join a configuration with TryBecomeReplicaRPC.
+func (s *Server[ExtraT]) ResetLog(index uint64) {
 	s.mu.Lock()
+	prevLog := s.log
+	s.isPrimary = false
+	s.startIndex = index
+	s.log = make([]LogEntryAndExtra[ExtraT], 0)
+	s.dstate.SetLog(index, make([]LogEntry, 0))
+	s.logReplaced()
+	// the old log might have been ahead
+	s.commitIndex = index
+	s.commitIndex_cond.Broadcast()
+	s.send_cond.Broadcast()
+	s.mu.Unlock()
 
-	if s.isEpochStale(args.epoch) {
-		s.mu.Unlock()
-		return EStale
+	cancelAll(prevLog)
+}
+
+func appendDone(err Error, end uint64) func() (Error, uint64) {
+	return func() (Error, uint64) {
+		return err, end
 	}
-	// else, the epoch is up-to-date
+}
 
-	if args.index < s.startIndex+uint64(len(s.log)) {
+// Internal RPC, in two steps. Appends a batch of operations to a replica, and
+// returns a function that waits until they are durable and then returns the
+// end of the log. Only the first step needs to run in the order the primary
+// sent the batches, so the replica can append more batches while the earlier
+// ones are being made durable.
+// Must have made sure that this replica has already entered the epoch.
+func (s *Server[ExtraT]) appendRPC(args *AppendArgs) func() (Error, uint64) {
+	s.mu.Lock()
+
+	if args.epoch < s.epoch {
 		s.mu.Unlock()
-		return ENone // already accepted it
-	} else if args.index > s.startIndex+uint64(len(s.log)) {
+		return appendDone(EStale, 0)
+	}
+	if args.epoch > s.epoch {
+		// the admin hasn't told this replica about the epoch yet, so its log
+		// may not match the primary's
+		end := s.logEnd()
 		s.mu.Unlock()
-		return EAppendOutOfOrder
+		return appendDone(EAppendOutOfOrder, end)
 	}
-	// else, must have args.index == s.startIndex + uint64(len(s.log))
-
-	s.log = append(s.log, LogEntryAndExtra[ExtraT]{Op: args.entry})
-	s.dstate.Append(args.entry) // make stuff durable
 
+	end := s.logEnd()
+	if args.index > end {
+		s.mu.Unlock()
+		return appendDone(EAppendOutOfOrder, end)
+	}
+	// skip what we already have
+	newEnd := args.index + uint64(len(args.entries))
+	if newEnd > end {
+		s.appendLocked(FmapList(args.entries[end-args.index:], addDefaultExtra[ExtraT]))
+	}
+	// Within an epoch, the log here is a prefix of the primary's.
+	if args.commitIndex < s.logEnd() {
+		s.advanceCommitIndex(args.commitIndex)
+	} else {
+		s.advanceCommitIndex(s.logEnd())
+	}
+	gen := s.logGen
 	s.mu.Unlock()
-	return ENone
+
+	return func() (Error, uint64) {
+		s.mu.Lock()
+		for s.durableIndex < newEnd && s.logGen == gen && s.epoch == args.epoch {
+			s.durable_cond.Wait()
+		}
+		if s.epoch != args.epoch {
+			s.mu.Unlock()
+			return EStale, 0
+		}
+		if s.durableIndex < newEnd {
+			// the log was replaced
+			end := s.logEnd()
+			s.mu.Unlock()
+			return EAppendOutOfOrder, end
+		}
+		end := s.logEnd()
+		s.mu.Unlock()
+		return ENone, end
+	}
 }
 
-// Enters new epoch.
+// Requires s.mu. Enters the epoch if it's newer.
 // returns true iff stale
 func (s *Server[ExtraT]) isEpochStale(epoch uint64) bool {
-	s.mu.Lock()
 	if s.epoch > epoch {
-		s.mu.Unlock()
 		return true
 	} else if s.epoch < epoch {
-		s.commitIndex_cond.Broadcast()
-		s.epoch = epoch
-		s.dstate.SetEpoch(epoch)
-		s.isPrimary = false
+		s.enterEpoch(epoch)
 	}
-	s.mu.Unlock()
 	return false
 }
 
+// Requires s.mu.
+func (s *Server[ExtraT]) enterEpoch(epoch uint64) {
+	s.epoch = epoch
+	s.dstate.SetEpoch(epoch)
+	s.isPrimary = false
+	s.send_cond.Broadcast()
+	s.durable_cond.Broadcast()
+}
+
 // Must only be invoked after the primary has already entered the new epoch.
 func (s *Server[ExtraT]) BecomePrimary(args *BecomePrimaryArgs) Error {
 	s.mu.Lock()
@@ -238,15 +439,20 @@ func (s *Server[ExtraT]) BecomePrimary(args *BecomePrimaryArgs) Error {
 	}
 
 	s.matchIndex = make([]uint64, len(args.Conf.Replicas))
+	s.isPrimary = true
 
-	// make clerks
-	s.clerks = make([]*Clerk, len(args.Conf.Replicas))
-	for i := range s.clerks {
-		s.clerks[i] = MakeClerk(args.Conf.Replicas[i])
+	for i, host := range args.Conf.Replicas {
+		ck, ok := s.clerks[host]
+		if !ok {
+			ck = MakeClerk(host)
+			s.clerks[host] = ck
+		}
+		idx := uint64(i)
+		go func() {
+			s.sendThread(args.Epoch, idx, ck)
+		}()
 	}
 
-	s.isPrimary = true
-
 	s.mu.Unlock()
 	return ENone
 }
@@ -260,6 +466,14 @@ func FmapList[T, S any](la []T, f func(T) S) []S {
 	return ret
 }
 
+func cancelAll[ExtraT any](log []LogEntryAndExtra[ExtraT]) {
+	for _, le := range log {
+		if le.haveCancel {
+			le.cancelFn()
+		}
+	}
+}
+
 // Tell this server to become a backup in the new configuration cn, with the
 // given log and epoch.
 //
@@ -269,96 +483,84 @@ func FmapList[T, S any](la []T, f func(T) S) []S {
 // EIncompleteLog and doesn't promise to have accepted args.log.
 func (s *Server[ExtraT]) TryBecomeReplicaRPC(args *BecomeReplicaArgs) Error {
 	s.mu.Lock()
-	// if this is not a BRAND NEW epoch number, ignore it
-	if args.Epoch <= s.epoch {
+	if args.Epoch < s.epoch {
 		s.mu.Unlock()
 		return EStale
 	}
-	s.epoch = args.Epoch
-
-	s.isPrimary = false
-
-	s.epoch = args.Epoch
-	s.dstate.SetEpoch(args.Epoch)
-
-	// XXX: We could do the following, but it's easier to only accept the log if
-	// s.startIndex >= args.startIndex, since that should be the case most of
-	// the time if doing a good reconfiguration.
-	/*
-		if args.startIndex > s.commitIndex {
-			// server can't accept
-			s.mu.Unlock()
-			return EIncompleteLog
-		}
-	*/
 
-	if args.StartIndex > s.startIndex {
-		// server won't accept; technically it could if args.startIndex <=
-		// s.commitIndex, see above comment.
+	// XXX: We could also accept the log if args.StartIndex <= s.commitIndex,
+	// but it's easier to only accept it if s.startIndex >= args.StartIndex,
+	// since that should be the case most of the time if doing a good
+	// reconfiguration (the state snapshot is from before args.StartIndex).
+	argsEnd := args.StartIndex + uint64(len(args.Log))
+	if args.StartIndex > s.startIndex || s.startIndex > argsEnd {
 		s.mu.Unlock()
 		return EIncompleteLog
 	}
+	if args.Epoch > s.epoch {
+		s.enterEpoch(args.Epoch)
+	}
+	s.isPrimary = false
 
 	prevLog := s.log
-	s.log = FmapList(args.Log[s.startIndex-args.StartIndex:],
-		func(e LogEntry) LogEntryAndExtra[ExtraT] {
-			return LogEntryAndExtra[ExtraT]{Op: e}
-		})
+	s.log = FmapList(args.Log[s.startIndex-args.StartIndex:], addDefaultExtra[ExtraT])
 
-	s.dstate.SetLog(args.StartIndex, args.Log)
+	s.dstate.SetLog(s.startIndex, FmapList(s.log, forgetExtra[ExtraT]))
+	s.logReplaced()
+	s.advanceCommitIndex(s.startIndex)
 	s.mu.Unlock()
 
 	// conservatively cancel all old ops
-	for _, le := range prevLog {
-		if le.haveCancel {
-			le.cancelFn()
-		}
-	}
+	cancelAll(prevLog)
 	return ENone
 }
 
-// Only possible error is EStale
+// Tell this server, which was a replica in the previous configuration, to
+// remain one in the new configuration, with the given log (which was taken from
+// some replica of the previous configuration, so it's either a prefix of this
+// server's log or has this server's log as a prefix).
+//
+// Possible errors are EStale, and EIncompleteLog if this server is missing
+// entries before args.StartIndex.
 func (s *Server[ExtraT]) RemainReplica(args *BecomeReplicaArgs) Error {
 	s.mu.Lock()
-	// if this is not a BRAND NEW epoch number, ignore it
-	if args.Epoch <= s.epoch {
+	if args.Epoch < s.epoch {
 		s.mu.Unlock()
 		return EStale
 	}
-	s.epoch = args.Epoch
-	s.dstate.SetEpoch(args.Epoch)
-
+	if args.Epoch > s.epoch {
+		s.enterEpoch(args.Epoch)
+	}
 	s.isPrimary = false
 
-	primitive.Assert(args.StartIndex < s.startIndex+uint64(len(s.log)))
-
-	if args.StartIndex+uint64(len(args.Log)) < s.startIndex+uint64(len(s.log)) {
-		// trim log
-		prevLog := s.log
-		s.log = s.log[:uint64(len(s.log))+args.StartIndex-s.startIndex]
-
-		// cancel overwritten ops
-		for _, le := range prevLog[uint64(len(s.log))+args.StartIndex-s.startIndex:] {
-			if le.haveCancel {
-				le.cancelFn()
-			}
+	argsEnd := args.StartIndex + uint64(len(args.Log))
+	end := s.logEnd()
+	var overwritten = make([]LogEntryAndExtra[ExtraT], 0)
+	if argsEnd < end {
+		// trim log, cancelling overwritten ops
+		var keep = uint64(0)
+		if argsEnd > s.startIndex {
+			keep = argsEnd - s.startIndex
+		}
+		overwritten = s.log[keep:]
+		s.log = s.log[:keep]
+	} else if argsEnd > end {
+		if end < args.StartIndex {
+			// we lost entries that were committed
+			s.mu.Unlock()
+			return EIncompleteLog
 		}
-	} else if args.StartIndex+uint64(len(args.Log)) > s.startIndex+uint64(len(s.log)) {
 		// grow log
 		s.log = append(s.log,
-			FmapList(args.Log[s.startIndex+uint64(len(s.log))-args.StartIndex:], addDefaultExtra[ExtraT])...)
-	}
-
-	if args.StartIndex > s.commitIndex {
-		s.commitIndex = args.StartIndex
-		s.commitIndex_cond.Broadcast()
+			FmapList(args.Log[end-args.StartIndex:], addDefaultExtra[ExtraT])...)
 	}
 
-	s.log = FmapList(args.Log, addDefaultExtra[ExtraT])
-
 	s.dstate.SetLog(s.startIndex, FmapList(s.log, forgetExtra[ExtraT]))
+	s.logReplaced()
+	s.advanceCommitIndex(args.StartIndex)
 	s.mu.Unlock()
 
+	cancelAll(overwritten)
 	return ENone
 }
 
@@ -370,6 +572,8 @@ func addDefaultExtra[ExtraT any](l LogEntry) LogEntryAndExtra[ExtraT] {
 	return LogEntryAndExtra[ExtraT]{Op: l}
 }
 
+// Enters the epoch, so that this server stops accepting appends from earlier
+// ones, and returns its log.
 func (s *Server[ExtraT]) GetUncommittedLog(epoch uint64) *GetLogReply {
 	s.mu.Lock()
 	reply := new(GetLogReply)
@@ -379,14 +583,67 @@ func (s *Server[ExtraT]) GetUncommittedLog(epoch uint64) *GetLogReply {
 		return reply
 	}
 
-	reply.log = FmapList(s.log[(s.commitIndex-s.startIndex):], forgetExtra[ExtraT])
-	reply.startIndex = s.commitIndex
+	// A new server needs the entries after its state snapshot, which might be
+	// from before commitIndex, so return all of them.
+	reply.log = FmapList(s.log, forgetExtra[ExtraT])
+	reply.startIndex = s.startIndex
 	reply.err = ENone
 
 	s.mu.Unlock()
 	return reply
 }
 
+// The epoch this server is in.
+func (s *Server[ExtraT]) Epoch() uint64 {
+	s.mu.Lock()
+	epoch := s.epoch
+	s.mu.Unlock()
+	return epoch
+}
+
+// Adds the handlers for this server's RPCs to handlers.
+func (s *Server[ExtraT]) registerHandlers(handlers map[uint64]func([]byte, *[]byte)) {
+	handlers[RPC_BECOMEPRIMARY] = func(args []byte, reply *[]byte) {
+		*reply = marshal.WriteInt(nil, s.BecomePrimary(DecodeBecomePrimaryArgs(args)))
+	}
+	handlers[RPC_TRYBECOMEREPLICA] = func(args []byte, reply *[]byte) {
+		*reply = marshal.WriteInt(nil, s.TryBecomeReplicaRPC(DecodeBecomeReplicaArgs(args)))
+	}
+	handlers[RPC_REMAINREPLICA] = func(args []byte, reply *[]byte) {
+		*reply = marshal.WriteInt(nil, s.RemainReplica(DecodeBecomeReplicaArgs(args)))
+	}
+	handlers[RPC_GETUNCOMMITTEDLOG] = func(args []byte, reply *[]byte) {
+		epoch, _ := marshal.ReadInt(args)
+		*reply = EncodeGetLogReply(s.GetUncommittedLog(epoch))
+	}
+}
+
+// Serves this server's RPCs, along with the application's appHandlers (which
+// should use rpcids from 16 up), at me. Only the admin may call appAdminRPCs.
+func (s *Server[ExtraT]) Serve(me grove_ffi.Address, appHandlers map[uint64]func([]byte, *[]byte), appAdminRPCs []uint64) {
+	handlers := make(map[uint64]func([]byte, *[]byte))
+	for rpcid, h := range appHandlers {
+		handlers[rpcid] = h
+	}
+	s.registerHandlers(handlers)
+
+	rs := urpc.MakeServer(handlers)
+	// The primary pipelines appends, and relies on them arriving in order; but
+	// only appending needs to be in order, not waiting for durability.
+	rs.HandleOrdered(RPC_APPEND, func(args []byte) func(reply *[]byte) {
+		wait := s.appendRPC(DecodeAppendArgs(args))
+		return func(reply *[]byte) {
+			err, logEnd := wait()
+			*reply = EncodeAppendReply(&AppendReply{err: err, logEnd: logEnd})
+		}
+	})
+	// only the reconfiguration admin changes epochs
+	rs.RestrictToAdmin([]uint64{RPC_BECOMEPRIMARY, RPC_TRYBECOMEREPLICA,
+		RPC_REMAINREPLICA, RPC_GETUNCOMMITTEDLOG})
+	rs.RestrictToAdmin(appAdminRPCs)
+	rs.Serve(me)
+}
+
 type ProtocolState struct {
 	epoch      uint64
 	startIndex uint64
@@ -397,14 +654,15 @@ func MakeServer[ExtraT any](dstate *DurableState, pstate *ProtocolState) *Server
 	s := new(Server[ExtraT])
 	s.mu = new(sync.Mutex)
 	s.dstate = dstate
+	s.durable_cond = sync.NewCond(s.mu)
+	s.send_cond = sync.NewCond(s.mu)
+	s.commitIndex_cond = sync.NewCond(s.mu)
+	s.clerks = make(map[grove_ffi.Address]*Clerk)
 
 	s.epoch = pstate.epoch
 	s.startIndex = pstate.startIndex
-	s.log = FmapList(pstate.log,
-		func(op LogEntry) LogEntryAndExtra[ExtraT] {
-			return LogEntryAndExtra[ExtraT]{Op: op}
-		},
-	)
+	s.log = FmapList(pstate.log, addDefaultExtra[ExtraT])
+	s.durableIndex = s.logEnd()
 
 	// We know that things are only truncated are being committed. Other than
 	// that, we don't bother remembering anything about commitIndex
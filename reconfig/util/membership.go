@@ -2,14 +2,31 @@ package util
 
 import (
 	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/tchajed/marshal"
 )
 
 type Configuration []grove_ffi.Address
 
+// Same format as vrsm/configservice.EncodeConfig: the number of addresses, then
+// the addresses.
 func EncodeConfiguration(c *Configuration) []byte {
-	panic("util: impl")
+	var enc = make([]byte, 0, 8+8*uint64(len(*c)))
+	enc = marshal.WriteInt(enc, uint64(len(*c)))
+	for _, h := range *c {
+		enc = marshal.WriteInt(enc, h)
+	}
+	return enc
 }
 
 func DecodeConfiguration(raw_config []byte) Configuration {
-	panic("util: impl")
+	var enc = raw_config
+	var n uint64
+	n, enc = marshal.ReadInt(enc)
+	c := make(Configuration, n)
+	var i = uint64(0)
+	for i < n {
+		c[i], enc = marshal.ReadInt(enc)
+		i++
+	}
+	return c
 }
@@ -1,6 +1,7 @@
 package reconnectclient
 
 import (
+	"context"
 	"sync"
 
 	"github.com/goose-lang/primitive"
@@ -15,15 +16,23 @@ type ReconnectingClient struct {
 	// making    bool
 	// made_cond *sync.Cond
 	addr grove_ffi.Address
+	src  grove_ffi.Address // see MakeReconnectingClientFrom
 }
 
 func MakeReconnectingClient(addr grove_ffi.Address) *ReconnectingClient {
+	return MakeReconnectingClientFrom(0, addr)
+}
+
+// Like MakeReconnectingClient, for a client used by the server listening at
+// src (see grove_ffi.ConnectFrom).
+func MakeReconnectingClientFrom(src grove_ffi.Address, addr grove_ffi.Address) *ReconnectingClient {
 	r := new(ReconnectingClient)
 	r.mu = new(sync.Mutex)
 	r.valid = false
 	// r.making = false
 	// r.made_cond = sync.NewCond(r.mu)
 	r.addr = addr
+	r.src = src
 	return r
 }
 
@@ -40,7 +49,7 @@ func (cl *ReconnectingClient) getClient() (uint64, *urpc.Client) {
 	cl.mu.Unlock()
 	var newRpcCl *urpc.Client
 	var err uint64
-	err, newRpcCl = urpc.TryMakeClient(cl.addr)
+	err, newRpcCl = urpc.TryMakeClientFrom(cl.src, cl.addr)
 
 	if err != 0 {
 		// FIXME: get rid of this throttling, now that there's no loop?
@@ -73,3 +82,19 @@ func (cl *ReconnectingClient) Call(rpcid uint64, args []byte, reply *[]byte, tim
 	}
 	return err
 }
+
+// Like Call, but gives up with urpc.ErrCanceled once ctx is done (see
+// urpc.Client.CallContext).
+func (cl *ReconnectingClient) CallContext(ctx context.Context, rpcid uint64, args []byte, reply *[]byte, timeout_ms uint64) uint64 {
+	err1, urpcCl := cl.getClient()
+	if err1 != 0 {
+		return err1
+	}
+	err := urpcCl.CallContext(ctx, rpcid, args, reply, timeout_ms)
+	if err == urpc.ErrDisconnect {
+		cl.mu.Lock()
+		cl.valid = false
+		cl.mu.Unlock()
+	}
+	return err
+}
@@ -0,0 +1,161 @@
+package trace
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type Config struct {
+	// where spans are written; appended to if it exists
+	File string
+	// the service.name of this process's spans, e.g. "vkv-server"
+	Service string
+	// the fraction of new traces to record, from 0 (none) to 1 (all)
+	SampleRate float64
+}
+
+// Turns on tracing in this process. Traces that started elsewhere are recorded
+// (if they were sampled there) even if SampleRate is 0.
+func Init(cfg *Config) error {
+	f, err := os.OpenFile(cfg.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	e := &fileExporter{f: f, w: bufio.NewWriter(f), service: cfg.Service}
+	if old := current.Swap(&config{exporter: e, sampleRate: cfg.SampleRate}); old != nil {
+		old.exporter.close()
+	}
+	go e.flushThread()
+	return nil
+}
+
+// Writes out any spans not yet written, and turns tracing off.
+func Shutdown() error {
+	cfg := current.Swap(nil)
+	if cfg == nil {
+		return nil
+	}
+	return cfg.exporter.close()
+}
+
+// How often buffered spans are written to the file.
+const flushInterval = time.Second
+
+type fileExporter struct {
+	mu      sync.Mutex
+	f       *os.File
+	w       *bufio.Writer
+	service string
+	closed  bool
+}
+
+func (e *fileExporter) flushThread() {
+	for {
+		time.Sleep(flushInterval)
+		e.mu.Lock()
+		if e.closed {
+			e.mu.Unlock()
+			return
+		}
+		e.w.Flush()
+		e.mu.Unlock()
+	}
+}
+
+func (e *fileExporter) close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.closed = true
+	if err := e.w.Flush(); err != nil {
+		e.f.Close()
+		return err
+	}
+	return e.f.Close()
+}
+
+// The OTLP/JSON encoding of a span, as one ExportTraceServiceRequest.
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              Kind       `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []otlpAttr `json:"attributes,omitempty"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttr `json:"attributes"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func (e *fileExporter) export(s *Span, end time.Time) {
+	span := otlpSpan{
+		TraceID:           s.sc.TraceID.String(),
+		SpanID:            s.sc.SpanID.String(),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: unixNano(s.start),
+		EndTimeUnixNano:   unixNano(end),
+	}
+	if s.parent != (SpanID{}) {
+		span.ParentSpanID = s.parent.String()
+	}
+	s.mu.Lock()
+	for _, a := range s.attrs {
+		span.Attributes = append(span.Attributes, otlpAttr{Key: a.key, Value: otlpValue{a.value}})
+	}
+	s.mu.Unlock()
+	line, _ := json.Marshal(&otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpAttr{
+			{Key: "service.name", Value: otlpValue{e.service}},
+		}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "github.com/mit-pdos/gokv"},
+			Spans: []otlpSpan{span},
+		}},
+	}}})
+
+	e.mu.Lock()
+	if !e.closed {
+		e.w.Write(line)
+		e.w.WriteByte('\n')
+	}
+	e.mu.Unlock()
+}
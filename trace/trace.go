@@ -0,0 +1,202 @@
+package trace
+
+// Request tracing. A trace is a tree of spans, each timing one step of handling
+// a request (a clerk's retry loop, an RPC, a wait for durability, ...). Spans
+// are passed down in a context.Context, and across RPCs by urpc, which sends
+// the SpanContext of the caller along with the request.
+//
+// Whether a trace is recorded is decided once, when its root span starts (see
+// Config.SampleRate); every span below it, in any process, follows that
+// decision. Spans of recorded traces are written, as they end, to the file
+// given to Init, one per line, in the OTLP/JSON format (as written by the
+// OpenTelemetry collector's file exporter), so that files from several
+// processes can be concatenated and loaded into any OpenTelemetry-compatible
+// viewer.
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"math/rand/v2"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+func (id SpanID) String() string  { return hex.EncodeToString(id[:]) }
+
+// Identifies a span, so that spans started below it (perhaps in another
+// process) can name it as their parent.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// Encodes sc as three uint64s, for sending in an RPC header.
+func (sc SpanContext) Words() (uint64, uint64, uint64) {
+	return binary.BigEndian.Uint64(sc.TraceID[:8]), binary.BigEndian.Uint64(sc.TraceID[8:]),
+		binary.BigEndian.Uint64(sc.SpanID[:])
+}
+
+// The SpanContext of a sampled span, encoded by Words.
+func FromWords(t1 uint64, t2 uint64, s uint64) SpanContext {
+	var sc SpanContext
+	binary.BigEndian.PutUint64(sc.TraceID[:8], t1)
+	binary.BigEndian.PutUint64(sc.TraceID[8:], t2)
+	binary.BigEndian.PutUint64(sc.SpanID[:], s)
+	sc.Sampled = true
+	return sc
+}
+
+type Kind uint64
+
+// As in OTLP.
+const (
+	KindInternal = Kind(1)
+	KindServer   = Kind(2)
+	KindClient   = Kind(3)
+)
+
+type attr struct {
+	key   string
+	value string
+}
+
+// A step of handling a request. The methods of a nil *Span, which is what
+// Start returns for traces that aren't recorded, do nothing.
+type Span struct {
+	sc     SpanContext
+	parent SpanID // zero for a root span
+	name   string
+	kind   Kind
+	start  time.Time
+
+	mu    sync.Mutex
+	attrs []attr
+	ended bool
+}
+
+type config struct {
+	exporter   *fileExporter
+	sampleRate float64
+}
+
+// nil until Init
+var current atomic.Pointer[config]
+
+func getConfig() *config {
+	return current.Load()
+}
+
+type ctxKey struct{}
+
+// The context of the span in ctx, if there is one.
+func SpanContextFrom(ctx context.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(ctxKey{}).(SpanContext)
+	return sc, ok
+}
+
+// Returns a context whose spans are children of the (remote) span sc.
+func WithRemoteParent(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, ctxKey{}, sc)
+}
+
+func newSpanID() SpanID {
+	var id SpanID
+	binary.BigEndian.PutUint64(id[:], rand.Uint64())
+	return id
+}
+
+// Starts a span called name, as a child of the span in ctx; if ctx has no span,
+// this is the root of a new trace, which is recorded with probability
+// Config.SampleRate. Returns a context for the children of the new span. The
+// span is nil if the trace isn't recorded.
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	return StartKind(ctx, name, KindInternal)
+}
+
+func StartKind(ctx context.Context, name string, kind Kind) (context.Context, *Span) {
+	cfg := getConfig()
+	if cfg == nil {
+		return ctx, nil
+	}
+	parent, ok := SpanContextFrom(ctx)
+	if ok && !parent.Sampled {
+		return ctx, nil
+	}
+	s := &Span{name: name, kind: kind, start: time.Now()}
+	if ok {
+		s.sc.TraceID = parent.TraceID
+		s.parent = parent.SpanID
+	} else {
+		if rand.Float64() >= cfg.sampleRate {
+			// record that this trace isn't sampled, so its children aren't
+			// either
+			return context.WithValue(ctx, ctxKey{}, SpanContext{}), nil
+		}
+		binary.BigEndian.PutUint64(s.sc.TraceID[:8], rand.Uint64())
+		binary.BigEndian.PutUint64(s.sc.TraceID[8:], rand.Uint64())
+	}
+	s.sc.SpanID = newSpanID()
+	s.sc.Sampled = true
+	return context.WithValue(ctx, ctxKey{}, s.sc), s
+}
+
+func (s *Span) SetAttr(key string, value string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs = append(s.attrs, attr{key, value})
+	s.mu.Unlock()
+}
+
+func (s *Span) SetAttrInt(key string, value uint64) {
+	s.SetAttr(key, strconv.FormatUint(value, 10))
+}
+
+// Ends the span, and writes it out. Only the first call does anything.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	end := time.Now()
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.mu.Unlock()
+	if cfg := getConfig(); cfg != nil {
+		cfg.exporter.export(s, end)
+	}
+}
+
+// Like StartKind, but only if ctx has a recorded span to be the parent; never
+// starts a new trace. For layers, like RPC libraries, that are only worth
+// tracing as part of some larger request.
+func StartChild(ctx context.Context, name string, kind Kind) (context.Context, *Span) {
+	parent, ok := SpanContextFrom(ctx)
+	if !ok || !parent.Sampled {
+		return ctx, nil
+	}
+	return StartKind(ctx, name, kind)
+}
+
+// Returns a context with the same span as ctx (if any), but not its deadline
+// or cancellation, for work that's part of the same request but must not give
+// up when the caller does.
+func Detach(ctx context.Context) context.Context {
+	sc, ok := SpanContextFrom(ctx)
+	if !ok {
+		return context.Background()
+	}
+	return context.WithValue(context.Background(), ctxKey{}, sc)
+}
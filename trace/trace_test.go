@@ -0,0 +1,102 @@
+package trace
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Reads back the spans written to fname.
+func readSpans(t *testing.T, fname string) []otlpSpan {
+	f, err := os.Open(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	spans := make([]otlpSpan, 0)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var tr otlpTraces
+		if err := json.Unmarshal(sc.Bytes(), &tr); err != nil {
+			t.Fatalf("bad line %q: %v", sc.Text(), err)
+		}
+		for _, rs := range tr.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}
+	return spans
+}
+
+func TestParentsAndExport(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "trace.json")
+	if err := Init(&Config{File: fname, Service: "test", SampleRate: 1}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, root := Start(context.Background(), "root")
+	_, child := StartChild(ctx, "child", KindClient)
+	child.SetAttrInt("n", 3)
+	child.End()
+	child.End() // only written once
+
+	// as on the other end of an RPC
+	sc, _ := SpanContextFrom(ctx)
+	remote := WithRemoteParent(context.Background(), FromWords(sc.Words()))
+	_, server := StartKind(remote, "server", KindServer)
+	server.End()
+	root.End()
+	if err := Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := readSpans(t, fname)
+	if len(spans) != 3 {
+		t.Fatalf("got %d spans: %+v", len(spans), spans)
+	}
+	c, s, r := spans[0], spans[1], spans[2]
+	if r.Name != "root" || r.ParentSpanID != "" || len(r.TraceID) != 32 {
+		t.Errorf("root %+v", r)
+	}
+	if c.Name != "child" || c.TraceID != r.TraceID || c.ParentSpanID != r.SpanID || c.Kind != KindClient {
+		t.Errorf("child %+v of %+v", c, r)
+	}
+	if len(c.Attributes) != 1 || c.Attributes[0].Key != "n" || c.Attributes[0].Value.StringValue != "3" {
+		t.Errorf("child attributes %+v", c.Attributes)
+	}
+	if s.Name != "server" || s.TraceID != r.TraceID || s.ParentSpanID != r.SpanID {
+		t.Errorf("server %+v of %+v", s, r)
+	}
+}
+
+func TestSampling(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "trace.json")
+	if err := Init(&Config{File: fname, Service: "test", SampleRate: 0}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, root := Start(context.Background(), "root")
+	if root != nil {
+		t.Errorf("sampled a trace at rate 0")
+	}
+	// children follow the root's decision
+	if _, child := Start(ctx, "child"); child != nil {
+		t.Errorf("started a child of an unsampled span")
+	}
+	// no new traces from StartChild
+	if _, s := StartChild(context.Background(), "rpc", KindClient); s != nil {
+		t.Errorf("StartChild started a trace")
+	}
+	// but traces from elsewhere are recorded
+	remote := WithRemoteParent(context.Background(), FromWords(1, 2, 3))
+	_, server := StartKind(remote, "server", KindServer)
+	server.End()
+	Shutdown()
+
+	spans := readSpans(t, fname)
+	if len(spans) != 1 || spans[0].ParentSpanID != "0000000000000003" {
+		t.Errorf("spans %+v", spans)
+	}
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"flag"
-	"fmt"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
@@ -18,16 +17,16 @@ func main() {
 		log.Println(http.ListenAndServe("localhost:6060", nil))
 	}()
 
-	var port uint64
-	flag.Uint64Var(&port, "port", 0, "port number to user for server")
+	var port string
+	flag.StringVar(&port, "port", "", "port number to user for server (or an address to listen on, e.g. [::]:PORT or unix:PATH)")
 	flag.Parse()
-	if port == 0 {
+	if port == "" {
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
 
-	me := grove_ffi.MakeAddress(fmt.Sprintf("0.0.0.0:%d", port))
+	me := grove_ffi.MakeListenAddress(port)
 	lockservice.MakeServer().Start(me)
-	log.Printf("Started lock server on port %d; id %d", port, me)
+	log.Printf("Started lock server on %s; id %d", port, me)
 	select {}
 }
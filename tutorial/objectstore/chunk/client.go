@@ -4,6 +4,7 @@ import (
 	"github.com/mit-pdos/gokv/connman"
 	"github.com/mit-pdos/gokv/grove_ffi"
 	"github.com/mit-pdos/gokv/tutorial/objectstore/chunk/writechunk_gk"
+	"github.com/mit-pdos/gokv/urpc"
 )
 
 type WriteID = uint64
@@ -19,15 +20,19 @@ type ClerkPool struct {
 	cm *connman.ConnMan
 }
 
-func (ck *ClerkPool) WriteChunk(addr grove_ffi.Address, args writechunk_gk.S) {
+// Returns urpc.ErrUnknownRPC if addr isn't a chunk server (that knows
+// WriteChunk), in which case nothing was written.
+func (ck *ClerkPool) WriteChunk(addr grove_ffi.Address, args writechunk_gk.S) urpc.Error {
 	req := writechunk_gk.Marshal(args, make([]byte, 0))
 	reply := new([]byte)
-	ck.cm.CallAtLeastOnce(addr, WriteChunkId, req, reply, 100 /*ms*/)
+	return ck.cm.CallAtLeastOnce(addr, WriteChunkId, req, reply, 100 /*ms*/)
 }
 
-func (ck *ClerkPool) GetChunk(addr grove_ffi.Address, content_hash string) []byte {
+// Returns urpc.ErrUnknownRPC if addr isn't a chunk server (that knows
+// GetChunk).
+func (ck *ClerkPool) GetChunk(addr grove_ffi.Address, content_hash string) ([]byte, urpc.Error) {
 	req := []byte(content_hash)
 	reply := new([]byte)
-	ck.cm.CallAtLeastOnce(addr, GetChunkId, req, reply, 100 /*ms*/)
-	return *reply
+	err := ck.cm.CallAtLeastOnce(addr, GetChunkId, req, reply, 100 /*ms*/)
+	return *reply, err
 }
@@ -45,6 +45,8 @@ func (w *Writer) AppendChunk(data []byte) {
 			Chunk:   data,
 			Index:   index,
 		}
+		// XXX: like the dir clerk's errors, an error here (addr is not a chunk
+		// server) is ignored for now
 		w.ck.chCk.WriteChunk(addr, args)
 		// XXX: do we want this? w.ck.dCK.RecordChunk(...)
 		w.wg.Done()
@@ -78,5 +80,7 @@ func (r *Reader) GetNextChunk() (bool, []byte) {
 	}
 	handle := r.chunkHandles[r.index]
 	r.index += 1
-	return true, r.ck.chCk.GetChunk(handle.Addr, handle.ContentHash)
+	// XXX: like the dir clerk's errors, an error here is ignored for now
+	data, _ := r.ck.chCk.GetChunk(handle.Addr, handle.ContentHash)
+	return true, data
 }
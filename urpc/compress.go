@@ -0,0 +1,70 @@
+package urpc
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"sync/atomic"
+)
+
+// Optional compression of large messages (e.g. state transfers), on
+// connections where both ends support FeatureCompression (see the handshake).
+// Request arguments or reply data of at least the compression threshold (see
+// SetCompressThreshold) are sent
+// DEFLATE-compressed, if that makes them smaller, with reqFlagCompressed set in
+// the rpcid or replyFlagCompressed set in the seqno. Handlers and callers only
+// ever see uncompressed data.
+
+const FeatureCompression = uint64(1)
+
+const reqFlagCompressed = uint64(1) << 62
+const replyFlagCompressed = uint64(1) << 61
+
+// Smaller messages aren't worth the CPU time.
+const DefaultCompressThreshold = uint64(64 * 1024)
+
+// 0 until SetCompressThreshold, for DefaultCompressThreshold
+var compressThreshold atomic.Uint64
+
+// Makes this process compress messages of at least n bytes; 0 means
+// DefaultCompressThreshold.
+func SetCompressThreshold(n uint64) {
+	compressThreshold.Store(n)
+}
+
+// Returns false if data is too small to bother, or doesn't compress.
+func compress(data []byte) ([]byte, bool) {
+	var threshold = compressThreshold.Load()
+	if threshold == 0 {
+		threshold = DefaultCompressThreshold
+	}
+	if uint64(len(data)) < threshold {
+		return nil, false
+	}
+	var buf bytes.Buffer
+	// BestSpeed, because we're compressing to save time on the network
+	w, _ := flate.NewWriter(&buf, flate.BestSpeed)
+	w.Write(data)
+	w.Close()
+	if buf.Len() >= len(data) {
+		return nil, false
+	}
+	return buf.Bytes(), true
+}
+
+// Returns false if data is corrupt, or decompresses to more than max bytes
+// (unless max is 0), so that a small message can't make us allocate a huge
+// buffer.
+func decompress(data []byte, max uint64) ([]byte, bool) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	var src io.Reader = r
+	if max != 0 {
+		src = io.LimitReader(r, int64(max)+1)
+	}
+	out, err := io.ReadAll(src)
+	if err != nil || (max != 0 && uint64(len(out)) > max) {
+		return nil, false
+	}
+	return out, true
+}
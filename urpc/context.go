@@ -0,0 +1,298 @@
+package urpc
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/goose-lang/primitive"
+	"github.com/goose-lang/std"
+	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/trace"
+	"github.com/tchajed/marshal"
+)
+
+// Calls that take a context.Context, and give up with ErrCanceled as soon as it
+// is done. If the context has a deadline, the time remaining is sent along with
+// the request, so that the server can skip requests whose caller has already
+// given up, and handlers registered with HandleContext can stop early.
+//
+// On the wire, a request with a deadline has reqFlagDeadline set in its rpcid,
+// and the number of nanoseconds left until the deadline between the seqno and
+// the arguments. Sending relative times means that the client and server
+// clocks need not agree. The deadline is only sent to servers that support
+// FeatureDeadline; servers from before it would take the flagged rpcid for
+// one they have no handler for.
+//
+// If the caller's ctx is part of a recorded trace (see package trace), and the
+// server supports FeatureTracing, the call is recorded as a span, and the
+// request has reqFlagTrace set and that span's context, as three words, after
+// the deadline (if any); the server records its handling of the request as a
+// child of that span, and passes it on in the ctx of handlers registered with
+// HandleContext.
+
+const reqFlagDeadline = uint64(1) << 63
+const reqFlagTrace = uint64(1) << 61
+
+// Supported if the server understands reqFlagTrace.
+const FeatureTracing = uint64(2)
+
+// Supported if the server understands reqFlagDeadline.
+const FeatureDeadline = uint64(4)
+
+// Registers a handler for rpcid that gets a context that is done once the
+// caller's deadline (if any) has passed. Takes precedence over a handler for
+// rpcid passed to MakeServer. Must be called before Serve.
+func (srv *Server) HandleContext(rpcid uint64, f func(ctx context.Context, args []byte, reply *[]byte)) {
+	srv.ctxHandlers[rpcid] = f
+}
+
+func handlerContext(ctx context.Context, deadline time.Time) (context.Context, context.CancelFunc) {
+	if deadline.IsZero() {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, deadline)
+}
+
+func remainingNs(deadline time.Time) uint64 {
+	if d := time.Until(deadline); d > 0 {
+		return uint64(d)
+	}
+	return 0
+}
+
+// Encodes a request, with the deadline unless it is the zero time or the
+// server doesn't support it, the span context sc if it is sampled, and args
+// compressed if that's worth it and the server supports it.
+func (cl *Client) encodeRequest(rpcid uint64, seqno uint64, deadline time.Time, sc trace.SpanContext, args []byte) []byte {
+	var flags = uint64(0)
+	var payload = args
+	if cl.hasFeature(FeatureCompression) {
+		if z, ok := compress(args); ok {
+			payload = z
+			flags = flags | reqFlagCompressed
+		}
+	}
+	if !cl.hasFeature(FeatureDeadline) {
+		deadline = time.Time{}
+	}
+	if !deadline.IsZero() {
+		flags = flags | reqFlagDeadline
+	}
+	if sc.Sampled {
+		flags = flags | reqFlagTrace
+	}
+	var data = make([]byte, 0, 8+8+8+8*3+len(payload))
+	data = marshal.WriteInt(data, rpcid|flags)
+	data = marshal.WriteInt(data, seqno)
+	if !deadline.IsZero() {
+		data = marshal.WriteInt(data, remainingNs(deadline))
+	}
+	if sc.Sampled {
+		t1, t2, s := sc.Words()
+		data = marshal.WriteInt(data, t1)
+		data = marshal.WriteInt(data, t2)
+		data = marshal.WriteInt(data, s)
+	}
+	return marshal.WriteBytes(data, payload)
+}
+
+// How long a traced call, or one with a deadline, on a new connection waits
+// for the server's hello, to find out whether the trace or deadline can be
+// sent along.
+const helloWaitMs = uint64(50)
+
+// Waits up to ms for the server's hello, if it hasn't come yet. Only the first
+// caller to get here waits, so that calls to a server from before the
+// handshake (which never sends a hello) don't all wait.
+func (cl *Client) waitForHello(ms uint64) {
+	deadline := time.Now().Add(time.Duration(ms) * time.Millisecond)
+	cl.mu.Lock()
+	for cl.rpcids == nil && !cl.helloWaited {
+		left := time.Until(deadline)
+		if left <= 0 {
+			cl.helloWaited = true
+			break
+		}
+		primitive.WaitTimeout(cl.helloCond, uint64(left.Milliseconds())+1)
+	}
+	cl.mu.Unlock()
+}
+
+// Like CallStart, but passes ctx's deadline (if any) on to the server.
+func (cl *Client) CallStartContext(ctx context.Context, rpcid uint64, args []byte) (*Callback, Error) {
+	_, hasDeadline := ctx.Deadline()
+	if sc, ok := trace.SpanContextFrom(ctx); hasDeadline || (ok && sc.Sampled) {
+		cl.waitForHello(helloWaitMs)
+	}
+	if ctx.Err() != nil {
+		observeCall(rpcid, time.Time{}, ErrCanceled)
+		return &Callback{}, ErrCanceled
+	}
+	if !cl.ServerHandles(rpcid) {
+		observeCall(rpcid, time.Time{}, ErrUnknownRPC)
+		return &Callback{}, ErrUnknownRPC
+	}
+	deadline, _ := ctx.Deadline()
+	cb := &Callback{reply: new([]byte), state: new(uint64), cond: sync.NewCond(cl.mu), deadline: deadline,
+		rpcid: rpcid, start: time.Now()}
+	var sc trace.SpanContext
+	if cl.hasFeature(FeatureTracing) {
+		ctx, cb.span = trace.StartChild(ctx, "urpc.call", trace.KindClient)
+		cb.span.SetAttrInt("rpc.id", rpcid)
+		sc, _ = trace.SpanContextFrom(ctx)
+	}
+	*cb.state = callbackStateWaiting
+	cl.mu.Lock()
+	seqno := cl.seq
+	cl.seq = std.SumAssumeNoOverflow(cl.seq, 1)
+	cl.pending[seqno] = cb
+	cl.mu.Unlock()
+	cb.seqno = seqno
+	cb.req = cl.encodeRequest(rpcid, seqno, deadline, sc, args)
+
+	if grove_ffi.Send(cl.conn, cb.req) {
+		cl.mu.Lock()
+		delete(cl.pending, seqno)
+		cl.mu.Unlock()
+		observeCall(rpcid, cb.start, ErrDisconnect)
+		endCallSpan(cb.span, ErrDisconnect)
+		return &Callback{}, ErrDisconnect
+	}
+	return cb, ErrNone
+}
+
+// The request to retransmit for cb, with the time left until its deadline
+// (if it was sent) brought up to date.
+func (cb *Callback) retransmission() []byte {
+	rpcid, _ := marshal.ReadInt(cb.req)
+	if rpcid&reqFlagDeadline == 0 {
+		return cb.req
+	}
+	req := make([]byte, 0, len(cb.req))
+	req = append(req, cb.req[:8+8]...)
+	req = marshal.WriteInt(req, remainingNs(cb.deadline))
+	return append(req, cb.req[8+8+8:]...)
+}
+
+func endCallSpan(span *trace.Span, err Error) {
+	if err != ErrNone {
+		span.SetAttr("error", errorLabel(err))
+	}
+	span.End()
+}
+
+// How long to wait (in ms) for an attempt that would otherwise wait wait ms,
+// without waiting past ctx's deadline. The wait can still end a little before
+// the deadline, or before ctx notices that it has passed; see ctxDone.
+func waitFor(ctx context.Context, wait uint64) uint64 {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return wait
+	}
+	left := time.Until(deadline).Milliseconds() + 1
+	if left < 1 {
+		return 1
+	}
+	if uint64(left) < wait {
+		return uint64(left)
+	}
+	return wait
+}
+
+// Whether ctx is done, or its deadline has passed even if its timer hasn't
+// fired yet.
+func ctxDone(ctx context.Context) bool {
+	if ctx.Err() != nil {
+		return true
+	}
+	deadline, ok := ctx.Deadline()
+	return ok && !time.Now().Before(deadline)
+}
+
+// Like CallComplete (retransmitting according to the client's RetryPolicy),
+// but returns ErrCanceled as soon as ctx is done.
+func (cl *Client) CallCompleteContext(ctx context.Context, cb *Callback, reply *[]byte, timeout_ms uint64) Error {
+	err := cl.callCompleteContext(ctx, cb, reply, timeout_ms)
+	observeCall(cb.rpcid, cb.start, err)
+	endCallSpan(cb.span, err)
+	return err
+}
+
+func (cl *Client) callCompleteContext(ctx context.Context, cb *Callback, reply *[]byte, timeout_ms uint64) Error {
+	// wake up the wait below when ctx is done
+	stop := context.AfterFunc(ctx, func() {
+		cl.mu.Lock()
+		cb.cond.Broadcast()
+		cl.mu.Unlock()
+	})
+	defer stop()
+
+	cl.mu.Lock()
+	policy := cl.policy
+	var wait = timeout_ms
+	var attempts = uint64(1)
+	for {
+		w := policy.jitter(wait)
+		shortened := waitFor(ctx, w) < w
+		if *cb.state == callbackStateWaiting && !ctxDone(ctx) {
+			primitive.WaitTimeout(cb.cond, waitFor(ctx, w))
+		}
+		if *cb.state != callbackStateWaiting || ctxDone(ctx) {
+			break
+		}
+		if shortened {
+			// Woke up for the deadline, a little early; that doesn't use up
+			// an attempt.
+			continue
+		}
+		if policy.MaxAttempts != 0 && attempts >= policy.MaxAttempts {
+			break
+		}
+		if policy.outOfTime(cb.start) {
+			break
+		}
+		cl.mu.Unlock()
+		if grove_ffi.Send(cl.conn, cb.retransmission()) {
+			cl.mu.Lock()
+			delete(cl.pending, cb.seqno)
+			cl.mu.Unlock()
+			return ErrDisconnect
+		}
+		cl.mu.Lock()
+		attempts = attempts + 1
+		wait = policy.nextWait(wait)
+	}
+
+	state := *cb.state
+	if state == callbackStateDone {
+		*reply = *cb.reply
+		cl.mu.Unlock()
+		return ErrNone
+	}
+	delete(cl.pending, cb.seqno)
+	cl.mu.Unlock()
+	if state == callbackStateAborted {
+		return ErrDisconnect
+	} else if state == callbackStateOverloaded {
+		return ErrOverload
+	} else if state == callbackStateUnknownRPC {
+		return ErrUnknownRPC
+	} else if state == callbackStateUnauthorized {
+		return ErrUnauthorized
+	} else if ctxDone(ctx) {
+		return ErrCanceled
+	} else {
+		return ErrTimeout
+	}
+}
+
+// Like Call, but gives up with ErrCanceled once ctx is done; timeout_ms is how
+// long the first attempt waits before the client's RetryPolicy retransmits.
+func (cl *Client) CallContext(ctx context.Context, rpcid uint64, args []byte, reply *[]byte, timeout_ms uint64) Error {
+	cb, err := cl.CallStartContext(ctx, rpcid, args)
+	if err != ErrNone {
+		return err
+	}
+	return cl.CallCompleteContext(ctx, cb, reply, timeout_ms)
+}
@@ -0,0 +1,36 @@
+package urpc
+
+import (
+	"flag"
+	"strconv"
+)
+
+// Registers -rpc-max-message-size, -rpc-max-inflight-per-conn and
+// -rpc-max-inflight on fs (flag.CommandLine if nil), which set the limits of
+// the servers this process makes (see ServerConfig) as the flags are parsed.
+func RegisterFlags(fs *flag.FlagSet) {
+	if fs == nil {
+		fs = flag.CommandLine
+	}
+	limit := func(name string, usage string, set func(cfg *ServerConfig, v uint64)) {
+		fs.Func(name, usage, func(s string) error {
+			v, err := strconv.ParseUint(s, 10, 64)
+			if err != nil {
+				return err
+			}
+			cfg := CurrentServerConfig()
+			set(&cfg, v)
+			SetServerConfig(cfg)
+			return nil
+		})
+	}
+	limit("rpc-max-message-size", "largest RPC request, in bytes, that servers accept; 0 means no limit", func(cfg *ServerConfig, v uint64) {
+		cfg.MaxMessageSize = v
+	})
+	limit("rpc-max-inflight-per-conn", "RPCs from one connection that servers run at once before they stop reading from it; 0 means no limit", func(cfg *ServerConfig, v uint64) {
+		cfg.MaxInflightPerConn = v
+	})
+	limit("rpc-max-inflight", "RPCs that servers run at once before they turn new ones away as overloaded; 0 means no limit", func(cfg *ServerConfig, v uint64) {
+		cfg.MaxInflight = v
+	})
+}
@@ -0,0 +1,155 @@
+package urpc
+
+import (
+	"sort"
+
+	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/tchajed/marshal"
+)
+
+// Connection handshake. Right after accepting a connection, the server sends a
+// hello (in place of a reply) with its protocol version, the optional features
+// it supports, and the rpcids it has handlers for:
+//
+//	helloMagic ++ version ++ features ++ len(rpcids) ++ rpcids
+//
+// A client that understands the hello answers (in place of a request) with
+//
+//	helloMagic ++ version ++ features
+//
+// where features are the ones both sides support, which from then on may be
+// used on the connection in either direction. The connection speaks the lower
+// of the two versions.
+//
+// Clients from before the handshake see the server's hello as a reply to a call
+// they never made, and ignore it; servers from before the handshake never send
+// a hello, so a new client never sends one to them either. Either way the
+// connection works as it always has, with no optional features.
+
+// ASCII "\0urpchel"; the top bits are clear, so this can't be mistaken for a
+// flagged seqno or rpcid.
+const helloMagic = uint64(0x007572706368656c)
+
+// The version of the wire protocol spoken by this package; bump this when the
+// format of requests or replies changes.
+const ProtocolVersion = uint64(1)
+
+// The oldest version we can still talk to.
+const minProtocolVersion = uint64(1)
+
+// Optional features that this package supports, as a bitmask.
+const supportedFeatures = FeatureCompression | FeatureTracing | FeatureDeadline
+
+func (srv *Server) rpcids() []uint64 {
+	set := make(map[uint64]bool)
+	for rpcid := range srv.handlers {
+		set[rpcid] = true
+	}
+	for rpcid := range srv.ctxHandlers {
+		set[rpcid] = true
+	}
+	for rpcid := range srv.splitHandlers {
+		set[rpcid] = true
+	}
+	ids := make([]uint64, 0, len(set))
+	for rpcid := range set {
+		ids = append(ids, rpcid)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func (srv *Server) sendHello(conn grove_ffi.Connection) bool {
+	ids := srv.rpcids()
+	var enc = make([]byte, 0, 8*(4+len(ids)))
+	enc = marshal.WriteInt(enc, helloMagic)
+	enc = marshal.WriteInt(enc, ProtocolVersion)
+	enc = marshal.WriteInt(enc, supportedFeatures)
+	enc = marshal.WriteInt(enc, uint64(len(ids)))
+	for _, rpcid := range ids {
+		enc = marshal.WriteInt(enc, rpcid)
+	}
+	return grove_ffi.Send(conn, enc)
+}
+
+// Handles the client's answer to our hello (everything after the magic).
+// Returns false if the client's protocol version is too old to talk to.
+func (c *serverConn) receiveHello(data []byte) bool {
+	version, data := marshal.ReadInt(data)
+	features, _ := marshal.ReadInt(data)
+	if version < minProtocolVersion {
+		logger.Warn("client's protocol version is too old", "version", version,
+			"minVersion", minProtocolVersion, "peer", grove_ffi.PeerAddress(c.conn))
+		return false
+	}
+	c.mu.Lock()
+	c.version = min(version, ProtocolVersion)
+	c.features = features & supportedFeatures
+	c.mu.Unlock()
+	return true
+}
+
+// Handles the server's hello (everything after the magic), and answers it.
+// Returns false if the server's protocol version is too old to talk to.
+func (cl *Client) receiveHello(data []byte) bool {
+	version, data := marshal.ReadInt(data)
+	features, data := marshal.ReadInt(data)
+	n, data := marshal.ReadInt(data)
+	if version < minProtocolVersion {
+		logger.Warn("server's protocol version is too old", "version", version,
+			"minVersion", minProtocolVersion, "peer", grove_ffi.AddressToStr(cl.host))
+		return false
+	}
+	rpcids := make(map[uint64]bool)
+	for i := uint64(0); i < n; i++ {
+		var rpcid uint64
+		rpcid, data = marshal.ReadInt(data)
+		rpcids[rpcid] = true
+	}
+	features = features & supportedFeatures
+
+	var enc = make([]byte, 0, 8*3)
+	enc = marshal.WriteInt(enc, helloMagic)
+	enc = marshal.WriteInt(enc, ProtocolVersion)
+	enc = marshal.WriteInt(enc, features)
+	if grove_ffi.Send(cl.conn, enc) {
+		return false
+	}
+
+	cl.mu.Lock()
+	cl.version = min(version, ProtocolVersion)
+	cl.features = features
+	cl.rpcids = rpcids
+	cl.helloCond.Broadcast()
+	cl.mu.Unlock()
+	return true
+}
+
+// The protocol version spoken on this connection; 0 if the server doesn't do
+// the handshake (or its hello hasn't arrived yet).
+func (cl *Client) Version() uint64 {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return cl.version
+}
+
+// Whether the server has a handler for rpcid. Always true if we haven't heard
+// the server's hello, in which case we can only find out by calling it.
+func (cl *Client) ServerHandles(rpcid uint64) bool {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return cl.rpcids == nil || cl.rpcids[rpcid]
+}
+
+// Whether feature was negotiated on this connection.
+func (cl *Client) hasFeature(feature uint64) bool {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return cl.features&feature != 0
+}
+
+func (c *serverConn) hasFeature(feature uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.features&feature != 0
+}
@@ -0,0 +1,62 @@
+package urpc
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/mit-pdos/gokv/metrics"
+)
+
+// Metrics for the RPCs that servers handle and clients make, labelled by
+// rpcid. Handler latency doesn't include time spent waiting behind earlier
+// requests on an ordered rpcid; call latency is from CallStart until
+// CallComplete returns.
+var (
+	serverRequests = metrics.Default.NewCounter("urpc_server_requests_total",
+		"Requests handled by urpc servers.", "rpc")
+	serverLatency = metrics.Default.NewHistogram("urpc_server_handler_seconds",
+		"Time spent in urpc request handlers.", metrics.LatencyBuckets, "rpc")
+	serverErrors = metrics.Default.NewCounter("urpc_server_errors_total",
+		"Requests that urpc servers didn't run, by reason: overload, unknown_rpc, unauthorized, or expired (the caller's deadline had passed).",
+		"rpc", "reason")
+
+	clientCalls = metrics.Default.NewCounter("urpc_client_calls_total",
+		"Calls made by urpc clients.", "rpc")
+	clientLatency = metrics.Default.NewHistogram("urpc_client_call_seconds",
+		"Time until urpc calls got a reply, for calls that did.", metrics.LatencyBuckets, "rpc")
+	clientErrors = metrics.Default.NewCounter("urpc_client_errors_total",
+		"Calls by urpc clients that failed, by error: timeout, disconnect, overload, canceled, unknown_rpc or unauthorized.",
+		"rpc", "error")
+)
+
+func rpcLabel(rpcid uint64) string {
+	return strconv.FormatUint(rpcid, 10)
+}
+
+func errorLabel(err Error) string {
+	if err == ErrTimeout {
+		return "timeout"
+	} else if err == ErrDisconnect {
+		return "disconnect"
+	} else if err == ErrOverload {
+		return "overload"
+	} else if err == ErrCanceled {
+		return "canceled"
+	} else if err == ErrUnknownRPC {
+		return "unknown_rpc"
+	} else if err == ErrUnauthorized {
+		return "unauthorized"
+	}
+	return strconv.FormatUint(err, 10)
+}
+
+// Records a call's outcome, once it's done; start is when it started.
+func observeCall(rpcid uint64, start time.Time, err Error) {
+	l := rpcLabel(rpcid)
+	clientCalls.Inc(l)
+	if err == ErrNone {
+		clientLatency.ObserveDuration(time.Since(start), l)
+	} else {
+		clientErrors.Inc(l, errorLabel(err))
+	}
+}
@@ -0,0 +1,97 @@
+package urpc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mit-pdos/gokv/grove_ffi"
+)
+
+// Writes a certificate for cn (valid for 127.0.0.1) signed by ca (self-signed
+// if ca is nil) to dir, returning the cert, its key, and the cert and key file
+// names.
+func writeCert(t *testing.T, dir string, cn string, ca *x509.Certificate, caKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	parent, signer := tmpl, key
+	if ca == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		parent, signer = ca, caKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	certFile := filepath.Join(dir, cn+".crt")
+	keyFile := filepath.Join(dir, cn+".key")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return cert, key, certFile, keyFile
+}
+
+// A TCP address on localhost that nothing is listening on.
+func freeAddress(t *testing.T) grove_ffi.Address {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return grove_ffi.MakeAddress(addr)
+}
+
+// Over TCP with TLS, this process's identity is the CommonName of its
+// certificate, so RestrictToAdmin lets it call admin RPCs when it is the admin,
+// and Restrict keeps it out of RPCs for others.
+func TestTLSRestrict(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey, caFile, _ := writeCert(t, dir, "ca", nil, nil)
+	_, _, certFile, keyFile := writeCert(t, dir, "admin", ca, caKey)
+	grove_ffi.ConfigureTLS(&grove_ffi.TLSConfig{CertFile: certFile, KeyFile: keyFile, CAFile: caFile,
+		AdminIdentities: []string{"admin"}})
+	defer grove_ffi.ConfigureTLS(nil)
+
+	handlers := map[uint64]func([]byte, *[]byte){
+		0: func(args []byte, reply *[]byte) { *reply = args },
+		1: func(args []byte, reply *[]byte) { *reply = args },
+	}
+	host := freeAddress(t)
+	srv := MakeServer(handlers)
+	srv.RestrictToAdmin([]uint64{0})
+	srv.Restrict(1, []string{"someone-else"})
+	srv.Serve(host)
+
+	cl := MakeClient(host)
+	reply := new([]byte)
+	if err := cl.Call(0, []byte("x"), reply, 1000); err != ErrNone || string(*reply) != "x" {
+		t.Errorf("admin RPC as the admin: %d, %q", err, *reply)
+	}
+	if err := cl.Call(1, []byte("x"), reply, 1000); err != ErrUnauthorized {
+		t.Errorf("expected unauthorized, got %d", err)
+	}
+}
@@ -2,87 +2,589 @@ package urpc
 
 import (
 	// "log"
-	"log"
+	"context"
 	"sync"
-	// "time"
+	"time"
 
 	"github.com/goose-lang/primitive"
 	"github.com/goose-lang/std"
 	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/logging"
+	"github.com/mit-pdos/gokv/trace"
 	"github.com/tchajed/marshal"
 )
 
+var logger = logging.For("urpc")
+
+// Limits that keep one misbehaving (or just very busy) client from exhausting
+// a server's memory or goroutines.
+type ServerConfig struct {
+	// Requests longer than this many bytes make the server hang up on the
+	// connection; 0 means no limit.
+	MaxMessageSize uint64
+	// Once this many requests from one connection are running, the server stops
+	// reading from that connection until one of them finishes, so that a fast
+	// client is slowed down by TCP flow control rather than by queueing up
+	// goroutines on the server.
+	MaxInflightPerConn uint64
+	// Once this many requests are running across all connections, new requests
+	// are answered right away with an overload reply (see ErrOverload) instead
+	// of being run.
+	MaxInflight uint64
+}
+
+func DefaultServerConfig() ServerConfig {
+	return ServerConfig{
+		MaxMessageSize:     1 << 30,
+		MaxInflightPerConn: 1024,
+		MaxInflight:        65536,
+	}
+}
+
+var serverConfigState struct {
+	mu  sync.Mutex
+	cfg ServerConfig
+	set bool
+}
+
+// The limits that MakeServer gives servers: DefaultServerConfig, unless
+// changed with SetServerConfig (or the flags from RegisterFlags).
+func CurrentServerConfig() ServerConfig {
+	serverConfigState.mu.Lock()
+	defer serverConfigState.mu.Unlock()
+	if !serverConfigState.set {
+		return DefaultServerConfig()
+	}
+	return serverConfigState.cfg
+}
+
+// Makes every later MakeServer in this process use cfg.
+func SetServerConfig(cfg ServerConfig) {
+	serverConfigState.mu.Lock()
+	serverConfigState.cfg = cfg
+	serverConfigState.set = true
+	serverConfigState.mu.Unlock()
+}
+
 type Server struct {
 	handlers map[uint64]func([]byte, *[]byte)
+	// rpcids that only some peers may call, with the identities of those peers
+	allowed map[uint64]map[string]bool
+	// rpcids whose requests on a connection are handled in order
+	ordered map[uint64]bool
+	// handlers that get the caller's deadline (see HandleContext)
+	ctxHandlers map[uint64]func(context.Context, []byte, *[]byte)
+	// ordered handlers that finish out of order (see HandleOrdered)
+	splitHandlers map[uint64]func([]byte) func(*[]byte)
+	cfg           ServerConfig
+
+	mu       *sync.Mutex
+	inflight uint64 // number of requests running, across all connections
+	// set by Serve, and the connections it accepted, for Close
+	listener grove_ffi.Listener
+	conns    map[grove_ffi.Connection]bool
+	closed   bool
 }
 
-func (srv *Server) rpcHandle(conn grove_ffi.Connection, rpcid uint64, seqno uint64, data []byte) {
+// Only lets peers with one of identities (see grove_ffi.PeerIdentity) call
+// rpcid. Must be called before Serve.
+func (srv *Server) Restrict(rpcid uint64, identities []string) {
+	ids := make(map[string]bool)
+	for _, id := range identities {
+		ids[id] = true
+	}
+	srv.allowed[rpcid] = ids
+}
+
+// Restricts rpcids to the admin identities configured for this process (see
+// grove_ffi.TLSConfig). Does nothing if TLS is off or there are no admin
+// identities, in which case anyone who can connect can call every RPC.
+func (srv *Server) RestrictToAdmin(rpcids []uint64) {
+	admins := grove_ffi.AdminIdentities()
+	if len(admins) == 0 {
+		return
+	}
+	for _, rpcid := range rpcids {
+		srv.Restrict(rpcid, admins)
+	}
+}
+
+// Requests for rpcid on any one connection are handled one at a time, in the
+// order they arrive, by a single goroutine for that connection (rather than
+// each in a goroutine of its own). Must be called before Serve.
+func (srv *Server) SetOrdered(rpcid uint64) {
+	srv.ordered[rpcid] = true
+}
+
+// Registers a handler for rpcid in two steps. The first runs in order with the
+// other ordered requests on the connection (see SetOrdered), and returns the
+// second, which runs in a goroutine of its own and fills in the reply; so a
+// handler can do its ordered work and then wait (e.g. for a disk write) without
+// holding up the requests behind it. Takes precedence over a handler for rpcid
+// passed to MakeServer. Must be called before Serve.
+func (srv *Server) HandleOrdered(rpcid uint64, f func(args []byte) func(reply *[]byte)) {
+	srv.splitHandlers[rpcid] = f
+	srv.ordered[rpcid] = true
+}
+
+func (srv *Server) authorized(conn grove_ffi.Connection, rpcid uint64) bool {
+	ids, ok := srv.allowed[rpcid]
+	if !ok {
+		return true
+	}
+	return ids[grove_ffi.PeerIdentity(conn)]
+}
+
+// Runs the handler for a request and sends its reply, then calls done. For a
+// handler registered with HandleOrdered, returns once its first step has run,
+// and finishes in another goroutine.
+func (srv *Server) rpcHandle(c *serverConn, rpcid uint64, seqno uint64, deadline time.Time, parent trace.SpanContext, data []byte, done func()) {
+	conn := c.conn
+	if !deadline.IsZero() && time.Now().After(deadline) {
+		// The caller has given up on this request, so don't bother.
+		serverErrors.Inc(rpcLabel(rpcid), "expired")
+		done()
+		return
+	}
+	if !srv.authorized(conn, rpcid) {
+		// Say so, rather than leave the client to time out and retry forever.
+		logger.Warn("rejecting RPC from unauthorized peer", "rpc", rpcid,
+			"peer", grove_ffi.PeerAddress(conn), "identity", grove_ffi.PeerIdentity(conn))
+		serverErrors.Inc(rpcLabel(rpcid), "unauthorized")
+		srv.sendError(conn, seqno, replyFlagUnauthorized)
+		done()
+		return
+	}
 	replyData := new([]byte)
 
-	f := srv.handlers[rpcid] // for Goose
-	f(data, replyData)       // call the function
+	start := time.Now()
+	var ctx = context.Background()
+	var span *trace.Span
+	if parent.Sampled {
+		ctx, span = trace.StartChild(trace.WithRemoteParent(ctx, parent), "urpc.handle", trace.KindServer)
+		span.SetAttrInt("rpc.id", rpcid)
+	}
+	if h, ok := srv.splitHandlers[rpcid]; ok {
+		rest := h(data)
+		go func() {
+			rest(replyData)
+			srv.sendReply(c, rpcid, seqno, start, span, *replyData)
+			done()
+		}()
+		return
+	}
+	if h, ok := srv.ctxHandlers[rpcid]; ok {
+		ctx, cancel := handlerContext(ctx, deadline)
+		h(ctx, data, replyData)
+		cancel()
+	} else {
+		f, ok := srv.handlers[rpcid] // for Goose
+		if !ok {
+			logger.Warn("no handler for RPC", "rpc", rpcid, "peer", grove_ffi.PeerAddress(conn))
+			serverErrors.Inc(rpcLabel(rpcid), "unknown_rpc")
+			span.SetAttr("error", "unknown_rpc")
+			span.End()
+			srv.sendError(conn, seqno, replyFlagUnknownRPC)
+			done()
+			return
+		}
+		f(data, replyData) // call the function
+	}
+	srv.sendReply(c, rpcid, seqno, start, span, *replyData)
+	done()
+}
+
+func (srv *Server) sendReply(c *serverConn, rpcid uint64, seqno uint64, start time.Time, span *trace.Span, reply []byte) {
+	span.End()
+	serverRequests.Inc(rpcLabel(rpcid))
+	serverLatency.ObserveDuration(time.Since(start), rpcLabel(rpcid))
 
-	data1 := make([]byte, 0, 8+len(*replyData))
-	data2 := marshal.WriteInt(data1, seqno)
-	data3 := marshal.WriteBytes(data2, *replyData)
+	var flags = uint64(0)
+	if c.hasFeature(FeatureCompression) {
+		if z, ok := compress(reply); ok {
+			reply = z
+			flags = replyFlagCompressed
+		}
+	}
+
+	data1 := make([]byte, 0, 8+len(reply))
+	data2 := marshal.WriteInt(data1, seqno|flags)
+	data3 := marshal.WriteBytes(data2, reply)
+	c.mu.Lock()
+	c.cacheReply(seqno, data3)
+	c.mu.Unlock()
 	// Ignore errors (what would we do about them anyway -- client will inevitably time out, and then retry)
-	grove_ffi.Send(conn, data3) // TODO: contention? should we buffer these in userspace too?
+	grove_ffi.Send(c.conn, data3) // TODO: contention? should we buffer these in userspace too?
+}
+
+// The top bits of a reply's seqno mark the reply as an error from urpc itself
+// rather than from the handler; clients from before these flags never send
+// seqnos that large, so never see them.
+const replyFlagOverload = uint64(1) << 63
+const replyFlagUnknownRPC = uint64(1) << 62
+const replyFlagUnauthorized = uint64(1) << 60
+const replyFlags = replyFlagOverload | replyFlagUnknownRPC | replyFlagCompressed | replyFlagUnauthorized
+
+func (srv *Server) sendError(conn grove_ffi.Connection, seqno uint64, flag uint64) {
+	data := marshal.WriteInt(make([]byte, 0, 8), seqno|flag)
+	grove_ffi.Send(conn, data)
+}
+
+// Takes one of the server-wide in-flight slots, if there is one left.
+func (srv *Server) tryAcquire() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.cfg.MaxInflight != 0 && srv.inflight >= srv.cfg.MaxInflight {
+		return false
+	}
+	srv.inflight += 1
+	return true
+}
+
+func (srv *Server) release() {
+	srv.mu.Lock()
+	srv.inflight -= 1
+	srv.mu.Unlock()
 }
 
 func MakeServer(handlers map[uint64]func([]byte, *[]byte)) *Server {
-	return &Server{handlers: handlers}
+	return MakeServerWithConfig(handlers, CurrentServerConfig())
+}
+
+func MakeServerWithConfig(handlers map[uint64]func([]byte, *[]byte), cfg ServerConfig) *Server {
+	return &Server{
+		handlers:      handlers,
+		allowed:       make(map[uint64]map[string]bool),
+		ordered:       make(map[uint64]bool),
+		splitHandlers: make(map[uint64]func([]byte) func(*[]byte)),
+		cfg:           cfg,
+		mu:            new(sync.Mutex),
+		conns:         make(map[grove_ffi.Connection]bool),
+
+		ctxHandlers: make(map[uint64]func(context.Context, []byte, *[]byte)),
+	}
+}
+
+type orderedRequest struct {
+	rpcid    uint64
+	seqno    uint64
+	deadline time.Time
+	parent   trace.SpanContext
+	req      []byte
+}
+
+// Per-connection server state.
+type serverConn struct {
+	conn grove_ffi.Connection
+	mu   *sync.Mutex
+	// signalled whenever a request finishes, a request is queued, or the
+	// connection closes
+	cond *sync.Cond
+	// Seqnos of requests on this connection whose handler is still running (or
+	// queued). A client retransmits a request with the same seqno when it times
+	// out; if the original is still running, its reply will do for both, so the
+	// retransmission is dropped rather than run again.
+	inflight map[uint64]bool
+	// Replies (as sent) to the most recent requests on this connection that
+	// have finished, so that a retransmission arriving after its request
+	// finished is answered with the same reply instead of running it again.
+	// Oldest first in replyOrder; at most replyCacheCount of them, and
+	// replyCacheBytes in all.
+	replies    map[uint64][]byte
+	replyOrder []uint64
+	replyBytes uint64
+	queue      []orderedRequest // requests for ordered rpcids, not yet handled
+	closed     bool
+	// negotiated in the handshake; both 0 if the client doesn't do it
+	version  uint64
+	features uint64
+}
+
+const replyCacheCount = uint64(256)
+const replyCacheBytes = uint64(4 << 20)
+
+// Remembers msg as the reply to seqno, forgetting the oldest replies to make
+// room. Requires c.mu.
+func (c *serverConn) cacheReply(seqno uint64, msg []byte) {
+	size := uint64(len(msg))
+	if size > replyCacheBytes {
+		return
+	}
+	for uint64(len(c.replyOrder)) >= replyCacheCount || c.replyBytes+size > replyCacheBytes {
+		oldest := c.replyOrder[0]
+		c.replyOrder = c.replyOrder[1:]
+		c.replyBytes -= uint64(len(c.replies[oldest]))
+		delete(c.replies, oldest)
+	}
+	c.replies[seqno] = msg
+	c.replyOrder = append(c.replyOrder, seqno)
+	c.replyBytes += size
+}
+
+func (srv *Server) finish(c *serverConn, seqno uint64) {
+	srv.release()
+	c.mu.Lock()
+	delete(c.inflight, seqno)
+	c.cond.Broadcast()
+	c.mu.Unlock()
+}
+
+// Handles the requests for ordered rpcids on c, one at a time.
+func (srv *Server) orderedThread(c *serverConn) {
+	c.mu.Lock()
+	for {
+		if len(c.queue) == 0 {
+			if c.closed {
+				break
+			}
+			c.cond.Wait()
+			continue
+		}
+		r := c.queue[0]
+		c.queue = c.queue[1:]
+		c.mu.Unlock()
+		srv.rpcHandle(c, r.rpcid, r.seqno, r.deadline, r.parent, r.req, func() {
+			srv.finish(c, r.seqno)
+		})
+		c.mu.Lock()
+	}
+	c.mu.Unlock()
 }
 
 func (srv *Server) readThread(conn grove_ffi.Connection) {
+	grove_ffi.SetMaxMessageSize(conn, srv.cfg.MaxMessageSize)
+	c := &serverConn{
+		conn:     conn,
+		mu:       new(sync.Mutex),
+		inflight: make(map[uint64]bool),
+		queue:    make([]orderedRequest, 0),
+		replies:  make(map[uint64][]byte),
+	}
+	c.cond = sync.NewCond(c.mu)
+	srv.sendHello(conn)
+	if len(srv.ordered) > 0 {
+		go func() {
+			srv.orderedThread(c)
+		}()
+	}
+
 	// lastRpcTime := time.Now()
 	for {
 		r := grove_ffi.Receive(conn)
 		if r.Err {
 			// This connection is *done* -- quit the thread.
+			c.mu.Lock()
+			c.closed = true
+			c.cond.Broadcast()
+			c.mu.Unlock()
 			break
 		}
 		data := r.Data
 		rpcid, data := marshal.ReadInt(data)
+		if rpcid == helloMagic {
+			if !c.receiveHello(data) {
+				grove_ffi.Close(conn)
+			}
+			continue
+		}
 		seqno, data := marshal.ReadInt(data)
+		var deadline time.Time
+		if rpcid&reqFlagDeadline != 0 {
+			rpcid = rpcid &^ reqFlagDeadline
+			var remaining uint64
+			remaining, data = marshal.ReadInt(data)
+			deadline = time.Now().Add(time.Duration(remaining))
+		}
+		var parent trace.SpanContext
+		if rpcid&reqFlagTrace != 0 {
+			rpcid = rpcid &^ reqFlagTrace
+			var t1, t2, s uint64
+			t1, data = marshal.ReadInt(data)
+			t2, data = marshal.ReadInt(data)
+			s, data = marshal.ReadInt(data)
+			parent = trace.FromWords(t1, t2, s)
+		}
+		if rpcid&reqFlagCompressed != 0 {
+			rpcid = rpcid &^ reqFlagCompressed
+			var ok bool
+			data, ok = decompress(data, srv.cfg.MaxMessageSize)
+			if !ok {
+				logger.Warn("bad compressed request; hanging up", "rpc", rpcid, "peer", grove_ffi.PeerAddress(conn))
+				grove_ffi.Close(conn)
+				continue
+			}
+		}
 		req := data // remaining data
 		// thisRpcTime := time.Now()
 		// if primitive.RandomUint64()%1024 == 0 {
 		// log.Printf("urpc time between RPCs: %v\n", thisRpcTime.Sub(lastRpcTime))
 		// }
 		// lastRpcTime = thisRpcTime
-		go func() { srv.rpcHandle(conn, rpcid, seqno, req) }() // XXX: this could (and probably should) be in a goroutine YYY: but readThread is already its own goroutine, so that seems redundant?
+		c.mu.Lock()
+		if c.inflight[seqno] {
+			c.mu.Unlock()
+			continue
+		}
+		if msg, ok := c.replies[seqno]; ok {
+			c.mu.Unlock()
+			grove_ffi.Send(conn, msg)
+			continue
+		}
+		if !srv.tryAcquire() {
+			c.mu.Unlock()
+			serverErrors.Inc(rpcLabel(rpcid), "overload")
+			srv.sendError(conn, seqno, replyFlagOverload)
+			continue
+		}
+		c.inflight[seqno] = true
+		if srv.ordered[rpcid] {
+			c.queue = append(c.queue, orderedRequest{rpcid: rpcid, seqno: seqno, deadline: deadline, parent: parent, req: req})
+			c.cond.Broadcast()
+		} else {
+			go func() {
+				srv.rpcHandle(c, rpcid, seqno, deadline, parent, req, func() {
+					srv.finish(c, seqno)
+				})
+			}()
+		}
+		// Backpressure: don't read more requests until this connection is
+		// below its limit.
+		for srv.cfg.MaxInflightPerConn != 0 && uint64(len(c.inflight)) >= srv.cfg.MaxInflightPerConn {
+			c.cond.Wait()
+		}
+		c.mu.Unlock()
 		continue
 	}
 }
 
 func (srv *Server) Serve(host grove_ffi.Address) {
 	listener := grove_ffi.Listen(grove_ffi.Address(host))
+	srv.mu.Lock()
+	srv.listener = listener
+	srv.mu.Unlock()
 	go func() {
 		for {
-			conn := grove_ffi.Accept(listener)
+			r := grove_ffi.TryAccept(listener)
+			if r.Err {
+				break
+			}
+			conn := r.Connection
+			srv.mu.Lock()
+			if srv.closed {
+				srv.mu.Unlock()
+				grove_ffi.Close(conn)
+				break
+			}
+			srv.conns[conn] = true
+			srv.mu.Unlock()
 			go func() {
 				srv.readThread(conn)
+				srv.mu.Lock()
+				delete(srv.conns, conn)
+				srv.mu.Unlock()
 			}()
 		}
 	}()
 }
 
+// Stops listening and hangs up on every client, so that another server can
+// listen on the same address (e.g. to restart this one in a test). Handlers
+// still running finish, but their replies go nowhere.
+func (srv *Server) Close() {
+	srv.mu.Lock()
+	srv.closed = true
+	listener := srv.listener
+	conns := make([]grove_ffi.Connection, 0, len(srv.conns))
+	for conn := range srv.conns {
+		conns = append(conns, conn)
+	}
+	srv.mu.Unlock()
+	if listener != nil {
+		grove_ffi.CloseListener(listener)
+	}
+	for _, conn := range conns {
+		grove_ffi.Close(conn)
+	}
+}
+
 const callbackStateWaiting uint64 = 0
 const callbackStateDone uint64 = 1
 const callbackStateAborted uint64 = 2
+const callbackStateOverloaded uint64 = 3
+const callbackStateUnknownRPC uint64 = 4
+const callbackStateUnauthorized uint64 = 5
 
 type Callback struct {
 	reply *[]byte
 	state *uint64
 	cond  *sync.Cond
+	seqno uint64
+	req   []byte // the encoded request, for retransmission
+	// when the caller gives up (see CallStartContext); the zero time if never
+	deadline time.Time
+	// for metrics and tracing
+	rpcid uint64
+	start time.Time
+	span  *trace.Span
 }
 
+// How CallComplete deals with timeouts. Instead of giving up, it can
+// retransmit the request with the *same* seqno, so that a reply to any of the
+// transmissions completes the call (and a server still running the original
+// ignores the retransmission).
+type RetryPolicy struct {
+	// Total number of times a request is sent before the call fails with
+	// ErrTimeout; 0 means retransmitting until there is a reply, the
+	// connection breaks, or MaxTotalMs is up.
+	MaxAttempts uint64
+	// Each attempt waits Multiplier times as long as the previous one (the first
+	// waits for the caller's timeout), up to MaxWaitMs (if nonzero).
+	Multiplier uint64
+	MaxWaitMs  uint64
+	// Each wait is shortened by a random amount of up to this many percent, so
+	// that clients that time out together don't all retransmit together.
+	JitterPercent uint64
+	// Once this many ms have passed since the call started without a reply, it
+	// fails with ErrTimeout even if it has attempts left; 0 means no limit. A
+	// connection that silently died (with no reset from the other end) looks
+	// just like a slow server, so this is what eventually gives up on it.
+	MaxTotalMs uint64
+}
+
+// Sends each request once, and fails after the caller's timeout.
+var DefaultRetryPolicy = &RetryPolicy{MaxAttempts: 1, Multiplier: 1}
+
+// Retransmits until there is a reply, doubling the wait each time up to 10s,
+// for up to a minute.
+var UntilReplyRetryPolicy = &RetryPolicy{MaxAttempts: 0, Multiplier: 2, MaxWaitMs: 10_000, JitterPercent: 20, MaxTotalMs: 60_000}
+
 type Client struct {
-	mu   *sync.Mutex
-	conn grove_ffi.Connection // for requests
-	seq  uint64               // next fresh sequence number
+	mu     *sync.Mutex
+	host   grove_ffi.Address
+	conn   grove_ffi.Connection // for requests
+	seq    uint64               // next fresh sequence number
+	policy *RetryPolicy
+	// The longest reply this client accepts (after decompression); 0 means no
+	// limit. Taken from the MaxMessageSize of CurrentServerConfig when the
+	// client is made, since that's what this process's servers accept.
+	maxMessageSize uint64
 
 	pending map[uint64]*Callback
+
+	// learned from the server's hello; rpcids is nil until then
+	version  uint64
+	features uint64
+	rpcids   map[uint64]bool
+	// signalled when the hello arrives
+	helloCond *sync.Cond
+	// set once a caller has waited for the hello and given up
+	helloWaited bool
+}
+
+func (cl *Client) SetRetryPolicy(p *RetryPolicy) {
+	cl.mu.Lock()
+	cl.policy = p
+	cl.mu.Unlock()
 }
 
 func (cl *Client) replyThread() {
@@ -100,16 +602,39 @@ func (cl *Client) replyThread() {
 		}
 		data := r.Data
 
-		seqno, data := marshal.ReadInt(data)
-		reply := data
+		rawSeqno, data := marshal.ReadInt(data)
+		if rawSeqno == helloMagic {
+			if !cl.receiveHello(data) {
+				grove_ffi.Close(cl.conn)
+			}
+			continue
+		}
+		seqno := rawSeqno &^ replyFlags
+		var reply = data
+		if rawSeqno&replyFlagCompressed != 0 {
+			var ok bool
+			reply, ok = decompress(data, cl.maxMessageSize)
+			if !ok {
+				grove_ffi.Close(cl.conn)
+				continue
+			}
+		}
 		// log.Printf("Got reply for call %d\n", seqno)
 
 		cl.mu.Lock()
 		cb, ok := cl.pending[seqno]
 		if ok {
 			delete(cl.pending, seqno)
-			*cb.reply = reply
-			*cb.state = callbackStateDone
+			if rawSeqno&replyFlagOverload != 0 {
+				*cb.state = callbackStateOverloaded
+			} else if rawSeqno&replyFlagUnknownRPC != 0 {
+				*cb.state = callbackStateUnknownRPC
+			} else if rawSeqno&replyFlagUnauthorized != 0 {
+				*cb.state = callbackStateUnauthorized
+			} else {
+				*cb.reply = reply
+				*cb.state = callbackStateDone
+			}
 			cb.cond.Signal()
 		}
 		cl.mu.Unlock()
@@ -118,18 +643,29 @@ func (cl *Client) replyThread() {
 }
 
 func TryMakeClient(host_name grove_ffi.Address) (uint64, *Client) {
+	return TryMakeClientFrom(0, host_name)
+}
+
+// Like TryMakeClient, for a client used by the server listening at src (see
+// grove_ffi.ConnectFrom).
+func TryMakeClientFrom(src grove_ffi.Address, host_name grove_ffi.Address) (uint64, *Client) {
 	host := grove_ffi.Address(host_name)
-	a := grove_ffi.Connect(host)
+	a := grove_ffi.ConnectFrom(src, host)
 	var nilClient *Client
 	if a.Err {
 		return 1, nilClient
 	}
 
 	cl := &Client{
+		host:    host,
 		conn:    a.Connection,
 		mu:      new(sync.Mutex),
 		seq:     1,
+		policy:  DefaultRetryPolicy,
 		pending: make(map[uint64]*Callback)}
+	cl.helloCond = sync.NewCond(cl.mu)
+	cl.maxMessageSize = CurrentServerConfig().MaxMessageSize
+	grove_ffi.SetMaxMessageSize(cl.conn, cl.maxMessageSize)
 
 	go func() {
 		cl.replyThread() // Goose doesn't support parameters in a go statement
@@ -140,22 +676,46 @@ func TryMakeClient(host_name grove_ffi.Address) (uint64, *Client) {
 func MakeClient(host_name grove_ffi.Address) *Client {
 	err, cl := TryMakeClient(host_name)
 	if err != 0 {
-		log.Printf("Unable to connect to %s", grove_ffi.AddressToStr(host_name))
+		logger.Error("unable to connect", "peer", grove_ffi.AddressToStr(host_name))
 	}
 	primitive.Assume(err == 0)
 	return cl
 }
 
+// Hangs up; calls still waiting for a reply fail with ErrDisconnect.
+func (cl *Client) Close() {
+	grove_ffi.Close(cl.conn)
+}
+
 type Error = uint64
 
 const ErrNone uint64 = 0
 const ErrTimeout uint64 = 1
 const ErrDisconnect uint64 = 2
 
+// The server was too busy to run the request; the call can be retried, but
+// preferably after backing off.
+const ErrOverload uint64 = 3
+
+// The caller's context was canceled, or its deadline passed, before a reply
+// came (see CallContext).
+const ErrCanceled uint64 = 4
+
+// The server has no handler for the rpcid.
+const ErrUnknownRPC uint64 = 5
+
+// The server only lets some peers call the rpcid, and this client isn't one of
+// them (see Server.Restrict). Retrying won't help.
+const ErrUnauthorized uint64 = 6
+
 func (cl *Client) CallStart(rpcid uint64, args []byte) (*Callback, Error) {
 	// log.Printf("Started call %d\n", rpcid)
+	if !cl.ServerHandles(rpcid) {
+		observeCall(rpcid, time.Time{}, ErrUnknownRPC)
+		return &Callback{}, ErrUnknownRPC
+	}
 	reply_buf := new([]byte)
-	cb := &Callback{reply: reply_buf, state: new(uint64), cond: sync.NewCond(cl.mu)}
+	cb := &Callback{reply: reply_buf, state: new(uint64), cond: sync.NewCond(cl.mu), rpcid: rpcid, start: time.Now()}
 	*cb.state = callbackStateWaiting
 	cl.mu.Lock()
 	seqno := cl.seq
@@ -163,6 +723,7 @@ func (cl *Client) CallStart(rpcid uint64, args []byte) (*Callback, Error) {
 	cl.seq = std.SumAssumeNoOverflow(cl.seq, 1)
 	cl.pending[seqno] = cb
 	cl.mu.Unlock()
+	cb.seqno = seqno
 
 	// If the `replyThread` goes down during this call, then
 	// - either this happens before the above critical section,
@@ -170,43 +731,106 @@ func (cl *Client) CallStart(rpcid uint64, args []byte) (*Callback, Error) {
 	// - or it happens after the critical section, in which case the `replyThread` will set
 	//   our status to `callbackStateAborted` which we will notice below.
 
-	data1 := make([]byte, 0, 8+8+len(args))
-	data2 := marshal.WriteInt(data1, rpcid)
-	data3 := marshal.WriteInt(data2, seqno)
-	reqData := marshal.WriteBytes(data3, args)
+	reqData := cl.encodeRequest(rpcid, seqno, time.Time{}, trace.SpanContext{}, args)
 	// fmt.Fprintf(os.Stderr, "%+v\n", reqData)
+	cb.req = reqData
 
 	if grove_ffi.Send(cl.conn, reqData) {
+		cl.mu.Lock()
+		delete(cl.pending, seqno)
+		cl.mu.Unlock()
 		// An error occured; this client is dead.
 		// (&Callback works around goose not translating "nil" properly.)
+		observeCall(rpcid, cb.start, ErrDisconnect)
 		return &Callback{}, ErrDisconnect
 	}
 
 	return cb, ErrNone
 }
 
+// How long to wait for the attempt after one that waited prevWait ms.
+func (p *RetryPolicy) nextWait(prevWait uint64) uint64 {
+	var w = prevWait * p.Multiplier
+	if p.MaxWaitMs != 0 && w > p.MaxWaitMs {
+		w = p.MaxWaitMs
+	}
+	return w
+}
+
+// Whether a call that started at start should stop retransmitting.
+func (p *RetryPolicy) outOfTime(start time.Time) bool {
+	return p.MaxTotalMs != 0 && uint64(time.Since(start).Milliseconds()) >= p.MaxTotalMs
+}
+
+func (p *RetryPolicy) jitter(wait uint64) uint64 {
+	if p.JitterPercent == 0 || wait == 0 {
+		return wait
+	}
+	maxJitter := wait * p.JitterPercent / 100
+	if maxJitter == 0 {
+		return wait
+	}
+	return wait - primitive.RandomUint64()%maxJitter
+}
+
 func (cl *Client) CallComplete(cb *Callback, reply *[]byte, timeout_ms uint64) Error {
+	err := cl.callComplete(cb, reply, timeout_ms)
+	observeCall(cb.rpcid, cb.start, err)
+	return err
+}
 
-	// wait for reply
+func (cl *Client) callComplete(cb *Callback, reply *[]byte, timeout_ms uint64) Error {
 	cl.mu.Lock()
-	if *cb.state == callbackStateWaiting {
-		// No reply yet (and `replyThread` hasn't aborted either).
-		// Wait just a single time; Go guarantees no spurious wakeups.
-		// log.Printf("Waiting for reply for call %d(%d)\n", seqno, rpcid)
-		primitive.WaitTimeout(cb.cond, timeout_ms) // make sure we don't get stuck waiting forever
+	policy := cl.policy
+	var wait = timeout_ms
+	var attempts = uint64(1)
+	for {
+		if *cb.state == callbackStateWaiting {
+			// No reply yet (and `replyThread` hasn't aborted either).
+			// Wait just a single time; Go guarantees no spurious wakeups.
+			primitive.WaitTimeout(cb.cond, policy.jitter(wait)) // make sure we don't get stuck waiting forever
+		}
+		if *cb.state != callbackStateWaiting {
+			break
+		}
+		if policy.MaxAttempts != 0 && attempts >= policy.MaxAttempts {
+			break
+		}
+		if policy.outOfTime(cb.start) {
+			break
+		}
+		// Resend with the same seqno, so that a reply to any of our
+		// transmissions completes this call.
+		cl.mu.Unlock()
+		if grove_ffi.Send(cl.conn, cb.req) {
+			cl.mu.Lock()
+			delete(cl.pending, cb.seqno)
+			cl.mu.Unlock()
+			return ErrDisconnect
+		}
+		cl.mu.Lock()
+		attempts = attempts + 1
+		wait = policy.nextWait(wait)
 	}
+
 	state := *cb.state
 	if state == callbackStateDone {
 		*reply = *cb.reply
 		cl.mu.Unlock()
 		return 0 // no error
 	} else {
+		// Nobody will wait for this reply anymore.
+		delete(cl.pending, cb.seqno)
 		cl.mu.Unlock()
 		if state == callbackStateAborted {
 			return ErrDisconnect
+		} else if state == callbackStateOverloaded {
+			return ErrOverload
+		} else if state == callbackStateUnknownRPC {
+			return ErrUnknownRPC
+		} else if state == callbackStateUnauthorized {
+			return ErrUnauthorized
 		} else {
-			// FIXME: in case of timeout, resend message with the same "seq", so that if the
-			// server responds to a resend, we accept that response for the original request.
 			return ErrTimeout
 		}
 	}
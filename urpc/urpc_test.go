@@ -0,0 +1,500 @@
+package urpc
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/metrics"
+	"github.com/tchajed/marshal"
+)
+
+func TestRetransmitSameSeqno(t *testing.T) {
+	var calls atomic.Uint64
+	handlers := map[uint64]func([]byte, *[]byte){
+		0: func(args []byte, reply *[]byte) {
+			calls.Add(1)
+			time.Sleep(150 * time.Millisecond) // longer than the client's timeout
+			*reply = args
+		},
+	}
+	host := grove_ffi.MakeAddress("unix:" + filepath.Join(t.TempDir(), "urpc.sock"))
+	MakeServer(handlers).Serve(host)
+
+	cl := MakeClient(host)
+	cl.SetRetryPolicy(&RetryPolicy{MaxAttempts: 0, Multiplier: 1})
+	reply := new([]byte)
+	if err := cl.Call(0, []byte("x"), reply, 20); err != ErrNone {
+		t.Fatalf("call failed: %d", err)
+	}
+	if string(*reply) != "x" {
+		t.Errorf("got reply %q", *reply)
+	}
+	// the retransmissions arrived while the original was running
+	if n := calls.Load(); n != 1 {
+		t.Errorf("handler ran %d times", n)
+	}
+	cl.mu.Lock()
+	if len(cl.pending) != 0 {
+		t.Errorf("pending not cleaned up: %v", cl.pending)
+	}
+	cl.mu.Unlock()
+}
+
+func TestRetransmitAfterReply(t *testing.T) {
+	var calls atomic.Uint64
+	handlers := map[uint64]func([]byte, *[]byte){
+		0: func(args []byte, reply *[]byte) { *reply = marshal.WriteInt(nil, calls.Add(1)) },
+	}
+	host := grove_ffi.MakeAddress("unix:" + filepath.Join(t.TempDir(), "urpc.sock"))
+	MakeServer(handlers).Serve(host)
+
+	// A retransmission that arrives after the reply was sent (e.g. because the
+	// reply was slow to arrive) gets the same reply, without running the
+	// handler again. Each request needs a reply, so skip the server's hello.
+	conn := grove_ffi.Connect(host).Connection
+	if r := grove_ffi.Receive(conn); r.Err {
+		t.Fatal("no hello")
+	}
+	req := marshal.WriteInt(marshal.WriteInt(nil, 0), 7)
+	var replies [][]byte
+	for i := 0; i < 2; i++ {
+		grove_ffi.Send(conn, req)
+		r := grove_ffi.Receive(conn)
+		if r.Err {
+			t.Fatal("no reply")
+		}
+		replies = append(replies, r.Data)
+	}
+	if !bytes.Equal(replies[0], replies[1]) {
+		t.Errorf("replies differ: %v, %v", replies[0], replies[1])
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("handler ran %d times", n)
+	}
+}
+
+func TestMaxTotalMs(t *testing.T) {
+	handlers := map[uint64]func([]byte, *[]byte){
+		0: func(args []byte, reply *[]byte) { time.Sleep(time.Second) },
+	}
+	host := grove_ffi.MakeAddress("unix:" + filepath.Join(t.TempDir(), "urpc.sock"))
+	MakeServer(handlers).Serve(host)
+
+	// retransmits forever, except for the cap
+	cl := MakeClient(host)
+	cl.SetRetryPolicy(&RetryPolicy{MaxAttempts: 0, Multiplier: 1, MaxTotalMs: 100})
+	start := time.Now()
+	if err := cl.Call(0, nil, new([]byte), 20); err != ErrTimeout {
+		t.Fatalf("expected timeout, got %d", err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("gave up after %v", d)
+	}
+}
+
+func TestTimeoutCleansUpPending(t *testing.T) {
+	handlers := map[uint64]func([]byte, *[]byte){
+		0: func(args []byte, reply *[]byte) { time.Sleep(100 * time.Millisecond) },
+	}
+	host := grove_ffi.MakeAddress("unix:" + filepath.Join(t.TempDir(), "urpc.sock"))
+	MakeServer(handlers).Serve(host)
+
+	cl := MakeClient(host)
+	cl.SetRetryPolicy(&RetryPolicy{MaxAttempts: 2, Multiplier: 2})
+	if err := cl.Call(0, nil, new([]byte), 10); err != ErrTimeout {
+		t.Fatalf("expected timeout, got %d", err)
+	}
+	cl.mu.Lock()
+	if len(cl.pending) != 0 {
+		t.Errorf("pending not cleaned up: %v", cl.pending)
+	}
+	cl.mu.Unlock()
+}
+
+func TestOverload(t *testing.T) {
+	release := make(chan struct{})
+	handlers := map[uint64]func([]byte, *[]byte){
+		0: func(args []byte, reply *[]byte) { <-release },
+	}
+	host := grove_ffi.MakeAddress("unix:" + filepath.Join(t.TempDir(), "urpc.sock"))
+	MakeServerWithConfig(handlers, ServerConfig{MaxInflightPerConn: 4, MaxInflight: 1}).Serve(host)
+
+	cl := MakeClient(host)
+	cb, err := cl.CallStart(0, nil)
+	if err != ErrNone {
+		t.Fatalf("call failed: %d", err)
+	}
+	time.Sleep(20 * time.Millisecond) // let the first call start running
+	if err := cl.Call(0, nil, new([]byte), 1000); err != ErrOverload {
+		t.Errorf("expected overload, got %d", err)
+	}
+	close(release)
+	if err := cl.CallComplete(cb, new([]byte), 1000); err != ErrNone {
+		t.Errorf("first call failed: %d", err)
+	}
+}
+
+func TestOrdered(t *testing.T) {
+	var mu sync.Mutex
+	order := make([]byte, 0)
+	handlers := map[uint64]func([]byte, *[]byte){
+		0: func(args []byte, reply *[]byte) {
+			// later requests would overtake earlier ones if they ran concurrently
+			time.Sleep(time.Duration(10-args[0]) * time.Millisecond)
+			mu.Lock()
+			order = append(order, args[0])
+			mu.Unlock()
+		},
+	}
+	host := grove_ffi.MakeAddress("unix:" + filepath.Join(t.TempDir(), "urpc.sock"))
+	srv := MakeServer(handlers)
+	srv.SetOrdered(0)
+	srv.Serve(host)
+
+	cl := MakeClient(host)
+	cbs := make([]*Callback, 0)
+	for i := byte(0); i < 5; i++ {
+		cb, err := cl.CallStart(0, []byte{i})
+		if err != ErrNone {
+			t.Fatalf("call failed: %d", err)
+		}
+		cbs = append(cbs, cb)
+	}
+	for _, cb := range cbs {
+		if err := cl.CallComplete(cb, new([]byte), 1000); err != ErrNone {
+			t.Fatalf("call failed: %d", err)
+		}
+	}
+	if string(order) != "\x00\x01\x02\x03\x04" {
+		t.Errorf("handled out of order: %v", order)
+	}
+}
+
+func TestHandleOrdered(t *testing.T) {
+	var mu sync.Mutex
+	order := make([]byte, 0)
+	release := make(chan bool)
+	host := grove_ffi.MakeAddress("unix:" + filepath.Join(t.TempDir(), "urpc.sock"))
+	srv := MakeServer(map[uint64]func([]byte, *[]byte){})
+	srv.HandleOrdered(0, func(args []byte) func(reply *[]byte) {
+		time.Sleep(time.Duration(10-args[0]) * time.Millisecond)
+		mu.Lock()
+		order = append(order, args[0])
+		mu.Unlock()
+		return func(reply *[]byte) {
+			// the first request only finishes once the last one has started,
+			// which it couldn't if this step held up the queue
+			if args[0] == 0 {
+				<-release
+			}
+			if args[0] == 4 {
+				close(release)
+			}
+			*reply = args
+		}
+	})
+	srv.Serve(host)
+
+	cl := MakeClient(host)
+	// once the hello has arrived, the client only sends the rpcids it lists
+	deadline := time.Now().Add(time.Second)
+	for cl.ServerHandles(7) {
+		if time.Now().After(deadline) {
+			t.Fatal("no hello")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if !cl.ServerHandles(0) {
+		t.Fatalf("the hello doesn't list the ordered handler: %v", cl.rpcids)
+	}
+	cbs := make([]*Callback, 0)
+	for i := byte(0); i < 5; i++ {
+		cb, err := cl.CallStart(0, []byte{i})
+		if err != ErrNone {
+			t.Fatalf("call failed: %d", err)
+		}
+		cbs = append(cbs, cb)
+	}
+	for i, cb := range cbs {
+		reply := new([]byte)
+		if err := cl.CallComplete(cb, reply, 1000); err != ErrNone || (*reply)[0] != byte(i) {
+			t.Fatalf("call %d failed: %d %v", i, err, *reply)
+		}
+	}
+	if string(order) != "\x00\x01\x02\x03\x04" {
+		t.Errorf("handled out of order: %v", order)
+	}
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	handlers := map[uint64]func([]byte, *[]byte){
+		0: func(args []byte, reply *[]byte) {},
+	}
+	host := grove_ffi.MakeAddress("unix:" + filepath.Join(t.TempDir(), "urpc.sock"))
+	MakeServerWithConfig(handlers, ServerConfig{MaxMessageSize: 64}).Serve(host)
+
+	cl := MakeClient(host)
+	if err := cl.Call(0, make([]byte, 10), new([]byte), 1000); err != ErrNone {
+		t.Fatalf("small call failed: %d", err)
+	}
+	if err := cl.Call(0, make([]byte, 100), new([]byte), 1000); err != ErrDisconnect {
+		t.Errorf("expected disconnect, got %d", err)
+	}
+}
+
+func TestRegisterFlags(t *testing.T) {
+	defer SetServerConfig(DefaultServerConfig())
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	RegisterFlags(fs)
+	if err := fs.Parse([]string{"-rpc-max-inflight", "5", "-rpc-max-message-size", "0"}); err != nil {
+		t.Fatal(err)
+	}
+	want := DefaultServerConfig()
+	want.MaxInflight = 5
+	want.MaxMessageSize = 0
+	if cfg := CurrentServerConfig(); cfg != want {
+		t.Errorf("flags set %+v, want %+v", cfg, want)
+	}
+	if MakeServer(nil).cfg != want {
+		t.Errorf("MakeServer ignores the flags")
+	}
+	if err := fs.Parse([]string{"-rpc-max-inflight", "lots"}); err == nil {
+		t.Errorf("accepted a bad limit")
+	}
+}
+
+func TestCallContextDeadline(t *testing.T) {
+	gotDeadline := make(chan bool, 1)
+	handlers := map[uint64]func([]byte, *[]byte){}
+	host := grove_ffi.MakeAddress("unix:" + filepath.Join(t.TempDir(), "urpc.sock"))
+	srv := MakeServer(handlers)
+	srv.HandleContext(0, func(ctx context.Context, args []byte, reply *[]byte) {
+		_, ok := ctx.Deadline()
+		gotDeadline <- ok
+		<-ctx.Done() // stop once the caller has given up
+	})
+	srv.Serve(host)
+
+	cl := MakeClient(host)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := cl.CallContext(ctx, 0, nil, new([]byte), 1000); err != ErrCanceled {
+		t.Fatalf("expected canceled, got %d", err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("call took %v to give up", d)
+	}
+	if !<-gotDeadline {
+		t.Errorf("handler didn't get the deadline")
+	}
+}
+
+// A server from before the handshake, which sends back each request's rpcid.
+func serveOld(host grove_ffi.Address) {
+	l := grove_ffi.Listen(host)
+	go func() {
+		for {
+			conn := grove_ffi.Accept(l)
+			go func() {
+				for {
+					r := grove_ffi.Receive(conn)
+					if r.Err {
+						return
+					}
+					rpcid, data := marshal.ReadInt(r.Data)
+					seqno, _ := marshal.ReadInt(data)
+					reply := marshal.WriteInt(make([]byte, 0, 16), seqno)
+					reply = marshal.WriteBytes(reply, marshal.WriteInt(nil, rpcid))
+					grove_ffi.Send(conn, reply)
+				}
+			}()
+		}
+	}()
+}
+
+func TestNoDeadlineForOldServer(t *testing.T) {
+	host := grove_ffi.MakeAddress("unix:" + filepath.Join(t.TempDir(), "urpc.sock"))
+	serveOld(host)
+
+	cl := MakeClient(host)
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		reply := new([]byte)
+		if err := cl.CallContext(ctx, 3, nil, reply, 1000); err != ErrNone {
+			t.Fatalf("call failed: %d", err)
+		}
+		cancel()
+		if rpcid, _ := marshal.ReadInt(*reply); rpcid != 3 {
+			t.Errorf("server got rpcid %#x", rpcid)
+		}
+	}
+}
+
+func TestHandshakeAndUnknownRPC(t *testing.T) {
+	handlers := map[uint64]func([]byte, *[]byte){
+		0: func(args []byte, reply *[]byte) { *reply = args },
+	}
+	host := grove_ffi.MakeAddress("unix:" + filepath.Join(t.TempDir(), "urpc.sock"))
+	MakeServer(handlers).Serve(host)
+
+	cl := MakeClient(host)
+	if err := cl.Call(0, []byte("x"), new([]byte), 1000); err != ErrNone {
+		t.Fatalf("call failed: %d", err)
+	}
+	// the hello is the first thing the server sends, so it's here by now
+	if v := cl.Version(); v != ProtocolVersion {
+		t.Errorf("got version %d", v)
+	}
+	if !cl.ServerHandles(0) || cl.ServerHandles(7) {
+		t.Errorf("wrong rpcids: %v", cl.rpcids)
+	}
+	if err := cl.Call(7, nil, new([]byte), 1000); err != ErrUnknownRPC {
+		t.Errorf("expected unknown RPC, got %d", err)
+	}
+
+	// as if the hello hadn't arrived: the server has to say so itself
+	cl.mu.Lock()
+	cl.rpcids = nil
+	cl.mu.Unlock()
+	if err := cl.Call(7, nil, new([]byte), 1000); err != ErrUnknownRPC {
+		t.Errorf("expected unknown RPC from server, got %d", err)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	big := bytes.Repeat([]byte("snapshot "), 100_000)
+	handlers := map[uint64]func([]byte, *[]byte){
+		0: func(args []byte, reply *[]byte) {
+			if !bytes.Equal(args, big) {
+				t.Errorf("handler got %d bytes", len(args))
+			}
+			*reply = args
+		},
+		1: func(args []byte, reply *[]byte) {},
+	}
+	host := grove_ffi.MakeAddress("unix:" + filepath.Join(t.TempDir(), "urpc.sock"))
+	MakeServer(handlers).Serve(host)
+
+	cl := MakeClient(host)
+	reply := new([]byte)
+	for i := 0; i < 2; i++ { // the first call may go out before the handshake is done
+		if err := cl.Call(0, big, reply, 1000); err != ErrNone {
+			t.Fatalf("call failed: %d", err)
+		}
+		if !bytes.Equal(*reply, big) {
+			t.Fatalf("got %d bytes back", len(*reply))
+		}
+	}
+	if !cl.hasFeature(FeatureCompression) {
+		t.Errorf("compression wasn't negotiated")
+	}
+
+	// a small compressed reply that decompresses to more than a client takes
+	cfg := DefaultServerConfig()
+	cfg.MaxMessageSize = uint64(len(big)) - 1
+	SetServerConfig(cfg)
+	small := MakeClient(host)
+	SetServerConfig(DefaultServerConfig())
+	if err := small.Call(1, nil, new([]byte), 1000); err != ErrNone || !small.hasFeature(FeatureCompression) {
+		t.Fatalf("handshake failed: %d", err)
+	}
+	if err := small.Call(0, big, reply, 1000); err != ErrDisconnect {
+		t.Errorf("expected disconnect on a reply past the limit, got %d", err)
+	}
+
+	z, ok := compress(big)
+	if !ok || len(z) >= len(big) {
+		t.Fatalf("didn't compress")
+	}
+	if _, ok := decompress(z, uint64(len(big))-1); ok {
+		t.Errorf("decompressed past the limit")
+	}
+}
+
+// The value of the series (e.g. `name{label="x"}`) in the Default registry;
+// 0 if it isn't there.
+func metricValue(series string) float64 {
+	var b bytes.Buffer
+	metrics.Default.Write(&b)
+	for _, line := range strings.Split(b.String(), "\n") {
+		if v, ok := strings.CutPrefix(line, series+" "); ok {
+			f, _ := strconv.ParseFloat(v, 64)
+			return f
+		}
+	}
+	return 0
+}
+
+func TestMetrics(t *testing.T) {
+	series := []string{
+		`urpc_server_requests_total{rpc="77"}`,
+		`urpc_server_handler_seconds_count{rpc="77"}`,
+		`urpc_client_calls_total{rpc="77"}`,
+		`urpc_client_call_seconds_count{rpc="77"}`,
+		`urpc_client_errors_total{rpc="78",error="unknown_rpc"}`,
+	}
+	want := []float64{3, 3, 3, 3, 1}
+	before := make([]float64, len(series))
+	for i, name := range series {
+		before[i] = metricValue(name)
+	}
+
+	handlers := map[uint64]func([]byte, *[]byte){
+		77: func(args []byte, reply *[]byte) { *reply = args },
+	}
+	host := grove_ffi.MakeAddress("unix:" + filepath.Join(t.TempDir(), "urpc.sock"))
+	MakeServer(handlers).Serve(host)
+
+	cl := MakeClient(host)
+	for i := 0; i < 3; i++ {
+		if err := cl.Call(77, nil, new([]byte), 1000); err != ErrNone {
+			t.Fatalf("call failed: %d", err)
+		}
+	}
+	if err := cl.Call(78, nil, new([]byte), 1000); err != ErrUnknownRPC {
+		t.Fatalf("expected unknown rpc, got %d", err)
+	}
+
+	for i, name := range series {
+		if d := metricValue(name) - before[i]; d != want[i] {
+			t.Errorf("%s went up by %v, not %v", name, d, want[i])
+		}
+	}
+}
+
+func TestRestrict(t *testing.T) {
+	handlers := map[uint64]func([]byte, *[]byte){
+		0: func(args []byte, reply *[]byte) { *reply = args },
+		1: func(args []byte, reply *[]byte) { *reply = args },
+		2: func(args []byte, reply *[]byte) { *reply = args },
+	}
+	host := grove_ffi.MakeAddress("unix:" + filepath.Join(t.TempDir(), "urpc.sock"))
+	srv := MakeServer(handlers)
+	srv.Restrict(1, []string{"admin"})
+	srv.RestrictToAdmin([]uint64{2}) // TLS is off, so this does nothing
+	srv.Serve(host)
+
+	cl := MakeClient(host)
+	reply := new([]byte)
+	if err := cl.Call(1, []byte("x"), reply, 1000); err != ErrUnauthorized {
+		t.Fatalf("expected unauthorized, got %d", err)
+	}
+	// the server didn't hang up
+	for _, rpcid := range []uint64{0, 2} {
+		if err := cl.Call(rpcid, []byte("y"), reply, 1000); err != ErrNone || string(*reply) != "y" {
+			t.Errorf("call %d after unauthorized one: %d, %q", rpcid, err, *reply)
+		}
+	}
+}
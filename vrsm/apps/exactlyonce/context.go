@@ -0,0 +1,34 @@
+package exactlyonce
+
+import (
+	"context"
+
+	"github.com/goose-lang/std"
+	"github.com/mit-pdos/gokv/trace"
+	"github.com/tchajed/marshal"
+)
+
+// Like ApplyExactlyOnce, but gives up once ctx is done, returning ctx.Err(). In
+// that case req might or might not have been applied, but it won't be applied
+// later, after some other request from this clerk.
+func (ck *Clerk) ApplyExactlyOnceContext(ctx context.Context, req []byte) ([]byte, error) {
+	ctx, span := trace.Start(ctx, "exactlyonce.Apply")
+	defer span.End()
+	span.SetAttrInt("cid", ck.cid)
+	span.SetAttrInt("seq", ck.seq)
+	var enc = make([]byte, 1, 1)
+	enc[0] = OPTYPE_RW
+	enc = marshal.WriteInt(enc, ck.cid)
+	enc = marshal.WriteInt(enc, ck.seq)
+	enc = marshal.WriteBytes(enc, req)
+	ck.seq = std.SumAssumeNoOverflow(ck.seq, 1)
+
+	return ck.ck.ApplyContext(ctx, enc)
+}
+
+func (ck *Clerk) ApplyReadonlyContext(ctx context.Context, req []byte) ([]byte, error) {
+	var enc = make([]byte, 1, 1)
+	enc[0] = OPTYPE_RO
+	enc = marshal.WriteBytes(enc, req)
+	return ck.ck.ApplyRoContext(ctx, enc)
+}
@@ -0,0 +1,42 @@
+package vkv
+
+import (
+	"context"
+
+	"github.com/mit-pdos/gokv/trace"
+)
+
+// Versions of the Clerk methods that give up once ctx is done, returning
+// ctx.Err(). A Put or CondPut that gives up might or might not have happened.
+// Each call is the root of a trace (see package trace), unless ctx already has
+// a span.
+
+func (ck *Clerk) PutContext(ctx context.Context, key, val string) error {
+	ctx, span := trace.Start(ctx, "vkv.Put")
+	defer span.End()
+	args := &PutArgs{
+		Key: key,
+		Val: val,
+	}
+	_, err := ck.cl.ApplyExactlyOnceContext(ctx, encodePutArgs(args))
+	return err
+}
+
+func (ck *Clerk) GetContext(ctx context.Context, key string) (string, error) {
+	ctx, span := trace.Start(ctx, "vkv.Get")
+	defer span.End()
+	ret, err := ck.cl.ApplyReadonlyContext(ctx, encodeGetArgs(key))
+	return string(ret), err
+}
+
+func (ck *Clerk) CondPutContext(ctx context.Context, key, expect, val string) (string, error) {
+	ctx, span := trace.Start(ctx, "vkv.CondPut")
+	defer span.End()
+	args := &CondPutArgs{
+		Key:    key,
+		Expect: expect,
+		Val:    val,
+	}
+	ret, err := ck.cl.ApplyExactlyOnceContext(ctx, encodeCondPutArgs(args))
+	return string(ret), err
+}
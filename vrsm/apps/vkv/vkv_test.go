@@ -0,0 +1,204 @@
+package vkv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/grove_ffi/memnet"
+	"github.com/mit-pdos/gokv/logging"
+	"github.com/mit-pdos/gokv/trace"
+	"github.com/mit-pdos/gokv/vrsm/configservice"
+	"github.com/mit-pdos/gokv/vrsm/e"
+	"github.com/mit-pdos/gokv/vrsm/reconfig"
+	"github.com/mit-pdos/gokv/vrsm/replica"
+	"github.com/mit-pdos/gokv/vrsm/vrsmtest"
+)
+
+// Starts a config server and three replicas on an in-memory network, and
+// initializes the system; returns the network, the config server and the
+// replicas.
+func startSystem(t *testing.T) (*memnet.Network, []grove_ffi.Address, []grove_ffi.Address) {
+	servers := []grove_ffi.Address{
+		grove_ffi.MakeAddress("10.0.1.1:1"),
+		grove_ffi.MakeAddress("10.0.1.2:1"),
+		grove_ffi.MakeAddress("10.0.1.3:1"),
+	}
+	n, confHosts := vrsmtest.StartConfigService(t, servers)
+	for i, srv := range servers {
+		Start(fmt.Sprint("kv", i, ".data"), srv, confHosts)
+	}
+	if err := reconfig.InitializeSystem(confHosts, servers); err != e.None {
+		t.Fatalf("InitializeSystem: %d", err)
+	}
+	return n, confHosts, servers
+}
+
+// A config server and three replicas on an in-memory network; after
+// reconfiguring to two of the replicas (and cutting off the third), clients see
+// everything written before.
+func TestReplicationAndReconfig(t *testing.T) {
+	n, confHosts, servers := startSystem(t)
+
+	ck := MakeClerk(confHosts)
+	for i := 0; i < 10; i++ {
+		ck.Put(fmt.Sprint("k", i), fmt.Sprint("v", i))
+	}
+	if r := ck.CondPut("k0", "v0", "w0"); r != "ok" {
+		t.Errorf("CondPut returned %q", r)
+	}
+
+	if err := reconfig.EnterNewConfig(confHosts, servers[1:]); err != e.None {
+		t.Fatalf("EnterNewConfig: %d", err)
+	}
+	n.Isolate(servers[0])
+
+	ck.Put("k10", "v10")
+	if v := ck.Get("k0"); v != "w0" {
+		t.Errorf("k0 = %q", v)
+	}
+	for i := 1; i <= 10; i++ {
+		if v := ck.Get(fmt.Sprint("k", i)); v != fmt.Sprint("v", i) {
+			t.Errorf("k%d = %q", i, v)
+		}
+	}
+
+	// the status reflects the new configuration, with servers[1] as primary
+	cs := waitHealthy(t, confHosts)
+	if cs.Epoch < 2 || len(cs.Replicas) != 2 || cs.Replicas[0] != servers[1] {
+		t.Fatalf("status shows epoch %d, replicas %v", cs.Epoch, cs.Replicas)
+	}
+	if p := cs.ReplicaStatus[0]; !p.IsPrimary || len(p.Backups) != 1 || p.Backups[0] != servers[2] ||
+		p.NextIndex < 12 || p.CommittedNextIndex != p.NextIndex {
+		t.Errorf("primary status %+v", p)
+	}
+
+	n.Isolate(servers[2])
+	problems := reconfig.GetClusterStatus(confHosts).Problems()
+	want := fmt.Sprintf("replica %s is unreachable", grove_ffi.AddressToStr(servers[2]))
+	if len(problems) != 1 || problems[0] != want {
+		t.Errorf("problems %q, want [%q]", problems, want)
+	}
+}
+
+// Waits for the system to have no problems (the primary might still be
+// getting its lease), and returns its status.
+func waitHealthy(t *testing.T, confHosts []grove_ffi.Address) *reconfig.ClusterStatus {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		cs := reconfig.GetClusterStatus(confHosts)
+		problems := cs.Problems()
+		if len(problems) == 0 {
+			return cs
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("problems: %q", problems)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// A traced Put is recorded as one trace, from the clerk through the primary to
+// each backup.
+func TestTracePut(t *testing.T) {
+	_, confHosts, servers := startSystem(t)
+	ck := MakeClerk(confHosts)
+
+	fname := filepath.Join(t.TempDir(), "trace.json")
+	if err := trace.Init(&trace.Config{File: fname, Service: "vkv-test", SampleRate: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ck.PutContext(context.Background(), "k", "v"); err != nil {
+		t.Fatal(err)
+	}
+	// the backups may still be writing theirs
+	time.Sleep(100 * time.Millisecond)
+	trace.Shutdown()
+
+	type span struct {
+		TraceID      string `json:"traceId"`
+		SpanID       string `json:"spanId"`
+		ParentSpanID string `json:"parentSpanId"`
+		Name         string `json:"name"`
+	}
+	var spans []span
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var tr struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct{ Spans []span }
+			}
+		}
+		if err := json.Unmarshal([]byte(line), &tr); err != nil {
+			t.Fatalf("bad line %q: %v", line, err)
+		}
+		spans = append(spans, tr.ResourceSpans[0].ScopeSpans[0].Spans...)
+	}
+
+	ids := make(map[string]bool)
+	counts := make(map[string]int)
+	for _, s := range spans {
+		ids[s.SpanID] = true
+		counts[s.Name]++
+	}
+	for _, s := range spans {
+		if s.TraceID != spans[0].TraceID {
+			t.Errorf("span %s in a different trace", s.Name)
+		}
+		if s.Name == "vkv.Put" {
+			if s.ParentSpanID != "" {
+				t.Errorf("root has a parent")
+			}
+		} else if !ids[s.ParentSpanID] {
+			t.Errorf("span %s has no parent in the trace", s.Name)
+		}
+	}
+	nbackups := len(servers) - 1
+	for name, n := range map[string]int{
+		"vkv.Put":              1,
+		"exactlyonce.Apply":    1,
+		"clerk.Apply":          1,
+		"replica.Apply":        1,
+		"replica.SendToBackup": nbackups,
+		"storage.WaitDurable":  1 + nbackups,
+	} {
+		if counts[name] != n {
+			t.Errorf("%d %s spans, want %d (got %v)", counts[name], name, n, counts)
+		}
+	}
+	// at least one call to the primary, and one to each backup
+	if counts["urpc.handle"] < 1+nbackups {
+		t.Errorf("%d urpc.handle spans", counts["urpc.handle"])
+	}
+}
+
+// Log levels can be changed through the config server's and replicas' admin
+// RPCs, and a bad spec is rejected without changing anything.
+func TestSetLogLevels(t *testing.T) {
+	_, confHosts, servers := startSystem(t)
+	old := logging.Levels()
+	defer logging.SetLevels(old)
+
+	err, ok, levels := replica.MakeClerk(servers[0]).SetLogLevels("replica=debug")
+	if err != e.None || !ok || !strings.Contains(levels, "replica=debug") {
+		t.Fatalf("replica SetLogLevels: %d %v %q", err, ok, levels)
+	}
+	configCk := configservice.MakeClerk(confHosts)
+	err, ok, levels = configCk.SetLogLevels(0, "paxos=loud")
+	if err != e.None || ok || !strings.Contains(levels, "loud") {
+		t.Fatalf("config SetLogLevels with a bad spec: %d %v %q", err, ok, levels)
+	}
+	err, ok, levels = configCk.SetLogLevels(0, "")
+	if err != e.None || !ok || strings.Contains(levels, "paxos=") || !strings.Contains(levels, "replica=debug") {
+		t.Fatalf("config SetLogLevels: %d %v %q", err, ok, levels)
+	}
+}
@@ -0,0 +1,89 @@
+package clerk
+
+import (
+	"context"
+	"time"
+
+	"github.com/goose-lang/primitive"
+	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/trace"
+	"github.com/mit-pdos/gokv/vrsm/e"
+)
+
+// Versions of Apply and ApplyRo that give up once ctx is done, returning
+// ctx.Err(), rather than retrying forever. If ApplyContext gives up, op might or
+// might not have been applied.
+
+// Sleeps for ns nanoseconds, or until ctx is done.
+func sleep(ctx context.Context, ns uint64) error {
+	t := time.NewTimer(time.Duration(ns))
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+func (ck *Clerk) ApplyContext(ctx context.Context, op []byte) ([]byte, error) {
+	ctx, span := trace.Start(ctx, "clerk.Apply")
+	defer span.End()
+	var attempts = uint64(0)
+	for {
+		attempts += 1
+		span.SetAttrInt("attempts", attempts)
+		err, ret := ck.replicaClerks[0].ApplyContext(ctx, op)
+		if err == e.None {
+			return ret, nil
+		}
+		if err := sleep(ctx, uint64(100)*uint64(1_000_000)); err != nil { // throttle retries to config server
+			return nil, err
+		}
+		config, err2 := ck.confCk.GetConfigContext(ctx)
+		if err2 != nil {
+			return nil, err2
+		}
+		if len(config) > 0 {
+			ck.replicaClerks = makeClerks(config)
+		}
+	}
+}
+
+func (ck *Clerk) ApplyRoContext(ctx context.Context, op []byte) ([]byte, error) {
+	ctx, span := trace.Start(ctx, "clerk.ApplyRo")
+	defer span.End()
+	ck.maybeRefreshPreference()
+	for {
+		// try the "preferred" replica first, then cycle around
+		offset := ck.preferredReplica
+		var i uint64
+		for i < uint64(len(ck.replicaClerks)) {
+			k := (i + offset) % uint64(len(ck.replicaClerks))
+			err, ret := ck.replicaClerks[k].ApplyRoContext(ctx, op)
+			if err == e.None {
+				ck.preferredReplica = k
+				return ret, nil
+			}
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			i += 1
+			ck.lastPreferenceRefresh, _ = grove_ffi.GetTimeRange()
+		}
+
+		timeToSleep := 5 + (primitive.RandomUint64() % 10)
+		if err := sleep(ctx, timeToSleep*uint64(1_000_000)); err != nil {
+			return nil, err
+		}
+		config, err := ck.confCk.GetConfigContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if len(config) > 0 {
+			ck.replicaClerks = makeClerks(config)
+			ck.lastPreferenceRefresh, _ = grove_ffi.GetTimeRange()
+			ck.preferredReplica = primitive.RandomUint64() % uint64(len(ck.replicaClerks))
+		}
+	}
+}
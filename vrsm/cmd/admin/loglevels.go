@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/vrsm/configservice"
+	"github.com/mit-pdos/gokv/vrsm/e"
+	"github.com/mit-pdos/gokv/vrsm/replica"
+)
+
+// Applies the log level spec (see logging.SetLevels) to every config server
+// and every replica in the current configuration, and prints each one's levels
+// afterwards; an empty spec just prints them. Returns whether every server
+// accepted spec.
+func setLogLevels(configHosts []grove_ffi.Address, spec string) bool {
+	var allOk = true
+	report := func(kind string, host grove_ffi.Address, err e.Error, ok bool, msg string) {
+		if err != e.None {
+			fmt.Printf("%s %s: unreachable\n", kind, grove_ffi.AddressToStr(host))
+			allOk = false
+		} else if !ok {
+			fmt.Printf("%s %s: rejected: %s\n", kind, grove_ffi.AddressToStr(host), msg)
+			allOk = false
+		} else {
+			fmt.Printf("%s %s: %s\n", kind, grove_ffi.AddressToStr(host), msg)
+		}
+	}
+
+	configCk := configservice.MakeClerk(configHosts)
+	for i, host := range configHosts {
+		err, ok, msg := configCk.SetLogLevels(uint64(i), spec)
+		report("config server", host, err, ok, msg)
+	}
+	for _, host := range configCk.GetConfig() {
+		err, ok, msg := replica.MakeClerk(host).SetLogLevels(spec)
+		report("replica", host, err, ok, msg)
+	}
+	return allOk
+}
@@ -7,7 +7,9 @@ import (
 	"os"
 	"time"
 
+	"github.com/mit-pdos/gokv/cluster"
 	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/logging"
 	"github.com/mit-pdos/gokv/vrsm/configservice"
 	"github.com/mit-pdos/gokv/vrsm/e"
 	"github.com/mit-pdos/gokv/vrsm/reconfig"
@@ -15,7 +17,10 @@ import (
 
 func main() {
 	var confStr string
+	var clusterFile string
 	flag.StringVar(&confStr, "conf", "", "address of config server")
+	flag.StringVar(&clusterFile, "config", "", "cluster description file (see the cluster package), in place of -conf; init then defaults to the file's initial replicas, and replicas can be given by name")
+	logging.RegisterFlags(nil)
 	flag.Parse()
 
 	rand.Seed(time.Now().UTC().UnixNano())
@@ -24,37 +29,66 @@ func main() {
 		if !b {
 			flag.PrintDefaults()
 			fmt.Println("Must provide command in form:")
-			fmt.Println(" init host1 [host2 ...]")
+			fmt.Println(" init host1 [host2 ...]    (hosts optional with -config)")
 			fmt.Println(" reconfig host1 [host2 ...]")
 			fmt.Println(" getconf")
+			fmt.Println(" status")
+			fmt.Println(" health")
+			fmt.Println(" loglevels [spec]    e.g. loglevels info,replica=debug")
 			os.Exit(1)
 		}
 	}
 
-	usage_assert(confStr != "")
+	usage_assert(confStr != "" || clusterFile != "")
 
-	confHost := grove_ffi.MakeAddress(confStr)
+	var confHosts []grove_ffi.Address
+	var vrsmCfg *cluster.VRSM
+	if confStr != "" {
+		confHosts = []grove_ffi.Address{grove_ffi.MakeAddress(confStr)}
+	} else {
+		c, err := cluster.Load(clusterFile)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if c.VRSM == nil {
+			fmt.Printf("%s has no vrsm section\n", clusterFile)
+			os.Exit(1)
+		}
+		c.Apply()
+		vrsmCfg = c.VRSM
+		confHosts = vrsmCfg.ConfigHosts()
+	}
+	// replicas named on the command line, by address or (with -config) name
+	parseServers := func(strs []string) []grove_ffi.Address {
+		servers := make([]grove_ffi.Address, 0)
+		for _, srvStr := range strs {
+			if vrsmCfg != nil {
+				servers = append(servers, vrsmCfg.ReplicaAddress(srvStr))
+			} else {
+				servers = append(servers, grove_ffi.MakeAddress(srvStr))
+			}
+		}
+		return servers
+	}
 
 	a := flag.Args()
 	usage_assert(len(a) > 0)
 	if a[0] == "init" {
-		servers := make([]grove_ffi.Address, 0)
-		for _, srvStr := range a[1:] {
-			servers = append(servers, grove_ffi.MakeAddress(srvStr))
+		servers := parseServers(a[1:])
+		if len(servers) == 0 && vrsmCfg != nil {
+			servers = vrsmCfg.InitialReplicas()
 		}
-		err := reconfig.InitializeSystem([]grove_ffi.Address{confHost}, servers)
+		err := reconfig.InitializeSystem(confHosts, servers)
 		if err != 0 {
 			fmt.Printf("Error %d while initializing system\n", err)
 		} else {
 			fmt.Printf("Initialized system\n")
 		}
 	} else if a[0] == "reconfig" {
-		servers := make([]grove_ffi.Address, 0)
-		for _, srvStr := range a[1:] {
-			servers = append(servers, grove_ffi.MakeAddress(srvStr))
-		}
+		servers := parseServers(a[1:])
 		for {
-			err := reconfig.EnterNewConfig([]grove_ffi.Address{confHost}, servers)
+			err := reconfig.EnterNewConfig(confHosts, servers)
 			if err == 0 {
 				fmt.Printf("Finished switching configuration\n")
 				break
@@ -65,7 +99,7 @@ func main() {
 			continue
 		}
 	} else if a[0] == "getconf" {
-		ck := configservice.MakeClerk([]grove_ffi.Address{confHost})
+		ck := configservice.MakeClerk(confHosts)
 		conf := ck.GetConfig()
 		fmt.Println("Got config")
 
@@ -74,5 +108,29 @@ func main() {
 			servers = append(servers, grove_ffi.AddressToStr(srv))
 		}
 		fmt.Printf("Configuration is: %v\n", servers)
+	} else if a[0] == "status" {
+		if !printStatus(reconfig.GetClusterStatus(confHosts)) {
+			os.Exit(1)
+		}
+	} else if a[0] == "health" {
+		problems := reconfig.GetClusterStatus(confHosts).Problems()
+		for _, p := range problems {
+			fmt.Println(p)
+		}
+		if len(problems) > 0 {
+			os.Exit(1)
+		}
+		fmt.Println("healthy")
+	} else if a[0] == "loglevels" {
+		usage_assert(len(a) <= 2)
+		var spec string
+		if len(a) == 2 {
+			spec = a[1]
+		}
+		if !setLogLevels(confHosts, spec) {
+			os.Exit(1)
+		}
+	} else {
+		usage_assert(false)
 	}
 }
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/vrsm/e"
+	"github.com/mit-pdos/gokv/vrsm/reconfig"
+)
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// How long until the lease expiration time exp, from now.
+func leaseString(exp uint64, now uint64) string {
+	if exp <= now {
+		return "expired"
+	}
+	return time.Duration(exp - now).Round(time.Millisecond).String()
+}
+
+// Prints a table of the config servers and one of the replicas, followed by
+// any problems. Returns whether there were none.
+func printStatus(cs *reconfig.ClusterStatus) bool {
+	now, _ := grove_ffi.GetTimeRange()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(w, "CONFIG SERVER\tLEADER\tPAXOS EPOCH\tEPOCH\tRESERVED EPOCH\tLEASE\tWANT LEASE TO EXPIRE")
+	for i, st := range cs.ConfigStatus {
+		host := grove_ffi.AddressToStr(cs.ConfigHosts[i])
+		if st.Err != e.None {
+			fmt.Fprintf(w, "%s\tunreachable\n", host)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%s\t%s\n", host, yesNo(st.IsLeader), st.PaxosEpoch,
+			st.Epoch, st.ReservedEpoch, leaseString(st.LeaseExpiration, now), yesNo(st.WantLeaseToExpire))
+	}
+	fmt.Fprintln(w)
+
+	fmt.Fprintln(w, "REPLICA\tEPOCH\tPRIMARY\tSEALED\tNEXT INDEX\tCOMMITTED\tLEASE\tBACKUPS")
+	for i, st := range cs.ReplicaStatus {
+		host := grove_ffi.AddressToStr(cs.Replicas[i])
+		if st.Err != e.None {
+			fmt.Fprintf(w, "%s\tunreachable\n", host)
+			continue
+		}
+		var lease = "none"
+		if st.LeaseValid {
+			lease = leaseString(st.LeaseExpiration, now)
+		}
+		backups := make([]string, 0)
+		for _, b := range st.Backups {
+			backups = append(backups, grove_ffi.AddressToStr(b))
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%d\t%d\t%s\t%s\n", host, st.Epoch, yesNo(st.IsPrimary), yesNo(st.Sealed),
+			st.NextIndex, st.CommittedNextIndex, lease, strings.Join(backups, ","))
+	}
+	w.Flush()
+
+	problems := cs.Problems()
+	if len(problems) > 0 {
+		fmt.Println()
+		fmt.Println("Problems:")
+		for _, p := range problems {
+			fmt.Println(" " + p)
+		}
+	}
+	return len(problems) == 0
+}
@@ -1,17 +1,26 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
 
+	"github.com/mit-pdos/gokv/cluster"
 	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/trace"
 	"github.com/mit-pdos/gokv/vrsm/apps/vkv"
 )
 
 func main() {
 	var confStr string
+	var traceFile string
+	var traceSample float64
+	var clusterFile string
 	flag.StringVar(&confStr, "conf", "", "Address of configuration server")
+	flag.StringVar(&clusterFile, "config", "", "cluster description file (see the cluster package), in place of -conf")
+	flag.StringVar(&traceFile, "trace", "", "file to append trace spans to, in OTLP/JSON; off if empty")
+	flag.Float64Var(&traceSample, "trace-sample", 1, "fraction of requests to trace, if -trace is given")
 	flag.Parse()
 
 	usage_assert := func(b bool) {
@@ -24,23 +33,45 @@ func main() {
 		}
 	}
 
-	if len(confStr) == 0 {
+	var confHosts []grove_ffi.Address
+	if len(confStr) != 0 {
+		confHosts = []grove_ffi.Address{grove_ffi.MakeAddress(confStr)}
+	} else if clusterFile != "" {
+		c, err := cluster.Load(clusterFile)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if c.VRSM == nil {
+			fmt.Printf("%s has no vrsm section\n", clusterFile)
+			os.Exit(1)
+		}
+		c.Apply()
+		confHosts = c.VRSM.ConfigHosts()
+	} else {
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
 
-	conf := grove_ffi.MakeAddress(confStr)
-	ck := vkv.MakeClerk([]grove_ffi.Address{conf})
+	if traceFile != "" {
+		if err := trace.Init(&trace.Config{File: traceFile, Service: "vkv-client", SampleRate: traceSample}); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		defer trace.Shutdown()
+	}
+
+	ck := vkv.MakeClerk(confHosts)
 
 	a := flag.Args()
 	usage_assert(len(a) > 0)
 	if a[0] == "put" {
 		usage_assert(len(a) == 3)
-		ck.Put(a[1], a[2])
+		ck.PutContext(context.Background(), a[1], a[2])
 		fmt.Printf("PUT %s ↦ %s\n", a[1], a[2])
 	} else if a[0] == "get" {
 		usage_assert(len(a) == 2)
-		v := ck.Get(a[1])
+		v, _ := ck.GetContext(context.Background(), a[1])
 		fmt.Printf("GET %s ↦ %s\n", a[1], v)
 	} else {
 		usage_assert(false)
@@ -3,31 +3,82 @@ package main
 import (
 	"flag"
 	"fmt"
+	"github.com/mit-pdos/gokv/cluster"
 	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/logging"
+	"github.com/mit-pdos/gokv/metrics"
+	"github.com/mit-pdos/gokv/urpc"
 	"github.com/mit-pdos/gokv/vrsm/configservice"
 	"log"
 	"os"
+	"strconv"
 )
 
 func main() {
-	var port uint64
-	flag.Uint64Var(&port, "port", 0, "port number to user for server; port + 1 is used for paxos")
+	var port string
+	var paxosPort string
+	var metricsAddr string
+	var clusterFile string
+	var nodeName string
+	flag.StringVar(&clusterFile, "config", "", "cluster description file to start from, with -node (see the cluster package); other flags override it")
+	flag.StringVar(&nodeName, "node", "", "name of this config server in the -config file")
+	flag.StringVar(&port, "port", "", "port number to user for server; port + 1 is used for paxos unless -paxos is given (or an address to listen on, e.g. [::]:PORT or unix:PATH)")
+	flag.StringVar(&paxosPort, "paxos", "", "port number or address to use for paxos; required if -port is not a port number")
+	flag.StringVar(&metricsAddr, "metrics", "", "address to serve Prometheus metrics on at /metrics, e.g. :9100; off if empty")
+	logging.RegisterFlags(nil)
+	urpc.RegisterFlags(nil)
 	flag.Parse()
 
-	if port == 0 {
-		flag.PrintDefaults()
-		os.Exit(1)
+	if paxosPort != "" && clusterFile != "" {
+		log.Fatal("-paxos can't be used with -config; the paxos peers are all in the file")
 	}
 
-	a := flag.Args()
-	servers := make([]grove_ffi.Address, 0)
-	for _, srvStr := range a {
-		servers = append(servers, grove_ffi.MakeAddress(srvStr))
+	fname := "config.data"
+	var me grove_ffi.Address
+	var paxosMe grove_ffi.Address
+	var paxosHosts []grove_ffi.Address
+	var servers []grove_ffi.Address
+	if clusterFile != "" {
+		c, n, err := cluster.LoadNode(clusterFile, nodeName, cluster.VRSMConfigServer)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cluster.FillString(&metricsAddr, "metrics", n.Metrics)
+		me = n.ListenAddress()
+		paxosMe = c.VRSM.PaxosAddress(n.Name)
+		paxosHosts = c.VRSM.PaxosHosts()
+		servers = c.VRSM.InitialReplicas()
+	} else {
+		if port == "" {
+			flag.PrintDefaults()
+			os.Exit(1)
+		}
+		if paxosPort == "" {
+			p, err := strconv.ParseUint(port, 10, 16)
+			if err != nil {
+				flag.PrintDefaults()
+				os.Exit(1)
+			}
+			paxosPort = fmt.Sprint(p + 1)
+		}
+		paxosMe = grove_ffi.MakeListenAddress(paxosPort)
+		paxosHosts = []grove_ffi.Address{paxosMe}
+	}
+	if port != "" {
+		me = grove_ffi.MakeListenAddress(port)
+	}
+	if len(flag.Args()) > 0 {
+		servers = make([]grove_ffi.Address, 0)
+		for _, srvStr := range flag.Args() {
+			servers = append(servers, grove_ffi.MakeAddress(srvStr))
+		}
 	}
 
-	me := grove_ffi.MakeAddress(fmt.Sprintf("0.0.0.0:%d", port))
-	paxosMe := grove_ffi.MakeAddress(fmt.Sprintf("0.0.0.0:%d", port+1))
-	configservice.StartServer("config.data", me, paxosMe, []grove_ffi.Address{paxosMe}, servers)
-	log.Printf("Started config server on port %d and %d; id %d", port, port+1, me)
+	if metricsAddr != "" {
+		metrics.Serve(metricsAddr)
+	}
+	configservice.StartServer(fname, me, paxosMe, paxosHosts, servers)
+	log.Printf("Started config server on %s and %s; id %d", grove_ffi.AddressToStr(me),
+		grove_ffi.AddressToStr(paxosMe), me)
 	select {}
 }
@@ -2,8 +2,12 @@ package main
 
 import (
 	"flag"
-	"fmt"
+	"github.com/mit-pdos/gokv/cluster"
 	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/logging"
+	"github.com/mit-pdos/gokv/metrics"
+	"github.com/mit-pdos/gokv/trace"
+	"github.com/mit-pdos/gokv/urpc"
 	"github.com/mit-pdos/gokv/vrsm/apps/vkv"
 	"log"
 	"os"
@@ -19,29 +23,58 @@ func main() {
 	}()
 
 	var fname string
-	var port uint64
+	var port string
 	var confStr string
-	flag.StringVar(&fname, "filename", "", "name of file that holds durable state for this server")
-	flag.Uint64Var(&port, "port", 0, "port number to user for server")
+	var metricsAddr string
+	var traceFile string
+	var traceSample float64
+	var clusterFile string
+	var nodeName string
+	flag.StringVar(&clusterFile, "config", "", "cluster description file to start from, with -node (see the cluster package); other flags override it")
+	flag.StringVar(&nodeName, "node", "", "name of this replica in the -config file")
+	flag.StringVar(&fname, "filename", "", "name of file that holds durable state for this server (in the node's dataDir with -config)")
+	flag.StringVar(&port, "port", "", "port number to user for server (or an address to listen on, e.g. [::]:PORT or unix:PATH)")
+	flag.StringVar(&metricsAddr, "metrics", "", "address to serve Prometheus metrics on at /metrics, e.g. :9100; off if empty")
 	flag.StringVar(&confStr, "conf", "", "address of config server")
+	flag.StringVar(&traceFile, "trace", "", "file to append trace spans to, in OTLP/JSON; off if empty")
+	flag.Float64Var(&traceSample, "trace-sample", 0, "fraction of requests to start traces for here; requests that come with a trace from the client are recorded regardless")
+	logging.RegisterFlags(nil)
+	urpc.RegisterFlags(nil)
 	flag.Parse()
 
-	if fname == "" {
-		flag.PrintDefaults()
-		os.Exit(1)
+	var me grove_ffi.Address
+	var confHosts []grove_ffi.Address
+	if clusterFile != "" {
+		c, n, err := cluster.LoadNode(clusterFile, nodeName, cluster.VRSMReplica)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cluster.FillString(&fname, "filename", "vkv.data")
+		cluster.FillString(&metricsAddr, "metrics", n.Metrics)
+		me = n.ListenAddress()
+		confHosts = c.VRSM.ConfigHosts()
 	}
-	if port == 0 {
-		flag.PrintDefaults()
-		os.Exit(1)
+	if port != "" {
+		me = grove_ffi.MakeListenAddress(port)
 	}
-	if confStr == "" {
+	if confStr != "" {
+		confHosts = []grove_ffi.Address{grove_ffi.MakeAddress(confStr)}
+	}
+
+	if fname == "" || me == 0 || len(confHosts) == 0 {
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
 
-	confHost := grove_ffi.MakeAddress(confStr)
-	me := grove_ffi.MakeAddress(fmt.Sprintf("0.0.0.0:%d", port))
-	vkv.Start(fname, me, []grove_ffi.Address{confHost})
-	log.Printf("Started vKV server on port %d; id %d", port, me)
+	if metricsAddr != "" {
+		metrics.Serve(metricsAddr)
+	}
+	if traceFile != "" {
+		if err := trace.Init(&trace.Config{File: traceFile, Service: "vkv-server", SampleRate: traceSample}); err != nil {
+			log.Fatal(err)
+		}
+	}
+	vkv.Start(fname, me, confHosts)
+	log.Printf("Started vKV server on %s; id %d", grove_ffi.AddressToStr(me), me)
 	select {}
 }
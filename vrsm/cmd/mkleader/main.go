@@ -2,21 +2,46 @@ package main
 
 import (
 	"flag"
+	"github.com/mit-pdos/gokv/cluster"
 	"github.com/mit-pdos/gokv/grove_ffi"
 	"github.com/mit-pdos/gokv/vrsm/paxos"
+	"log"
 	"os"
 )
 
 func main() {
 	var host string
+	var clusterFile string
+	var nodeName string
 	flag.StringVar(&host, "host", "", "address of paxos server (e.g. 10.0.0.1:12345)")
+	flag.StringVar(&clusterFile, "config", "", "cluster description file (see the cluster package), in place of -host")
+	flag.StringVar(&nodeName, "node", "", "name of the config server in the -config file to make leader; the first one if empty")
 	flag.Parse()
 
-	if host == "" {
+	var addr grove_ffi.Address
+	if host != "" {
+		addr = grove_ffi.MakeAddress(host)
+	} else if clusterFile != "" {
+		c, err := cluster.Load(clusterFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if c.VRSM == nil {
+			log.Fatalf("%s has no vrsm section", clusterFile)
+		}
+		c.Apply()
+		if nodeName == "" {
+			nodeName = c.VRSM.Config[0].Name
+		}
+		if _, role, err := c.Node(nodeName); err != nil || role != cluster.VRSMConfigServer {
+			log.Fatalf("%s has no config server called %q", clusterFile, nodeName)
+		}
+		addr = c.VRSM.PaxosAddress(nodeName)
+	} else {
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
 
-	ck := paxos.MakeSingleClerk(grove_ffi.MakeAddress(host))
+	ck := paxos.MakeSingleClerk(addr)
 	ck.TryBecomeLeader()
 }
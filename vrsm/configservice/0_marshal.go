@@ -2,6 +2,7 @@ package configservice
 
 import (
 	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/vrsm/e"
 	"github.com/tchajed/marshal"
 )
 
@@ -26,3 +27,43 @@ func DecodeConfig(enc_config []byte) []grove_ffi.Address {
 	}
 	return config
 }
+
+type GetStatusReply struct {
+	Err               e.Error
+	Epoch             uint64
+	ReservedEpoch     uint64
+	LeaseExpiration   uint64
+	WantLeaseToExpire bool
+	// as of the last state this server heard about, which may be stale if it
+	// isn't the leader
+	Config     []grove_ffi.Address
+	IsLeader   bool   // whether this server is the paxos leader
+	PaxosEpoch uint64 // the paxos epoch this server is in
+}
+
+func EncodeGetStatusReply(reply *GetStatusReply) []byte {
+	var enc = make([]byte, 0, 8*8+8*uint64(len(reply.Config)))
+	enc = marshal.WriteInt(enc, reply.Err)
+	enc = marshal.WriteInt(enc, reply.Epoch)
+	enc = marshal.WriteInt(enc, reply.ReservedEpoch)
+	enc = marshal.WriteInt(enc, reply.LeaseExpiration)
+	enc = marshal.WriteBool(enc, reply.WantLeaseToExpire)
+	enc = marshal.WriteBool(enc, reply.IsLeader)
+	enc = marshal.WriteInt(enc, reply.PaxosEpoch)
+	enc = marshal.WriteBytes(enc, EncodeConfig(reply.Config))
+	return enc
+}
+
+func DecodeGetStatusReply(enc_reply []byte) *GetStatusReply {
+	var enc = enc_reply
+	reply := new(GetStatusReply)
+	reply.Err, enc = marshal.ReadInt(enc)
+	reply.Epoch, enc = marshal.ReadInt(enc)
+	reply.ReservedEpoch, enc = marshal.ReadInt(enc)
+	reply.LeaseExpiration, enc = marshal.ReadInt(enc)
+	reply.WantLeaseToExpire, enc = marshal.ReadBool(enc)
+	reply.IsLeader, enc = marshal.ReadBool(enc)
+	reply.PaxosEpoch, enc = marshal.ReadInt(enc)
+	reply.Config = DecodeConfig(enc)
+	return reply
+}
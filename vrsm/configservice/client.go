@@ -2,10 +2,13 @@ package configservice
 
 import (
 	"sync"
+	"sync/atomic"
 
 	"github.com/goose-lang/primitive"
 	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/logging"
 	"github.com/mit-pdos/gokv/reconnectclient"
+	"github.com/mit-pdos/gokv/urpc"
 	"github.com/mit-pdos/gokv/vrsm/e"
 	"github.com/tchajed/marshal"
 )
@@ -21,9 +24,47 @@ const (
 	RPC_GETCONFIG      = uint64(1)
 	RPC_TRYWRITECONFIG = uint64(2)
 	RPC_GETLEASE       = uint64(3)
+	RPC_GETSTATUS      = uint64(4)
+	RPC_SETLOGLEVELS   = uint64(5)
 )
 
+// How long clerks wait for each reply before trying again, in milliseconds.
+type Timeouts struct {
+	// every RPC except TryWriteConfig
+	CallMs uint64
+	// TryWriteConfig, which may have to wait out the current lease, so should
+	// be longer than LeaseInterval
+	WriteConfigMs uint64
+}
+
+var clerkTimeouts = Timeouts{CallMs: 100, WriteConfigMs: 2000}
+
+// Set once the first clerk or server is made; from then on, they read
+// clerkTimeouts and leaseInterval without locking, so those can no longer
+// change.
+var settingsUsed atomic.Bool
+
+func checkSettable(setter string) {
+	if settingsUsed.Load() {
+		panic("configservice: " + setter + " called after a server or clerk was made")
+	}
+}
+
+// The timeouts of every clerk in this process.
+func ClerkTimeouts() Timeouts {
+	return clerkTimeouts
+}
+
+// Sets the timeouts of every clerk in this process. It must be called before
+// any config server or clerk is made (the cluster package does so at startup),
+// and panics otherwise.
+func SetClerkTimeouts(t Timeouts) {
+	checkSettable("SetClerkTimeouts")
+	clerkTimeouts = t
+}
+
 func MakeClerk(hosts []grove_ffi.Address) *Clerk {
+	settingsUsed.Store(true)
 	var cls = make([]*reconnectclient.ReconnectingClient, 0)
 	for _, host := range hosts {
 		cls = append(cls, reconnectclient.MakeReconnectingClient(host))
@@ -31,13 +72,19 @@ func MakeClerk(hosts []grove_ffi.Address) *Clerk {
 	return &Clerk{cls: cls, mu: new(sync.Mutex)}
 }
 
-func (ck *Clerk) ReserveEpochAndGetConfig() (uint64, []grove_ffi.Address) {
+// Returns e.Unauthorized if the config service doesn't let this process
+// reserve epochs (see urpc.Server.RestrictToAdmin), and otherwise e.None along
+// with the epoch and the config.
+func (ck *Clerk) ReserveEpochAndGetConfig() (e.Error, uint64, []grove_ffi.Address) {
 	reply := new([]byte)
 	for {
 		ck.mu.Lock()
 		l := ck.leader
 		ck.mu.Unlock()
-		err := ck.cls[l].Call(RPC_RESERVEEPOCH, make([]byte, 0), reply, 100 /* ms */)
+		err := ck.cls[l].Call(RPC_RESERVEEPOCH, make([]byte, 0), reply, clerkTimeouts.CallMs)
+		if err == urpc.ErrUnauthorized {
+			return e.Unauthorized, 0, nil
+		}
 		if err != 0 {
 			continue
 		}
@@ -61,14 +108,14 @@ func (ck *Clerk) ReserveEpochAndGetConfig() (uint64, []grove_ffi.Address) {
 	var epoch uint64
 	epoch, *reply = marshal.ReadInt(*reply)
 	config := DecodeConfig(*reply)
-	return epoch, config
+	return e.None, epoch, config
 }
 
 func (ck *Clerk) GetConfig() []grove_ffi.Address {
 	reply := new([]byte)
 	for {
 		i := primitive.RandomUint64() % uint64(len(ck.cls))
-		err := ck.cls[i].Call(RPC_GETCONFIG, make([]byte, 0), reply, 100 /* ms */)
+		err := ck.cls[i].Call(RPC_GETCONFIG, make([]byte, 0), reply, clerkTimeouts.CallMs)
 		if err == 0 {
 			break
 		}
@@ -91,7 +138,10 @@ func (ck *Clerk) TryWriteConfig(epoch uint64, config []grove_ffi.Address) e.Erro
 		l := ck.leader
 		ck.mu.Unlock()
 
-		err := ck.cls[l].Call(RPC_TRYWRITECONFIG, args, reply, 2000 /* ms */)
+		err := ck.cls[l].Call(RPC_TRYWRITECONFIG, args, reply, clerkTimeouts.WriteConfigMs)
+		if err == urpc.ErrUnauthorized {
+			return e.Unauthorized
+		}
 		if err != 0 {
 			continue
 		}
@@ -124,7 +174,7 @@ func (ck *Clerk) GetLease(epoch uint64) (e.Error, uint64) {
 		l := ck.leader
 		ck.mu.Unlock()
 
-		err := ck.cls[l].Call(RPC_GETLEASE, args, reply, 100 /* ms */)
+		err := ck.cls[l].Call(RPC_GETLEASE, args, reply, clerkTimeouts.CallMs)
 		if err != 0 {
 			continue
 		}
@@ -146,3 +196,29 @@ func (ck *Clerk) GetLease(epoch uint64) (e.Error, uint64) {
 	leaseExpiration, _ := marshal.ReadInt(enc)
 	return err2, leaseExpiration
 }
+
+// Asks hosts[i] (of the hosts the clerk was made with) for its status, once.
+func (ck *Clerk) GetStatus(i uint64) *GetStatusReply {
+	reply := new([]byte)
+	err := ck.cls[i].Call(RPC_GETSTATUS, make([]byte, 0), reply, clerkTimeouts.CallMs)
+	if err != 0 {
+		return &GetStatusReply{Err: e.Timeout}
+	}
+	return DecodeGetStatusReply(*reply)
+}
+
+// Changes the log levels of hosts[i] (see logging.SetLevels); an empty spec
+// leaves them as they are. Returns whether the server accepted spec, and its
+// levels afterwards (or why it didn't).
+func (ck *Clerk) SetLogLevels(i uint64, spec string) (e.Error, bool, string) {
+	reply := new([]byte)
+	err := ck.cls[i].Call(RPC_SETLOGLEVELS, []byte(spec), reply, clerkTimeouts.CallMs)
+	if err == urpc.ErrUnauthorized {
+		return e.Unauthorized, false, ""
+	}
+	if err != 0 {
+		return e.Timeout, false, ""
+	}
+	ok, msg := logging.DecodeSetLevelsReply(*reply)
+	return e.None, ok, msg
+}
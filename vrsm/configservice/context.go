@@ -0,0 +1,112 @@
+package configservice
+
+import (
+	"context"
+	"errors"
+
+	"github.com/goose-lang/primitive"
+	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/urpc"
+	"github.com/mit-pdos/gokv/vrsm/e"
+	"github.com/tchajed/marshal"
+)
+
+// Versions of the Clerk methods that, instead of retrying forever, give up once
+// ctx is done and return ctx.Err().
+
+// Returned by the Context methods when the config service doesn't let this
+// process make the call (see urpc.Server.RestrictToAdmin).
+var ErrUnauthorized = errors.New("configservice: not authorized")
+
+// Moves on to the next server if l is still who we think is leader.
+func (ck *Clerk) leaderFailed(l uint64) {
+	ck.mu.Lock()
+	if l == ck.leader {
+		ck.leader = (ck.leader + 1) % uint64(len(ck.cls))
+	}
+	ck.mu.Unlock()
+}
+
+// Calls rpcid on the leader until it doesn't reply e.NotLeader. Returns the
+// reply, which starts with an e.Error.
+func (ck *Clerk) callLeader(ctx context.Context, rpcid uint64, args []byte, timeout_ms uint64) ([]byte, error) {
+	reply := new([]byte)
+	for {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		ck.mu.Lock()
+		l := ck.leader
+		ck.mu.Unlock()
+		err := ck.cls[l].CallContext(ctx, rpcid, args, reply, timeout_ms)
+		if err == urpc.ErrUnauthorized {
+			return nil, ErrUnauthorized
+		}
+		if err != 0 {
+			continue
+		}
+		err2, _ := marshal.ReadInt(*reply)
+		if err2 == e.NotLeader {
+			ck.leaderFailed(l)
+			continue
+		}
+		return *reply, nil
+	}
+}
+
+func (ck *Clerk) ReserveEpochAndGetConfigContext(ctx context.Context) (uint64, []grove_ffi.Address, error) {
+	for {
+		reply, err := ck.callLeader(ctx, RPC_RESERVEEPOCH, make([]byte, 0), clerkTimeouts.CallMs)
+		if err != nil {
+			return 0, nil, err
+		}
+		err2, enc := marshal.ReadInt(reply)
+		if err2 != e.None {
+			continue
+		}
+		epoch, enc := marshal.ReadInt(enc)
+		return epoch, DecodeConfig(enc), nil
+	}
+}
+
+func (ck *Clerk) GetConfigContext(ctx context.Context) ([]grove_ffi.Address, error) {
+	reply := new([]byte)
+	for {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		i := primitive.RandomUint64() % uint64(len(ck.cls))
+		err := ck.cls[i].CallContext(ctx, RPC_GETCONFIG, make([]byte, 0), reply, clerkTimeouts.CallMs)
+		if err == 0 {
+			break
+		}
+	}
+	return DecodeConfig(*reply), nil
+}
+
+func (ck *Clerk) TryWriteConfigContext(ctx context.Context, epoch uint64, config []grove_ffi.Address) (e.Error, error) {
+	var args = make([]byte, 0, 8+8*len(config))
+	args = marshal.WriteInt(args, epoch)
+	args = marshal.WriteBytes(args, EncodeConfig(config))
+	// high timeout; see TryWriteConfig
+	reply, err := ck.callLeader(ctx, RPC_TRYWRITECONFIG, args, clerkTimeouts.WriteConfigMs)
+	if err == ErrUnauthorized {
+		return e.Unauthorized, err
+	}
+	if err != nil {
+		return e.Timeout, err
+	}
+	err2, _ := marshal.ReadInt(reply)
+	return err2, nil
+}
+
+func (ck *Clerk) GetLeaseContext(ctx context.Context, epoch uint64) (e.Error, uint64, error) {
+	args := marshal.WriteInt(make([]byte, 0, 8), epoch)
+	reply, err := ck.callLeader(ctx, RPC_GETLEASE, args, clerkTimeouts.CallMs)
+	if err != nil {
+		return e.Timeout, 0, err
+	}
+	err2, enc := marshal.ReadInt(reply)
+	leaseExpiration, _ := marshal.ReadInt(enc)
+	return err2, leaseExpiration, nil
+}
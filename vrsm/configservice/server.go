@@ -1,18 +1,35 @@
 package configservice
 
 import (
-	"log"
+	"log/slog"
+	"time"
 
 	"github.com/goose-lang/primitive"
 	"github.com/goose-lang/std"
 	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/logging"
 	"github.com/mit-pdos/gokv/urpc"
 	"github.com/mit-pdos/gokv/vrsm/e"
 	"github.com/mit-pdos/gokv/vrsm/paxos"
 	"github.com/tchajed/marshal"
 )
 
-const LeaseInterval = uint64(1_000_000_000) // 1 second
+var logger = logging.For("configservice")
+
+var leaseInterval = uint64(1_000_000_000) // 1 second
+
+// How long a lease lasts, in nanoseconds. Every config server and replica in a
+// system should agree on this.
+func LeaseInterval() uint64 {
+	return leaseInterval
+}
+
+// Sets LeaseInterval. Like SetClerkTimeouts, it must be called before any
+// config server or clerk is made, and panics otherwise.
+func SetLeaseInterval(ns uint64) {
+	checkSettable("SetLeaseInterval")
+	leaseInterval = ns
+}
 
 type state struct {
 	epoch             uint64
@@ -50,7 +67,17 @@ func decodeState(e []byte) *state {
 }
 
 type Server struct {
-	s *paxos.Server
+	s   *paxos.Server
+	log *slog.Logger
+}
+
+// For logging.
+func configStrs(config []grove_ffi.Address) []string {
+	strs := make([]string, len(config))
+	for i, host := range config {
+		strs[i] = grove_ffi.AddressToStr(host)
+	}
+	return strs
 }
 
 func (s *Server) tryAcquire() (bool, *state, func() bool) {
@@ -79,6 +106,7 @@ func (s *Server) ReserveEpochAndGetConfig(args []byte, reply *[]byte) {
 	if !tryReleaseFn() {
 		return
 	}
+	s.log.Info("reserved epoch", "epoch", reservedEpoch)
 	*reply = make([]byte, 0, 8+8+8*len(config))
 	*reply = marshal.WriteInt(*reply, e.None)
 	*reply = marshal.WriteInt(*reply, reservedEpoch)
@@ -107,7 +135,8 @@ func (s *Server) TryWriteConfig(args []byte, reply *[]byte) {
 				break
 			}
 			*reply = marshal.WriteInt(nil, e.Stale)
-			log.Printf("Stale: %d < %d", epoch, st.reservedEpoch)
+			s.log.Warn("rejected config: epoch is stale", "epoch", epoch,
+				"reservedEpoch", st.reservedEpoch)
 			break
 		} else if epoch > st.epoch {
 			l, _ := grove_ffi.GetTimeRange()
@@ -118,7 +147,7 @@ func (s *Server) TryWriteConfig(args []byte, reply *[]byte) {
 				if !tryReleaseFn() {
 					break
 				}
-				log.Println("New config is:", st.config)
+				s.log.Info("entered new epoch", "epoch", epoch, "config", configStrs(config))
 				*reply = marshal.WriteInt(nil, e.None)
 				break
 			} else {
@@ -127,6 +156,8 @@ func (s *Server) TryWriteConfig(args []byte, reply *[]byte) {
 				if !tryReleaseFn() {
 					break
 				}
+				s.log.Info("waiting for lease to expire before entering new epoch",
+					"epoch", epoch, "oldEpoch", st.epoch, "wait", time.Duration(timeToSleep))
 				primitive.Sleep(timeToSleep) // sleep long enough for lease to be expired
 				continue
 			}
@@ -152,7 +183,8 @@ func (s *Server) GetLease(args []byte, reply *[]byte) {
 	}
 
 	if st.epoch != epoch || st.wantLeaseToExpire {
-		log.Println("Rejected lease request", epoch, st.epoch, st.wantLeaseToExpire)
+		s.log.Debug("rejected lease request", "requestEpoch", epoch, "epoch", st.epoch,
+			"wantLeaseToExpire", st.wantLeaseToExpire)
 		if !tryReleaseFn() {
 			return
 		}
@@ -162,7 +194,7 @@ func (s *Server) GetLease(args []byte, reply *[]byte) {
 	}
 
 	l, _ := grove_ffi.GetTimeRange()
-	newLeaseExpiration := l + LeaseInterval
+	newLeaseExpiration := l + leaseInterval
 	if newLeaseExpiration > st.leaseExpiration {
 		st.leaseExpiration = newLeaseExpiration
 	}
@@ -174,9 +206,28 @@ func (s *Server) GetLease(args []byte, reply *[]byte) {
 	*reply = marshal.WriteInt(*reply, newLeaseExpiration)
 }
 
+// Reports this server's view of the state, without going through paxos, so
+// that it works on any server, leader or not.
+func (s *Server) GetStatus(args []byte, reply *[]byte) {
+	st := decodeState(s.s.WeakRead())
+	isLeader, paxosEpoch := s.s.Status()
+	*reply = EncodeGetStatusReply(&GetStatusReply{
+		Err:               e.None,
+		Epoch:             st.epoch,
+		ReservedEpoch:     st.reservedEpoch,
+		LeaseExpiration:   st.leaseExpiration,
+		WantLeaseToExpire: st.wantLeaseToExpire,
+		Config:            st.config,
+		IsLeader:          isLeader,
+		PaxosEpoch:        paxosEpoch,
+	})
+}
+
 func makeServer(fname string, paxosMe grove_ffi.Address,
 	hosts []grove_ffi.Address, initconfig []grove_ffi.Address) *Server {
+	settingsUsed.Store(true)
 	s := new(Server)
+	s.log = logger
 	initEnc := encodeState(&state{config: initconfig})
 
 	s.s = paxos.StartServer(fname, initEnc, paxosMe, hosts)
@@ -193,8 +244,14 @@ func StartServer(fname string, me grove_ffi.Address, paxosMe grove_ffi.Address,
 	handlers[RPC_GETCONFIG] = s.GetConfig
 	handlers[RPC_TRYWRITECONFIG] = s.TryWriteConfig
 	handlers[RPC_GETLEASE] = s.GetLease
+	handlers[RPC_GETSTATUS] = s.GetStatus
+	handlers[RPC_SETLOGLEVELS] = logging.SetLevelsRPC
 
 	rs := urpc.MakeServer(handlers)
+	// only the reconfiguration admin reserves epochs and writes configs, and
+	// only operators change log levels
+	rs.RestrictToAdmin([]uint64{RPC_RESERVEEPOCH, RPC_TRYWRITECONFIG, RPC_SETLOGLEVELS})
+	s.log = logger.With("server", grove_ffi.AddressToStr(me))
 	rs.Serve(me)
 	return s
 }
@@ -16,6 +16,9 @@ const (
 	Sealed       = uint64(6)
 	LeaseExpired = uint64(7)
 	Leased       = uint64(8)
+	// The server doesn't let this process call the RPC (see
+	// urpc.Server.RestrictToAdmin).
+	Unauthorized = uint64(9)
 )
 
 func EncodeError(err Error) []byte {
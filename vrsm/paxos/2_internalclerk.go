@@ -1,6 +1,8 @@
 package paxos
 
 import (
+	"sync/atomic"
+
 	"github.com/mit-pdos/gokv/grove_ffi"
 	"github.com/mit-pdos/gokv/reconnectclient"
 )
@@ -11,12 +13,34 @@ const (
 	RPC_BECOME_LEADER     = uint64(2)
 )
 
+var rpcTimeoutMs = uint64(500)
+
+// Set once the first clerk is made; from then on, clerks read rpcTimeoutMs
+// without locking, so it can no longer change.
+var clerksMade atomic.Bool
+
+// How long paxos servers (and MakeSingleClerk clerks) wait for each reply from
+// another server, in milliseconds.
+func RPCTimeoutMs() uint64 {
+	return rpcTimeoutMs
+}
+
+// Sets RPCTimeoutMs. It must be called before any paxos server or clerk is
+// made (the cluster package does so at startup), and panics otherwise.
+func SetRPCTimeoutMs(ms uint64) {
+	if clerksMade.Load() {
+		panic("paxos: SetRPCTimeoutMs called after a server or clerk was made")
+	}
+	rpcTimeoutMs = ms
+}
+
 // these clerks hide connection failures, and retry forever
 type singleClerk struct {
 	cl *reconnectclient.ReconnectingClient
 }
 
 func MakeSingleClerk(addr grove_ffi.Address) *singleClerk {
+	clerksMade.Store(true)
 	// make a bunch of urpc clients
 	ck := &singleClerk{
 		cl: reconnectclient.MakeReconnectingClient(addr),
@@ -25,10 +49,16 @@ func MakeSingleClerk(addr grove_ffi.Address) *singleClerk {
 	return ck
 }
 
+// A clerk for the server me to talk to its peer addr.
+func makePeerClerk(me grove_ffi.Address, addr grove_ffi.Address) *singleClerk {
+	clerksMade.Store(true)
+	return &singleClerk{cl: reconnectclient.MakeReconnectingClientFrom(me, addr)}
+}
+
 func (s *singleClerk) enterNewEpoch(args *enterNewEpochArgs) *enterNewEpochReply {
 	raw_args := encodeEnterNewEpochArgs(args)
 	raw_reply := new([]byte)
-	err := s.cl.Call(RPC_ENTER_NEW_EPOCH, raw_args, raw_reply, 500 /* ms */)
+	err := s.cl.Call(RPC_ENTER_NEW_EPOCH, raw_args, raw_reply, rpcTimeoutMs)
 	if err == 0 {
 		return decodeEnterNewEpochReply(*raw_reply)
 	} else {
@@ -40,7 +70,7 @@ func (s *singleClerk) enterNewEpoch(args *enterNewEpochArgs) *enterNewEpochReply
 func (s *singleClerk) applyAsFollower(args *applyAsFollowerArgs) *applyAsFollowerReply {
 	raw_args := encodeApplyAsFollowerArgs(args)
 	raw_reply := new([]byte)
-	err := s.cl.Call(RPC_APPLY_AS_FOLLOWER, raw_args, raw_reply, 500 /* ms */)
+	err := s.cl.Call(RPC_APPLY_AS_FOLLOWER, raw_args, raw_reply, rpcTimeoutMs)
 	if err == 0 {
 		return decodeApplyAsFollowerReply(*raw_reply)
 	} else {
@@ -51,5 +81,5 @@ func (s *singleClerk) applyAsFollower(args *applyAsFollowerArgs) *applyAsFollowe
 func (s *singleClerk) TryBecomeLeader() {
 	// make the server the primary
 	reply := new([]byte)
-	s.cl.Call(RPC_BECOME_LEADER, make([]byte, 0), reply, 500 /* ms */)
+	s.cl.Call(RPC_BECOME_LEADER, make([]byte, 0), reply, rpcTimeoutMs)
 }
@@ -1,15 +1,18 @@
 package paxos
 
 import (
-	"log"
+	"log/slog"
 	"sync"
 
 	"github.com/goose-lang/std"
 	"github.com/mit-pdos/gokv/asyncfile"
 	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/logging"
 	"github.com/mit-pdos/gokv/urpc"
 )
 
+var logger = logging.For("paxos")
+
 type paxosState struct {
 	epoch         uint64
 	acceptedEpoch uint64
@@ -23,6 +26,8 @@ type Server struct {
 	ps      *paxosState
 	storage *asyncfile.AsyncFile
 	clerks  []*singleClerk
+	log     *slog.Logger
+	rpc     *urpc.Server // nil until StartServer serves
 }
 
 func (s *Server) withLock(f func(ps *paxosState)) {
@@ -81,18 +86,18 @@ func (s *Server) enterNewEpoch(args *enterNewEpochArgs, reply *enterNewEpochRepl
 }
 
 func (s *Server) TryBecomeLeader() {
-	log.Println("started trybecomeleader")
-	// defer log.Println("finished trybecomeleader")
 	s.mu.Lock()
 	if s.ps.isLeader {
-		log.Println("already leader")
+		epoch := s.ps.epoch
 		s.mu.Unlock()
+		s.log.Info("asked to become leader, but already leader", "epoch", epoch)
 		return
 	}
 	// pick a new epoch number
 	clerks := s.clerks
 	args := &enterNewEpochArgs{epoch: s.ps.epoch + 1}
 	s.mu.Unlock()
+	s.log.Info("trying to become leader", "epoch", args.epoch)
 
 	var numReplies = uint64(0)
 	replies := make([]*enterNewEpochReply, uint64(len(clerks)))
@@ -149,7 +154,7 @@ func (s *Server) TryBecomeLeader() {
 		// replies from replica servers, which we anyways won't look at.
 		s.withLock(func(ps *paxosState) {
 			if ps.epoch <= args.epoch {
-				log.Printf("succeeded becomeleader in epoch %d\n", args.epoch)
+				s.log.Info("became leader", "epoch", args.epoch, "index", latestReply.nextIndex)
 				ps.epoch = args.epoch
 				ps.isLeader = true
 				ps.acceptedEpoch = ps.epoch
@@ -160,7 +165,8 @@ func (s *Server) TryBecomeLeader() {
 		mu.Unlock()
 	} else {
 		mu.Unlock()
-		log.Println("failed becomeleader")
+		s.log.Warn("failed to become leader", "epoch", args.epoch,
+			"accepted", numSuccesses, "servers", n)
 	}
 }
 
@@ -239,13 +245,23 @@ func (s *Server) WeakRead() []byte {
 	return ret
 }
 
-func makeServer(fname string, initstate []byte, config []grove_ffi.Address) *Server {
+// Returns whether this server thinks it is the leader, and the epoch it's in.
+func (s *Server) Status() (bool, uint64) {
+	s.mu.Lock()
+	isLeader := s.ps.isLeader
+	epoch := s.ps.epoch
+	s.mu.Unlock()
+	return isLeader, epoch
+}
+
+func makeServer(fname string, initstate []byte, me grove_ffi.Address, config []grove_ffi.Address) *Server {
 	s := new(Server)
 	s.mu = new(sync.Mutex)
+	s.log = logger
 
 	s.clerks = make([]*singleClerk, 0)
 	for _, host := range config {
-		s.clerks = append(s.clerks, MakeSingleClerk(host))
+		s.clerks = append(s.clerks, makePeerClerk(me, host))
 	}
 
 	var encstate []byte
@@ -260,7 +276,7 @@ func makeServer(fname string, initstate []byte, config []grove_ffi.Address) *Ser
 }
 
 func StartServer(fname string, initstate []byte, me grove_ffi.Address, config []grove_ffi.Address) *Server {
-	s := makeServer(fname, initstate, config)
+	s := makeServer(fname, initstate, me, config)
 
 	handlers := make(map[uint64]func([]byte, *[]byte))
 	handlers[RPC_APPLY_AS_FOLLOWER] = func(raw_args []byte, raw_reply *[]byte) {
@@ -282,6 +298,14 @@ func StartServer(fname string, initstate []byte, me grove_ffi.Address, config []
 	}
 
 	r := urpc.MakeServer(handlers)
+	s.log = logger.With("server", grove_ffi.AddressToStr(me))
+	s.rpc = r
 	r.Serve(me)
 	return s
 }
+
+// Stops serving RPCs, so that a new server can start on the same address; the
+// state on disk is left as it is.
+func (s *Server) Close() {
+	s.rpc.Close()
+}
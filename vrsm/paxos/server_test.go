@@ -0,0 +1,75 @@
+package paxos
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/grove_ffi/memfs"
+	"github.com/mit-pdos/gokv/grove_ffi/memnet"
+)
+
+// A single-node paxos server never forgets a committed state across a crash,
+// and never recovers a state that wasn't proposed.
+func TestCrashRecovery(t *testing.T) {
+	grove_ffi.SetTransport(memnet.New(1))
+	defer grove_ffi.SetTransport(nil)
+	me := grove_ffi.MakeAddress("10.0.0.1:1")
+	h := &memfs.Harness{
+		Seed:   1,
+		Config: memfs.Config{TornWrites: true},
+	}
+	h.Setup = func() (func(), func() error) {
+		var mu sync.Mutex
+		var proposed []byte
+		var committed int
+		var running *Server
+		workload := func() {
+			s := StartServer("paxos", nil, me, []grove_ffi.Address{me})
+			mu.Lock()
+			running = s
+			mu.Unlock()
+			s.TryBecomeLeader()
+			for i := 0; i < 10; i++ {
+				err, state, release := s.TryAcquire()
+				if err != ENone {
+					// only if the crash made TryBecomeLeader time out
+					return
+				}
+				*state = append(*state, byte('a'+i))
+				mu.Lock()
+				proposed = append([]byte(nil), *state...)
+				mu.Unlock()
+				if release() == ENone {
+					mu.Lock()
+					committed = len(proposed)
+					mu.Unlock()
+				}
+			}
+		}
+		check := func() error {
+			mu.Lock()
+			defer mu.Unlock()
+			// free the address for the next run's server
+			if running != nil {
+				running.Close()
+			}
+			s := makeServer("paxos", nil, me, nil)
+			defer s.storage.Close()
+			state := s.ps.state
+			if !bytes.HasPrefix(proposed, state) || len(state) < committed {
+				return fmt.Errorf("recovered %q, but proposed %q of which %d were committed", state, proposed, committed)
+			}
+			if s.ps.nextIndex != uint64(len(state)) {
+				return fmt.Errorf("recovered nextIndex %d with state %q", s.ps.nextIndex, state)
+			}
+			return nil
+		}
+		return workload, check
+	}
+	if err := h.Run(); err != nil {
+		t.Fatal(err)
+	}
+}
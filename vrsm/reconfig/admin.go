@@ -1,27 +1,33 @@
 package reconfig
 
 import (
-	"log"
 	"sync"
 
 	"github.com/goose-lang/primitive"
 	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/logging"
 	"github.com/mit-pdos/gokv/vrsm/configservice"
 	"github.com/mit-pdos/gokv/vrsm/e"
 	"github.com/mit-pdos/gokv/vrsm/replica"
 )
 
+var logger = logging.For("reconfig")
+
 func EnterNewConfig(configHosts []grove_ffi.Address, servers []grove_ffi.Address) e.Error {
 	if len(servers) == 0 {
-		log.Println("Tried creating empty config")
+		logger.Error("refusing to enter an empty config")
 		return e.EmptyConfig
 	}
 
 	configCk := configservice.MakeClerk(configHosts)
 	// Get new epoch number from config service.
 	// Read from config service, fenced with that epoch.
-	epoch, oldServers := configCk.ReserveEpochAndGetConfig()
-	log.Printf("Reserved %d", epoch)
+	rerr, epoch, oldServers := configCk.ReserveEpochAndGetConfig()
+	if rerr != e.None {
+		logger.Error("failed to reserve an epoch", "err", rerr)
+		return rerr
+	}
+	logger.Info("reserved epoch", "epoch", epoch)
 
 	// Enter new epoch on one of the old servers.
 	// Get a copy of the state from that old server.
@@ -32,7 +38,8 @@ func EnterNewConfig(configHosts []grove_ffi.Address, servers []grove_ffi.Address
 	oldClerk := replica.MakeClerk(oldServers[id])
 	reply := oldClerk.GetState(&replica.GetStateArgs{Epoch: epoch})
 	if reply.Err != e.None {
-		log.Printf("Error while getting state and sealing in epoch %d", epoch)
+		logger.Error("failed to get state and seal", "epoch", epoch,
+			"peer", grove_ffi.AddressToStr(oldServers[id]), "err", reply.Err)
 		return reply.Err
 	}
 
@@ -70,17 +77,19 @@ func EnterNewConfig(configHosts []grove_ffi.Address, servers []grove_ffi.Address
 		i += 1
 	}
 	if err != e.None {
-		log.Println("Error while setting state and entering new epoch")
+		logger.Error("failed to set state and enter new epoch", "epoch", epoch, "err", err)
 		return err
 	}
 
 	// Write to config service saying the new servers have up-to-date state.
 	if configCk.TryWriteConfig(epoch, servers) != e.None {
-		log.Println("Error while writing to config service")
+		logger.Error("failed to write new config", "epoch", epoch)
 		return e.Stale
 	}
 
 	// Tell one of the servers to become primary.
 	clerks[0].BecomePrimary(&replica.BecomePrimaryArgs{Epoch: epoch, Replicas: servers})
+	logger.Info("entered new config", "epoch", epoch, "index", reply.NextIndex,
+		"primary", grove_ffi.AddressToStr(servers[0]))
 	return e.None
 }
@@ -0,0 +1,145 @@
+package reconfig
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/vrsm/configservice"
+	"github.com/mit-pdos/gokv/vrsm/e"
+	"github.com/mit-pdos/gokv/vrsm/replica"
+)
+
+// The state of a whole system, as reported by each config server and by each
+// replica in the current configuration.
+type ClusterStatus struct {
+	ConfigHosts []grove_ffi.Address
+	// ConfigStatus[i] is from ConfigHosts[i]; its Err is e.Timeout if that
+	// server didn't reply
+	ConfigStatus []*configservice.GetStatusReply
+
+	// the current epoch and configuration, according to the paxos leader
+	// among the config servers (or, if there is none, the config server in
+	// the highest epoch)
+	Epoch    uint64
+	Replicas []grove_ffi.Address
+	// ReplicaStatus[i] is from Replicas[i]
+	ReplicaStatus []*replica.GetStatusReply
+}
+
+// Asks every config server, and every replica in the configuration they
+// report, for its status. Servers that don't reply promptly are reported as
+// such rather than waited for.
+func GetClusterStatus(configHosts []grove_ffi.Address) *ClusterStatus {
+	cs := &ClusterStatus{ConfigHosts: configHosts}
+	configCk := configservice.MakeClerk(configHosts)
+	cs.ConfigStatus = make([]*configservice.GetStatusReply, len(configHosts))
+	var best *configservice.GetStatusReply
+	for i := range configHosts {
+		st := configCk.GetStatus(uint64(i))
+		cs.ConfigStatus[i] = st
+		if st.Err != e.None {
+			continue
+		}
+		if best == nil || (st.IsLeader && !best.IsLeader) ||
+			(st.IsLeader == best.IsLeader && st.Epoch > best.Epoch) {
+			best = st
+		}
+	}
+	if best == nil {
+		return cs
+	}
+	cs.Epoch = best.Epoch
+	cs.Replicas = best.Config
+
+	cs.ReplicaStatus = make([]*replica.GetStatusReply, len(cs.Replicas))
+	wg := new(sync.WaitGroup)
+	for i, host := range cs.Replicas {
+		i := i
+		host := host
+		wg.Add(1)
+		go func() {
+			cs.ReplicaStatus[i] = replica.MakeClerk(host).GetStatus()
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	return cs
+}
+
+// Returns what's wrong with the system, if anything: servers that are
+// unreachable, replicas that are not in the current epoch or are behind the
+// primary, the lack of a single primary with a valid lease, and so on.
+func (cs *ClusterStatus) Problems() []string {
+	problems := make([]string, 0)
+	haveLeader := false
+	reachable := false
+	for i, st := range cs.ConfigStatus {
+		host := grove_ffi.AddressToStr(cs.ConfigHosts[i])
+		if st.Err != e.None {
+			problems = append(problems, fmt.Sprintf("config server %s is unreachable", host))
+			continue
+		}
+		reachable = true
+		if st.IsLeader {
+			haveLeader = true
+		}
+		if st.IsLeader && st.WantLeaseToExpire {
+			problems = append(problems, fmt.Sprintf("config server %s is waiting for the primary's lease to expire, to enter a new epoch", host))
+		}
+	}
+	if !reachable {
+		return problems
+	}
+	if !haveLeader {
+		problems = append(problems, "no config server is the paxos leader")
+	}
+	if cs.Epoch == 0 {
+		problems = append(problems, "the system has not been initialized (it's in epoch 0)")
+		return problems
+	}
+
+	var primary *replica.GetStatusReply
+	var primaryHost string
+	numPrimaries := 0
+	for i, st := range cs.ReplicaStatus {
+		host := grove_ffi.AddressToStr(cs.Replicas[i])
+		if st.Err != e.None {
+			problems = append(problems, fmt.Sprintf("replica %s is unreachable", host))
+			continue
+		}
+		if st.Epoch != cs.Epoch {
+			problems = append(problems, fmt.Sprintf("replica %s is in epoch %d, not %d", host, st.Epoch, cs.Epoch))
+			continue
+		}
+		if st.Sealed {
+			problems = append(problems, fmt.Sprintf("replica %s is sealed", host))
+		}
+		if st.IsPrimary {
+			numPrimaries += 1
+			primary = st
+			primaryHost = host
+		}
+	}
+	if numPrimaries == 0 {
+		problems = append(problems, fmt.Sprintf("no replica is primary in epoch %d", cs.Epoch))
+		return problems
+	} else if numPrimaries > 1 {
+		problems = append(problems, fmt.Sprintf("%d replicas are primary in epoch %d", numPrimaries, cs.Epoch))
+		return problems
+	}
+	if !primary.LeaseValid {
+		problems = append(problems, fmt.Sprintf("primary %s doesn't have a valid lease, so can't serve reads", primaryHost))
+	}
+	// everything the primary has committed, every backup has applied
+	for i, st := range cs.ReplicaStatus {
+		if st.Err != e.None || st.Epoch != cs.Epoch || st.IsPrimary {
+			continue
+		}
+		if st.NextIndex < primary.CommittedNextIndex {
+			problems = append(problems, fmt.Sprintf("replica %s has applied %d operations, fewer than the %d the primary has committed",
+				grove_ffi.AddressToStr(cs.Replicas[i]), st.NextIndex, primary.CommittedNextIndex))
+		}
+	}
+	return problems
+}
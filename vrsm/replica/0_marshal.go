@@ -158,3 +158,52 @@ func DecodeIncreaseCommitArgs(args []byte) IncreaseCommitArgs {
 	a, _ := marshal.ReadInt(args)
 	return a
 }
+
+type GetStatusReply struct {
+	Err                e.Error
+	Epoch              uint64
+	Sealed             bool
+	IsPrimary          bool
+	NextIndex          uint64
+	CommittedNextIndex uint64
+	LeaseValid         bool
+	LeaseExpiration    uint64
+	Backups            []grove_ffi.Address // only on the primary
+}
+
+func EncodeGetStatusReply(reply *GetStatusReply) []byte {
+	var enc = make([]byte, 0, 8*8+8*uint64(len(reply.Backups)))
+	enc = marshal.WriteInt(enc, reply.Err)
+	enc = marshal.WriteInt(enc, reply.Epoch)
+	enc = marshal.WriteBool(enc, reply.Sealed)
+	enc = marshal.WriteBool(enc, reply.IsPrimary)
+	enc = marshal.WriteInt(enc, reply.NextIndex)
+	enc = marshal.WriteInt(enc, reply.CommittedNextIndex)
+	enc = marshal.WriteBool(enc, reply.LeaseValid)
+	enc = marshal.WriteInt(enc, reply.LeaseExpiration)
+	enc = marshal.WriteInt(enc, uint64(len(reply.Backups)))
+	for _, h := range reply.Backups {
+		enc = marshal.WriteInt(enc, h)
+	}
+	return enc
+}
+
+func DecodeGetStatusReply(enc_reply []byte) *GetStatusReply {
+	var enc = enc_reply
+	reply := new(GetStatusReply)
+	reply.Err, enc = marshal.ReadInt(enc)
+	reply.Epoch, enc = marshal.ReadInt(enc)
+	reply.Sealed, enc = marshal.ReadBool(enc)
+	reply.IsPrimary, enc = marshal.ReadBool(enc)
+	reply.NextIndex, enc = marshal.ReadInt(enc)
+	reply.CommittedNextIndex, enc = marshal.ReadInt(enc)
+	reply.LeaseValid, enc = marshal.ReadBool(enc)
+	reply.LeaseExpiration, enc = marshal.ReadInt(enc)
+	var backupsLen uint64
+	backupsLen, enc = marshal.ReadInt(enc)
+	reply.Backups = make([]grove_ffi.Address, backupsLen)
+	for i := range reply.Backups {
+		reply.Backups[i], enc = marshal.ReadInt(enc)
+	}
+	return reply
+}
@@ -1,13 +1,20 @@
 package replica
 
 import (
+	"context"
+	"sync/atomic"
+
+	"github.com/mit-pdos/gokv/connman"
 	"github.com/mit-pdos/gokv/grove_ffi"
-	"github.com/mit-pdos/gokv/reconnectclient"
+	"github.com/mit-pdos/gokv/logging"
+	"github.com/mit-pdos/gokv/trace"
+	"github.com/mit-pdos/gokv/urpc"
 	"github.com/mit-pdos/gokv/vrsm/e"
 )
 
 type Clerk struct {
-	cl *reconnectclient.ReconnectingClient
+	cm   *connman.ConnMan
+	host grove_ffi.Address
 }
 
 const (
@@ -19,17 +26,95 @@ const (
 	// RPC_ROAPPLYASBACKUP = uint64(5)
 	RPC_ROPRIMARYAPPLY = uint64(6)
 	RPC_INCREASECOMMIT = uint64(7)
+	RPC_GETSTATUS      = uint64(8)
+	RPC_SETLOGLEVELS   = uint64(9)
 )
 
+// How long clerks wait for each reply, in milliseconds.
+type Timeouts struct {
+	// Apply, from clients
+	ApplyMs uint64
+	// ApplyRo, which waits for earlier writes to commit
+	ApplyRoMs uint64
+	// from the primary to its backups
+	ApplyAsBackupMs uint64
+	// GetState and SetState, which carry the whole state
+	StateTransferMs uint64
+	// everything else: BecomePrimary, IncreaseCommitIndex, GetStatus, ...
+	ControlMs uint64
+}
+
+var clerkTimeouts = Timeouts{
+	ApplyMs:         5000,
+	ApplyRoMs:       1000,
+	ApplyAsBackupMs: 1000,
+	StateTransferMs: 10000,
+	ControlMs:       100,
+}
+
+// Set once the first clerk or server is made; from then on, they read
+// clerkTimeouts and backupConnConfig without locking, so those can no longer
+// change.
+var settingsUsed atomic.Bool
+
+func checkSettable(setter string) {
+	if settingsUsed.Load() {
+		panic("replica: " + setter + " called after a server or clerk was made")
+	}
+}
+
+// The timeouts of every clerk in this process.
+func ClerkTimeouts() Timeouts {
+	return clerkTimeouts
+}
+
+// Sets the timeouts of every clerk in this process. It must be called before
+// any replica server or clerk is made (the cluster package does so at
+// startup), and panics otherwise.
+func SetClerkTimeouts(t Timeouts) {
+	checkSettable("SetClerkTimeouts")
+	clerkTimeouts = t
+}
+
 func MakeClerk(host grove_ffi.Address) *Clerk {
-	return &Clerk{cl: reconnectclient.MakeReconnectingClient(host)}
+	return MakeClerkWithConnMan(host, connman.MakeConnMan())
+}
+
+// A clerk that shares cm's connections to host with everyone else using cm.
+func MakeClerkWithConnMan(host grove_ffi.Address, cm *connman.ConnMan) *Clerk {
+	settingsUsed.Store(true)
+	return &Clerk{cm: cm, host: host}
+}
+
+// Sends the request once, reconnecting first if need be.
+func (ck *Clerk) call(rpcid uint64, args []byte, reply *[]byte, timeout_ms uint64) uint64 {
+	return ck.cm.CallWithRetries(ck.host, rpcid, args, reply, timeout_ms, 1)
+}
+
+// The e.Error for a call that failed with the urpc error err.
+func callError(err uint64) e.Error {
+	if err == urpc.ErrUnauthorized {
+		return e.Unauthorized
+	}
+	return e.Timeout
 }
 
 func (ck *Clerk) ApplyAsBackup(args *ApplyAsBackupArgs) e.Error {
 	reply := new([]byte)
-	err := ck.cl.Call(RPC_APPLYASBACKUP, EncodeApplyAsBackupArgs(args), reply, 1000 /* ms */)
+	err := ck.call(RPC_APPLYASBACKUP, EncodeApplyAsBackupArgs(args), reply, clerkTimeouts.ApplyAsBackupMs)
+	if err != 0 {
+		return callError(err)
+	} else {
+		return e.DecodeError(*reply)
+	}
+}
+
+// ApplyAsBackup, passing on the trace in ctx (if any), but not ctx's deadline.
+func (ck *Clerk) applyAsBackup(ctx context.Context, args *ApplyAsBackupArgs) e.Error {
+	reply := new([]byte)
+	err := ck.cm.CallWithRetriesContext(trace.Detach(ctx), ck.host, RPC_APPLYASBACKUP, EncodeApplyAsBackupArgs(args), reply, clerkTimeouts.ApplyAsBackupMs, 1)
 	if err != 0 {
-		return e.Timeout
+		return callError(err)
 	} else {
 		return e.DecodeError(*reply)
 	}
@@ -37,9 +122,9 @@ func (ck *Clerk) ApplyAsBackup(args *ApplyAsBackupArgs) e.Error {
 
 func (ck *Clerk) SetState(args *SetStateArgs) e.Error {
 	reply := new([]byte)
-	err := ck.cl.Call(RPC_SETSTATE, EncodeSetStateArgs(args), reply, 10000 /* ms */)
+	err := ck.call(RPC_SETSTATE, EncodeSetStateArgs(args), reply, clerkTimeouts.StateTransferMs)
 	if err != 0 {
-		return e.Timeout
+		return callError(err)
 	} else {
 		return e.DecodeError(*reply)
 	}
@@ -49,9 +134,9 @@ func (ck *Clerk) GetState(args *GetStateArgs) *GetStateReply {
 	reply := new([]byte)
 	// XXX: high timeout for this, because if the state is large, it will take a
 	// long time to get.
-	err := ck.cl.Call(RPC_GETSTATE, EncodeGetStateArgs(args), reply, 10000 /* ms */)
+	err := ck.call(RPC_GETSTATE, EncodeGetStateArgs(args), reply, clerkTimeouts.StateTransferMs)
 	if err != 0 {
-		return &GetStateReply{Err: e.Timeout}
+		return &GetStateReply{Err: callError(err)}
 	} else {
 		return DecodeGetStateReply(*reply)
 	}
@@ -59,9 +144,9 @@ func (ck *Clerk) GetState(args *GetStateArgs) *GetStateReply {
 
 func (ck *Clerk) BecomePrimary(args *BecomePrimaryArgs) e.Error {
 	reply := new([]byte)
-	err := ck.cl.Call(RPC_BECOMEPRIMARY, EncodeBecomePrimaryArgs(args), reply, 100 /* ms */)
+	err := ck.call(RPC_BECOMEPRIMARY, EncodeBecomePrimaryArgs(args), reply, clerkTimeouts.ControlMs)
 	if err != 0 {
-		return e.Timeout
+		return callError(err)
 	} else {
 		return e.DecodeError(*reply)
 	}
@@ -69,26 +154,49 @@ func (ck *Clerk) BecomePrimary(args *BecomePrimaryArgs) e.Error {
 
 func (ck *Clerk) Apply(op []byte) (e.Error, []byte) {
 	reply := new([]byte)
-	err := ck.cl.Call(RPC_PRIMARYAPPLY, op, reply, 5000 /* ms */)
+	err := ck.call(RPC_PRIMARYAPPLY, op, reply, clerkTimeouts.ApplyMs)
 	if err == 0 {
 		r := DecodeApplyReply(*reply)
 		return r.Err, r.Reply
 	} else {
-		return e.Timeout, nil
+		return callError(err), nil
 	}
 }
 
 func (ck *Clerk) ApplyRo(op []byte) (e.Error, []byte) {
 	reply := new([]byte)
-	err := ck.cl.Call(RPC_ROPRIMARYAPPLY, op, reply, 1000 /* ms */)
+	err := ck.call(RPC_ROPRIMARYAPPLY, op, reply, clerkTimeouts.ApplyRoMs)
 	if err == 0 {
 		r := DecodeApplyReply(*reply)
 		return r.Err, r.Reply
 	} else {
-		return e.Timeout, nil
+		return callError(err), nil
 	}
 }
 
 func (ck *Clerk) IncreaseCommitIndex(n uint64) e.Error {
-	return ck.cl.Call(RPC_INCREASECOMMIT, EncodeIncreaseCommitArgs(n), new([]byte), 100 /* ms */)
+	return ck.call(RPC_INCREASECOMMIT, EncodeIncreaseCommitArgs(n), new([]byte), clerkTimeouts.ControlMs)
+}
+
+func (ck *Clerk) GetStatus() *GetStatusReply {
+	reply := new([]byte)
+	err := ck.call(RPC_GETSTATUS, make([]byte, 0), reply, clerkTimeouts.ControlMs)
+	if err != 0 {
+		return &GetStatusReply{Err: callError(err)}
+	} else {
+		return DecodeGetStatusReply(*reply)
+	}
+}
+
+// Changes the replica's log levels (see logging.SetLevels); an empty spec
+// leaves them as they are. Returns whether the replica accepted spec, and its
+// levels afterwards (or why it didn't).
+func (ck *Clerk) SetLogLevels(spec string) (e.Error, bool, string) {
+	reply := new([]byte)
+	err := ck.call(RPC_SETLOGLEVELS, []byte(spec), reply, clerkTimeouts.ControlMs)
+	if err != 0 {
+		return callError(err), false, ""
+	}
+	ok, msg := logging.DecodeSetLevelsReply(*reply)
+	return e.None, ok, msg
 }
@@ -0,0 +1,32 @@
+package replica
+
+import (
+	"context"
+
+	"github.com/mit-pdos/gokv/vrsm/e"
+)
+
+// Versions of the client-facing calls that give up as soon as ctx is done
+// (returning e.Timeout), and pass ctx's deadline on to the server.
+
+func (ck *Clerk) ApplyContext(ctx context.Context, op []byte) (e.Error, []byte) {
+	reply := new([]byte)
+	err := ck.cm.CallWithRetriesContext(ctx, ck.host, RPC_PRIMARYAPPLY, op, reply, clerkTimeouts.ApplyMs, 1)
+	if err == 0 {
+		r := DecodeApplyReply(*reply)
+		return r.Err, r.Reply
+	} else {
+		return e.Timeout, nil
+	}
+}
+
+func (ck *Clerk) ApplyRoContext(ctx context.Context, op []byte) (e.Error, []byte) {
+	reply := new([]byte)
+	err := ck.cm.CallWithRetriesContext(ctx, ck.host, RPC_ROPRIMARYAPPLY, op, reply, clerkTimeouts.ApplyRoMs, 1)
+	if err == 0 {
+		r := DecodeApplyReply(*reply)
+		return r.Err, r.Reply
+	} else {
+		return e.Timeout, nil
+	}
+}
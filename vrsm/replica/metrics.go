@@ -0,0 +1,50 @@
+package replica
+
+import (
+	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/metrics"
+)
+
+// Reports s's state as gauges, labelled with its address me. Backup lag is how
+// many operations the primary has applied that a backup isn't known to have.
+func (s *Server) registerMetrics(me grove_ffi.Address) {
+	server := grove_ffi.AddressToStr(me)
+	labels := []string{"server"}
+	gauge := func(name string, help string, f func() float64) {
+		metrics.Default.NewGaugeFunc(name, help, labels, func(emit metrics.Emit) {
+			s.mu.Lock()
+			v := f()
+			s.mu.Unlock()
+			emit(v, server)
+		})
+	}
+	gauge("vrsm_replica_epoch", "The epoch the replica is in.", func() float64 {
+		return float64(s.epoch)
+	})
+	gauge("vrsm_replica_next_index", "The number of operations the replica has applied.", func() float64 {
+		return float64(s.nextIndex)
+	})
+	gauge("vrsm_replica_committed_next_index", "The number of operations the replica knows to be committed.", func() float64 {
+		return float64(s.committedNextIndex)
+	})
+	gauge("vrsm_replica_is_primary", "Whether the replica is the primary.", func() float64 {
+		return metrics.Bool(s.isPrimary)
+	})
+	gauge("vrsm_replica_lease_valid", "Whether the replica holds an unexpired lease, so can serve reads.", func() float64 {
+		_, h := grove_ffi.GetTimeRange()
+		return metrics.Bool(s.leaseValid && h < s.leaseExpiration)
+	})
+
+	metrics.Default.NewGaugeFunc("vrsm_replica_backup_lag",
+		"Operations applied by the primary that a backup isn't known to have applied yet.",
+		[]string{"server", "backup"}, func(emit metrics.Emit) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if !s.isPrimary {
+				return
+			}
+			for i, host := range s.backupHosts {
+				emit(float64(s.nextIndex-s.backupNextIndex[i]), server, grove_ffi.AddressToStr(host))
+			}
+		})
+}
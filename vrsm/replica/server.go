@@ -1,17 +1,24 @@
 package replica
 
 import (
-	"log"
+	"context"
+	"log/slog"
 	"sync"
+	"time"
 
 	"github.com/goose-lang/primitive"
 	"github.com/goose-lang/std"
+	"github.com/mit-pdos/gokv/connman"
 	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/logging"
+	"github.com/mit-pdos/gokv/trace"
 	"github.com/mit-pdos/gokv/urpc"
 	"github.com/mit-pdos/gokv/vrsm/configservice"
 	"github.com/mit-pdos/gokv/vrsm/e"
 )
 
+var logger = logging.For("replica")
+
 type Server struct {
 	mu        *sync.Mutex
 	epoch     uint64
@@ -24,7 +31,13 @@ type Server struct {
 	// still waiting for ops to be made locally durable.
 	canBecomePrimary bool
 	isPrimary        bool
-	clerks           [][]*Clerk
+	backups          []*Clerk
+	// backupNextIndex[i] is the nextIndex that backups[i], at
+	// backupHosts[i], is known to have reached (for metrics)
+	backupHosts     []grove_ffi.Address
+	backupNextIndex []uint64
+	// connections to the backups, shared by concurrent operations
+	cm *connman.ConnMan
 
 	isPrimary_cond *sync.Cond
 
@@ -38,6 +51,9 @@ type Server struct {
 	committedNextIndex      uint64
 	committedNextIndex_cond *sync.Cond
 	confCk                  *configservice.Clerk
+
+	// logger, with this server's address once it's serving
+	log *slog.Logger
 }
 
 // Applies the RO op immediately, but then waits for it to be committed before
@@ -51,23 +67,22 @@ func (s *Server) ApplyRoWaitForCommit(op Op) *ApplyReply {
 	// log.Printf("Got ro request %d", x)
 	s.mu.Lock()
 	if !s.leaseValid {
+		epoch := s.epoch
 		s.mu.Unlock()
-		log.Printf("Lease invalid")
+		s.log.Debug("rejected read: no valid lease", "epoch", epoch)
 		reply.Err = e.LeaseExpired
 		return reply
 	}
-	if primitive.RandomUint64()%10000 == 0 {
-		log.Printf("Server nextIndex=%d commitIndex=%d", s.nextIndex, s.committedNextIndex)
-	}
-
 	var lastModifiedIndex uint64
 	lastModifiedIndex, reply.Reply = s.sm.ApplyReadonly(op)
 	epoch := s.epoch
 
 	_, h := grove_ffi.GetTimeRange()
 	if s.leaseExpiration <= h {
+		leaseExpiration := s.leaseExpiration
 		s.mu.Unlock()
-		log.Printf("Lease expired because %d < %d", s.leaseExpiration, h)
+		s.log.Debug("rejected read: lease expired", "epoch", epoch,
+			"leaseExpiration", leaseExpiration, "now", h)
 		reply.Err = e.LeaseExpired
 		return reply
 	}
@@ -104,6 +119,12 @@ func (s *Server) IncreaseCommitIndex(newCommittedNextIndex uint64) {
 
 // called on the primary server to apply a new operation.
 func (s *Server) Apply(op Op) *ApplyReply {
+	return s.apply(context.Background(), op)
+}
+
+// Apply, recording spans under the trace in ctx (if any); ctx is only used for
+// tracing, so this doesn't give up when ctx is done.
+func (s *Server) apply(ctx context.Context, op Op) *ApplyReply {
 	reply := new(ApplyReply)
 	reply.Reply = nil
 	// reply.Err = e.ENone
@@ -130,9 +151,12 @@ func (s *Server) Apply(op Op) *ApplyReply {
 	s.nextIndex = std.SumAssumeNoOverflow(s.nextIndex, 1)
 	nextIndex := s.nextIndex
 	epoch := s.epoch
-	clerks := s.clerks
+	clerks := s.backups
 
 	s.mu.Unlock()
+	ctx, span := trace.StartChild(ctx, "replica.Apply", trace.KindInternal)
+	span.SetAttrInt("epoch", epoch)
+	span.SetAttrInt("index", opIndex)
 	// end := primitive.TimeNow()
 	// if primitive.RandomUint64()%1024 == 0 {
 	// log.Printf("replica.mu crit section: %d ns", end-begin)
@@ -146,17 +170,19 @@ func (s *Server) Apply(op Op) *ApplyReply {
 		op:    op,
 	}
 
-	clerks_inner := clerks[primitive.RandomUint64()%uint64(len(clerks))]
-	errs := make([]e.Error, len(clerks_inner))
-	for i, clerk := range clerks_inner {
-		// use a random socket
+	errs := make([]e.Error, len(clerks))
+	for i, clerk := range clerks {
 		clerk := clerk
 		i := i
 		wg.Add(1)
 		go func() {
+			ctx, span := trace.StartChild(ctx, "replica.SendToBackup", trace.KindInternal)
+			span.SetAttr("backup", grove_ffi.AddressToStr(clerk.host))
+			var attempts = uint64(0)
 			// retry if we get OutOfOrder errors
 			for {
-				err := clerk.ApplyAsBackup(args)
+				attempts += 1
+				err := clerk.applyAsBackup(ctx, args)
 				// log.Printf("Sending applyasbackup")
 				if err == e.OutOfOrder || err == e.Timeout {
 					continue
@@ -165,18 +191,28 @@ func (s *Server) Apply(op Op) *ApplyReply {
 					break
 				}
 			}
+			span.SetAttrInt("attempts", attempts)
+			span.End()
+			if errs[i] == e.None {
+				s.backupApplied(epoch, uint64(i), opIndex+1)
+			} else {
+				s.log.Warn("backup rejected operation", "epoch", epoch, "index", opIndex,
+					"peer", grove_ffi.AddressToStr(clerk.host), "err", errs[i])
+			}
 			wg.Done()
 		}()
 	}
 	wg.Wait()
 
 	// log.Printf("wait durable: %d", nextIndex)
+	_, durSpan := trace.StartChild(ctx, "storage.WaitDurable", trace.KindInternal)
 	waitForDurable()
+	durSpan.End()
 	// log.Printf("done durable: %d", nextIndex)
 
 	var err = e.None
 	var i = uint64(0)
-	for i < uint64(len(clerks_inner)) {
+	for i < uint64(len(clerks)) {
 		err2 := errs[i]
 		if err2 != e.None {
 			err = err2
@@ -184,22 +220,36 @@ func (s *Server) Apply(op Op) *ApplyReply {
 		i += 1
 	}
 	reply.Err = err
+	span.SetAttrInt("error", err)
+	span.End()
 
 	if err == e.None {
 		s.IncreaseCommitIndex(nextIndex)
 	} else {
 		// stop acting as primary in epoch
 		s.mu.Lock()
-		if s.epoch == epoch {
+		if s.epoch == epoch && s.isPrimary {
 			s.isPrimary = false
+			s.mu.Unlock()
+			s.log.Info("stopped acting as primary", "epoch", epoch, "index", opIndex)
+		} else {
+			s.mu.Unlock()
 		}
-		s.mu.Unlock()
 	}
 
 	// log.Println("Apply() returned ", err)
 	return reply
 }
 
+// Notes that backups[i] has reached nextIndex in epoch.
+func (s *Server) backupApplied(epoch uint64, i uint64, nextIndex uint64) {
+	s.mu.Lock()
+	if s.epoch == epoch && s.isPrimary && nextIndex > s.backupNextIndex[i] {
+		s.backupNextIndex[i] = nextIndex
+	}
+	s.mu.Unlock()
+}
+
 func (s *Server) leaseRenewalThread() {
 	var latestEpoch uint64
 	for {
@@ -211,7 +261,8 @@ func (s *Server) leaseRenewalThread() {
 			s.leaseValid = true
 			s.mu.Unlock()
 			// log.Printf("Got lease")
-			primitive.Sleep(uint64(250) * 1_000_000)
+			// renew well before it expires
+			primitive.Sleep(configservice.LeaseInterval() / 4)
 		} else if latestEpoch != s.epoch {
 			latestEpoch = s.epoch
 			s.mu.Unlock()
@@ -235,16 +286,15 @@ func (s *Server) sendIncreaseCommitThread() {
 	// push it to the backups. We chose option 2 here
 	for {
 		s.mu.Lock()
-		for !s.isPrimary || len(s.clerks[0]) == 0 {
+		for !s.isPrimary || len(s.backups) == 0 {
 			s.isPrimary_cond.Wait()
 		}
 		newCommittedNextIndex := s.committedNextIndex
-		clerks := s.clerks
+		clerks := s.backups
 		s.mu.Unlock()
 
-		clerks_inner := clerks[primitive.RandomUint64()%uint64(len(clerks))] // use a random socket
 		wg := new(sync.WaitGroup)
-		for _, clerk := range clerks_inner {
+		for _, clerk := range clerks {
 			clerk := clerk
 			wg.Add(1)
 			go func() {
@@ -276,11 +326,22 @@ func (s *Server) isEpochStale(epoch uint64) bool {
 // called on backup servers to apply an operation so it is replicated and
 // can be considered committed by primary.
 func (s *Server) ApplyAsBackup(args *ApplyAsBackupArgs) e.Error {
+	return s.applyAsBackup(context.Background(), args)
+}
+
+// ApplyAsBackup, recording spans under the trace in ctx (if any).
+func (s *Server) applyAsBackup(ctx context.Context, args *ApplyAsBackupArgs) e.Error {
 	// log.Printf("Received applyasbackup")
 	// defer log.Printf("Exiting applyasbackup")
 	s.mu.Lock()
 
 	// operation sequencing
+	var orderSpan *trace.Span
+	if args.index > s.nextIndex {
+		_, orderSpan = trace.StartChild(ctx, "replica.WaitForEarlierOps", trace.KindInternal)
+		orderSpan.SetAttrInt("index", args.index)
+		orderSpan.SetAttrInt("nextIndex", s.nextIndex)
+	}
 	for args.index > s.nextIndex && s.epoch == args.epoch && !s.sealed {
 		cond, ok := s.opAppliedConds[args.index]
 		if !ok {
@@ -290,10 +351,14 @@ func (s *Server) ApplyAsBackup(args *ApplyAsBackupArgs) e.Error {
 			cond.Wait()
 		}
 	}
+	orderSpan.End()
 	// By this point, if the server is unsealed and in the right epoch, then
 	// args.index <= s.nextIndex.
 	if s.sealed {
+		epoch := s.epoch
 		s.mu.Unlock()
+		s.log.Debug("rejected operation: sealed", "epoch", epoch, "requestEpoch", args.epoch,
+			"index", args.index)
 		return e.Stale
 	}
 
@@ -305,7 +370,10 @@ func (s *Server) ApplyAsBackup(args *ApplyAsBackupArgs) e.Error {
 	// optimization.
 
 	if s.isEpochStale(args.epoch) {
+		epoch := s.epoch
 		s.mu.Unlock()
+		s.log.Debug("rejected operation: stale epoch", "epoch", epoch, "requestEpoch", args.epoch,
+			"index", args.index)
 		return e.Stale
 	}
 
@@ -331,7 +399,9 @@ func (s *Server) ApplyAsBackup(args *ApplyAsBackupArgs) e.Error {
 	}
 
 	s.mu.Unlock()
+	_, durSpan := trace.StartChild(ctx, "storage.WaitDurable", trace.KindInternal)
 	waitFn()
+	durSpan.End()
 
 	return e.None
 }
@@ -345,7 +415,8 @@ func (s *Server) SetState(args *SetStateArgs) e.Error {
 		s.mu.Unlock()
 		return e.None
 	} else {
-		log.Print("Entered new epoch")
+		s.log.Info("entered new epoch", "epoch", args.Epoch, "oldEpoch", s.epoch,
+			"index", args.NextIndex, "committedIndex", args.CommittedNextIndex)
 		s.isPrimary = false
 		s.canBecomePrimary = true
 		s.epoch = args.Epoch
@@ -396,35 +467,81 @@ func (s *Server) BecomePrimary(args *BecomePrimaryArgs) e.Error {
 	// BecomePrimary can only be called on args.Epoch if the server already
 	// entered epoch args.Epoch
 	if args.Epoch != s.epoch || !s.canBecomePrimary {
-		log.Printf("Wrong epoch in BecomePrimary request (in %d, got %d)", s.epoch, args.Epoch)
+		epoch := s.epoch
+		canBecomePrimary := s.canBecomePrimary
 		s.mu.Unlock()
+		s.log.Warn("rejected BecomePrimary", "epoch", epoch, "requestEpoch", args.Epoch,
+			"canBecomePrimary", canBecomePrimary)
 		return e.Stale
 	}
-	log.Println("Became Primary")
+	s.log.Info("became primary", "epoch", s.epoch, "index", s.nextIndex,
+		"backups", len(args.Replicas)-1)
 	s.isPrimary = true
 	s.isPrimary_cond.Signal()
 	s.canBecomePrimary = false
 
 	// XXX: should probably not bother doing this if we are already the primary
 	// in this epoch
-	numClerks := uint64(32) // XXX: 32 clients per backup; this should probably be a configuration parameter
-	s.clerks = make([][]*Clerk, numClerks)
-	var j = uint64(0)
-	for j < numClerks {
-		clerks := make([]*Clerk, len(args.Replicas)-1)
-		var i = uint64(0)
-		for i < uint64(len(clerks)) {
-			clerks[i] = MakeClerk(args.Replicas[i+1])
-			i++
-		}
-		s.clerks[j] = clerks
-		j++
+	s.backups = make([]*Clerk, len(args.Replicas)-1)
+	s.backupHosts = args.Replicas[1:]
+	s.backupNextIndex = make([]uint64, len(s.backups))
+	var i = uint64(0)
+	for i < uint64(len(s.backups)) {
+		s.backups[i] = MakeClerkWithConnMan(args.Replicas[i+1], s.cm)
+		// the backups entered this epoch with the state we have
+		s.backupNextIndex[i] = s.nextIndex
+		i++
 	}
 	s.mu.Unlock()
 	return e.None
 }
 
+// Reports the server's state, for monitoring. LeaseValid is whether the lease
+// is unexpired as well as valid, i.e. whether the server can serve reads.
+func (s *Server) GetStatus() *GetStatusReply {
+	s.mu.Lock()
+	_, h := grove_ffi.GetTimeRange()
+	reply := &GetStatusReply{
+		Err:                e.None,
+		Epoch:              s.epoch,
+		Sealed:             s.sealed,
+		IsPrimary:          s.isPrimary,
+		NextIndex:          s.nextIndex,
+		CommittedNextIndex: s.committedNextIndex,
+		LeaseValid:         s.leaseValid && h < s.leaseExpiration,
+		LeaseExpiration:    s.leaseExpiration,
+	}
+	if s.isPrimary {
+		reply.Backups = s.backupHosts
+	}
+	s.mu.Unlock()
+	return reply
+}
+
+var backupConnConfig = connman.Config{
+	ConnsPerHost: 32,
+	Policy:       connman.LeastLoaded,
+	// closes connections to servers that are no longer backups
+	IdleTimeout: time.Minute,
+	MinBackoff:  10 * time.Millisecond,
+	MaxBackoff:  time.Second,
+}
+
+// How a primary connects to its backups: concurrent operations are spread over
+// up to 32 connections to each backup (by default; see the cluster package).
+func BackupConnConfig() connman.Config {
+	return backupConnConfig
+}
+
+// Sets BackupConnConfig. Like SetClerkTimeouts, it must be called before any
+// replica server or clerk is made, and panics otherwise.
+func SetBackupConnConfig(cfg connman.Config) {
+	checkSettable("SetBackupConnConfig")
+	backupConnConfig = cfg
+}
+
 func MakeServer(sm *StateMachine, confHosts []grove_ffi.Address, nextIndex uint64, epoch uint64, sealed bool) *Server {
+	settingsUsed.Store(true)
 	s := new(Server)
 	s.mu = new(sync.Mutex)
 	s.epoch = epoch
@@ -437,8 +554,11 @@ func MakeServer(sm *StateMachine, confHosts []grove_ffi.Address, nextIndex uint6
 	s.canBecomePrimary = false
 	s.opAppliedConds = make(map[uint64]*sync.Cond)
 	s.confCk = configservice.MakeClerk(confHosts)
+	cmConfig := backupConnConfig
+	s.cm = connman.MakeConnManWithConfig(&cmConfig)
 	s.committedNextIndex_cond = sync.NewCond(s.mu)
 	s.isPrimary_cond = sync.NewCond(s.mu)
+	s.log = logger
 
 	return s
 }
@@ -446,10 +566,6 @@ func MakeServer(sm *StateMachine, confHosts []grove_ffi.Address, nextIndex uint6
 func (s *Server) Serve(me grove_ffi.Address) {
 	handlers := make(map[uint64]func([]byte, *[]byte))
 
-	handlers[RPC_APPLYASBACKUP] = func(args []byte, reply *[]byte) {
-		*reply = e.EncodeError(s.ApplyAsBackup(DecodeApplyAsBackupArgs(args)))
-	}
-
 	handlers[RPC_SETSTATE] = func(args []byte, reply *[]byte) {
 		*reply = e.EncodeError(s.SetState(DecodeSetStateArgs(args)))
 	}
@@ -462,10 +578,6 @@ func (s *Server) Serve(me grove_ffi.Address) {
 		*reply = e.EncodeError(s.BecomePrimary(DecodeBecomePrimaryArgs(args)))
 	}
 
-	handlers[RPC_PRIMARYAPPLY] = func(args []byte, reply *[]byte) {
-		*reply = EncodeApplyReply(s.Apply(args))
-	}
-
 	handlers[RPC_ROPRIMARYAPPLY] = func(args []byte, reply *[]byte) {
 		*reply = EncodeApplyReply(s.ApplyRoWaitForCommit(args))
 	}
@@ -474,8 +586,25 @@ func (s *Server) Serve(me grove_ffi.Address) {
 		s.IncreaseCommitIndex(DecodeIncreaseCommitArgs(args))
 	}
 
+	handlers[RPC_GETSTATUS] = func(args []byte, reply *[]byte) {
+		*reply = EncodeGetStatusReply(s.GetStatus())
+	}
+
+	handlers[RPC_SETLOGLEVELS] = logging.SetLevelsRPC
+
 	rs := urpc.MakeServer(handlers)
+	// these get the caller's trace, if any
+	rs.HandleContext(RPC_APPLYASBACKUP, func(ctx context.Context, args []byte, reply *[]byte) {
+		*reply = e.EncodeError(s.applyAsBackup(ctx, DecodeApplyAsBackupArgs(args)))
+	})
+	rs.HandleContext(RPC_PRIMARYAPPLY, func(ctx context.Context, args []byte, reply *[]byte) {
+		*reply = EncodeApplyReply(s.apply(ctx, args))
+	})
+	// these are only used by reconfiguration and operators
+	rs.RestrictToAdmin([]uint64{RPC_SETSTATE, RPC_GETSTATE, RPC_BECOMEPRIMARY, RPC_SETLOGLEVELS})
+	s.log = logger.With("server", grove_ffi.AddressToStr(me))
 	rs.Serve(me)
+	s.registerMetrics(me)
 
 	go func() { s.leaseRenewalThread() }()
 	go func() { s.sendIncreaseCommitThread() }()
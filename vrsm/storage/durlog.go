@@ -4,10 +4,13 @@ import (
 	"github.com/goose-lang/std"
 	"github.com/mit-pdos/gokv/aof"
 	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/logging"
 	"github.com/mit-pdos/gokv/vrsm/replica"
 	"github.com/tchajed/marshal"
 )
 
+var logger = logging.For("storage")
+
 type InMemoryStateMachine struct {
 	ApplyReadonly func([]byte) (uint64, []byte)
 	ApplyVolatile func([]byte) []byte
@@ -100,6 +103,8 @@ func (s *StateMachine) setStateAndUnseal(snap []byte, nextIndex uint64, epoch ui
 	s.sealed = false
 	s.smMem.SetState(snap, nextIndex)
 	s.makeDurableWithSnap(snap)
+	logger.Info("wrote snapshot", "file", s.fname, "epoch", epoch, "index", nextIndex,
+		"bytes", len(snap))
 }
 
 func (s *StateMachine) getStateAndSeal() []byte {
@@ -138,6 +143,7 @@ func recoverStateMachine(smMem *InMemoryStateMachine, fname string) *StateMachin
 		grove_ffi.FileWrite(s.fname, initialContents)
 
 		s.logFile = aof.CreateAppendOnlyFile(fname)
+		logger.Info("created new log", "file", fname)
 		return s
 	}
 
@@ -159,6 +165,7 @@ func recoverStateMachine(smMem *InMemoryStateMachine, fname string) *StateMachin
 	// load protocol state
 
 	// apply ops to bring in-memory state up to date
+	snapIndex := s.nextIndex
 	for {
 		// XXX: this depends on the fact that an `op` takes up at least 2 bytes
 		// e.g. because its opLen takes 8 bytes. A single extra byte is
@@ -178,6 +185,8 @@ func recoverStateMachine(smMem *InMemoryStateMachine, fname string) *StateMachin
 	if len(enc) > 0 {
 		s.sealed = true
 	}
+	logger.Info("recovered from log", "file", fname, "epoch", s.epoch, "index", s.nextIndex,
+		"replayed", s.nextIndex-snapIndex, "sealed", s.sealed)
 
 	return s
 }
@@ -0,0 +1,38 @@
+// Package vrsmtest sets up what tests of systems built on the vrsm config
+// service share: an in-memory network and file system, and a config service
+// running on them.
+package vrsmtest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mit-pdos/gokv/grove_ffi"
+	"github.com/mit-pdos/gokv/grove_ffi/memfs"
+	"github.com/mit-pdos/gokv/grove_ffi/memnet"
+	"github.com/mit-pdos/gokv/vrsm/configservice"
+	"github.com/mit-pdos/gokv/vrsm/paxos"
+)
+
+// Installs an in-memory network, which delays, duplicates and reorders a few
+// messages, and an in-memory file system, and starts a single-node config
+// service whose initial configuration is servers. Returns the network (to
+// inject more faults) and the config service's hosts.
+//
+// The network is switched back to the real one when t finishes, but the file
+// system is left installed: servers keep running, and writing their durable
+// state, after the test.
+func StartConfigService(t testing.TB, servers []grove_ffi.Address) (*memnet.Network, []grove_ffi.Address) {
+	grove_ffi.SetFileSystem(memfs.New(1))
+	n := memnet.New(1)
+	n.SetConfig(memnet.Config{MaxDelay: time.Millisecond, DupPercent: 5, Reorder: true})
+	grove_ffi.SetTransport(n)
+	t.Cleanup(func() { grove_ffi.SetTransport(nil) })
+
+	conf := grove_ffi.MakeAddress("10.0.0.1:1")
+	confPaxos := grove_ffi.MakeAddress("10.0.0.1:2")
+	configservice.StartServer("config.data", conf, confPaxos, []grove_ffi.Address{confPaxos}, servers)
+	// as vrsm/cmd/mkleader does
+	paxos.MakeSingleClerk(confPaxos).TryBecomeLeader()
+	return n, []grove_ffi.Address{conf}
+}